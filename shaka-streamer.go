@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/Koodeyo-Media/shaka-streamer-go/binaries"
 	"github.com/Koodeyo-Media/shaka-streamer-go/streamer"
@@ -22,6 +23,8 @@ func main() {
 	useSystemBinaries := flag.Bool("use-system-binaries", false, "Use FFmpeg, FFprobe and Shaka Packager binaries found in PATH instead of the ones offered by Shaka Streamer.")
 	setup := flag.Bool("setup", false, "Downloads package containing FFmpeg, FFprobe, and Shaka Packager static builds.")
 	test_assets := flag.Bool("test-assets", false, "Downloads all the assets for tests.")
+	generate_test_assets := flag.Bool("generate-test-assets", false, "Generates stand-ins for the assets for tests with FFmpeg, instead of downloading them.")
+	serve := flag.String("serve", "", "Serve the output folder over HTTP at this address, for example :8080. Without input and pipeline configs, only serves existing output. (optional)")
 
 	flag.Parse()
 
@@ -37,6 +40,18 @@ func main() {
 		return
 	}
 
+	if *generate_test_assets {
+		if err := tests.GenerateTestAssets("ffmpeg"); err != nil {
+			fmt.Println(err)
+		}
+		return
+	}
+
+	if *serve != "" && *inputConfig == "" && *pipelineConfig == "" {
+		serveOutput(*output, *serve)
+		return
+	}
+
 	if *inputConfig == "" {
 		fmt.Println("The path to the input config file is required.")
 		return
@@ -54,6 +69,7 @@ func main() {
 	fmt.Printf("Output: %s\n", *output)
 	fmt.Printf("Skip Deps Check: %t\n", *skipDepsCheck)
 	fmt.Printf("Use System Binaries: %t\n", *useSystemBinaries)
+	fmt.Printf("Serve: %s\n", *serve)
 
 	inputConfigData, err := os.ReadFile(*inputConfig)
 	if err != nil {
@@ -98,4 +114,47 @@ func main() {
 			os.Exit(1)
 		}
 	}
+
+	controller := streamer.ControllerNode{}
+	node := controller.Start(streamer.ControllerParams{
+		OutputLocation:     *output,
+		InputConfigDict:    inputConfigDict,
+		PipelineConfigDict: pipelineConfigDict,
+		BitrateConfigDict:  bitrateConfigDict,
+		BucketURL:          *cloudURL,
+		CheckDeps:          !*skipDepsCheck,
+		UseHermetic:        !*useSystemBinaries,
+		ServeAddress:       *serve,
+	})
+
+	status := node.CheckStatus()
+	for status == streamer.Running {
+		time.Sleep(time.Second)
+		status = node.CheckStatus()
+	}
+
+	// Once the pipeline is finished, the output is served until the process
+	// is killed or the server fails.
+	for *serve != "" && status == streamer.Finished {
+		time.Sleep(time.Second)
+		status = node.CheckStatus()
+	}
+
+	node.Stop()
+	node.Close()
+
+	if status == streamer.Errored {
+		fmt.Fprintln(os.Stderr, "The pipeline failed.")
+		os.Exit(1)
+	}
+}
+
+// Serves the output folder over HTTP until the process is killed.
+func serveOutput(output string, address string) {
+	fmt.Printf("Serving %s at %s\n", output, address)
+
+	if err := streamer.NewOriginServerNode(output, address).ListenAndServe(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error serving output: %v\n", err)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,418 @@
+// A module to read HLS and DASH manifests for abr_pull inputs.
+package streamer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// How long to wait for a source manifest to download.
+const ABR_PULL_TIMEOUT = 10 * time.Second
+
+// The selection options of an abr_pull input.
+type AbrPullConfig struct {
+	/*
+		The bandwidth of the HLS variant or DASH video representation to pull, in
+		bits per second.
+
+			Must match a bandwidth in the source manifest exactly.  If unspecified,
+			the highest one is used.
+	*/
+	Bandwidth int `yaml:"bandwidth"`
+
+	/*
+		The ID of the DASH representation to read.
+
+			If unspecified, it is chosen from the manifest by media_type, language
+			and bandwidth.
+	*/
+	Representation string `yaml:"representation"`
+}
+
+// A single rendition of an HLS or DASH source.
+type AbrRendition struct {
+	MediaType MediaType
+
+	// The URL FFmpeg should read.  For HLS, this is a media playlist.  For
+	// DASH, this is the manifest itself.
+	URL string
+
+	// The ID of the DASH representation.  Empty for HLS.
+	Representation string
+
+	Language  string
+	Bandwidth int
+
+	// True if the manifest marks this rendition as the default for its type.
+	Default bool
+}
+
+/*
+Downloads an HLS master playlist or DASH manifest, and lists the renditions
+of the variant with the given bandwidth.
+
+	A bandwidth of 0 selects the highest variant.  For DASH, the bandwidth
+	only applies to video, and the highest representation of each audio or
+	text adaptation set is listed.
+*/
+func GetAbrRenditions(manifestURL string, bandwidth int) ([]AbrRendition, error) {
+	client := http.Client{Timeout: ABR_PULL_TIMEOUT}
+
+	resp, err := client.Get(manifestURL)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download %s: %s", manifestURL, resp.Status)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(bytes.TrimSpace(body), []byte("#EXTM3U")) {
+		return parseHlsRenditions(body, manifestURL, bandwidth)
+	}
+
+	return parseDashRenditions(body, manifestURL, bandwidth)
+}
+
+/*
+Picks the rendition an input should read.
+
+	With a language, the rendition must have that language.  Otherwise, the
+	default rendition is preferred, followed by the first one listed.
+*/
+func selectAbrRendition(renditions []AbrRendition, mediaType MediaType, language string, representation string) (*AbrRendition, error) {
+	var candidates []AbrRendition
+
+	for _, r := range renditions {
+		if r.MediaType != mediaType {
+			continue
+		}
+
+		if language != "" && r.Language != language {
+			continue
+		}
+
+		if representation != "" && r.Representation != representation {
+			continue
+		}
+
+		candidates = append(candidates, r)
+	}
+
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no %s rendition matches language %q and representation %q", mediaType, language, representation)
+	}
+
+	for _, r := range candidates {
+		if r.Default {
+			return &r, nil
+		}
+	}
+
+	return &candidates[0], nil
+}
+
+// Resolves a URI from a manifest against the manifest's own URL.
+func resolveURI(baseURL string, uri string) (string, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return "", err
+	}
+
+	ref, err := url.Parse(uri)
+	if err != nil {
+		return "", err
+	}
+
+	return base.ResolveReference(ref).String(), nil
+}
+
+// An #EXT-X-STREAM-INF tag and the URI which follows it.
+type hlsVariant struct {
+	attributes map[string]string
+	uri        string
+	bandwidth  int
+}
+
+func parseHlsRenditions(body []byte, manifestURL string, bandwidth int) ([]AbrRendition, error) {
+	var variants []hlsVariant
+	var media []map[string]string
+
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		if strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			attributes := extractAttributes(line)
+			variants = append(variants, hlsVariant{
+				attributes: attributes,
+				bandwidth:  ParseInt(attributes["BANDWIDTH"]),
+			})
+		} else if strings.HasPrefix(line, "#EXT-X-MEDIA:") {
+			media = append(media, extractAttributes(line))
+		} else if line != "" && !strings.HasPrefix(line, "#") {
+			if len(variants) > 0 && variants[len(variants)-1].uri == "" {
+				variants[len(variants)-1].uri = line
+			}
+		}
+	}
+
+	if len(variants) == 0 {
+		// This is already a media playlist, so it is read as it is.
+		return []AbrRendition{
+			{MediaType: VIDEO, URL: manifestURL},
+			{MediaType: AUDIO, URL: manifestURL},
+		}, nil
+	}
+
+	sort.SliceStable(variants, func(a, b int) bool {
+		return variants[a].bandwidth > variants[b].bandwidth
+	})
+
+	variant := &variants[0]
+	if bandwidth != 0 {
+		variant = nil
+		available := []string{}
+
+		for idx := range variants {
+			available = append(available, strconv.Itoa(variants[idx].bandwidth))
+			if variants[idx].bandwidth == bandwidth {
+				variant = &variants[idx]
+			}
+		}
+
+		if variant == nil {
+			return nil, fmt.Errorf("no variant has bandwidth %d; available: %s", bandwidth, strings.Join(available, ", "))
+		}
+	}
+
+	variantURL, err := resolveURI(manifestURL, variant.uri)
+	if err != nil {
+		return nil, err
+	}
+
+	renditions := []AbrRendition{
+		{MediaType: VIDEO, URL: variantURL, Bandwidth: variant.bandwidth},
+	}
+
+	groups := map[string]MediaType{
+		"AUDIO":     AUDIO,
+		"SUBTITLES": TEXT,
+	}
+
+	for groupType, mediaType := range groups {
+		groupID, ok := variant.attributes[groupType]
+		if !ok {
+			if mediaType == AUDIO {
+				// Without an audio group, the audio is muxed into the variant.
+				renditions = append(renditions, AbrRendition{MediaType: AUDIO, URL: variantURL})
+			}
+
+			continue
+		}
+
+		for _, m := range media {
+			if m["TYPE"] != groupType || m["GROUP-ID"] != groupID {
+				continue
+			}
+
+			renditionURL := variantURL
+			if uri, ok := m["URI"]; ok {
+				renditionURL, err = resolveURI(manifestURL, uri)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			renditions = append(renditions, AbrRendition{
+				MediaType: mediaType,
+				URL:       renditionURL,
+				Language:  m["LANGUAGE"],
+				Default:   m["DEFAULT"] == "YES",
+			})
+		}
+	}
+
+	return renditions, nil
+}
+
+// The parts of a DASH manifest needed to pick a representation.
+type dashMpd struct {
+	Type                  string       `xml:"type,attr"`
+	AvailabilityStartTime string       `xml:"availabilityStartTime,attr"`
+	Periods               []dashPeriod `xml:"Period"`
+}
+
+type dashPeriod struct {
+	Start          string              `xml:"start,attr"`
+	AdaptationSets []dashAdaptationSet `xml:"AdaptationSet"`
+}
+
+// Matches an xs:duration of days, hours, minutes and seconds, such as
+// "PT1H30M" or "P1DT0.5S".
+var xsDurationRegex = regexp.MustCompile(`^P(?:(\d+)D)?(?:T(?:(\d+)H)?(?:(\d+)M)?(?:(\d+(?:\.\d+)?)S)?)?$`)
+
+// Parses an xs:duration.  Years and months have no fixed length, and aren't
+// supported.
+func parseXsDuration(value string) (time.Duration, bool) {
+	match := xsDurationRegex.FindStringSubmatch(value)
+	if match == nil || value == "P" || strings.HasSuffix(value, "T") {
+		return 0, false
+	}
+
+	var seconds float64
+	for i, unit := range []float64{24 * 60 * 60, 60 * 60, 60, 1} {
+		if match[i+1] != "" {
+			n, _ := strconv.ParseFloat(match[i+1], 64)
+			seconds += n * unit
+		}
+	}
+
+	return time.Duration(seconds * float64(time.Second)), true
+}
+
+/*
+Returns the period to read from.
+
+	A static manifest is read from its first period.  In a live manifest, it
+	is the last period which has started by now: periods announced ahead of
+	time come after it.  A period with no start follows the one before it, so
+	it is taken to have started.
+*/
+func (m dashMpd) currentPeriod(now time.Time) dashPeriod {
+	current := m.Periods[0]
+	if m.Type != "dynamic" {
+		return current
+	}
+
+	availabilityStart, err := time.Parse(time.RFC3339, m.AvailabilityStartTime)
+
+	for _, period := range m.Periods[1:] {
+		start, ok := parseXsDuration(period.Start)
+		if ok && err == nil && availabilityStart.Add(start).After(now) {
+			break
+		}
+
+		current = period
+	}
+
+	return current
+}
+
+type dashAdaptationSet struct {
+	ContentType string `xml:"contentType,attr"`
+	MimeType    string `xml:"mimeType,attr"`
+	Lang        string `xml:"lang,attr"`
+	Roles       []struct {
+		Value string `xml:"value,attr"`
+	} `xml:"Role"`
+	Representations []struct {
+		ID        string `xml:"id,attr"`
+		MimeType  string `xml:"mimeType,attr"`
+		Bandwidth int    `xml:"bandwidth,attr"`
+	} `xml:"Representation"`
+}
+
+// Returns the media type of an adaptation set, or "" if it isn't supported.
+func (a dashAdaptationSet) mediaType() MediaType {
+	mimeType := a.MimeType
+	if mimeType == "" && len(a.Representations) > 0 {
+		mimeType = a.Representations[0].MimeType
+	}
+
+	contentType := a.ContentType
+	if contentType == "" {
+		contentType = strings.SplitN(mimeType, "/", 2)[0]
+	}
+
+	switch {
+	case contentType == "video":
+		return VIDEO
+	case contentType == "audio":
+		return AUDIO
+	case contentType == "text", strings.HasPrefix(mimeType, "application/ttml"):
+		return TEXT
+	}
+
+	return ""
+}
+
+func parseDashRenditions(body []byte, manifestURL string, bandwidth int) ([]AbrRendition, error) {
+	var mpd dashMpd
+	if err := xml.Unmarshal(body, &mpd); err != nil {
+		return nil, fmt.Errorf("%s is neither an HLS playlist nor a DASH manifest: %v", manifestURL, err)
+	}
+
+	if len(mpd.Periods) == 0 {
+		return nil, fmt.Errorf("%s has no periods", manifestURL)
+	}
+
+	var renditions []AbrRendition
+	available := []string{}
+
+	for _, set := range mpd.currentPeriod(time.Now()).AdaptationSets {
+		mediaType := set.mediaType()
+		if mediaType == "" || len(set.Representations) == 0 {
+			continue
+		}
+
+		isDefault := false
+		for _, role := range set.Roles {
+			isDefault = isDefault || role.Value == "main"
+		}
+
+		for _, rep := range set.Representations {
+			if mediaType == VIDEO {
+				available = append(available, strconv.Itoa(rep.Bandwidth))
+			}
+
+			renditions = append(renditions, AbrRendition{
+				MediaType:      mediaType,
+				URL:            manifestURL,
+				Representation: rep.ID,
+				Language:       set.Lang,
+				Bandwidth:      rep.Bandwidth,
+				Default:        isDefault,
+			})
+		}
+	}
+
+	// Prefer the highest representations, so they are selected first.
+	sort.SliceStable(renditions, func(a, b int) bool {
+		return renditions[a].Bandwidth > renditions[b].Bandwidth
+	})
+
+	if bandwidth == 0 {
+		return renditions, nil
+	}
+
+	var selected []AbrRendition
+	for _, r := range renditions {
+		if r.MediaType != VIDEO || r.Bandwidth == bandwidth {
+			selected = append(selected, r)
+		}
+	}
+
+	if len(selected) == len(renditions)-len(available) {
+		return nil, fmt.Errorf("no video representation has bandwidth %d; available: %s", bandwidth, strings.Join(available, ", "))
+	}
+
+	return selected, nil
+}
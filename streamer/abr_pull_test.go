@@ -0,0 +1,254 @@
+package streamer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testHlsMaster = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="en",NAME="English",DEFAULT=NO,URI="audio/en.m3u8"
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",LANGUAGE="fr",NAME="Français",DEFAULT=YES,URI="audio/fr.m3u8"
+#EXT-X-MEDIA:TYPE=SUBTITLES,GROUP-ID="subs",LANGUAGE="de",NAME="Deutsch",URI="text/de.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,CODECS="avc1.64001f,mp4a.40.2",AUDIO="aac",SUBTITLES="subs"
+video/720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,CODECS="avc1.640028,mp4a.40.2",AUDIO="aac",SUBTITLES="subs"
+video/1080p.m3u8
+`
+
+const testDashMpd = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic">
+  <Period id="0">
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="video_720p" bandwidth="2500000"/>
+      <Representation id="video_1080p" bandwidth="5000000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4" lang="en">
+      <Representation id="audio_en" bandwidth="128000"/>
+    </AdaptationSet>
+    <AdaptationSet mimeType="audio/mp4" lang="es">
+      <Role schemeIdUri="urn:mpeg:dash:role:2011" value="main"/>
+      <Representation id="audio_es" bandwidth="128000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>
+`
+
+// A live manifest of two periods which have started, and one announced ahead
+// of time.
+const testDashMultiPeriodMpd = `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="dynamic" availabilityStartTime="2020-01-01T00:00:00Z">
+  <Period id="0" start="PT0S">
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="video_pre_roll" bandwidth="2500000"/>
+    </AdaptationSet>
+  </Period>
+  <Period id="1" start="PT1H">
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="video_programme" bandwidth="2500000"/>
+    </AdaptationSet>
+  </Period>
+  <Period id="2" start="P36500D">
+    <AdaptationSet contentType="video" mimeType="video/mp4">
+      <Representation id="video_next" bandwidth="2500000"/>
+    </AdaptationSet>
+  </Period>
+</MPD>
+`
+
+// Serves the master playlist above, with live media playlists whose segments
+// advance with the clock, and the DASH manifests above.
+func newTestAbrServer() *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/master.m3u8", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testHlsMaster))
+	})
+
+	mux.HandleFunc("/manifest.mpd", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testDashMpd))
+	})
+
+	mux.HandleFunc("/multi_period.mpd", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testDashMultiPeriodMpd))
+	})
+
+	mediaPlaylist := func(w http.ResponseWriter, r *http.Request) {
+		sequence := time.Now().Unix() / 2
+
+		var playlist strings.Builder
+		fmt.Fprintf(&playlist, "#EXTM3U\n#EXT-X-TARGETDURATION:2\n#EXT-X-MEDIA-SEQUENCE:%d\n", sequence)
+		for n := sequence; n < sequence+3; n++ {
+			fmt.Fprintf(&playlist, "#EXTINF:2.0,\nsegment_%d.ts\n", n)
+		}
+
+		w.Write([]byte(playlist.String()))
+	}
+
+	mux.HandleFunc("/video/", mediaPlaylist)
+	mux.HandleFunc("/audio/", mediaPlaylist)
+	mux.HandleFunc("/text/", mediaPlaylist)
+
+	return httptest.NewServer(mux)
+}
+
+func TestSelectAbrRendition(t *testing.T) {
+	server := newTestAbrServer()
+	defer server.Close()
+
+	tests := []struct {
+		name               string
+		manifest           string
+		bandwidth          int
+		mediaType          MediaType
+		language           string
+		wantURL            string
+		wantRepresentation string
+		wantLanguage       string
+		wantErr            bool
+	}{
+		{
+			name:      "HLS highest variant",
+			manifest:  "/master.m3u8",
+			mediaType: VIDEO,
+			wantURL:   "/video/1080p.m3u8",
+		},
+		{
+			name:      "HLS configured variant",
+			manifest:  "/master.m3u8",
+			bandwidth: 2500000,
+			mediaType: VIDEO,
+			wantURL:   "/video/720p.m3u8",
+		},
+		{
+			name:      "HLS unknown variant",
+			manifest:  "/master.m3u8",
+			bandwidth: 1000,
+			mediaType: VIDEO,
+			wantErr:   true,
+		},
+		{
+			name:         "HLS default audio",
+			manifest:     "/master.m3u8",
+			mediaType:    AUDIO,
+			wantURL:      "/audio/fr.m3u8",
+			wantLanguage: "fr",
+		},
+		{
+			name:         "HLS audio by language",
+			manifest:     "/master.m3u8",
+			mediaType:    AUDIO,
+			language:     "en",
+			wantURL:      "/audio/en.m3u8",
+			wantLanguage: "en",
+		},
+		{
+			name:      "HLS missing language",
+			manifest:  "/master.m3u8",
+			mediaType: AUDIO,
+			language:  "ja",
+			wantErr:   true,
+		},
+		{
+			name:         "HLS subtitles",
+			manifest:     "/master.m3u8",
+			mediaType:    TEXT,
+			wantURL:      "/text/de.m3u8",
+			wantLanguage: "de",
+		},
+		{
+			name:      "HLS media playlist",
+			manifest:  "/video/720p.m3u8",
+			mediaType: VIDEO,
+			wantURL:   "/video/720p.m3u8",
+		},
+		{
+			name:               "DASH highest representation",
+			manifest:           "/manifest.mpd",
+			mediaType:          VIDEO,
+			wantURL:            "/manifest.mpd",
+			wantRepresentation: "video_1080p",
+		},
+		{
+			name:               "DASH configured representation",
+			manifest:           "/manifest.mpd",
+			bandwidth:          2500000,
+			mediaType:          VIDEO,
+			wantURL:            "/manifest.mpd",
+			wantRepresentation: "video_720p",
+		},
+		{
+			name:               "DASH main audio",
+			manifest:           "/manifest.mpd",
+			mediaType:          AUDIO,
+			wantURL:            "/manifest.mpd",
+			wantRepresentation: "audio_es",
+			wantLanguage:       "es",
+		},
+		{
+			name:               "DASH current period",
+			manifest:           "/multi_period.mpd",
+			mediaType:          VIDEO,
+			wantURL:            "/multi_period.mpd",
+			wantRepresentation: "video_programme",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			renditions, err := GetAbrRenditions(server.URL+tt.manifest, tt.bandwidth)
+
+			var got *AbrRendition
+			if err == nil {
+				got, err = selectAbrRendition(renditions, tt.mediaType, tt.language, "")
+			}
+
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			if got.URL != server.URL+tt.wantURL {
+				t.Errorf("URL = %v, want %v", got.URL, server.URL+tt.wantURL)
+			}
+
+			if got.Representation != tt.wantRepresentation {
+				t.Errorf("Representation = %v, want %v", got.Representation, tt.wantRepresentation)
+			}
+
+			if got.Language != tt.wantLanguage {
+				t.Errorf("Language = %v, want %v", got.Language, tt.wantLanguage)
+			}
+		})
+	}
+}
+
+func Test_parseXsDuration(t *testing.T) {
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{value: "PT0S", want: 0, wantOk: true},
+		{value: "PT1H30M", want: 90 * time.Minute, wantOk: true},
+		{value: "P1DT0.5S", want: 24*time.Hour + 500*time.Millisecond, wantOk: true},
+		{value: "P1M"},
+		{value: "PT"},
+		{value: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			got, ok := parseXsDuration(tt.value)
+			if got != tt.want || ok != tt.wantOk {
+				t.Errorf("parseXsDuration() = %v, %v, want %v, %v", got, ok, tt.want, tt.wantOk)
+			}
+		})
+	}
+}
@@ -2,8 +2,13 @@
 package streamer
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"math"
 	"os/exec"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -12,12 +17,24 @@ import (
 // TYPES_WE_CANT_PROBE are input types that cannot be probed by ffprobe.
 var TYPES_WE_CANT_PROBE = []InputType{
 	EXTERNAL_COMMAND,
+	// Nothing can be probed until an encoder connects.
+	RTMP,
+	// Every property of a generated stream is already known.
+	GENERATOR,
+	// The files of a playlist can change while it runs.
+	PLAYLIST,
+	// Cues only exist once they are pushed.
+	CUE_API,
 }
 
 // HermeticFFProbe is a module level variable that might be set by the controller node
 // if the user chooses to use the shaka streamer bundled binaries.
 var HermeticFFProbe string = "ffprobe"
 
+// HermeticFFmpeg is the FFmpeg used for detection which needs decoded frames,
+// and is set by the controller node along with HermeticFFProbe.
+var HermeticFFmpeg string = "ffmpeg"
+
 /*
 Autodetect some feature of the input, if possible, using ffprobe.
 Args:
@@ -36,6 +53,36 @@ func probe(i Input, field string) (string, error) {
 		return "", fmt.Errorf("%s not supported", i.InputType)
 	}
 
+	args := probeArgs(i, field)
+
+	cmd := exec.Command(args[0], args[1:]...)
+	outputBytes, err := cmd.CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("error running command: %v", err)
+	}
+
+	// The output is either some probe information or just a blank line.
+	s := strings.TrimSpace(string(outputBytes))
+	if s == "" {
+		return "", nil
+	}
+
+	// With certain container formats, ffprobe returns a duplicate
+	// output and some empty lines in between. Issue #119
+	lines := strings.Split(s, "\n")
+	s = lines[0]
+
+	//  Webcams on Linux seem to behave badly if the device is rapidly opened and
+	//  closed.  Therefore, sleep for 1 second after a webcam probe.
+	if i.InputType == WEBCAM {
+		time.Sleep(time.Second)
+	}
+
+	return s, nil
+}
+
+// Builds the ffprobe command line which shows a field of this input.
+func probeArgs(i Input, field string) []string {
 	args := []string{
 		// Probe this input file
 		HermeticFFProbe,
@@ -57,35 +104,110 @@ func probe(i Input, field string) (string, error) {
 		"-of", "compact=p=0:nk=1",
 	)
 
-	cmd := exec.Command(args[0], args[1:]...)
-	outputBytes, err := cmd.CombinedOutput()
+	return args
+}
+
+// A stream of an input, as described by ffprobe.
+type ProbedStream struct {
+	CodecType   string            `json:"codec_type"`
+	CodecName   string            `json:"codec_name"`
+	Tags        map[string]string `json:"tags"`
+	Disposition map[string]int    `json:"disposition"`
+}
+
+// Describes the stream for an error message, such as "aac (fra, default)".
+func (s ProbedStream) String() string {
+	details := []string{}
+	if language := s.Tags["language"]; language != "" {
+		details = append(details, language)
+	}
+
+	for _, disposition := range TRACK_DISPOSITIONS {
+		key := string(disposition)
+		if ffprobeKey, ok := FFPROBE_DISPOSITIONS[disposition]; ok {
+			key = ffprobeKey
+		}
+
+		if s.Disposition[key] != 0 {
+			details = append(details, string(disposition))
+		}
+	}
+
+	if len(details) == 0 {
+		return s.CodecName
+	}
+
+	return fmt.Sprintf("%s (%s)", s.CodecName, strings.Join(details, ", "))
+}
+
+/*
+Returns every stream of the media type of this input, in order, so the
+position of a stream is its track number.
+
+	With media_type 'all', every stream is returned.  With a program, only the
+	streams of that program are returned.
+*/
+func ProbeStreams(i Input) ([]ProbedStream, error) {
+	if ContainsInputType(TYPES_WE_CANT_PROBE, i.InputType) {
+		// Not supported for this type.
+		return nil, fmt.Errorf("%s not supported", i.InputType)
+	}
+
+	specifier := map[MediaType]string{VIDEO: "v", AUDIO: "a", TEXT: "s"}[i.MediaType]
+	if i.Program != 0 {
+		specifier = strings.TrimSuffix(fmt.Sprintf("p:%d:%s", i.Program, specifier), ":")
+	}
+
+	args := []string{HermeticFFProbe, i.Name}
+	args = append(args, i.GetInputArgs()...)
+	if specifier != "" {
+		args = append(args, "-select_streams", specifier)
+	}
+
+	args = append(args,
+		"-show_entries", "stream=codec_type,codec_name:stream_tags=language:stream_disposition",
+		"-loglevel", "quiet",
+		"-of", "json",
+	)
+
+	outputBytes, err := exec.Command(args[0], args[1:]...).Output()
 	if err != nil {
-		return "", fmt.Errorf("error running command: %v", err)
+		return nil, fmt.Errorf("error running command: %v", err)
 	}
 
-	// The output is either some probe information or just a blank line.
-	s := strings.TrimSpace(string(outputBytes))
-	if s == "" {
-		return "", nil
+	var output struct {
+		Streams []ProbedStream `json:"streams"`
 	}
 
-	// With certain container formats, ffprobe returns a duplicate
-	// output and some empty lines in between. Issue #119
-	lines := strings.Split(s, "\n")
-	s = lines[0]
+	if err := json.Unmarshal(outputBytes, &output); err != nil {
+		return nil, fmt.Errorf("unexpected ffprobe output: %v", err)
+	}
 
-	//  Webcams on Linux seem to behave badly if the device is rapidly opened and
-	//  closed.  Therefore, sleep for 1 second after a webcam probe.
-	if i.InputType == WEBCAM {
-		time.Sleep(time.Second)
+	return output.Streams, nil
+}
+
+// IsAlive returns true if ffprobe finds the stream for this input within the
+// given time.  Unlike IsPresent, this gives up on a live source which hangs.
+func IsAlive(i Input, timeout time.Duration) bool {
+	if ContainsInputType(TYPES_WE_CANT_PROBE, i.InputType) {
+		return true
 	}
 
-	return s, nil
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	args := probeArgs(i, "stream=index")
+	output, err := exec.CommandContext(ctx, args[0], args[1:]...).Output()
+	return err == nil && len(strings.TrimSpace(string(output))) > 0
 }
 
 // IsPresent returns true if the stream for this input is indeed found.
 // If we can't probe this input type, assume it is present.
 func IsPresent(i Input) bool {
+	if ContainsInputType(TYPES_WE_CANT_PROBE, i.InputType) {
+		return true
+	}
+
 	s, err := probe(i, "stream=index")
 	return err == nil && len(s) > 0
 }
@@ -113,7 +235,21 @@ func GetInterlaced(i Input) bool {
 
 func GetFrameRate(i Input) float64 {
 	s, _ := probe(i, "stream=avg_frame_rate")
+	frameRate := parseFrameRate(s)
+
+	// The detected frame rate for interlaced content is twice what it should be.
+	// It's actually the field rate, where it takes two interlaced fields to make
+	// a frame. Because we have to know if it's interlaced already, we must
+	// assert that is_interlaced has been set before now.
+	if i.IsInterlaced && strings.Contains(s, "/") {
+		frameRate /= 2.0
+	}
 
+	return frameRate
+}
+
+// Converts a frame rate from ffprobe into a float.
+func parseFrameRate(s string) float64 {
 	// This string is the framerate in the form of a fraction, such as '24/1' or
 	// '30000/1001'. Occasionally, there is a pipe after the framerate, such as
 	// '32700/1091|'. We must split it into pieces and do the division to get a
@@ -122,50 +258,229 @@ func GetFrameRate(i Input) float64 {
 	if len(pieces) == 1 {
 		frameRate, _ := strconv.ParseFloat(pieces[0], 64)
 		return frameRate
-	} else {
-		numerator, _ := strconv.ParseFloat(pieces[0], 64)
-		denominator, _ := strconv.ParseFloat(pieces[1], 64)
-		frameRate := numerator / denominator
-
-		// The detected frame rate for interlaced content is twice what it should be.
-		// It's actually the field rate, where it takes two interlaced fields to make
-		// a frame. Because we have to know if it's interlaced already, we must
-		// assert that is_interlaced has been set before now.
-		if i.IsInterlaced {
-			frameRate /= 2.0
+	}
+
+	numerator, _ := strconv.ParseFloat(pieces[0], 64)
+	denominator, _ := strconv.ParseFloat(pieces[1], 64)
+	if denominator == 0 {
+		return 0
+	}
+
+	return numerator / denominator
+}
+
+/*
+Returns true if we detect that the frames of the input are not evenly
+spaced.
+
+	ffprobe's r_frame_rate is the rate at which every timestamp falls on a
+	frame, and avg_frame_rate is the number of frames over the duration.  With
+	a constant frame rate, they agree.
+*/
+func GetVariableFrameRate(i Input) bool {
+	s, err := probe(i, "stream=r_frame_rate,avg_frame_rate")
+	if err != nil {
+		return false
+	}
+
+	// This is in the form of 'R_FRAME_RATE|AVG_FRAME_RATE', such as
+	// '90000/1|29869/1000'.
+	rates := strings.Split(strings.TrimSuffix(s, "|"), "|")
+	if len(rates) < 2 {
+		return false
+	}
+
+	exact, average := parseFrameRate(rates[0]), parseFrameRate(rates[1])
+	if exact <= 0 || average <= 0 {
+		// A live stream may not know its average yet.
+		return false
+	}
+
+	// Allow for the rounding of the average.
+	return math.Abs(exact-average)/exact > 0.01
+}
+
+// The frame rates a variable frame rate is normalised to.
+var STANDARD_FRAME_RATES = []float64{
+	24000.0 / 1001, 24, 25, 30000.0 / 1001, 30, 50, 60000.0 / 1001, 60,
+}
+
+/*
+Returns the common frame rate nearest to an average one, such as 30 for
+29.87.
+
+	A rate far from any of them, such as that of a slideshow, is rounded to
+	the nearest whole frame instead.
+*/
+func standardFrameRate(frameRate float64) float64 {
+	nearest := STANDARD_FRAME_RATES[0]
+	for _, standard := range STANDARD_FRAME_RATES {
+		if math.Abs(standard-frameRate) < math.Abs(nearest-frameRate) {
+			nearest = standard
 		}
+	}
 
-		return frameRate
+	if math.Abs(nearest-frameRate)/nearest > 0.05 {
+		return math.Max(1, math.Round(frameRate))
 	}
+
+	return nearest
 }
 
-// Returns the autodetected resolution of the input.
+// The picture of a video input as it is shown.
+type DisplaySize struct {
+	// The size of the picture once it is rotated.
+	Width  int
+	Height int
+
+	/*
+		How far the stored picture is turned clockwise to show it: 0, 90, 180 or
+		270 degrees.
+
+			Phones record this in a rotation tag, or in a display matrix.
+	*/
+	Rotation int
+}
+
+/*
+Returns the autodetected size of the picture of a video input, as it is
+shown.
+
+	A picture turned on its side by its metadata has its width and height
+	swapped.
+*/
+func GetDisplaySize(i Input) (DisplaySize, error) {
+	if ContainsInputType(TYPES_WE_CANT_PROBE, i.InputType) {
+		// Not supported for this type.
+		return DisplaySize{}, fmt.Errorf("%s not supported", i.InputType)
+	}
+
+	args := []string{HermeticFFProbe, i.Name}
+	args = append(args, i.GetInputArgs()...)
+	args = append(args,
+		"-select_streams", i.GetStreamSpecifier(),
+		"-show_entries", "stream=width,height:stream_tags=rotate:stream_side_data=rotation",
+		"-loglevel", "quiet",
+		"-of", "json",
+	)
+
+	outputBytes, err := exec.Command(args[0], args[1:]...).Output()
+	if err != nil {
+		return DisplaySize{}, fmt.Errorf("error running command: %v", err)
+	}
+
+	var output struct {
+		Streams []struct {
+			Width        int               `json:"width"`
+			Height       int               `json:"height"`
+			Tags         map[string]string `json:"tags"`
+			SideDataList []struct {
+				Rotation *float64 `json:"rotation"`
+			} `json:"side_data_list"`
+		} `json:"streams"`
+	}
+
+	if err := json.Unmarshal(outputBytes, &output); err != nil {
+		return DisplaySize{}, fmt.Errorf("unexpected ffprobe output: %v", err)
+	}
+
+	if len(output.Streams) == 0 {
+		return DisplaySize{}, fmt.Errorf("no video stream in %s", i.Name)
+	}
+
+	stream := output.Streams[0]
+
+	// The rotate tag of older versions of FFmpeg is clockwise, while the
+	// display matrix which replaced it is counter-clockwise.
+	clockwise := 0.0
+	if rotate, err := strconv.ParseFloat(stream.Tags["rotate"], 64); err == nil {
+		clockwise = rotate
+	}
+
+	for _, sideData := range stream.SideDataList {
+		if sideData.Rotation != nil {
+			clockwise = -*sideData.Rotation
+		}
+	}
+
+	size := DisplaySize{
+		Width:    stream.Width,
+		Height:   stream.Height,
+		Rotation: normalizeRotation(clockwise),
+	}
+
+	if size.Rotation == 90 || size.Rotation == 270 {
+		size.Width, size.Height = size.Height, size.Width
+	}
+
+	return size, nil
+}
+
+// Rounds a rotation in degrees to the nearest quarter turn, from 0 to 270.
+func normalizeRotation(degrees float64) int {
+	quarters := int(math.Round(degrees / 90))
+	return ((quarters%4 + 4) % 4) * 90
+}
+
+/*
+Returns the autodetected resolution of the input.
+
+	The resolution is that of the picture as it is shown, so a clip recorded
+	on its side isn't taken for a wider one.  A cropped input is sized by the
+	picture it keeps, so letterboxing doesn't lift it into a bigger bucket.
+*/
 func GetResolution(i Input) VideoResolutionName {
-	// resolutionString
-	rs, _ := probe(i, "stream=width,height")
+	width, height := i.Processing.Crop.Width, i.Processing.Crop.Height
+
+	if width == 0 || height == 0 {
+		display, err := GetDisplaySize(i)
+		if err != nil {
+			return ""
+		}
 
-	// This is the resolution of the video in the form of 'WIDTH|HEIGHT'.  For
-	// example, '1920|1080'.  Occasionally, there is a pipe after the resolution,
-	// such as '1920|1080|'.  We have to split up width and height and match that
-	// to a named resolution.
-	// resolutionArray
-	ra := strings.Split(strings.TrimRight(rs, "|"), "|")
-	width, _ := strconv.Atoi(ra[0])
-	height, _ := strconv.Atoi(ra[1])
+		width, height = display.Width, display.Height
+	}
 
-	for key, bucket := range *DefaultVideoResolutions {
-		// You use this as chance to set bucket Name.
-		bucket.Name = key
+	return resolutionForSize(width, height, i.FrameRate)
+}
 
-		size := width == bucket.MaxWidth && height <= bucket.MaxHeight
+/*
+Returns the smallest named resolution which holds a picture of this size
+and frame rate.
 
-		// The first bucket this fits into is the one.
-		if size && i.FrameRate <= bucket.MaxFrameRate {
-			return key
+	A portrait picture is matched on its side, so a 1080x1920 clip is 1080p.
+*/
+func resolutionForSize(width int, height int, frameRate float64) VideoResolutionName {
+	if height > width {
+		width, height = height, width
+	}
+
+	resolutions := *DefaultVideoResolutions
+
+	keys := make([]VideoResolutionName, 0, len(resolutions))
+	for key := range resolutions {
+		keys = append(keys, key)
+	}
+
+	// From the smallest, and at the same size, those with a frame rate limit
+	// first.
+	sort.Slice(keys, func(a, b int) bool {
+		ra, rb := resolutions[keys[a]], resolutions[keys[b]]
+		if ra.MaxHeight != rb.MaxHeight {
+			return ra.MaxHeight < rb.MaxHeight
 		}
 
-		// high frame rate
-		if size && i.FrameRate > 30 && bucket.MaxFrameRate == 0 {
+		return ra.MaxFrameRate != 0 && rb.MaxFrameRate == 0
+	})
+
+	for _, key := range keys {
+		bucket := resolutions[key]
+
+		// A bucket without a max frame rate takes high frame rates.
+		fast := bucket.MaxFrameRate == 0 || frameRate <= bucket.MaxFrameRate
+
+		// The first bucket this fits into is the one.
+		if width <= bucket.MaxWidth && height <= bucket.MaxHeight && fast {
 			return key
 		}
 	}
@@ -191,3 +506,150 @@ func GetChannelLayout(i Input) AudioChannelLayoutName {
 
 	return ""
 }
+
+// The number of points in a file at which cropdetect samples the picture.
+const CROP_DETECT_SAMPLES = 5
+
+// The number of frames cropdetect looks at in each sample.
+const CROP_DETECT_FRAMES = 60
+
+var cropDetectRegex = regexp.MustCompile(`crop=(\d+):(\d+):(\d+):(\d+)`)
+
+// The picture inside the black bars at one point of an input, as cropdetect
+// saw it.
+type CropSample struct {
+	// The time of the sample in the input, in seconds.
+	Time float64 `json:"time"`
+
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+}
+
+// Returns the autodetected duration of the input in seconds, or 0 if it has
+// none, such as a live stream.
+func GetDuration(i Input) float64 {
+	s, _ := probe(i, "format=duration")
+
+	duration, err := strconv.ParseFloat(strings.TrimSuffix(s, "|"), 64)
+	if err != nil {
+		return 0
+	}
+
+	return duration
+}
+
+/*
+Detect the black bars around the picture of a video input with FFmpeg's
+cropdetect filter.
+
+	A file is sampled at several points along its length, and a stream only
+	from where it is joined.  Samples of a black picture find nothing, and are
+	left out.
+
+	Returns the smallest rectangle holding the picture of every sample, so a
+	bright scene is never cut to fit a dark one.
+*/
+func DetectCrop(i Input) (CropConfig, error) {
+	times := []float64{0}
+	if duration := GetDuration(i); duration > 0 {
+		times = nil
+		for n := 0; n < CROP_DETECT_SAMPLES; n++ {
+			// Evenly spaced, away from the titles at either end.
+			times = append(times, duration*(float64(n)+0.5)/CROP_DETECT_SAMPLES)
+		}
+	}
+
+	var samples []CropSample
+	for _, at := range times {
+		sample, found, err := detectCropAt(i, at)
+		if err != nil {
+			return CropConfig{}, err
+		}
+
+		if found {
+			samples = append(samples, sample)
+		}
+	}
+
+	if len(samples) == 0 {
+		return CropConfig{}, fmt.Errorf("no crop was detected in %s", i.Name)
+	}
+
+	return stableCrop(samples), nil
+}
+
+// Runs cropdetect on the frames of an input from a point in time.
+func detectCropAt(i Input, at float64) (CropSample, bool, error) {
+	args := []string{HermeticFFmpeg, "-hide_banner", "-nostats"}
+	args = append(args, i.GetInputArgs()...)
+	if at > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(at, 'f', 3, 64))
+	}
+
+	args = append(args,
+		"-i", i.Name,
+		"-map", "0:"+i.GetStreamSpecifier(),
+		// Round the rectangle to even sizes, which the encoders require.
+		"-vf", "cropdetect=round=2",
+		"-frames:v", strconv.Itoa(CROP_DETECT_FRAMES),
+		"-f", "null", "-",
+	)
+
+	output, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return CropSample{}, false, fmt.Errorf("failed to detect the crop of %s: %v", i.Name, err)
+	}
+
+	// cropdetect reports the rectangle of every frame so far, so the last
+	// report covers the whole sample.
+	matches := cropDetectRegex.FindAllStringSubmatch(string(output), -1)
+	if len(matches) == 0 {
+		return CropSample{}, false, nil
+	}
+
+	sample := parseCropDetect(matches[len(matches)-1])
+	sample.Time = at
+	return sample, true, nil
+}
+
+// Converts a crop=W:H:X:Y match of cropdetect's log into a sample.
+func parseCropDetect(match []string) CropSample {
+	width, _ := strconv.Atoi(match[1])
+	height, _ := strconv.Atoi(match[2])
+	x, _ := strconv.Atoi(match[3])
+	y, _ := strconv.Atoi(match[4])
+
+	return CropSample{Width: width, Height: height, X: x, Y: y}
+}
+
+// Returns the smallest rectangle, of even size, holding every sample.
+func stableCrop(samples []CropSample) CropConfig {
+	left, top := samples[0].X, samples[0].Y
+	right, bottom := left+samples[0].Width, top+samples[0].Height
+
+	for _, sample := range samples[1:] {
+		if sample.X < left {
+			left = sample.X
+		}
+		if sample.Y < top {
+			top = sample.Y
+		}
+		if sample.X+sample.Width > right {
+			right = sample.X + sample.Width
+		}
+		if sample.Y+sample.Height > bottom {
+			bottom = sample.Y + sample.Height
+		}
+	}
+
+	width, height := right-left, bottom-top
+	return CropConfig{
+		Width:   width - width%2,
+		Height:  height - height%2,
+		X:       &left,
+		Y:       &top,
+		samples: samples,
+	}
+}
@@ -37,3 +37,116 @@ func Test_probe(t *testing.T) {
 		})
 	}
 }
+
+func Test_resolutionForSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		width     int
+		height    int
+		frameRate float64
+		want      VideoResolutionName
+	}{
+		{name: "exact", width: 1920, height: 1080, frameRate: 30, want: "1080p"},
+		{name: "letterboxed", width: 1920, height: 800, frameRate: 24, want: "1080p"},
+		{name: "cropped to 4:3", width: 1440, height: 1080, frameRate: 25, want: "1080p"},
+		{name: "cropped below 720p", width: 1280, height: 536, frameRate: 24, want: "720p"},
+		{name: "high frame rate", width: 1280, height: 720, frameRate: 60, want: "720p-hfr"},
+		{name: "portrait", width: 1080, height: 1920, frameRate: 30, want: "1080p"},
+		{name: "too big", width: 10000, height: 5000, frameRate: 30, want: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := resolutionForSize(tt.width, tt.height, tt.frameRate); got != tt.want {
+				t.Errorf("resolutionForSize() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetDisplaySize(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   DisplaySize
+	}{
+		{
+			name:   "upright",
+			output: `{"streams": [{"width": 1920, "height": 1080}]}`,
+			want:   DisplaySize{Width: 1920, Height: 1080},
+		},
+		{
+			name:   "display matrix",
+			output: `{"streams": [{"width": 1920, "height": 1080, "side_data_list": [{"side_data_type": "Display Matrix", "rotation": -90}]}]}`,
+			want:   DisplaySize{Width: 1080, Height: 1920, Rotation: 90},
+		},
+		{
+			name:   "rotate tag",
+			output: `{"streams": [{"width": 1920, "height": 1080, "tags": {"rotate": "270"}}]}`,
+			want:   DisplaySize{Width: 1080, Height: 1920, Rotation: 270},
+		},
+		{
+			name:   "upside down",
+			output: `{"streams": [{"width": 1920, "height": 1080, "side_data_list": [{"rotation": 180}]}]}`,
+			want:   DisplaySize{Width: 1920, Height: 1080, Rotation: 180},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeTools(t, "#!/bin/sh\ncat <<'EOF'\n"+tt.output+"\nEOF\n", "")
+
+			got, err := GetDisplaySize(Input{InputType: FILE, Name: "clip.mov", MediaType: VIDEO})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("GetDisplaySize() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGetVariableFrameRate(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   bool
+	}{
+		{name: "constant", output: "30000/1001|30000/1001", want: false},
+		{name: "rounded average", output: "25/1|2497/100", want: false},
+		{name: "phone recording", output: "90000/1|29869/1000", want: true},
+		{name: "live stream", output: "30/1|0/0", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fakeTools(t, "#!/bin/sh\necho '"+tt.output+"'\n", "")
+
+			if got := GetVariableFrameRate(Input{InputType: FILE, Name: "clip.mp4", MediaType: VIDEO}); got != tt.want {
+				t.Errorf("GetVariableFrameRate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_standardFrameRate(t *testing.T) {
+	tests := []struct {
+		frameRate float64
+		want      float64
+	}{
+		{frameRate: 29.869, want: 30000.0 / 1001},
+		{frameRate: 30.4, want: 30},
+		{frameRate: 24.6, want: 25},
+		{frameRate: 58.1, want: 60000.0 / 1001},
+		{frameRate: 12.3, want: 12},
+		{frameRate: 0.2, want: 1},
+	}
+
+	for _, tt := range tests {
+		if got := standardFrameRate(tt.frameRate); got != tt.want {
+			t.Errorf("standardFrameRate(%v) = %v, want %v", tt.frameRate, got, tt.want)
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"math"
 	"regexp"
+	"strconv"
 	"strings"
 
 	"github.com/creasty/defaults"
@@ -18,7 +19,13 @@ func (b BitrateString) Name() string {
 	return "bitrate string"
 }
 
+// Checks the bitrate string.  An empty one is unset, and is rejected by the
+// empty=false validator of the fields which require it.
 func (bs BitrateString) Validate() error {
+	if bs == "" {
+		return nil
+	}
+
 	if !regexp.MustCompile(`^\d.*[kKmM]$`).MatchString(string(bs)) {
 		return errors.New("not a bitrate string (e.g. 500k or 7.5M)")
 	}
@@ -26,6 +33,30 @@ func (bs BitrateString) Validate() error {
 	return nil
 }
 
+// Returns the bitrate in bits per second.
+func (bs BitrateString) BitsPerSecond() (float64, error) {
+	if bs == "" {
+		return 0, errors.New("no bitrate")
+	}
+
+	if err := bs.Validate(); err != nil {
+		return 0, err
+	}
+
+	s := string(bs)
+	value, err := strconv.ParseFloat(s[:len(s)-1], 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a bitrate string", s)
+	}
+
+	switch s[len(s)-1] {
+	case 'k', 'K':
+		return value * 1e3, nil
+	default:
+		return value * 1e6, nil
+	}
+}
+
 type AudioCodecName string
 
 type VideoResolutionName string
@@ -33,19 +64,53 @@ type VideoResolutionName string
 type AudioChannelLayoutName string
 
 const (
-	AAC  AudioCodecName = "aac"
-	OPUS AudioCodecName = "opus"
-	AC3  AudioCodecName = "ac3"
-	EAC3 AudioCodecName = "eac3"
+	AAC       AudioCodecName = "aac"
+	OPUS      AudioCodecName = "opus"
+	AC3       AudioCodecName = "ac3"
+	EAC3      AudioCodecName = "eac3"
+	HE_AAC    AudioCodecName = "he-aac"    // HE-AAC v1, AAC with SBR
+	HE_AAC_V2 AudioCodecName = "he-aac-v2" // HE-AAC v2, with SBR and PS, for stereo only
+	FLAC      AudioCodecName = "flac"      // Lossless
+	MP3       AudioCodecName = "mp3"       // For mono and stereo only
+	AC4       AudioCodecName = "ac4"       // Passthrough only, since FFmpeg can't encode it
+)
+
+// Every audio codec.
+var AUDIO_CODECS = []AudioCodecName{AAC, OPUS, AC3, EAC3, HE_AAC, HE_AAC_V2, FLAC, MP3, AC4}
+
+// The audio codecs which can be copied from the input, rather than encoded.
+var PASSTHROUGH_AUDIO_CODECS = []AudioCodecName{AC3, EAC3, AC4}
+
+// The audio codecs which hold at most two channels.
+var STEREO_AUDIO_CODECS = []AudioCodecName{HE_AAC_V2, MP3}
+
+// The prefix of an audio codec which is copied from the input, such as
+// "copy:eac3".
+const AUDIO_PASSTHROUGH_PREFIX = "copy:"
+
+// The container of a packaged stream.
+type OutputFormat string
+
+const (
+	// Fragmented MP4, which is also the container of CMAF.  DASH and HLS both
+	// take it.
+	OUTPUT_FORMAT_MP4 OutputFormat = "mp4"
+	// WebM, which only DASH takes.
+	OUTPUT_FORMAT_WEBM OutputFormat = "webm"
 )
 
 type AudioCodec struct {
 	Name AudioCodecName
+	// True if the input is already in this codec, and is copied.
+	Passthrough bool
+	// The container of the output, or empty for the default of the codec.
+	OutputFormat OutputFormat
 }
 
 func NewAudioCodec(name AudioCodecName) *AudioCodec {
 	return &AudioCodec{
-		Name: name,
+		Name:        AudioCodecName(strings.TrimPrefix(string(name), AUDIO_PASSTHROUGH_PREFIX)),
+		Passthrough: strings.HasPrefix(string(name), AUDIO_PASSTHROUGH_PREFIX),
 	}
 }
 
@@ -61,8 +126,18 @@ func (a *AudioCodec) GetFFmpegCodecString(hwaccelAPI string) string {
 	//   The encoder 'opus' is experimental but experimental codecs are not
 	//   enabled, add '-strict -2' if you want to use it. Alternatively use the
 	//   non experimental encoder 'libopus'.
-	if a.Name == OPUS {
+	if a.Passthrough {
+		return "copy"
+	}
+
+	switch a.Name {
+	case OPUS:
 		return "libopus"
+	case HE_AAC, HE_AAC_V2:
+		// The native AAC encoder has no SBR or PS.
+		return "libfdk_aac"
+	case MP3:
+		return "libmp3lame"
 	}
 
 	return string(a.Name)
@@ -70,18 +145,28 @@ func (a *AudioCodec) GetFFmpegCodecString(hwaccelAPI string) string {
 
 // Returns an FFmpeg output format suitable for this codec.
 func (a *AudioCodec) GetOutputFormat() string {
-	// Returns an FFmpeg output format suitable for this codec.
-	// TODO: consider Opus in mp4 by default
-	// TODO(#31): add support for configurable output format per-codec
+	if a.OutputFormat != "" {
+		return string(a.OutputFormat)
+	}
+
 	if a.Name == OPUS {
 		return "webm"
-	} else if a.Name == AAC || a.Name == AC3 || a.Name == EAC3 {
+	} else if ContainsString(audioCodecStrings(AUDIO_CODECS), string(a.Name)) {
 		return "mp4"
 	} else {
-		panic(fmt.Sprintf("No mapping for output format for codec %s", a))
+		panic(fmt.Sprintf("No mapping for output format for codec %s", a.Name))
 	}
 }
 
+func audioCodecStrings(codecs []AudioCodecName) []string {
+	strs := make([]string, 0, len(codecs))
+	for _, codec := range codecs {
+		strs = append(strs, string(codec))
+	}
+
+	return strs
+}
+
 type VideoCodecName string
 
 const (
@@ -94,6 +179,8 @@ const (
 type VideoCodec struct {
 	Name  VideoCodecName
 	HWAcc bool
+	// The container of the output, or empty for the default of the codec.
+	OutputFormat OutputFormat
 }
 
 func NewVideoCodec(name VideoCodecName) *VideoCodec {
@@ -122,8 +209,10 @@ func (v *VideoCodec) GetFFmpegCodecString(hwaccelApi string) string {
 
 // Returns an FFmpeg output format suitable for this codec.
 func (c *VideoCodec) GetOutputFormat() string {
-	// TODO: consider VP9 in mp4 by default
-	// TODO(#31): add support for configurable output format per-codec
+	if c.OutputFormat != "" {
+		return string(c.OutputFormat)
+	}
+
 	switch c.Name {
 	case VP9:
 		return "webm"
@@ -149,7 +238,7 @@ type AudioChannelLayout struct {
 		   kilobits per second or megabits per second.
 		   For example, this could be '500k' or '7.5M'.
 	*/
-	Bitrates map[AudioCodecName]BitrateString `yaml:"bitrates" validate:"empty=false"`
+	Bitrates map[AudioCodecName]BitrateString `yaml:"bitrates" validate:"empty=false > empty=false"`
 }
 
 func NewAudioChannelLayout(maxChannels int, bitrates map[AudioCodecName]BitrateString) *AudioChannelLayout {
@@ -159,30 +248,48 @@ func NewAudioChannelLayout(maxChannels int, bitrates map[AudioCodecName]BitrateS
 	}
 }
 
+/*
+The default channel layouts.
+
+	FLAC is lossless, and AC-4 is copied, so their bitrates only name the
+	output.  HE-AAC v2 is only for stereo, and MP3 has no surround.
+*/
 var DefaultAudioChannelLayouts = &map[AudioChannelLayoutName]*AudioChannelLayout{
 	"mono": NewAudioChannelLayout(1, map[AudioCodecName]BitrateString{
-		AAC:  "64k",
-		OPUS: "32k",
-		AC3:  "96k",
-		EAC3: "48k",
+		AAC:    "64k",
+		OPUS:   "32k",
+		AC3:    "96k",
+		EAC3:   "48k",
+		HE_AAC: "32k",
+		FLAC:   "512k",
+		MP3:    "64k",
+		AC4:    "32k",
 	}),
 	"stereo": NewAudioChannelLayout(2, map[AudioCodecName]BitrateString{
-		AAC:  "128k",
-		OPUS: "64k",
-		AC3:  "192k",
-		EAC3: "96k",
+		AAC:       "128k",
+		OPUS:      "64k",
+		AC3:       "192k",
+		EAC3:      "96k",
+		HE_AAC:    "48k",
+		HE_AAC_V2: "32k",
+		FLAC:      "1M",
+		MP3:       "128k",
+		AC4:       "64k",
 	}),
 	"surround": NewAudioChannelLayout(6, map[AudioCodecName]BitrateString{
-		AAC:  "256k",
-		OPUS: "128k",
-		AC3:  "384k",
-		EAC3: "192k",
+		AAC:    "256k",
+		OPUS:   "128k",
+		AC3:    "384k",
+		EAC3:   "192k",
+		HE_AAC: "128k",
+		FLAC:   "3M",
+		AC4:    "144k",
 	}),
 }
 
 type VideoResolution struct {
 	/** key. */
-	Name VideoResolutionName
+	Name VideoResolutionName `yaml:"-"`
 	// The maximum width in pixels for this named resolution.
 	MaxWidth int `yaml:"max_width"`
 
@@ -196,7 +303,10 @@ type VideoResolution struct {
 	*/
 	MaxFrameRate float64 `yaml:"max_frame_rate"`
 
-	Bitrates map[VideoCodecName]BitrateString `yaml:"bitrates"`
+	Bitrates map[VideoCodecName]BitrateString `yaml:"bitrates" validate:"> empty=false"`
+
+	// How the encoder spends the bitrate of this resolution.
+	RateControl RateControlConfig `yaml:"rate_control,omitempty"`
 }
 
 // validations
@@ -215,6 +325,8 @@ func (vr *VideoResolution) UnmarshalYAML(unmarshal func(interface{}) error) erro
 		panic(err)
 	}
 
+	vr.RateControl.check()
+
 	return nil
 }
 
@@ -381,14 +493,25 @@ func (bc *BitrateConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 	return nil
 }
 
-// Defaults
+/*
+Defaults
+
+	A config is decoded into these maps, so they are copies, and the default
+	ones are left as they are.
+*/
 func (bc *BitrateConfig) SetDefaults() {
 	if defaults.CanUpdate(bc.VideoResolutions) {
-		bc.VideoResolutions = *DefaultVideoResolutions
+		bc.VideoResolutions = map[VideoResolutionName]*VideoResolution{}
+		for name, resolution := range *DefaultVideoResolutions {
+			bc.VideoResolutions[name] = resolution
+		}
 	}
 
 	if defaults.CanUpdate(bc.AudioChannelLayouts) {
-		bc.AudioChannelLayouts = *DefaultAudioChannelLayouts
+		bc.AudioChannelLayouts = map[AudioChannelLayoutName]*AudioChannelLayout{}
+		for name, layout := range *DefaultAudioChannelLayouts {
+			bc.AudioChannelLayouts[name] = layout
+		}
 	}
 }
 
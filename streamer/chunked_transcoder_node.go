@@ -0,0 +1,436 @@
+// A module that encodes the video of a VOD in chunks, in parallel.
+package streamer
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The options of a VOD encode split into chunks.
+type ChunkedEncodeConfig struct {
+	/*
+		If true, the video of each file input is split into chunks, which are
+		encoded at once by several FFmpeg processes, and stitched back together
+		for the packager.
+
+		  Only valid for VOD, and not with two_pass.  Audio, text and inputs
+		  which are not files are encoded as usual.
+	*/
+	Enable bool `yaml:"enable"`
+
+	// The length of each chunk, in segments.
+	ChunkSegments int `yaml:"chunk_segments" default:"15"`
+
+	// The most chunks encoded at once.  Defaults to the number of CPUs.
+	Concurrency int `yaml:"concurrency"`
+}
+
+// Checks the chunked encode options of a pipeline.
+func (c ChunkedEncodeConfig) check(pipelineConfig PipelineConfig) {
+	if !c.Enable {
+		return
+	}
+
+	if pipelineConfig.StreamingMode != VOD {
+		panic(NewMalformedField(c, "Enable", `only valid when streaming_mode is "vod"`))
+	}
+
+	if pipelineConfig.TwoPass {
+		panic(NewConflictingFields(pipelineConfig, "TwoPass", "ChunkedEncode"))
+	}
+
+	if c.ChunkSegments < 1 {
+		panic(NewMalformedField(c, "ChunkSegments", "must be at least 1"))
+	}
+
+	if c.Concurrency < 0 {
+		panic(NewMalformedField(c, "Concurrency", "must not be negative"))
+	}
+}
+
+// Returns the most chunks to encode at once.
+func (c ChunkedEncodeConfig) concurrency() int {
+	if c.Concurrency == 0 {
+		return runtime.NumCPU()
+	}
+
+	return c.Concurrency
+}
+
+// A part of the video of an input, from start to end in seconds.
+type encodeChunk struct {
+	start float64
+	end   float64
+	path  string
+}
+
+// A video output whose input is encoded in chunks.
+type chunkedStream struct {
+	stream *VideoOutputStream
+	input  Input
+	chunks []encodeChunk
+}
+
+/*
+Transcodes a VOD like a TranscoderNode, but encodes the video of file inputs
+in chunks, in parallel.
+
+	Each chunk is a whole number of segments, counted in frames, so it starts
+	on a keyframe at a segment boundary of the output.  Once every chunk of a
+	video output is encoded, the fragmented MP4s are joined by FFmpeg's concat
+	demuxer, which keeps the timestamps continuous, and copied into the pipe
+	of the output.  The segments of the stitched video are the same as those
+	of a single encode.
+*/
+type ChunkedTranscoderNode struct {
+	NodeBase
+	inputs         []Input
+	pipelineConfig PipelineConfig
+	outputs        []MediaOutputStream
+	index          int
+	tempDir        string
+	ffmpeg         string
+	mu             sync.Mutex
+	processes      map[*exec.Cmd]bool
+	stopped        bool
+	err            error
+	Status         ProcessStatus
+}
+
+func NewChunkedTranscoderNode(inputs []Input, pipelineConfig PipelineConfig, outputs []MediaOutputStream, index int, tempDir string, hermeticFFmpeg string) *ChunkedTranscoderNode {
+	n := &ChunkedTranscoderNode{
+		inputs:         inputs,
+		pipelineConfig: pipelineConfig,
+		outputs:        outputs,
+		index:          index,
+		tempDir:        tempDir,
+		ffmpeg:         "ffmpeg",
+		processes:      map[*exec.Cmd]bool{},
+		Status:         Finished,
+	}
+
+	if hermeticFFmpeg != "" {
+		n.ffmpeg = hermeticFFmpeg
+	}
+
+	return n
+}
+
+func (n *ChunkedTranscoderNode) Start() {
+	n.mu.Lock()
+	n.Status = Running
+	n.mu.Unlock()
+
+	go n.run()
+}
+
+func (n *ChunkedTranscoderNode) CheckStatus() ProcessStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.Status
+}
+
+func (n *ChunkedTranscoderNode) Stop() {
+	n.mu.Lock()
+	n.stopped = true
+	processes := make([]*exec.Cmd, 0, len(n.processes))
+	for process := range n.processes {
+		processes = append(processes, process)
+	}
+	n.mu.Unlock()
+
+	for _, process := range processes {
+		killProcessGroup(process)
+	}
+}
+
+func (n *ChunkedTranscoderNode) isStopped() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.stopped
+}
+
+// Records the first failure of the node, and stops everything else, since
+// the encode can't be finished without it.
+func (n *ChunkedTranscoderNode) fail(err error) {
+	n.mu.Lock()
+	if n.err == nil && !n.stopped {
+		n.err = err
+	}
+	n.mu.Unlock()
+
+	n.Stop()
+}
+
+func (n *ChunkedTranscoderNode) run() {
+	streams, rest := n.plan()
+
+	var wg sync.WaitGroup
+
+	if len(rest.outputs) > 0 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := n.runProcess(rest.commandLine(0), fmt.Sprintf("TranscoderNode-%d.log", n.index)); err != nil {
+				n.fail(fmt.Errorf("the transcoder failed: %v", err))
+			}
+		}()
+	}
+
+	// The chunks are started in order, so the first outputs are stitched
+	// while the others are still encoding.
+	slots := make(chan struct{}, n.pipelineConfig.ChunkedEncode.concurrency())
+	for s, stream := range streams {
+		var chunksDone sync.WaitGroup
+
+		for c, chunk := range stream.chunks {
+			slots <- struct{}{}
+			if n.isStopped() {
+				<-slots
+				break
+			}
+
+			args := n.chunkCommandLine(stream, chunk)
+			logFile := fmt.Sprintf("TranscoderNode-%d-chunk-%d-%d.log", n.index, s, c)
+			name := stream.stream.Resolution.Name
+
+			chunksDone.Add(1)
+			go func(c int) {
+				defer chunksDone.Done()
+				defer func() { <-slots }()
+
+				if err := n.runProcess(args, logFile); err != nil {
+					n.fail(fmt.Errorf("chunk %d of %s failed: %v", c, name, err))
+				}
+			}(c)
+		}
+
+		wg.Add(1)
+		go func(s int, stream chunkedStream) {
+			defer wg.Done()
+			chunksDone.Wait()
+
+			if n.isStopped() {
+				return
+			}
+
+			if err := n.stitch(stream, s); err != nil {
+				n.fail(fmt.Errorf("stitching %s failed: %v", stream.stream.Resolution.Name, err))
+			}
+		}(s, stream)
+	}
+
+	wg.Wait()
+
+	for _, stream := range streams {
+		for _, chunk := range stream.chunks {
+			os.Remove(chunk.path)
+		}
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", n.err)
+		n.Status = Errored
+	} else {
+		n.Status = Finished
+	}
+}
+
+/*
+Splits the outputs into the video outputs which are encoded in chunks, and a
+transcoder for everything else.
+
+	Only files can be read from any point, and only those of a known length
+	can be split.
+*/
+func (n *ChunkedTranscoderNode) plan() ([]chunkedStream, *TranscoderNode) {
+	var streams []chunkedStream
+	var restOutputs []MediaOutputStream
+
+	durations := map[string]float64{}
+
+	for _, output := range n.outputs {
+		video, ok := output.(*VideoOutputStream)
+		input := output.GetInput()
+
+		if ok && input.InputType == FILE && input.relayFormat == "" {
+			if _, probed := durations[input.Name]; !probed {
+				durations[input.Name] = GetDuration(input)
+			}
+
+			chunks := n.splitChunks(video, input, durations[input.Name], len(streams))
+			if len(chunks) > 0 {
+				streams = append(streams, chunkedStream{stream: video, input: input, chunks: chunks})
+				continue
+			}
+		}
+
+		restOutputs = append(restOutputs, output)
+	}
+
+	var restInputs []Input
+	for _, input := range n.inputs {
+		for _, output := range restOutputs {
+			if output.GetInput().Name == input.Name && output.GetInput().GetStreamSpecifier() == input.GetStreamSpecifier() {
+				restInputs = append(restInputs, input)
+				break
+			}
+		}
+	}
+
+	return streams, NewTranscoderNode(restInputs, n.pipelineConfig, restOutputs, n.index, n.ffmpeg)
+}
+
+/*
+Splits the part of an input which is encoded into chunks, each a whole number
+of segments long.
+
+	A segment is as many frames as a keyframe interval of the output, so the
+	chunks start on frames where a single encode would put a keyframe.
+	Returns nothing if the length of the input is unknown.
+*/
+func (n *ChunkedTranscoderNode) splitChunks(stream *VideoOutputStream, input Input, duration float64, index int) []encodeChunk {
+	start, end := 0.0, duration
+	if input.StartTime != "" {
+		start, _ = parseFFmpegTime(input.StartTime)
+	}
+	if input.EndTime != "" {
+		if to, err := parseFFmpegTime(input.EndTime); err == nil && (end == 0 || to < end) {
+			end = to
+		}
+	}
+
+	if end <= start {
+		return nil
+	}
+
+	segmentSize := n.pipelineConfig.SegmentSize
+	chunkSegments := float64(n.pipelineConfig.ChunkedEncode.ChunkSegments)
+
+	length := chunkSegments * segmentSize
+	if frameRate := outputFrameRate(input, stream.Resolution); frameRate > 0 {
+		if keyframeInterval := int(segmentSize * frameRate); keyframeInterval > 0 {
+			length = chunkSegments * float64(keyframeInterval) / frameRate
+		}
+	}
+
+	var chunks []encodeChunk
+	for at := start; at < end; at += length {
+		chunks = append(chunks, encodeChunk{
+			start: at,
+			end:   math.Min(at+length, end),
+			path:  filepath.Join(n.tempDir, fmt.Sprintf("chunk-%d-%d-%d.mp4", n.index, index, len(chunks))),
+		})
+	}
+
+	return chunks
+}
+
+// Returns the command line which encodes a chunk of a video output to its
+// file.
+func (n *ChunkedTranscoderNode) chunkCommandLine(stream chunkedStream, chunk encodeChunk) []string {
+	input := stream.input
+	input.StartTime = strconv.FormatFloat(chunk.start, 'f', 6, 64)
+	input.EndTime = strconv.FormatFloat(chunk.end, 'f', 6, 64)
+	// The stitched video is offset as a whole.
+	input.AvOffset = ""
+
+	t := NewTranscoderNode([]Input{input}, n.pipelineConfig, []MediaOutputStream{stream.stream}, n.index, n.ffmpeg)
+	args := t.commandLine(0)
+
+	// The last argument is the pipe of the output, which the stitch writes to
+	// instead.
+	args[len(args)-1] = chunk.path
+
+	return args
+}
+
+// Joins the chunks of a video output, and copies them into its pipe.
+func (n *ChunkedTranscoderNode) stitch(stream chunkedStream, index int) error {
+	list := filepath.Join(n.tempDir, fmt.Sprintf("chunks-%d-%d.txt", n.index, index))
+
+	var contents strings.Builder
+	for _, chunk := range stream.chunks {
+		contents.WriteString("file '" + strings.ReplaceAll(chunk.path, "'", `'\''`) + "'\n")
+	}
+
+	if err := os.WriteFile(list, []byte(contents.String()), 0644); err != nil {
+		return err
+	}
+
+	defer os.Remove(list)
+
+	logFile := fmt.Sprintf("TranscoderNode-%d-stitch-%d.log", n.index, index)
+	return n.runProcess(stitchCommandLine(n.ffmpeg, n.pipelineConfig, stream, list), logFile)
+}
+
+func stitchCommandLine(ffmpeg string, pipelineConfig PipelineConfig, stream chunkedStream, list string) []string {
+	args := []string{ffmpeg, "-y"}
+
+	if pipelineConfig.Quiet {
+		args = append(args, "-loglevel", "error")
+	}
+
+	args = append(args,
+		// Each chunk follows the end of the one before it.
+		"-f", "concat", "-safe", "0",
+	)
+
+	if stream.input.AvOffset != "" {
+		args = append(args, "-itsoffset", stream.input.AvOffset)
+	}
+
+	ipcPipe := stream.stream.GetIpcPipe()
+
+	return append(args,
+		"-i", list,
+		"-map", "0:v:0",
+		// The chunks are already encoded.
+		"-c", "copy",
+		// The same fragmented MP4 a single encode writes to the pipe.
+		"-f", "mp4",
+		"-movflags", "+frag_keyframe",
+		"-frag_duration", strconv.FormatInt(int64(pipelineConfig.SegmentSize*1e6), 10),
+		ipcPipe.WriteEnd(),
+	)
+}
+
+// Runs a process in its own group, so that Stop can end it, and waits for it.
+func (n *ChunkedTranscoderNode) runProcess(args []string, logFile string) error {
+	env := map[string]string{}
+
+	if n.pipelineConfig.DebugLogs {
+		// Use this environment variable to turn on ffmpeg's logging.
+		env["FFREPORT"] = fmt.Sprintf("file=%s:level=32", logFile)
+	}
+
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return fmt.Errorf("stopped")
+	}
+
+	process := n.CreateProcess(BaseParams{args: args, env: env})
+	n.processes[process] = true
+	n.mu.Unlock()
+
+	err := process.Wait()
+
+	n.mu.Lock()
+	delete(n.processes, process)
+	n.mu.Unlock()
+
+	return err
+}
@@ -0,0 +1,150 @@
+package streamer
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestChunkedEncodeConfig_check(t *testing.T) {
+	enabled := ChunkedEncodeConfig{Enable: true, ChunkSegments: 15}
+
+	tests := []struct {
+		name           string
+		pipelineConfig PipelineConfig
+		wantErr        bool
+	}{
+		{name: "disabled", pipelineConfig: PipelineConfig{StreamingMode: LIVE}},
+		{name: "enabled", pipelineConfig: PipelineConfig{StreamingMode: VOD, ChunkedEncode: enabled}},
+		{name: "live", pipelineConfig: PipelineConfig{StreamingMode: LIVE, ChunkedEncode: enabled}, wantErr: true},
+		{name: "two pass", pipelineConfig: PipelineConfig{StreamingMode: VOD, TwoPass: true, ChunkedEncode: enabled}, wantErr: true},
+		{name: "empty chunks", pipelineConfig: PipelineConfig{StreamingMode: VOD, ChunkedEncode: ChunkedEncodeConfig{Enable: true}}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				err := recover()
+				_, malformed := err.(*MalformedField)
+				_, conflicting := err.(*ConflictingFields)
+				if (malformed || conflicting) != tt.wantErr {
+					t.Errorf("check() panicked with %v, want an error = %v", err, tt.wantErr)
+				}
+			}()
+
+			tt.pipelineConfig.ChunkedEncode.check(tt.pipelineConfig)
+		})
+	}
+}
+
+func TestChunkedTranscoderNode_splitChunks(t *testing.T) {
+	pipelineConfig := PipelineConfig{SegmentSize: 4, ChunkedEncode: ChunkedEncodeConfig{ChunkSegments: 2}}
+	node := NewChunkedTranscoderNode(nil, pipelineConfig, nil, 0, "/tmp", "")
+
+	resolution := VideoResolution{Name: "720p", MaxWidth: 1280, MaxHeight: 720}
+
+	tests := []struct {
+		name     string
+		input    Input
+		duration float64
+		want     [][2]float64
+	}{
+		{
+			name:     "whole file",
+			input:    Input{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, FrameRate: 25},
+			duration: 20,
+			want:     [][2]float64{{0, 8}, {8, 16}, {16, 20}},
+		},
+		{
+			name:     "trimmed",
+			input:    Input{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, FrameRate: 25, StartTime: "5", EndTime: "00:00:15"},
+			duration: 20,
+			want:     [][2]float64{{5, 13}, {13, 15}},
+		},
+		{
+			// A segment is 119 frames, so a chunk is 238 of them.
+			name:     "fractional frame rate",
+			input:    Input{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, FrameRate: 29.97},
+			duration: 10,
+			want:     [][2]float64{{0, 238 / 29.97}, {238 / 29.97, 10}},
+		},
+		{
+			name:  "unknown length",
+			input: Input{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, FrameRate: 25},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := &VideoOutputStream{Resolution: resolution}
+
+			var got [][2]float64
+			for _, chunk := range node.splitChunks(stream, tt.input, tt.duration, 0) {
+				got = append(got, [2]float64{chunk.start, chunk.end})
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("splitChunks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkedTranscoderNode(t *testing.T) {
+	// Stand-ins for ffprobe, which finds a 25 second file, and ffmpeg, which
+	// writes the range of a chunk, or joins the files of a concat list.
+	script := `#!/bin/sh
+for arg; do
+  case "$previous" in
+    -ss) start=$arg ;;
+    -to) end=$arg ;;
+    -i) input=$arg ;;
+  esac
+  previous=$arg
+  output=$arg
+done
+case "$*" in
+  *"-f concat"*) sed -n "s/^file '\(.*\)'$/\1/p" "$input" | xargs cat > "$output" ;;
+  *) echo "$start-$end" > "$output" ;;
+esac
+`
+	_, ffmpeg := fakeTools(t, "#!/bin/sh\necho 25.000000\n", script)
+
+	input := Input{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, FrameRate: 25, Resolution: "720p"}
+	resolution := *NewBitrateConfig().GetResolutionValue("720p")
+	resolution.Name = "720p"
+	stream := NewVideoOutputStream(input, t.TempDir(), getTestVideoCodec(), resolution)
+
+	pipelineConfig := PipelineConfig{
+		StreamingMode: VOD,
+		SegmentSize:   2,
+		ChunkedEncode: ChunkedEncodeConfig{Enable: true, ChunkSegments: 5, Concurrency: 2},
+	}
+
+	node := NewChunkedTranscoderNode([]Input{input}, pipelineConfig, []MediaOutputStream{stream}, 0, t.TempDir(), ffmpeg)
+	node.Start()
+
+	// The packager's end of the pipe.
+	ipcPipe := stream.GetIpcPipe()
+	stitched, err := os.ReadFile(ipcPipe.ReadEnd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for node.CheckStatus() == Running && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status := node.CheckStatus(); status != Finished {
+		t.Fatalf("CheckStatus() = %v, want Finished", status)
+	}
+
+	// The chunks are 10 seconds, and are joined in order.
+	want := []string{"0.000000-10.000000", "10.000000-20.000000", "20.000000-25.000000"}
+	if got := strings.Fields(string(stitched)); !reflect.DeepEqual(got, want) {
+		t.Errorf("the pipe received %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,428 @@
+// A module for the CEA-608 and CEA-708 captions embedded in video streams.
+package streamer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// What to do with the closed captions embedded in a video input.
+type ClosedCaptionsMode string
+
+const (
+	// Decode the captions into a WebVTT text stream for each channel.
+	CAPTIONS_EXTRACT ClosedCaptionsMode = "extract"
+
+	// Keep the captions in the encoded video, and signal them in the manifests.
+	CAPTIONS_PASSTHROUGH ClosedCaptionsMode = "passthrough"
+)
+
+// The DASH Accessibility schemes of CEA-608 channels and CEA-708 services,
+// defined by SCTE 214-1.
+const (
+	CEA608_ACCESSIBILITY_SCHEME = "urn:scte:dash:cc:cea-608:2015"
+	CEA708_ACCESSIBILITY_SCHEME = "urn:scte:dash:cc:cea-708:2015"
+)
+
+// The group ID of the closed captions in an HLS master playlist.
+const HLS_CLOSED_CAPTIONS_GROUP = "cc"
+
+// The suffix of the copies of the manifests which signal the closed captions.
+const CAPTIONED_MANIFEST_SUFFIX = "_captions"
+
+var (
+	cea608ChannelRegex = regexp.MustCompile(`^CC([1-4])$`)
+	cea708ServiceRegex = regexp.MustCompile(`^SERVICE([1-9][0-9]?)$`)
+
+	hlsCodecsRegex        = regexp.MustCompile(`CODECS="([^"]*)"`)
+	mpdAdaptationSetRegex = regexp.MustCompile(`(?s)<AdaptationSet\b.*?</AdaptationSet>`)
+	mpdCodecsRegex        = regexp.MustCompile(`\bcodecs="([^"]*)"`)
+
+	// The children of an adaptation set which come after Accessibility.
+	mpdAccessibilityFollowersRegex = regexp.MustCompile(`\n([ \t]*)<(Role|Rating|Viewpoint|ContentComponent|BaseURL|SegmentBase|SegmentList|SegmentTemplate|Representation)\b`)
+)
+
+// A closed caption channel and the language it carries.
+type CaptionChannel struct {
+	/*
+		The channel: 'CC1' to 'CC4' for CEA-608, or 'SERVICE1' to 'SERVICE63' for
+		CEA-708.
+	*/
+	Channel string `yaml:"channel" validate:"empty=false"`
+
+	// The language of the channel.  Defaults to 'und' (undetermined).
+	Language string `yaml:"language"`
+}
+
+// Returns the language of the channel, or 'und' if it has none.
+func (c CaptionChannel) GetLanguage() string {
+	if c.Language == "" {
+		return "und"
+	}
+
+	return c.Language
+}
+
+// Returns true if the channel is a CEA-708 service, rather than a CEA-608
+// channel.
+func (c CaptionChannel) isCea708() bool {
+	return cea708ServiceRegex.MatchString(c.Channel)
+}
+
+// Returns an error if the channel is neither a CEA-608 channel nor a CEA-708
+// service.
+func (c CaptionChannel) check() error {
+	if cea608ChannelRegex.MatchString(c.Channel) {
+		return nil
+	}
+
+	if match := cea708ServiceRegex.FindStringSubmatch(c.Channel); match != nil {
+		if service, _ := strconv.Atoi(match[1]); service <= 63 {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%q is not CC1 to CC4 or SERVICE1 to SERVICE63", c.Channel)
+}
+
+/*
+Returns the CEA-608 data field which carries the channel, in the terms of
+FFmpeg's closed caption decoder.
+
+	CC1 and CC2 are in the first field, and CC3 and CC4 in the second.
+*/
+func (c CaptionChannel) dataField() string {
+	if c.Channel == "CC3" || c.Channel == "CC4" {
+		return "second"
+	}
+
+	return "first"
+}
+
+// The closed captions options of a video input.
+type ClosedCaptionsConfig struct {
+	/*
+		Can be 'extract' or 'passthrough'.
+
+			With 'extract', each channel becomes a WebVTT text stream in its language.
+			FFmpeg can only decode CC1 and CC3, and only from inputs it reads
+			directly: input_type 'file', 'looped_file' or 'udp_ts'.
+
+			With 'passthrough', the captions stay in the encoded H.264 video, and
+			are signalled with CLOSED-CAPTIONS in the HLS master playlist and an
+			Accessibility descriptor in DASH.  Shaka Packager can't signal them, so
+			they are signalled in copies of its manifests with a '_captions'
+			suffix, such as 'hls_captions.m3u8' and 'dash_captions.mpd', which
+			players should load instead.  The copies are only written when the
+			output location is local.
+
+			If unspecified, the captions are not extracted or signalled.
+	*/
+	Mode ClosedCaptionsMode `yaml:"mode"`
+
+	// The channels to extract or signal.  Defaults to CC1 alone.
+	Channels []CaptionChannel `yaml:"channels"`
+}
+
+// Returns the channels, or CC1 alone if there are none.
+func (c ClosedCaptionsConfig) GetChannels() []CaptionChannel {
+	if len(c.Channels) == 0 {
+		return []CaptionChannel{{Channel: "CC1", Language: "und"}}
+	}
+
+	return c.Channels
+}
+
+// Checks the closed captions options of an input.
+func (i *Input) checkClosedCaptions() {
+	captions := i.ClosedCaptions
+	if captions.Mode != CAPTIONS_EXTRACT && captions.Mode != CAPTIONS_PASSTHROUGH {
+		panic(NewMalformedField(captions, "Mode", `must be "extract" or "passthrough"`))
+	}
+
+	if i.MediaType != VIDEO {
+		panic(NewMalformedField(*i, "ClosedCaptions", `only valid with media_type "video"`))
+	}
+
+	seen := map[string]bool{}
+	for _, channel := range captions.Channels {
+		if err := channel.check(); err != nil {
+			panic(NewMalformedField(channel, "Channel", err.Error()))
+		}
+
+		if seen[channel.Channel] {
+			panic(NewMalformedField(captions, "Channels", fmt.Sprintf("%s is listed more than once", channel.Channel)))
+		}
+
+		seen[channel.Channel] = true
+
+		if captions.Mode == CAPTIONS_EXTRACT && channel.Channel != "CC1" && channel.Channel != "CC3" {
+			reason := "FFmpeg can only extract CC1 and CC3; use passthrough for other channels"
+			panic(NewMalformedField(channel, "Channel", reason))
+		}
+	}
+
+	if captions.Mode == CAPTIONS_EXTRACT {
+		if i.InputType != FILE && i.InputType != LOOPED_FILE && i.InputType != UDP_TS {
+			reason := fmt.Sprintf("extract is not supported with input_type %s", i.InputType)
+			panic(NewMalformedField(captions, "Mode", reason))
+		}
+
+		// The captions are read by a second demuxer, which could not follow a
+		// switch to a backup source or a slice of the input.
+		reason := "not supported when closed captions are extracted"
+		if len(i.Failover.Backups) > 0 {
+			panic(NewMalformedField(*i, "Failover", reason))
+		}
+
+		i.disallowField("StartTime", reason)
+		i.disallowField("EndTime", reason)
+	}
+}
+
+/*
+Returns a text input for each channel of a video input whose closed captions
+are extracted, and none otherwise.
+
+	Each text input reads the video input a second time, through FFmpeg's
+	lavfi movie source, which outputs the captions as a subtitle stream.
+*/
+func (i Input) captionInputs() []Input {
+	if i.MediaType != VIDEO || i.ClosedCaptions.Mode != CAPTIONS_EXTRACT {
+		return nil
+	}
+
+	var inputs []Input
+	for _, channel := range i.ClosedCaptions.GetChannels() {
+		inputs = append(inputs, Input{
+			InputType:      i.InputType,
+			Name:           i.Name,
+			MediaType:      TEXT,
+			Language:       channel.GetLanguage(),
+			Udp:            i.Udp,
+			captionChannel: channel,
+		})
+	}
+
+	return inputs
+}
+
+/*
+Get the FFmpeg filter graph which produces the captions of an input.
+
+	The graph is read by FFmpeg's lavfi input format, in place of a file name.
+	Its subtitle stream is the first one, and holds the captions of the
+	channel's data field.
+*/
+func (i Input) GetCaptionsGraph() string {
+	options := []string{escapeFilterValue(i.Name)}
+
+	if i.InputType == UDP_TS {
+		options = append(options, "f=mpegts")
+	}
+
+	if i.InputType == LOOPED_FILE {
+		// Loop the input forever, as the video input does.
+		options = append(options, "loop=0")
+	}
+
+	return fmt.Sprintf("movie=%s[out0+subcc]", strings.Join(options, ":"))
+}
+
+/*
+Escape a filter option value, so it can be embedded in a filter graph.
+
+	The value is escaped once for the option list of the filter, and once
+	more for the graph itself.
+*/
+func escapeFilterValue(value string) string {
+	optionEscaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `:`, `\:`)
+	graphEscaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`, `[`, `\[`, `]`, `\]`, `,`, `\,`, `;`, `\;`)
+
+	return graphEscaper.Replace(optionEscaper.Replace(value))
+}
+
+/*
+Returns the DASH Accessibility descriptors which signal the given caption
+channels.
+
+	SCTE 214-1 lists every channel of a scheme in a single descriptor, such as
+	"CC1=eng;CC3=spa" for CEA-608 and "1=lang:eng;2=lang:spa" for CEA-708.
+*/
+func dashCaptionAccessibilities(channels []CaptionChannel) []string {
+	var cea608, cea708 []string
+	for _, channel := range channels {
+		if channel.isCea708() {
+			service := strings.TrimPrefix(channel.Channel, "SERVICE")
+			cea708 = append(cea708, fmt.Sprintf("%s=lang:%s", service, channel.GetLanguage()))
+		} else {
+			cea608 = append(cea608, fmt.Sprintf("%s=%s", channel.Channel, channel.GetLanguage()))
+		}
+	}
+
+	var accessibilities []string
+	if len(cea608) > 0 {
+		accessibilities = append(accessibilities, fmt.Sprintf(`<Accessibility schemeIdUri="%s" value="%s"/>`, CEA608_ACCESSIBILITY_SCHEME, strings.Join(cea608, ";")))
+	}
+
+	if len(cea708) > 0 {
+		accessibilities = append(accessibilities, fmt.Sprintf(`<Accessibility schemeIdUri="%s" value="%s"/>`, CEA708_ACCESSIBILITY_SCHEME, strings.Join(cea708, ";")))
+	}
+
+	return accessibilities
+}
+
+// Returns true if the CODECS attribute of a variant names a video codec which
+// can carry closed captions.
+func codecsCarryCaptions(codecs string) bool {
+	for _, codec := range strings.Split(codecs, ",") {
+		if strings.HasPrefix(codec, "avc1") || strings.HasPrefix(codec, "avc3") {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Returns the path of the copy of a manifest which signals the closed captions,
+such as 'hls_captions.m3u8' for 'hls.m3u8'.
+
+	Shaka Packager owns the manifests it writes, and rewrites them while it
+	runs, so the captions are signalled in a copy at a fixed name instead.
+*/
+func captionedManifestPath(path string) string {
+	ext := filepath.Ext(path)
+	return strings.TrimSuffix(path, ext) + CAPTIONED_MANIFEST_SUFFIX + ext
+}
+
+/*
+Add the given closed caption channels to the contents of an HLS master
+playlist.
+
+	Shaka Packager does not know about captions inside the video, so a
+	CLOSED-CAPTIONS rendition is added for each channel, and the group is
+	referenced by every H.264 variant.
+*/
+func addClosedCaptionsToMasterPlaylist(content string, channels []CaptionChannel) (string, error) {
+	var renditions []string
+	for _, channel := range channels {
+		rendition := fmt.Sprintf(`#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="%s",NAME="%s"`, HLS_CLOSED_CAPTIONS_GROUP, channel.Channel)
+		if channel.GetLanguage() != "und" {
+			rendition += fmt.Sprintf(`,LANGUAGE="%s"`, channel.Language)
+		}
+
+		rendition += fmt.Sprintf(`,INSTREAM-ID="%s"`, channel.Channel)
+		renditions = append(renditions, rendition)
+	}
+
+	var lines []string
+	added := false
+
+	for _, line := range strings.Split(content, "\n") {
+		if !strings.HasPrefix(line, "#EXT-X-STREAM-INF:") {
+			lines = append(lines, line)
+			continue
+		}
+
+		if !added {
+			// The renditions go before the first variant, after any other media.
+			lines = append(lines, renditions...)
+			lines = append(lines, "")
+			added = true
+		}
+
+		if match := hlsCodecsRegex.FindStringSubmatch(line); match != nil && codecsCarryCaptions(match[1]) {
+			line += fmt.Sprintf(`,CLOSED-CAPTIONS="%s"`, HLS_CLOSED_CAPTIONS_GROUP)
+		}
+
+		lines = append(lines, line)
+	}
+
+	if !added {
+		return "", fmt.Errorf("the playlist has no variants")
+	}
+
+	return strings.Join(lines, "\n"), nil
+}
+
+/*
+Add the given closed caption channels to the contents of a DASH manifest.
+
+	The Accessibility descriptors go in every adaptation set of H.264 video,
+	before the elements which the schema puts after them.
+*/
+func addClosedCaptionsToMpd(content string, channels []CaptionChannel) (string, error) {
+	if !strings.Contains(content, "</MPD>") {
+		return "", fmt.Errorf("the manifest is incomplete")
+	}
+
+	accessibilities := dashCaptionAccessibilities(channels)
+
+	return mpdAdaptationSetRegex.ReplaceAllStringFunc(content, func(adaptationSet string) string {
+		match := mpdCodecsRegex.FindStringSubmatch(adaptationSet)
+		if match == nil || !codecsCarryCaptions(match[1]) {
+			return adaptationSet
+		}
+
+		child := mpdAccessibilityFollowersRegex.FindStringSubmatchIndex(adaptationSet)
+		if child == nil {
+			return adaptationSet
+		}
+
+		// Indent the descriptors like the element they go before.
+		indent := adaptationSet[child[2]:child[3]]
+		var descriptors string
+		for _, accessibility := range accessibilities {
+			descriptors += "\n" + indent + accessibility
+		}
+
+		return adaptationSet[:child[0]] + descriptors + adaptationSet[child[0]:]
+	}), nil
+}
+
+/*
+Write a copy of a manifest, with the closed captions added to it by the given
+function, next to the manifest.
+
+	The copy is replaced in one step, so a player never reads half of it.
+*/
+func writeCaptionedManifest(path string, channels []CaptionChannel, addClosedCaptions func(string, []CaptionChannel) (string, error)) error {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	captioned, err := addClosedCaptions(string(content), channels)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	copyPath := captionedManifestPath(path)
+	temp, err := os.CreateTemp(filepath.Dir(copyPath), ".captions-*"+filepath.Ext(copyPath))
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.WriteString(captioned); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Chmod(0644); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), copyPath)
+}
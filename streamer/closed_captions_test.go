@@ -0,0 +1,222 @@
+package streamer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestInput_checkClosedCaptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   Input
+		wantErr bool
+	}{
+		{
+			name:  "extract",
+			input: Input{InputType: UDP_TS, MediaType: VIDEO, ClosedCaptions: ClosedCaptionsConfig{Mode: CAPTIONS_EXTRACT, Channels: []CaptionChannel{{"CC1", "eng"}, {"CC3", "spa"}}}},
+		},
+		{
+			name:  "passthrough of 708 services",
+			input: Input{InputType: SRT, MediaType: VIDEO, ClosedCaptions: ClosedCaptionsConfig{Mode: CAPTIONS_PASSTHROUGH, Channels: []CaptionChannel{{"CC2", "fra"}, {"SERVICE63", "eng"}}}},
+		},
+		{
+			name:    "unknown mode",
+			input:   Input{InputType: FILE, MediaType: VIDEO, ClosedCaptions: ClosedCaptionsConfig{Mode: "burn"}},
+			wantErr: true,
+		},
+		{
+			name:    "audio",
+			input:   Input{InputType: FILE, MediaType: AUDIO, ClosedCaptions: ClosedCaptionsConfig{Mode: CAPTIONS_EXTRACT}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown channel",
+			input:   Input{InputType: FILE, MediaType: VIDEO, ClosedCaptions: ClosedCaptionsConfig{Mode: CAPTIONS_PASSTHROUGH, Channels: []CaptionChannel{{"SERVICE64", ""}}}},
+			wantErr: true,
+		},
+		{
+			name:    "repeated channel",
+			input:   Input{InputType: FILE, MediaType: VIDEO, ClosedCaptions: ClosedCaptionsConfig{Mode: CAPTIONS_PASSTHROUGH, Channels: []CaptionChannel{{"CC1", "eng"}, {"CC1", "spa"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "extract of an undecodable channel",
+			input:   Input{InputType: FILE, MediaType: VIDEO, ClosedCaptions: ClosedCaptionsConfig{Mode: CAPTIONS_EXTRACT, Channels: []CaptionChannel{{"CC2", "eng"}}}},
+			wantErr: true,
+		},
+		{
+			name:    "extract from a relayed input",
+			input:   Input{InputType: RTMP, MediaType: VIDEO, ClosedCaptions: ClosedCaptionsConfig{Mode: CAPTIONS_EXTRACT}},
+			wantErr: true,
+		},
+		{
+			name:    "extract from a slice",
+			input:   Input{InputType: FILE, MediaType: VIDEO, StartTime: "10", ClosedCaptions: ClosedCaptionsConfig{Mode: CAPTIONS_EXTRACT}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if _, ok := recover().(*MalformedField); ok != tt.wantErr {
+					t.Errorf("checkClosedCaptions() panicked = %v, want %v", ok, tt.wantErr)
+				}
+			}()
+
+			tt.input.checkClosedCaptions()
+		})
+	}
+}
+
+func TestInput_captionInputs(t *testing.T) {
+	video := Input{
+		InputType:      LOOPED_FILE,
+		Name:           "news, 9:00.ts",
+		MediaType:      VIDEO,
+		ClosedCaptions: ClosedCaptionsConfig{Mode: CAPTIONS_EXTRACT, Channels: []CaptionChannel{{"CC1", "eng"}, {"CC3", ""}}},
+	}
+
+	inputs := expandInputs([]Input{video})
+	if len(inputs) != 3 {
+		t.Fatalf("expandInputs() returned %d inputs, want 3", len(inputs))
+	}
+
+	captions := inputs[2]
+	if captions.MediaType != TEXT || captions.Language != "und" || captions.GetStreamSpecifier() != "s:0" {
+		t.Errorf("caption input = %+v, want an undetermined text input", captions)
+	}
+
+	wantArgs := []string{"-f", "lavfi", "-data_field", "second"}
+	if got := captions.GetInputArgs(); !reflect.DeepEqual(got, wantArgs) {
+		t.Errorf("GetInputArgs() = %v, want %v", got, wantArgs)
+	}
+
+	wantGraph := `movie=news\, 9\\:00.ts:loop=0[out0+subcc]`
+	if got := captions.GetCaptionsGraph(); got != wantGraph {
+		t.Errorf("GetCaptionsGraph() = %s, want %s", got, wantGraph)
+	}
+
+	video.ClosedCaptions.Mode = CAPTIONS_PASSTHROUGH
+	if got := video.captionInputs(); len(got) != 0 {
+		t.Errorf("captionInputs() = %v, want none with passthrough", got)
+	}
+}
+
+func TestDashCaptionAccessibilities(t *testing.T) {
+	channels := []CaptionChannel{{"CC1", "eng"}, {"CC3", ""}, {"SERVICE2", "spa"}}
+	want := []string{
+		`<Accessibility schemeIdUri="urn:scte:dash:cc:cea-608:2015" value="CC1=eng;CC3=und"/>`,
+		`<Accessibility schemeIdUri="urn:scte:dash:cc:cea-708:2015" value="2=lang:spa"/>`,
+	}
+
+	if got := dashCaptionAccessibilities(channels); !reflect.DeepEqual(got, want) {
+		t.Errorf("dashCaptionAccessibilities() = %v, want %v", got, want)
+	}
+}
+
+func TestWriteCaptionedManifest_MasterPlaylist(t *testing.T) {
+	master := `#EXTM3U
+## Generated with https://github.com/google/shaka-packager version v2.6.1
+
+#EXT-X-MEDIA:TYPE=AUDIO,URI="audio.m3u8",GROUP-ID="default-audio-group",LANGUAGE="en",NAME="stream_0"
+
+#EXT-X-STREAM-INF:BANDWIDTH=1195000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=854x480,AUDIO="default-audio-group"
+video_480p.m3u8
+
+#EXT-X-STREAM-INF:BANDWIDTH=1024000,CODECS="vp09.00.30.08,mp4a.40.2",RESOLUTION=854x480,AUDIO="default-audio-group"
+video_480p_vp9.m3u8
+`
+	want := `#EXTM3U
+## Generated with https://github.com/google/shaka-packager version v2.6.1
+
+#EXT-X-MEDIA:TYPE=AUDIO,URI="audio.m3u8",GROUP-ID="default-audio-group",LANGUAGE="en",NAME="stream_0"
+
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="CC1",LANGUAGE="eng",INSTREAM-ID="CC1"
+#EXT-X-MEDIA:TYPE=CLOSED-CAPTIONS,GROUP-ID="cc",NAME="SERVICE1",INSTREAM-ID="SERVICE1"
+
+#EXT-X-STREAM-INF:BANDWIDTH=1195000,CODECS="avc1.4d401f,mp4a.40.2",RESOLUTION=854x480,AUDIO="default-audio-group",CLOSED-CAPTIONS="cc"
+video_480p.m3u8
+
+#EXT-X-STREAM-INF:BANDWIDTH=1024000,CODECS="vp09.00.30.08,mp4a.40.2",RESOLUTION=854x480,AUDIO="default-audio-group"
+video_480p_vp9.m3u8
+`
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "hls.m3u8")
+	if err := os.WriteFile(path, []byte(master), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	channels := []CaptionChannel{{"CC1", "eng"}, {"SERVICE1", ""}}
+	if err := writeCaptionedManifest(path, channels, addClosedCaptionsToMasterPlaylist); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dir, "hls_captions.m3u8"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(got) != want {
+		t.Errorf("playlist =\n%s\nwant\n%s", got, want)
+	}
+
+	// The packager's own playlist is left alone.
+	if original, _ := os.ReadFile(path); string(original) != master {
+		t.Errorf("the packager's playlist was changed to\n%s", original)
+	}
+}
+
+func TestAddClosedCaptionsToMpd(t *testing.T) {
+	mpd := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static">
+  <Period id="0">
+    <AdaptationSet id="0" contentType="video" maxWidth="854" maxHeight="480" segmentAlignment="true">
+      <Role schemeIdUri="urn:mpeg:dash:role:2011" value="main"/>
+      <Representation id="0" bandwidth="1195000" codecs="avc1.4d401f" mimeType="video/mp4" width="854" height="480"/>
+    </AdaptationSet>
+    <AdaptationSet id="1" contentType="video" maxWidth="854" maxHeight="480" segmentAlignment="true">
+      <Representation id="1" bandwidth="1024000" codecs="vp09.00.30.08" mimeType="video/mp4" width="854" height="480"/>
+    </AdaptationSet>
+    <AdaptationSet id="2" contentType="audio" lang="en" segmentAlignment="true">
+      <Representation id="2" bandwidth="128000" codecs="mp4a.40.2" mimeType="audio/mp4"/>
+    </AdaptationSet>
+  </Period>
+</MPD>
+`
+	want := `<?xml version="1.0" encoding="UTF-8"?>
+<MPD xmlns="urn:mpeg:dash:schema:mpd:2011" type="static">
+  <Period id="0">
+    <AdaptationSet id="0" contentType="video" maxWidth="854" maxHeight="480" segmentAlignment="true">
+      <Accessibility schemeIdUri="urn:scte:dash:cc:cea-608:2015" value="CC1=eng;CC3=spa"/>
+      <Role schemeIdUri="urn:mpeg:dash:role:2011" value="main"/>
+      <Representation id="0" bandwidth="1195000" codecs="avc1.4d401f" mimeType="video/mp4" width="854" height="480"/>
+    </AdaptationSet>
+    <AdaptationSet id="1" contentType="video" maxWidth="854" maxHeight="480" segmentAlignment="true">
+      <Representation id="1" bandwidth="1024000" codecs="vp09.00.30.08" mimeType="video/mp4" width="854" height="480"/>
+    </AdaptationSet>
+    <AdaptationSet id="2" contentType="audio" lang="en" segmentAlignment="true">
+      <Representation id="2" bandwidth="128000" codecs="mp4a.40.2" mimeType="audio/mp4"/>
+    </AdaptationSet>
+  </Period>
+</MPD>
+`
+
+	channels := []CaptionChannel{{"CC1", "eng"}, {"CC3", "spa"}}
+	got, err := addClosedCaptionsToMpd(mpd, channels)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got != want {
+		t.Errorf("manifest =\n%s\nwant\n%s", got, want)
+	}
+
+	// A manifest read while the packager was writing it is not copied.
+	if _, err := addClosedCaptionsToMpd(mpd[:len(mpd)/2], channels); err == nil {
+		t.Errorf("addClosedCaptionsToMpd() of half a manifest succeeded")
+	}
+}
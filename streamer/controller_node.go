@@ -25,17 +25,24 @@ type ControllerNode struct {
 	hermeticPackager string
 	inputConfig      InputConfig
 	pipelineConfig   PipelineConfig
-	nodes            []interface{}
+	// The resolutions and channel layouts of this job.
+	bitrateConfig *BitrateConfig
+	nodes         []interface{}
 }
 
+// The options of a run, as given on the command line.
 type ControllerParams struct {
-	outputLocation     string
-	inputConfigDict    InputConfig
-	pipelineConfigDict PipelineConfig
-	bitrateConfigDict  BitrateConfig
-	bucketURL          string
-	checkDeps          bool
-	useHermetic        bool
+	OutputLocation     string
+	InputConfigDict    InputConfig
+	PipelineConfigDict PipelineConfig
+	BitrateConfigDict  BitrateConfig
+	BucketURL          string
+	CheckDeps          bool
+	UseHermetic        bool
+
+	// The address to serve the output folder at while it is written, such as
+	// ":8080".  If blank, the output is not served.
+	ServeAddress string
 }
 
 func NewControllerNode() *ControllerNode {
@@ -48,14 +55,15 @@ func NewControllerNode() *ControllerNode {
 	}
 
 	return &ControllerNode{
-		tempDir: tempDir,
+		tempDir:       tempDir,
+		bitrateConfig: NewBitrateConfig(),
 	}
 }
 
 func (c ControllerNode) Start(params ControllerParams) *ControllerNode {
 	rootDir, _ := RootDir()
 
-	if params.useHermetic {
+	if params.UseHermetic {
 		ffmpeg := FileExists(filepath.Join(rootDir, streamer_binaries.Ffmpeg))
 		ffprobe := FileExists(filepath.Join(rootDir, streamer_binaries.Ffprobe))
 		packager := FileExists(filepath.Join(rootDir, streamer_binaries.Packager))
@@ -69,8 +77,8 @@ func (c ControllerNode) Start(params ControllerParams) *ControllerNode {
 		panic("Controller already started!")
 	}
 
-	if params.checkDeps {
-		if params.useHermetic {
+	if params.CheckDeps {
+		if params.UseHermetic {
 			// If we are using the hermetic binaries, check the module version.
 			// We must match on the first two digits, but the last one can vary between
 			// the two modules.
@@ -127,7 +135,7 @@ func (c ControllerNode) Start(params ControllerParams) *ControllerNode {
 			}
 		}
 
-		if params.bucketURL != "" {
+		if params.BucketURL != "" {
 			// Check that the Google Cloud SDK is at least v212, which introduced
 			// gsutil 4.33 with an important rsync bug fix.
 			// https://cloud.google.com/sdk/docs/release-notes
@@ -139,63 +147,157 @@ func (c ControllerNode) Start(params ControllerParams) *ControllerNode {
 		}
 	}
 
-	if params.bucketURL != "" {
+	if params.BucketURL != "" {
 		// If using cloud storage, make sure the user is logged in and can access
 		// the destination, independent of the version check above.
-		CloudNode{}.CheckAccess(params.bucketURL)
+		CloudNode{}.CheckAccess(params.BucketURL)
 	}
 
 	cn := NewControllerNode()
 
-	if params.useHermetic {
+	if params.UseHermetic {
 		cn.hermeticFfmpeg = filepath.Join(rootDir, streamer_binaries.Ffmpeg)
 		cn.hermeticPackager = filepath.Join(rootDir, streamer_binaries.Packager)
 		HermeticFFProbe = filepath.Join(rootDir, streamer_binaries.Ffprobe)
+		HermeticFFmpeg = cn.hermeticFfmpeg
 	}
 
-	cn.inputConfig = params.inputConfigDict
-	cn.pipelineConfig = params.pipelineConfigDict
+	cn.inputConfig = params.InputConfigDict
+	cn.pipelineConfig = params.PipelineConfigDict
 
-	if !IsURL(params.outputLocation) {
+	if params.CheckDeps {
+		ffmpeg := "ffmpeg"
+		if cn.hermeticFfmpeg != "" {
+			ffmpeg = cn.hermeticFfmpeg
+		}
+
+		// Some audio encoders, such as libfdk_aac for HE-AAC, are only in some
+		// builds of FFmpeg.
+		for _, codec := range cn.pipelineConfig.GetAudioCodecs() {
+			if codec.Passthrough {
+				continue
+			}
+
+			encoder := codec.GetFFmpegCodecString(cn.pipelineConfig.HWAccelAPI)
+			if err := CheckFFmpegEncoder(ffmpeg, encoder); err != nil {
+				panic(fmt.Sprintf("The %s audio codec needs FFmpeg with the %s encoder: %v", codec.Name, encoder, err))
+			}
+		}
+	}
+
+	// The resolutions and channel layouts of a bitrate config hold the defaults
+	// it didn't change.
+	if params.BitrateConfigDict.VideoResolutions != nil {
+		cn.bitrateConfig.VideoResolutions = params.BitrateConfigDict.VideoResolutions
+	}
+
+	if params.BitrateConfigDict.AudioChannelLayouts != nil {
+		cn.bitrateConfig.AudioChannelLayouts = params.BitrateConfigDict.AudioChannelLayouts
+	}
+
+	if !IsURL(params.OutputLocation) {
 		// Check if the directory for outputted Packager files exists, and if it
 		// does, delete it and remake a new one.
-		if err := RemoveIfExists(params.outputLocation); err != nil {
+		if err := RemoveIfExists(params.OutputLocation); err != nil {
 			panic(err)
 		}
 
-		if err := os.MkdirAll(params.outputLocation, os.ModePerm); err != nil {
+		if err := os.MkdirAll(params.OutputLocation, os.ModePerm); err != nil {
 			panic(err)
 		}
 	} else {
 		// Check some restrictions and other details on HTTP output.
-		if !params.pipelineConfigDict.SegmentPerFile {
+		if !params.PipelineConfigDict.SegmentPerFile {
 			panic("For HTTP PUT uploads, the pipeline segment_per_file setting must be set to True!")
 		}
 
-		if params.bucketURL != "" {
+		if params.BucketURL != "" {
 			panic("Cloud bucket upload is incompatible with HTTP PUT support.")
 		}
 
-		if len(params.inputConfigDict.MultiPeriodInputsList) > 0 {
+		if len(params.InputConfigDict.MultiPeriodInputsList) > 0 {
 			// TODO: Edit Multiperiod input list implementation to support HTTP outputs
 			panic("Multiperiod input list support is incompatible with HTTP outputs.")
 		}
 	}
 
-	if params.pipelineConfigDict.LowLatencyDashMode {
+	if cn.pipelineConfig.UtcTimingServer.Enable {
+		utcTimingServer := cn.pipelineConfig.UtcTimingServer
+
+		if utcTimingServer.ListenAddress != "" {
+			node := NewUtcTimingServerNode(utcTimingServer.ListenAddress)
+			node.Start()
+			cn.nodes = append(cn.nodes, node)
+		}
+
+		// Point the DASH manifest at the embedded server unless the user chose
+		// other time sources.
+		if len(cn.pipelineConfig.UTCTimings) == 0 {
+			cn.pipelineConfig.UTCTimings = utcTimingServer.GetUtcTimings()
+		}
+	}
+
+	if params.PipelineConfigDict.LowLatencyDashMode {
 		// Check some restrictions on LL-DASH packaging.
-		if !ContainsString(ManifestFormatListToStringList(params.pipelineConfigDict.ManifestFormat), string(DASH)) {
+		if !ContainsString(ManifestFormatListToStringList(params.PipelineConfigDict.ManifestFormat), string(DASH)) {
 			panic("low_latency_dash_mode is only compatible with DASH outputs. manifest_format must include DASH")
 		}
 
-		if len(params.pipelineConfigDict.UTCTimings) == 0 {
+		if len(cn.pipelineConfig.UTCTimings) == 0 {
 			panic("For low_latency_dash_mode, the utc_timings must be set.")
 		}
 	}
 
 	// Note that we remove the trailing slash from the output location, because
 	// otherwise GCS would create a subdirectory whose name is "".
-	outputLocation := strings.TrimSuffix(params.outputLocation, "/")
+	outputLocation := strings.TrimSuffix(params.OutputLocation, "/")
+
+	if params.ServeAddress != "" {
+		if IsURL(outputLocation) {
+			panic("Serving the output over HTTP is incompatible with HTTP outputs.")
+		}
+
+		// Serve the output folder to players while it is being written.
+		server := NewOriginServerNode(outputLocation, params.ServeAddress)
+		server.Start()
+		cn.nodes = append(cn.nodes, server)
+	}
+
+	if cn.pipelineConfig.PerTitle.Enable {
+		if IsURL(outputLocation) {
+			panic("per_title is incompatible with HTTP outputs.")
+		}
+
+		inputs := append([]Input{}, cn.inputConfig.Inputs...)
+		for _, period := range cn.inputConfig.MultiPeriodInputsList {
+			inputs = append(inputs, period.Inputs...)
+		}
+
+		ladder, err := FitPerTitleLadder(inputs, cn.pipelineConfig, cn.bitrateConfig, cn.tempDir)
+		if err != nil {
+			panic(fmt.Sprintf("failed to fit the ladder: %v", err))
+		}
+
+		if err := WritePerTitleLadder(ladder, filepath.Join(outputLocation, cn.pipelineConfig.PerTitle.Output)); err != nil {
+			panic(fmt.Sprintf("failed to write the ladder: %v", err))
+		}
+
+		ApplyPerTitleLadder(ladder, &cn.pipelineConfig, cn.bitrateConfig)
+	}
+
+	var report *JobReport
+	if cn.pipelineConfig.JobReport != "" {
+		if IsURL(outputLocation) {
+			panic("job_report is incompatible with HTTP outputs.")
+		}
+
+		// Written before the nodes are made, since they replace the names of some
+		// inputs with pipes.
+		report = NewJobReport(cn.inputConfig)
+		if err := report.Write(filepath.Join(outputLocation, cn.pipelineConfig.JobReport)); err != nil {
+			panic(fmt.Sprintf("failed to write the job report: %v", err))
+		}
+	}
 
 	// InputConfig contains inputs only.
 	if len(cn.inputConfig.Inputs) > 0 {
@@ -220,6 +322,14 @@ func (c ControllerNode) Start(params ControllerParams) *ControllerNode {
 		}
 	}
 
+	if cn.pipelineConfig.Quality.Enable {
+		// The renditions are measured once every packager has finished, and
+		// the scores are added to the job report.
+		node := NewQualityNode(cn.pipelineConfig, cn.packagerNodes(), report, filepath.Join(outputLocation, cn.pipelineConfig.JobReport), cn.tempDir, cn.hermeticFfmpeg)
+		node.Start()
+		cn.nodes = append(cn.nodes, node)
+	}
+
 	return cn
 }
 
@@ -230,7 +340,296 @@ type appendNodeParams struct {
 	index          int
 }
 
-func (c ControllerNode) appendNodesForInputsList(params appendNodeParams) {
+func (c *ControllerNode) appendNodesForInputsList(params appendNodeParams) {
+	// Sidecar subtitles are converted to WebVTT before anything reads them.
+	c.convertTextInputs(params.inputs)
+
+	// Inputs received over the network are relayed to the transcoder through
+	// pipes, so they need a node of their own.
+	c.appendRtmpIngestNodes(params.inputs)
+	c.appendRelayNodes(params.inputs)
+	c.appendPlaylistNodes(params.inputs)
+
+	// Live text is written to the packager by a node of its own.
+	c.appendLiveTextNodes(params.inputs)
+
+	outputs := c.outputStreams(params.inputs)
+	if len(outputs) == 0 {
+		return
+	}
+
+	// Only the inputs with an output to encode are read by FFmpeg.  The rest
+	// are read by the packager directly.
+	var transcodedInputs []Input
+	for _, input := range params.inputs {
+		for _, output := range outputs {
+			outputInput := output.GetInput()
+			if !output.SkippedTranscoding() && outputInput.Name == input.Name && outputInput.GetStreamSpecifier() == input.GetStreamSpecifier() {
+				transcodedInputs = append(transcodedInputs, input)
+				break
+			}
+		}
+	}
+
+	if len(transcodedInputs) > 0 {
+		if c.pipelineConfig.ChunkedEncode.Enable {
+			// The video of files is encoded in chunks, in parallel.
+			node := NewChunkedTranscoderNode(transcodedInputs, c.pipelineConfig, outputs, params.index, c.tempDir, c.hermeticFfmpeg)
+			node.Start()
+			c.nodes = append(c.nodes, node)
+		} else {
+			node := NewTranscoderNode(transcodedInputs, c.pipelineConfig, outputs, params.index, c.hermeticFfmpeg)
+			node.Start()
+			c.nodes = append(c.nodes, node)
+		}
+	}
+
+	// The packager of a period writes to a folder of its own.
+	outputLocation := buildPath(params.outputLocation, params.periodDir)
+	packager := NewPackagerNode(c.pipelineConfig, outputLocation, outputs, params.index, c.hermeticPackager)
+	packager.Start()
+	c.nodes = append(c.nodes, packager)
+}
+
+/*
+Creates the output streams of a list of inputs: every audio codec in each
+channel layout the input has enough channels for, every video codec in each
+resolution no larger than the input, and the text.  A copied audio codec has
+a single output, in the channel layout of the input.
+
+	WebVTT and TTML files are read by the packager directly, without a pipe.
+*/
+func (c *ControllerNode) outputStreams(inputs []Input) []MediaOutputStream {
+	var outputs []MediaOutputStream
+
+	for _, input := range inputs {
+		switch input.MediaType {
+		case AUDIO:
+			inputLayout := input.GetChannelLayout()
+
+			for _, codec := range c.pipelineConfig.GetAudioCodecs() {
+				if codec.Passthrough {
+					// A copy keeps the channels of the input, so there is only one.
+					if inputLayout != nil {
+						outputs = append(outputs, NewAudioOutputStream(input, c.tempDir, codec, *inputLayout))
+					}
+
+					continue
+				}
+
+				for _, name := range c.pipelineConfig.ChannelLayouts {
+					layout := c.bitrateConfig.GetChannelLayoutValue(name)
+					if layout == nil || inputLayout != nil && layout.MaxChannels > inputLayout.MaxChannels {
+						// Upmixing adds nothing.
+						continue
+					}
+
+					outputs = append(outputs, NewAudioOutputStream(input, c.tempDir, codec, *layout))
+				}
+			}
+		case VIDEO:
+			size := input.GetResolution()
+
+			for _, codec := range c.pipelineConfig.GetVideoCodecs() {
+				for _, name := range c.pipelineConfig.Resolutions {
+					resolution := c.bitrateConfig.GetResolutionValue(name)
+					if resolution == nil || size != nil && resolution.MaxHeight > size.MaxHeight {
+						// Upscaling wastes bits.
+						continue
+					}
+
+					named := *resolution
+					named.Name = name
+					outputs = append(outputs, NewVideoOutputStream(input, c.tempDir, codec, named))
+				}
+			}
+		case TEXT:
+			skipTranscoding := strings.HasSuffix(input.Name, ".vtt") || strings.HasSuffix(input.Name, ".ttml")
+			outputs = append(outputs, NewTextOutputStream(input, c.tempDir, skipTranscoding))
+		}
+	}
+
+	return outputs
+}
+
+/*
+Converts text inputs in SRT, TTML or SCC to WebVTT files in the temporary
+directory, and points the inputs at them.
+
+	A text input with no language of its own takes the one the file declares.
+*/
+func (c *ControllerNode) convertTextInputs(inputs []Input) {
+	for idx := range inputs {
+		input := &inputs[idx]
+		if !input.needsTextConversion() {
+			continue
+		}
+
+		output, err := os.CreateTemp(c.tempDir, "text-*.vtt")
+		if err != nil {
+			panic(err)
+		}
+		output.Close()
+
+		language, err := ConvertToWebVtt(input.Name, input.TextTiming, output.Name())
+		if err != nil {
+			panic(err)
+		}
+
+		if language != "" && (input.Language == "" || input.Language == "und") {
+			input.Language = language
+		}
+
+		input.resetName(output.Name())
+		input.TextTiming = TextTimingConfig{}
+	}
+}
+
+/*
+Creates one RtmpIngestNode per RTMP listen URL.
+
+	Each input gets its own pipe from the ingest node, so the audio and video
+	tracks of one connection can be read as separate inputs.
+*/
+func (c *ControllerNode) appendRtmpIngestNodes(inputs []Input) {
+	ingestNodes := map[string]*RtmpIngestNode{}
+
+	for idx := range inputs {
+		input := &inputs[idx]
+		if input.InputType != RTMP {
+			continue
+		}
+
+		node, ok := ingestNodes[input.Name]
+		if !ok {
+			node = NewRtmpIngestNode(input.Name)
+			ingestNodes[input.Name] = node
+			c.nodes = append(c.nodes, node)
+		}
+
+		pipe := NewPipe()
+		pipe.CreateIpcPipe(c.tempDir, ".flv")
+		node.AddOutput(pipe.WriteEnd())
+		input.resetToRelay(pipe.ReadEnd(), "flv")
+	}
+
+	for _, node := range ingestNodes {
+		node.Start()
+	}
+}
+
+/*
+Creates one RelayNode per live source which can be lost: SRT URLs, inputs
+with failover backups, and, if there is a slate, any network feed or device.
+
+	The relay node reconnects, switches to a backup or shows the slate when a
+	source fails, while the pipe to the transcoder stays open, so the packager
+	keeps running through outages.
+*/
+func (c *ControllerNode) appendRelayNodes(inputs []Input) {
+	slate := c.pipelineConfig.Slate
+	if c.pipelineConfig.StreamingMode != LIVE {
+		slate = SlateConfig{}
+	}
+
+	relayNodes := map[string]*RelayNode{}
+
+	for idx := range inputs {
+		input := &inputs[idx]
+
+		isRelayed := input.InputType == SRT || len(input.Failover.Backups) > 0
+		if slate.IsEnabled() && ContainsInputType(SLATE_INPUT_TYPES, input.InputType) {
+			isRelayed = true
+		}
+
+		if !isRelayed || input.MediaType == TEXT {
+			continue
+		}
+
+		node, ok := relayNodes[input.Name]
+		if !ok {
+			node = NewRelayNode(*input, slate, c.hermeticFfmpeg)
+			relayNodes[input.Name] = node
+			c.nodes = append(c.nodes, node)
+		}
+
+		pipe := NewPipe()
+		pipe.CreateIpcPipe(c.tempDir, ".ts")
+		trackNum := node.AddOutput(pipe.WriteEnd(), *input)
+		input.resetToRelay(pipe.ReadEnd(), "mpegts")
+		input.resetTrack(trackNum)
+	}
+
+	for _, node := range relayNodes {
+		node.Start()
+	}
+}
+
+/*
+Creates one PlaylistNode per playlist file.
+
+	Each input gets its own pipe from the playlist node, so the audio and
+	video tracks of a channel can be read as separate inputs.
+*/
+func (c *ControllerNode) appendPlaylistNodes(inputs []Input) {
+	slate := c.pipelineConfig.Slate
+	if c.pipelineConfig.StreamingMode != LIVE {
+		slate = SlateConfig{}
+	}
+
+	playlistNodes := map[string]*PlaylistNode{}
+
+	for idx := range inputs {
+		input := &inputs[idx]
+		if input.InputType != PLAYLIST {
+			continue
+		}
+
+		node, ok := playlistNodes[input.Name]
+		if !ok {
+			node = NewPlaylistNode(input.Name, slate, c.hermeticFfmpeg)
+			playlistNodes[input.Name] = node
+			c.nodes = append(c.nodes, node)
+		}
+
+		pipe := NewPipe()
+		pipe.CreateIpcPipe(c.tempDir, ".ts")
+		trackNum := node.AddOutput(pipe.WriteEnd(), *input)
+		input.resetToRelay(pipe.ReadEnd(), "mpegts")
+		input.resetTrack(trackNum)
+	}
+
+	for _, node := range playlistNodes {
+		node.Start()
+	}
+}
+
+/*
+Creates one LiveTextNode per text input from an external command or a cue
+API, and points the input at the pipe the node writes WebVTT to.
+
+	The packager reads the pipe directly, since FFmpeg can't read WebVTT until
+	the stream ends.
+*/
+func (c *ControllerNode) appendLiveTextNodes(inputs []Input) {
+	for idx := range inputs {
+		input := &inputs[idx]
+		if input.MediaType != TEXT || (input.InputType != EXTERNAL_COMMAND && input.InputType != CUE_API) {
+			continue
+		}
+
+		if c.pipelineConfig.StreamingMode != LIVE {
+			panic(NewMalformedField(*input, "InputType", fmt.Sprintf("text from input_type %s is only supported in live streams", input.InputType)))
+		}
+
+		pipe := NewPipe()
+		pipe.CreateIpcPipe(c.tempDir, ".vtt")
+
+		node := NewLiveTextNode(*input, c.tempDir, pipe.WriteEnd(), c.pipelineConfig.SegmentSize)
+		c.nodes = append(c.nodes, node)
+		input.resetName(pipe.ReadEnd())
+		node.Start()
+	}
 }
 
 func (cn ControllerNode) packagerNodes() []PackagerNode {
@@ -245,8 +644,50 @@ func (cn ControllerNode) packagerNodes() []PackagerNode {
 	return nodes
 }
 
+/*
+Returns the status of the pipeline: Errored if any node failed, Running if any
+node is still running, and Finished otherwise.
+
+	The servers run until they are stopped, so only their failures count.
+*/
+func (c ControllerNode) CheckStatus() ProcessStatus {
+	status := Finished
+
+	for _, node := range c.nodes {
+		n, ok := node.(interface{ CheckStatus() ProcessStatus })
+		if !ok {
+			continue
+		}
+
+		nodeStatus := n.CheckStatus()
+		if nodeStatus == Errored {
+			return Errored
+		}
+
+		if nodeStatus == Running && !isServerNode(node) {
+			status = Running
+		}
+	}
+
+	return status
+}
+
+// Returns true for the nodes which only serve, and never finish on their own.
+func isServerNode(node interface{}) bool {
+	switch node.(type) {
+	case *OriginServerNode, *UtcTimingServerNode:
+		return true
+	default:
+		return false
+	}
+}
+
 func (c ControllerNode) Stop() {
-	// Implementation of the stop method
+	for _, node := range c.nodes {
+		if n, ok := node.(interface{ Stop() }); ok {
+			n.Stop()
+		}
+	}
 }
 
 func (c ControllerNode) Close() {
@@ -2,7 +2,9 @@ package streamer
 
 import (
 	"os"
+	"reflect"
 	"testing"
+	"time"
 )
 
 func TestControllerNode_Start(t *testing.T) {
@@ -20,13 +22,13 @@ func TestControllerNode_Start(t *testing.T) {
 		{
 			name: "start",
 			args: ControllerParams{
-				inputConfigDict:    InputConfig{},
-				pipelineConfigDict: PipelineConfig{},
-				bitrateConfigDict:  BitrateConfig{},
-				bucketURL:          "",
-				outputLocation:     "",
-				useHermetic:        false,
-				checkDeps:          true,
+				InputConfigDict:    InputConfig{},
+				PipelineConfigDict: PipelineConfig{},
+				BitrateConfigDict:  BitrateConfig{},
+				BucketURL:          "",
+				OutputLocation:     "",
+				UseHermetic:        false,
+				CheckDeps:          true,
 			},
 		},
 	}
@@ -44,3 +46,225 @@ func TestControllerNode_Start(t *testing.T) {
 		})
 	}
 }
+
+func TestControllerNode_CheckStatus(t *testing.T) {
+	tests := []struct {
+		name  string
+		nodes []interface{}
+		want  ProcessStatus
+	}{
+		{name: "no nodes", want: Finished},
+		{name: "running", nodes: []interface{}{&QualityNode{Status: Finished}, &QualityNode{Status: Running}}, want: Running},
+		{name: "errored", nodes: []interface{}{&QualityNode{Status: Running}, &QualityNode{Status: Errored}}, want: Errored},
+		{name: "only serving", nodes: []interface{}{&OriginServerNode{Status: Running}, &QualityNode{Status: Finished}}, want: Finished},
+		{name: "server failed", nodes: []interface{}{&OriginServerNode{Status: Errored}}, want: Errored},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := ControllerNode{nodes: tt.nodes}
+
+			if got := c.CheckStatus(); got != tt.want {
+				t.Errorf("CheckStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestControllerNode_appendNodesForInputsList(t *testing.T) {
+	// Nothing is read from the input, so the video can't be chunked, and is
+	// encoded in one piece.
+	_, ffmpeg := fakeTools(t, "#!/bin/sh\n", "#!/bin/sh\nexit 0\n")
+
+	tests := []struct {
+		name    string
+		chunked bool
+	}{
+		{name: "single encode"},
+		{name: "chunked encode", chunked: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &ControllerNode{
+				tempDir:          t.TempDir(),
+				hermeticFfmpeg:   ffmpeg,
+				hermeticPackager: ffmpeg,
+				bitrateConfig:    NewBitrateConfig(),
+				pipelineConfig: PipelineConfig{
+					StreamingMode: VOD,
+					VideoCodecs:   []VideoCodecName{H264},
+					Resolutions:   []VideoResolutionName{"360p", "720p", "1080p"},
+					ChunkedEncode: ChunkedEncodeConfig{Enable: tt.chunked},
+				},
+			}
+
+			inputs := []Input{{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, Resolution: "720p", FrameRate: 30}}
+			c.appendNodesForInputsList(appendNodeParams{inputs: inputs, outputLocation: t.TempDir()})
+			t.Cleanup(c.Stop)
+
+			if len(c.nodes) != 2 {
+				t.Fatalf("got %d nodes, want a transcoder and a packager", len(c.nodes))
+			}
+
+			if chunked, ok := c.nodes[0].(*ChunkedTranscoderNode); ok != tt.chunked {
+				t.Errorf("the transcoder is a %T, chunked = %v", c.nodes[0], tt.chunked)
+			} else if ok {
+				for chunked.CheckStatus() == Running {
+					time.Sleep(10 * time.Millisecond)
+				}
+			}
+
+			packager, ok := c.nodes[1].(*PackagerNode)
+			if !ok {
+				t.Fatalf("got a %T, want a packager", c.nodes[1])
+			}
+
+			// 1080p is larger than the input.
+			if len(packager.OutputStreams) != 2 {
+				t.Errorf("got %d outputs, want 360p and 720p", len(packager.OutputStreams))
+			}
+		})
+	}
+}
+
+func TestControllerNode_outputStreams_OutputFormat(t *testing.T) {
+	c := &ControllerNode{
+		tempDir:       t.TempDir(),
+		bitrateConfig: NewBitrateConfig(),
+		pipelineConfig: PipelineConfig{
+			StreamingMode:  VOD,
+			AudioCodecs:    []AudioCodecName{OPUS},
+			VideoCodecs:    []VideoCodecName{VP9, H264},
+			Resolutions:    []VideoResolutionName{"720p"},
+			ChannelLayouts: []AudioChannelLayoutName{"stereo"},
+			OutputFormat:   map[string]OutputFormat{"vp9": OUTPUT_FORMAT_MP4},
+		},
+	}
+
+	inputs := []Input{
+		{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, Resolution: "720p", FrameRate: 30},
+		{InputType: FILE, Name: "talk.mp4", MediaType: AUDIO, Language: "eng", ChannelLayout: "stereo"},
+	}
+
+	outputs := c.outputStreams(inputs)
+	args := NewTranscoderNode(inputs, c.pipelineConfig, outputs, 0, "").commandLine(0)
+
+	tests := []struct {
+		want     string
+		dashOnly bool
+	}{
+		{want: "video_720p_1M_vp9.mp4"},
+		{want: "video_720p_2M_h264.mp4"},
+		// Opus keeps the default of its codec.
+		{want: "audio_eng_2c_64k_opus.webm", dashOnly: true},
+	}
+
+	if len(outputs) != len(tests) {
+		t.Fatalf("got %d outputs, want %d", len(outputs), len(tests))
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			single := outputs[i].GetSingleSegFile()
+			if got := single.WriteEnd(); got != tt.want {
+				t.Errorf("GetSingleSegFile() = %v, want %v", got, tt.want)
+			}
+
+			if got := outputs[i].IsDashOnly(); got != tt.dashOnly {
+				t.Errorf("IsDashOnly() = %v, want %v", got, tt.dashOnly)
+			}
+
+			// Whatever the container of the packaged output, the pipe to the
+			// packager carries fragmented MP4.
+			format := ""
+			ipcPipe := outputs[i].GetIpcPipe()
+			for j, arg := range args {
+				if arg == "-f" {
+					format = args[j+1]
+				}
+
+				if arg == ipcPipe.WriteEnd() {
+					break
+				}
+			}
+
+			if format != "mp4" {
+				t.Errorf("the pipe is written with -f %q, want mp4", format)
+			}
+		})
+	}
+}
+
+func TestControllerNode_outputStreams_Passthrough(t *testing.T) {
+	c := &ControllerNode{
+		tempDir:       t.TempDir(),
+		bitrateConfig: NewBitrateConfig(),
+		pipelineConfig: PipelineConfig{
+			StreamingMode:  VOD,
+			AudioCodecs:    []AudioCodecName{"copy:eac3", AAC},
+			ChannelLayouts: []AudioChannelLayoutName{"stereo", "surround"},
+		},
+	}
+
+	inputs := []Input{{InputType: FILE, Name: "concert.mkv", MediaType: AUDIO, Language: "eng", ChannelLayout: "surround"}}
+
+	var got []string
+	for _, output := range c.outputStreams(inputs) {
+		single := output.GetSingleSegFile()
+		got = append(got, single.WriteEnd())
+	}
+
+	// The copy is made once, with the channels of the input.
+	want := []string{"audio_eng_6c_copy_eac3.mp4", "audio_eng_2c_128k_aac.mp4", "audio_eng_6c_256k_aac.mp4"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("outputs = %v, want %v", got, want)
+	}
+}
+
+func TestControllerNode_outputStreams(t *testing.T) {
+	c := &ControllerNode{
+		tempDir:       t.TempDir(),
+		bitrateConfig: NewBitrateConfig(),
+		pipelineConfig: PipelineConfig{
+			AudioCodecs:    []AudioCodecName{AAC},
+			VideoCodecs:    []VideoCodecName{H264},
+			Resolutions:    []VideoResolutionName{"360p", "720p", "1080p"},
+			ChannelLayouts: []AudioChannelLayoutName{"stereo", "surround"},
+		},
+	}
+
+	inputs := []Input{
+		{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, Resolution: "720p"},
+		{InputType: FILE, Name: "talk.mp4", MediaType: AUDIO, Language: "eng", ChannelLayout: "stereo"},
+		{InputType: FILE, Name: "talk.vtt", MediaType: TEXT, Language: "eng"},
+	}
+
+	// Nothing is upscaled or upmixed.
+	tests := []struct {
+		want            string
+		skipTranscoding bool
+	}{
+		{want: "video_360p_400k_h264.mp4"},
+		{want: "video_720p_2M_h264.mp4"},
+		{want: "audio_eng_2c_128k_aac.mp4"},
+		// WebVTT is read by the packager as it is.
+		{want: "text_eng.mp4", skipTranscoding: true},
+	}
+
+	outputs := c.outputStreams(inputs)
+	if len(outputs) != len(tests) {
+		t.Fatalf("got %d outputs, want %d", len(outputs), len(tests))
+	}
+
+	for i, tt := range tests {
+		single := outputs[i].GetSingleSegFile()
+		if got := single.WriteEnd(); got != tt.want {
+			t.Errorf("output %d is %v, want %v", i, got, tt.want)
+		}
+
+		if got := outputs[i].SkippedTranscoding(); got != tt.skipTranscoding {
+			t.Errorf("output %d skips transcoding = %v, want %v", i, got, tt.skipTranscoding)
+		}
+	}
+}
@@ -3,6 +3,8 @@ package streamer
 import (
 	"fmt"
 	"runtime"
+	"strconv"
+	"strings"
 
 	"github.com/creasty/defaults"
 	"gopkg.in/dealancer/validate.v2"
@@ -16,9 +18,224 @@ const (
 	LOOPED_FILE      InputType = "looped_file"      // A track from a file, looped forever by FFmpeg. Usable only with live. Does not support media_type of 'text'.
 	WEBCAM           InputType = "webcam"           // A webcam device. Usable only with live. The device path should be given in the name field. For example, on Linux, this might be /dev/video0. Only supports media_type of 'video'.
 	MICROPHONE       InputType = "microphone"       // A microphone device. Usable only with live. The device path should given in the name field. For example, on Linux, this might be "default". Only supports media_type of 'audio'.
-	EXTERNAL_COMMAND InputType = "external_command" // An external command that generates a stream of audio or video. The command should be given in the name field, using shell quoting rules. The command should send its generated output to the path in the environment variable $SHAKA_STREAMER_EXTERNAL_COMMAND_OUTPUT, which Shaka Streamer set to the path to the output pipe. May require the user of extra_input_args if FFmpeg can't guess the format or framerate. Does not support media_type of 'text'.
+	EXTERNAL_COMMAND InputType = "external_command" // An external command that generates a stream of audio or video. The command should be given in the name field, using shell quoting rules. The command should send its generated output to the path in the environment variable $SHAKA_STREAMER_EXTERNAL_COMMAND_OUTPUT, which Shaka Streamer set to the path to the output pipe. May require the user of extra_input_args if FFmpeg can't guess the format or framerate. With media_type of 'text', the command should write WebVTT, timed in seconds since it started, and is usable only with live.
+	RTMP             InputType = "rtmp"             // A stream pushed by an RTMP encoder, such as OBS. Usable only with live. The listen URL should be given in the name field, in the form rtmp://HOST:PORT/APP/STREAM_KEY. Connections with any other app or stream key are rejected. Inputs with the same name share one connection, so the audio and video tracks of an encoder can be separate inputs. Does not support media_type of 'text'.
+	SRT              InputType = "srt"              // An MPEG-TS stream over SRT. Usable only with live. The SRT URL should be given in the name field, and the connection is configured in the srt field. The connection is retried whenever the sender drops. Inputs with the same name share one connection. Does not support media_type of 'text'.
+	UDP_TS           InputType = "udp_ts"           // An MPEG-TS stream over UDP, such as a multicast feed from a broadcast headend. Usable only with live. The UDP URL should be given in the name field, such as udp://239.1.1.1:5000. Streams can be selected with program and pid, and the receive buffer is configured in the udp field. Does not support media_type of 'text'.
+	ABR_PULL         InputType = "abr_pull"         // A rendition of an existing HLS or DASH stream, for re-packaging it with a new ladder. The manifest URL should be given in the name field. The rendition is chosen by media_type, language and the abr_pull field, and live manifests are followed as they update.
+	GENERATOR        InputType = "generator"        // A synthetic test pattern or tone generated by FFmpeg, which needs no media at all. The generator should be given in the name field: 'testsrc2', 'smptehdbars' or 'color' (black) for video, or 'sine' or 'anullsrc' (silence) for audio. Nothing is auto-detected, since every property is known. Does not support media_type of 'text'.
+	PLAYLIST         InputType = "playlist"         // A linear channel of files played back to back in real time. Usable only with live. The path to a playlist file should be given in the name field. Items can be trimmed and scheduled at wall-clock times, and the playlist file can be edited while running. Inputs with the same name share one playlist, so the audio and video tracks can be separate inputs. Nothing is auto-detected, so frame_rate and resolution are required for video. Does not support media_type of 'text'.
+	CUE_API          InputType = "cue_api"          // Live text cues pushed over HTTP, such as from a captioner or a speech-to-text service. Usable only with live. The listen URL should be given in the name field, such as http://0.0.0.0:8090/cues. Each POST carries a JSON cue, or an array of them. Only supports media_type of 'text'.
 )
 
+// The input types which can carry text.
+var TEXT_INPUT_TYPES = []InputType{
+	FILE,
+	ABR_PULL,
+	// A live WebVTT stream from a command, such as a speech-to-text tool.
+	EXTERNAL_COMMAND,
+	CUE_API,
+}
+
+// The test patterns and tones a generator input can produce.
+var GENERATOR_SOURCES = map[MediaType][]string{
+	VIDEO: {"testsrc2", "smptehdbars", "color"},
+	AUDIO: {"sine", "anullsrc"},
+}
+
+// The input types which can back up a live input.
+var FAILOVER_SOURCE_TYPES = []InputType{
+	LOOPED_FILE,
+	WEBCAM,
+	MICROPHONE,
+	SRT,
+	UDP_TS,
+	GENERATOR,
+}
+
+// Define a new type called GeneratorOverlay, which is essentially a string.
+type GeneratorOverlay string
+
+const (
+	GENERATOR_CLOCK    GeneratorOverlay = "clock"    // The wall-clock time.
+	GENERATOR_TIMECODE GeneratorOverlay = "timecode" // A timecode counting from the start of the stream.
+)
+
+// Define a new type called SrtMode, which is essentially a string.
+type SrtMode string
+
+const (
+	SRT_LISTENER SrtMode = "listener" // Wait for the sender to connect.
+	SRT_CALLER   SrtMode = "caller"   // Connect to a sender which is listening.
+)
+
+// The receive options of a UDP input.
+type UdpConfig struct {
+	/*
+		The size of the receive FIFO, in 188-byte packets.
+
+			A large FIFO absorbs bursts in the feed while the transcoder is busy.
+	*/
+	FifoSize int `yaml:"fifo_size" default:"1000000"`
+
+	// If true, keep reading when the FIFO overruns, and drop the lost packets.
+	OverrunNonfatal bool `yaml:"overrun_nonfatal" default:"true"`
+}
+
+// Define a new type called TrackDisposition, which is essentially a string.
+type TrackDisposition string
+
+const (
+	DISPOSITION_DEFAULT          TrackDisposition = "default"          // The track to play by default.
+	DISPOSITION_ORIGINAL         TrackDisposition = "original"         // The original language track.
+	DISPOSITION_DUB              TrackDisposition = "dub"              // A dubbed track.
+	DISPOSITION_COMMENTARY       TrackDisposition = "commentary"       // A commentary track.
+	DISPOSITION_FORCED           TrackDisposition = "forced"           // Forced subtitles.
+	DISPOSITION_HEARING_IMPAIRED TrackDisposition = "hearing_impaired" // A track for the hearing impaired, such as SDH subtitles.
+	DISPOSITION_VISUAL_IMPAIRED  TrackDisposition = "visual_impaired"  // A track for the visually impaired, such as audio description.
+)
+
+// The dispositions a track can be selected by.
+var TRACK_DISPOSITIONS = []TrackDisposition{
+	DISPOSITION_DEFAULT,
+	DISPOSITION_ORIGINAL,
+	DISPOSITION_DUB,
+	DISPOSITION_COMMENTARY,
+	DISPOSITION_FORCED,
+	DISPOSITION_HEARING_IMPAIRED,
+	DISPOSITION_VISUAL_IMPAIRED,
+}
+
+// The name ffprobe gives each disposition, where it differs.
+var FFPROBE_DISPOSITIONS = map[TrackDisposition]string{
+	DISPOSITION_COMMENTARY: "comment",
+}
+
+// The options of a generator input.
+type GeneratorConfig struct {
+	/*
+		The duration of the generated stream, in seconds.
+
+			If unspecified, the stream never ends, which is only useful with live.
+	*/
+	Duration float64 `yaml:"duration"`
+
+	/*
+		Text to burn into a generated video.  Can be 'clock' or 'timecode'.
+
+			If unspecified, nothing is burned in.
+	*/
+	Overlay GeneratorOverlay `yaml:"overlay"`
+
+	// The frequency of a generated tone, in Hz.
+	Frequency int `yaml:"frequency" default:"1000"`
+}
+
+/*
+A backup source of a live input.
+
+	A backup has the same fields as an input for reading a source, and takes
+	every other property, such as media_type and track_num, from the input it
+	backs up.  The program and pid of the input are not used, since they are
+	specific to the primary source.
+*/
+type FailoverSource struct {
+	InputType      InputType       `yaml:"input_type"`
+	Name           string          `yaml:"name" validate:"empty=false"`
+	ExtraInputArgs string          `yaml:"extra_input_args"`
+	Srt            SrtConfig       `yaml:"srt"`
+	Udp            UdpConfig       `yaml:"udp"`
+	Generator      GeneratorConfig `yaml:"generator"`
+}
+
+func (s *FailoverSource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	// set defaults.
+	if err := defaults.Set(s); err != nil {
+		panic(err)
+	}
+
+	type plain FailoverSource
+
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+
+	// validations
+	if err := validate.Validate(s); err != nil {
+		panic(err)
+	}
+
+	return nil
+}
+
+// Returns the input which reads this source in place of the primary input.
+func (s FailoverSource) asInput(primary Input) Input {
+	i := primary
+	i.InputType = s.InputType
+	i.Name = s.Name
+	i.ExtraInputArgs = s.ExtraInputArgs
+	i.Srt = s.Srt
+	i.Udp = s.Udp
+	i.Generator = s.Generator
+	i.Program = 0
+	i.Pid = 0
+	i.Failover = FailoverConfig{}
+	i.relayFormat = ""
+
+	return i
+}
+
+/*
+The failover options of a live input.
+
+	The primary source and its backups are relayed to the transcoder one at a
+	time, through a pipe which stays open, so the packager keeps running when
+	a source fails.  Sources which are switched to should use the same codecs
+	as the primary, except for webcams, microphones and generators, which are
+	encoded by the relay.
+*/
+type FailoverConfig struct {
+	// Backup sources, in the order in which they are tried.
+	Backups []FailoverSource `yaml:"backups"`
+
+	/*
+		The number of seconds without any data after which a source is considered
+		stalled, and the next source is used.
+
+			A source which exits is replaced right away.
+	*/
+	StallTimeout float64 `yaml:"stall_timeout" default:"5"`
+
+	/*
+		If true, switch back to the primary source once it can be probed again.
+
+			If false, a backup stays in use until it fails.
+	*/
+	RevertToPrimary bool `yaml:"revert_to_primary"`
+
+	// The number of seconds between probes of the primary source, while a backup is in use.
+	RevertInterval float64 `yaml:"revert_interval" default:"10"`
+}
+
+// The connection options of an SRT input.
+type SrtConfig struct {
+	// The connection mode.  Can be 'listener' or 'caller'.
+	Mode SrtMode `yaml:"mode" default:"caller"`
+
+	// The receiver latency, in milliseconds.
+	Latency int `yaml:"latency" default:"120"`
+
+	/*
+		The passphrase used to decrypt the stream.
+
+			Must be between 10 and 79 characters.  If empty, the stream is not encrypted.
+	*/
+	Passphrase string `yaml:"passphrase"`
+
+	// The stream ID sent to the sender, which some senders use to pick a stream.
+	StreamID string `yaml:"stream_id"`
+}
+
 // Define a new type called MediaType, which is essentially a string.
 type MediaType string
 
@@ -27,8 +244,35 @@ const (
 	AUDIO MediaType = "audio"
 	VIDEO MediaType = "video"
 	TEXT  MediaType = "text"
+	ALL   MediaType = "all" // Every track of the input, expanded into one input per track.
 )
 
+// Subtitle codecs which are text, and so can be packaged.  Bitmap subtitles
+// can't be.
+var TEXT_SUBTITLE_CODECS = []string{"subrip", "webvtt", "ass", "ssa", "mov_text", "text"}
+
+// The options of an input with media_type 'all'.
+type AllTracksConfig struct {
+	/*
+		The media types of the tracks to use.
+
+			If unspecified, video, audio and text tracks are all used.
+	*/
+	MediaTypes []MediaType `yaml:"media_types"`
+
+	// Skip audio and text tracks with any of these languages, such as 'und'.
+	SkipLanguages []string `yaml:"skip_languages"`
+
+	// Skip tracks with any of these dispositions, such as 'commentary'.
+	SkipDispositions []TrackDisposition `yaml:"skip_dispositions"`
+
+	// The filters of each video track, in place of the filters field.
+	VideoFilters []string `yaml:"video_filters"`
+
+	// The filters of each audio track, in place of the filters field.
+	AudioFilters []string `yaml:"audio_filters"`
+}
+
 // An object representing a single input stream to Shaka Streamer.
 type Input struct {
 	// The type of the input.
@@ -51,6 +295,30 @@ type Input struct {
 		 quoting rules. The command should send its generated output to the path in
 		 the environment variable $SHAKA_STREAMER_EXTERNAL_COMMAND_OUTPUT, which Shaka
 		 Streamer set to the path to the output pipe.
+
+		 With inputType set to 'rtmp', this is the URL to listen on for an RTMP
+		 encoder, in the form rtmp://HOST:PORT/APP/STREAM_KEY.  The encoder must
+		 publish to exactly this app and stream key.
+
+		 With inputType set to 'srt', this is an SRT URL, such as
+		 'srt://0.0.0.0:9000' in listener mode or 'srt://truck.example:9000' in
+		 caller mode.
+
+		 With inputType set to 'udp_ts', this is a UDP URL, such as
+		 'udp://239.1.1.1:5000' for a multicast group.
+
+		 With inputType set to 'abr_pull', this is the URL of an HLS master playlist
+		 or a DASH manifest.
+
+		 With inputType set to 'generator', this is the FFmpeg source to generate:
+		 'testsrc2', 'smptehdbars' or 'color' (black) for video, or 'sine' or
+		 'anullsrc' (silence) for audio.
+
+		 With inputType set to 'playlist', this is the path to a playlist file,
+		 which lists the files to play in order.
+
+		 With inputType set to 'cue_api', this is the URL to listen on for text
+		 cues, such as 'http://0.0.0.0:8090/cues'.
 	*/
 	Name string `yaml:"name" validate:"empty=false"`
 
@@ -64,7 +332,15 @@ type Input struct {
 	*/
 	ExtraInputArgs string `yaml:"extra_input_args" default:""`
 
-	// The media type of the input stream.
+	/*
+		The media type of the input stream.
+
+			With media_type 'all', the input is probed and replaced by one input for
+			each of its tracks, with track_num, language, channel_layout and
+			resolution filled in.  The other fields apply to every track, and the
+			language is used for tracks which have none.  Which tracks are used is
+			configured in the all_tracks field.
+	*/
 	MediaType MediaType `yaml:"media_type" validate:"empty=false"`
 
 	/*
@@ -73,7 +349,7 @@ type Input struct {
 			Only valid for media_type of 'video'.
 
 			Can be auto-detected for some input types, but may be required for others.
-			For example, required for input_type of 'external_command'.
+			For example, required for input_type of 'external_command' or 'rtmp'.
 	*/
 	FrameRate float64 `yaml:"frame_rate"`
 
@@ -83,7 +359,7 @@ type Input struct {
 			Only valid for media_type of 'video'.
 
 			Can be auto-detected for some input types, but may be required for others.
-			For example, required for input_type of 'external_command'.
+			For example, required for input_type of 'external_command' or 'rtmp'.
 	*/
 	Resolution VideoResolutionName `yaml:"resolution"`
 
@@ -102,6 +378,48 @@ type Input struct {
 	*/
 	TrackNum int `yaml:"track_num" default:"0"`
 
+	/*
+		The program number of an MPEG-TS input.
+
+		  If set, track_num counts only the tracks of this program, so a single
+		  multi-program transport stream can feed several inputs.
+
+		  If unspecified, the tracks of all programs are counted.
+	*/
+	Program int `yaml:"program"`
+
+	/*
+		The PID of an MPEG-TS input.
+
+		  If set, the track with this PID is used, and track_num and program are
+		  ignored.  0, the PID of the PAT, leaves it unset.
+	*/
+	Pid int `yaml:"pid"`
+
+	/*
+		Select the track by its language tag, such as 'fra', instead of by
+		track_num.
+
+		  Together with track_disposition and track_codec, this picks the one
+		  track of the media_type which matches every selector given, so a config
+		  keeps working when tracks are added to the input.  It is an error if no
+		  track or more than one track matches.
+
+		  Only valid for input types which can be auto-detected.
+	*/
+	TrackLanguage string `yaml:"track_language"`
+
+	/*
+		Select the track by its disposition, instead of by track_num.
+
+		  Can be 'default', 'original', 'dub', 'commentary', 'forced',
+		  'hearing_impaired' or 'visual_impaired'.
+	*/
+	TrackDisposition TrackDisposition `yaml:"track_disposition"`
+
+	// Select the track by its codec, such as 'ac3', instead of by track_num.
+	TrackCodec string `yaml:"track_codec"`
+
 	/*
 		True if the input video is interlaced.
 
@@ -114,10 +432,29 @@ type Input struct {
 	*/
 	IsInterlaced bool `yaml:"is_interlaced"`
 
+	/*
+		True if the frames of the input video are not evenly spaced, as in many
+		phone and screen recordings.
+
+		  Only valid for media_type of 'video'.
+
+		  If true, the video is encoded at the constant rate of frame_rate, so
+		  its keyframes fall on segment boundaries.
+
+		  Can be auto-detected for some input types, but defaults to False for
+		  others.
+	*/
+	IsVariableFrameRate bool `yaml:"is_variable_frame_rate"`
+
 	/*
 		The language of an audio or text stream.
 
-			With input_type set to 'file' or 'looped_file', this will be auto-detected.
+			With input_type set to 'file', 'looped_file' or 'udp_ts', this will be
+			auto-detected.  For MPEG-TS, it comes from the language descriptors in the
+			PMT.
+
+			With input_type set to 'abr_pull', this selects the rendition to pull, and
+			defaults to the language of the default rendition in the source manifest.
 			Otherwise, it will default to 'und' (undetermined).
 	*/
 	Language string `yaml:"language"`
@@ -139,6 +476,18 @@ type Input struct {
 	*/
 	EndTime string `yaml:"end_time"`
 
+	/*
+		How far to shift the timestamps of this track, to fix a constant offset
+		between the audio and video of a source.
+
+			In seconds, or as [-][HH:]MM:SS[.m...].  A positive offset plays the
+			track later, and a negative one earlier.  For example, an audio input
+			with '0.12' plays its sound 120ms later against the video.
+
+			Not supported with media_type of 'text'.  Use text_timing instead.
+	*/
+	AvOffset string `yaml:"av_offset"`
+
 	/*
 		Optional value for a custom DRM label, which defines the encryption key
 		  applied to the stream. If not provided, the DRM label is derived from stream
@@ -159,6 +508,52 @@ type Input struct {
 			Not supported with media_type of 'text'.
 	*/
 	Filters []string `yaml:"filters"`
+
+	// The connection options for input_type of 'srt'.
+	Srt SrtConfig `yaml:"srt"`
+
+	// The receive options for input_type of 'udp_ts'.
+	Udp UdpConfig `yaml:"udp"`
+
+	// The selection options for input_type of 'abr_pull'.
+	AbrPull AbrPullConfig `yaml:"abr_pull"`
+
+	// The options for input_type of 'generator'.
+	Generator GeneratorConfig `yaml:"generator"`
+
+	// Backup sources for a live input, and when to switch to them.
+	Failover FailoverConfig `yaml:"failover"`
+
+	// The options for media_type of 'all'.
+	AllTracks AllTracksConfig `yaml:"all_tracks"`
+
+	/*
+		The timing options of a text input.
+
+			SRT, TTML, DFXP and SCC files are converted to WebVTT before packaging,
+			and a WebVTT file is rewritten if it has an offset.
+	*/
+	TextTiming TextTimingConfig `yaml:"text_timing"`
+
+	// What to do with the CEA-608 and CEA-708 captions in a video input.
+	ClosedCaptions ClosedCaptionsConfig `yaml:"closed_captions"`
+
+	/*
+		Typed processing of a video input: crop, denoise, rotate, flip, pad and
+		watermark.
+
+			These are checked and ordered for you, unlike raw filters.
+	*/
+	Processing VideoProcessingConfig `yaml:"processing"`
+
+	// The format of the pipe this input is relayed through, if any.
+	relayFormat string
+
+	// The caption channel of a text input extracted from a video input, if any.
+	captionChannel CaptionChannel
+
+	// The shown size of the picture of a video input, once it is detected.
+	display DisplaySize
 }
 
 func NewInput(inputType InputType, name string, mediaType MediaType, filters []string) *Input {
@@ -206,23 +601,66 @@ func (i *Input) SetDefaults() {
 		i.InputType = FILE
 	}
 
-	// Check if track is available
-	if !IsPresent(*i) {
+	if i.MediaType == ALL {
+		// The tracks are probed when the input is expanded.
+		i.checkAllTracks()
+		return
+	}
+
+	if i.InputType == ABR_PULL {
+		// Find the rendition in the source manifest before probing it.
+		i.resolveAbrPull()
+	}
+
+	if i.InputType == GENERATOR {
+		// Every property of a generated stream is known, so these defaults take
+		// the place of auto-detection.
+		i.setGeneratorDefaults()
+	}
+
+	if i.TrackLanguage != "" || i.TrackDisposition != "" || i.TrackCodec != "" {
+		// Find the track_num of the selected track before probing it.
+		i.resolveTrackSelectors()
+	}
+
+	// Check if track is available.  FFmpeg can't read every subtitle format we
+	// convert, so those only need to exist.
+	if i.needsTextConversion() && !FileExists(i.Name) || !i.needsTextConversion() && !IsPresent(*i) {
 		panic(NewInputNotFound(*i))
 	}
 
+	// The picture of a cropped input decides its resolution, so the crop is
+	// detected first.
+	if i.Processing.isSet() {
+		i.checkProcessing()
+		i.detectCrop()
+	}
+
 	if i.MediaType == VIDEO {
 		// These fields are required for video inputs.
 		// We will attempt to auto-detect them if possible.
 
+		// Inputs which can't be probed are taken to be upright.
+		i.display, _ = GetDisplaySize(*i)
+
 		if defaults.CanUpdate(i.IsInterlaced) {
 			i.IsInterlaced = GetInterlaced(*i)
 		}
 
+		if defaults.CanUpdate(i.IsVariableFrameRate) {
+			i.IsVariableFrameRate = GetVariableFrameRate(*i)
+		}
+
 		if defaults.CanUpdate(i.FrameRate) {
 			i.FrameRate = GetFrameRate(*i)
 			// FrameRate is required
 			i.requireField("FrameRate")
+
+			if i.IsVariableFrameRate {
+				// The average of a variable frame rate is rarely round, so encode
+				// at the nearest common rate.
+				i.FrameRate = standardFrameRate(i.FrameRate)
+			}
 		}
 
 		if defaults.CanUpdate(i.Resolution) {
@@ -251,8 +689,12 @@ func (i *Input) SetDefaults() {
 		}
 	}
 
+	if i.InputType == CUE_API && i.MediaType != TEXT {
+		panic(NewMalformedField(*i, "MediaType", `must be "text" with input_type cue_api`))
+	}
+
 	if i.MediaType == TEXT {
-		if i.InputType != FILE {
+		if !ContainsInputType(TEXT_INPUT_TYPES, i.InputType) {
 			reason := fmt.Sprintf("text streams are not supported in input_type %s", i.InputType)
 			i.disallowField("InputType", reason)
 		}
@@ -261,10 +703,40 @@ func (i *Input) SetDefaults() {
 		reason := `not supported with media_type "text"`
 		i.disallowField("StartTime", reason)
 		i.disallowField("EndTime", reason)
+		i.disallowField("AvOffset", `not supported with media_type "text", use text_timing instead`)
 
 		if len(i.Filters) > 0 {
 			i.disallowField("Filters", reason)
 		}
+
+		if i.TextTiming.Offset != "" {
+			frameRate := i.TextTiming.FrameRate
+			if frameRate == 0 {
+				frameRate = SCC_FRAME_RATE
+			}
+
+			if _, err := parseTextOffset(i.TextTiming.Offset, frameRate); err != nil {
+				panic(NewMalformedField(i.TextTiming, "Offset", err.Error()))
+			}
+		}
+	} else if i.TextTiming != (TextTimingConfig{}) {
+		panic(NewMalformedField(*i, "TextTiming", `only valid with media_type "text"`))
+	}
+
+	if i.AvOffset != "" {
+		if _, err := parseFFmpegTime(strings.TrimPrefix(i.AvOffset, "-")); err != nil {
+			panic(NewMalformedField(*i, "AvOffset", err.Error()))
+		}
+
+		// Extracted captions are read through a filter graph, which can't be
+		// shifted along with the video.
+		if i.ClosedCaptions.Mode == CAPTIONS_EXTRACT {
+			panic(NewConflictingFields(*i, "AvOffset", "ClosedCaptions"))
+		}
+	}
+
+	if i.ClosedCaptions.Mode != "" || len(i.ClosedCaptions.Channels) > 0 {
+		i.checkClosedCaptions()
 	}
 
 	if i.InputType != FILE {
@@ -273,6 +745,53 @@ func (i *Input) SetDefaults() {
 		i.disallowField("StartTime", reason)
 		i.disallowField("EndTime", reason)
 	}
+
+	if i.Program < 0 {
+		panic(NewMalformedField(*i, "Program", "must not be negative"))
+	}
+
+	if i.Pid < 0 || i.Pid > 0x1fff {
+		panic(NewMalformedField(*i, "Pid", "must be between 1 and 8191, or 0 to leave it unset"))
+	}
+
+	if len(i.Failover.Backups) > 0 {
+		if i.InputType == RTMP || i.InputType == EXTERNAL_COMMAND || i.InputType == ABR_PULL || i.InputType == PLAYLIST || i.InputType == CUE_API {
+			reason := fmt.Sprintf("not supported with input_type %s", i.InputType)
+			panic(NewMalformedField(*i, "Failover", reason))
+		}
+
+		for _, backup := range i.Failover.Backups {
+			if !ContainsInputType(FAILOVER_SOURCE_TYPES, backup.InputType) {
+				reason := fmt.Sprintf("input_type must be one of %v", FAILOVER_SOURCE_TYPES)
+				panic(NewMalformedField(backup, "InputType", reason))
+			}
+		}
+	}
+
+	if i.InputType == SRT {
+		if i.Srt.Mode != SRT_LISTENER && i.Srt.Mode != SRT_CALLER {
+			panic(NewMalformedField(i.Srt, "Mode", `must be "listener" or "caller"`))
+		}
+
+		if length := len(i.Srt.Passphrase); length > 0 && (length < 10 || length > 79) {
+			panic(NewMalformedField(i.Srt, "Passphrase", "must be between 10 and 79 characters"))
+		}
+	}
+}
+
+// Returns true if this is a text file which must be converted to WebVTT
+// before packaging.
+func (i Input) needsTextConversion() bool {
+	if i.MediaType != TEXT || i.InputType != FILE {
+		return false
+	}
+
+	format := GetSubtitleFormat(i.Name)
+	if format == SUBTITLE_WEBVTT {
+		return i.TextTiming.Offset != ""
+	}
+
+	return format != ""
 }
 
 // Set the name to a pipe path into which this input's contents are fed.
@@ -280,6 +799,401 @@ func (i *Input) resetName(pipePath string) {
 	i.Name = pipePath
 }
 
+// Set the name to a pipe path into which a relay node writes this input's
+// contents in the given format.
+func (i *Input) resetToRelay(pipePath string, format string) {
+	i.resetName(pipePath)
+	i.relayFormat = format
+}
+
+// Select a track of the relayed stream, which replaces any selection made
+// in the original source.
+func (i *Input) resetTrack(trackNum int) {
+	i.TrackNum = trackNum
+	i.Program = 0
+	i.Pid = 0
+	i.AbrPull.Representation = ""
+}
+
+func (i *Input) setGeneratorDefaults() {
+	if !ContainsString(GENERATOR_SOURCES[i.MediaType], i.Name) {
+		reason := fmt.Sprintf("must be one of %v for media_type %s", GENERATOR_SOURCES[i.MediaType], i.MediaType)
+		panic(NewMalformedField(*i, "Name", reason))
+	}
+
+	if i.Generator.Overlay != "" && i.Generator.Overlay != GENERATOR_CLOCK && i.Generator.Overlay != GENERATOR_TIMECODE {
+		panic(NewMalformedField(i.Generator, "Overlay", `must be "clock" or "timecode"`))
+	}
+
+	if i.Generator.Duration < 0 {
+		panic(NewMalformedField(i.Generator, "Duration", "must not be negative"))
+	}
+
+	if i.MediaType == VIDEO {
+		if defaults.CanUpdate(i.FrameRate) {
+			i.FrameRate = 30
+		}
+
+		if defaults.CanUpdate(i.Resolution) {
+			i.Resolution = "720p"
+		}
+
+		if i.GetResolution() == nil {
+			panic(NewMalformedField(*i, "Resolution", "is not a known resolution"))
+		}
+	}
+
+	if i.MediaType == AUDIO {
+		if defaults.CanUpdate(i.ChannelLayout) {
+			i.ChannelLayout = "stereo"
+		}
+
+		if i.GetChannelLayout() == nil {
+			panic(NewMalformedField(*i, "ChannelLayout", "is not a known channel layout"))
+		}
+	}
+}
+
+/*
+Get the FFmpeg filter graph which produces a generator input.
+
+	The graph is read by FFmpeg's lavfi input format, in place of a file name.
+*/
+func (i Input) GetGeneratorGraph() string {
+	var options []string
+	if i.Generator.Duration > 0 {
+		options = append(options, fmt.Sprintf("duration=%s", strconv.FormatFloat(i.Generator.Duration, 'f', -1, 64)))
+	}
+
+	if i.MediaType == AUDIO {
+		var graph string
+		if i.Name == "anullsrc" {
+			// Silence has no frequency, and its duration is trimmed separately.
+			graph = "anullsrc=sample_rate=48000"
+			if i.Generator.Duration > 0 {
+				graph += fmt.Sprintf(",atrim=duration=%s", strconv.FormatFloat(i.Generator.Duration, 'f', -1, 64))
+			}
+		} else {
+			options = append(options, fmt.Sprintf("frequency=%d", i.Generator.Frequency), "sample_rate=48000")
+			graph = fmt.Sprintf("%s=%s", i.Name, strings.Join(options, ":"))
+		}
+
+		// The tone is mono, so copy it to every channel.
+		channels := i.GetChannelLayout().MaxChannels
+		pan := []string{fmt.Sprintf("pan=%dc", channels)}
+		for c := 0; c < channels; c++ {
+			pan = append(pan, fmt.Sprintf("c%d=c0", c))
+		}
+
+		return graph + "," + strings.Join(pan, "|")
+	}
+
+	resolution := i.GetResolution()
+	options = append(options,
+		fmt.Sprintf("size=%dx%d", resolution.MaxWidth, resolution.MaxHeight),
+		fmt.Sprintf("rate=%s", strconv.FormatFloat(i.FrameRate, 'f', -1, 64)))
+	graph := fmt.Sprintf("%s=%s", i.Name, strings.Join(options, ":"))
+
+	// Text is sized and placed relative to the frame, in the lower third.
+	drawtext := "drawtext=fontsize=h/12:fontcolor=white:box=1:boxcolor=black@0.6:x=(w-tw)/2:y=h*2/3"
+	switch i.Generator.Overlay {
+	case GENERATOR_CLOCK:
+		graph += "," + drawtext + `:text='%{localtime\:%T}'`
+	case GENERATOR_TIMECODE:
+		graph += "," + drawtext + fmt.Sprintf(`:timecode='00\:00\:00\:00':rate=%s`, strconv.FormatFloat(i.FrameRate, 'f', -1, 64))
+	}
+
+	return graph
+}
+
+// Points this input at the rendition of its source manifest which matches its
+// media type, language and abr_pull options.
+func (i *Input) resolveAbrPull() {
+	renditions, err := GetAbrRenditions(i.Name, i.AbrPull.Bandwidth)
+	if err != nil {
+		panic(NewMalformedField(*i, "Name", err.Error()))
+	}
+
+	rendition, err := selectAbrRendition(renditions, i.MediaType, i.Language, i.AbrPull.Representation)
+	if err != nil {
+		panic(NewInputNotFound(*i))
+	}
+
+	i.Name = rendition.URL
+	i.AbrPull.Representation = rendition.Representation
+
+	if defaults.CanUpdate(i.Language) && rendition.Language != "" {
+		i.Language = rendition.Language
+	}
+}
+
+// Checks the fields of an input with media_type 'all'.
+func (i *Input) checkAllTracks() {
+	if ContainsInputType(TYPES_WE_CANT_PROBE, i.InputType) || i.InputType == ABR_PULL {
+		reason := fmt.Sprintf("'all' is not supported with input_type %s", i.InputType)
+		panic(NewMalformedField(*i, "MediaType", reason))
+	}
+
+	reason := `not supported with media_type "all"`
+	i.disallowField("TrackNum", reason)
+	i.disallowField("Pid", reason)
+	i.disallowField("TrackLanguage", reason)
+	i.disallowField("TrackDisposition", reason)
+	i.disallowField("TrackCodec", reason)
+
+	if len(i.Filters) > 0 {
+		panic(NewMalformedField(*i, "Filters", "use all_tracks.video_filters or all_tracks.audio_filters with media_type \"all\""))
+	}
+
+	for _, mediaType := range i.AllTracks.MediaTypes {
+		if mediaType != VIDEO && mediaType != AUDIO && mediaType != TEXT {
+			reason := fmt.Sprintf("unknown media type %q", mediaType)
+			panic(NewMalformedField(i.AllTracks, "MediaTypes", reason))
+		}
+	}
+
+	for _, disposition := range i.AllTracks.SkipDispositions {
+		if !ContainsDisposition(TRACK_DISPOSITIONS, disposition) {
+			reason := fmt.Sprintf("unknown disposition %q", disposition)
+			panic(NewMalformedField(i.AllTracks, "SkipDispositions", reason))
+		}
+	}
+}
+
+/*
+Returns one input for each track of an input with media_type 'all', and the
+input itself otherwise.
+
+	Tracks are skipped if they are of an unwanted media type, language or
+	disposition, or if they can't be transcoded at all, such as cover art and
+	bitmap subtitles.
+*/
+func (i Input) expandAllTracks() []Input {
+	if i.MediaType != ALL {
+		return []Input{i}
+	}
+
+	streams, err := ProbeStreams(i)
+	if err != nil {
+		panic(NewInputNotFound(i))
+	}
+
+	mediaTypes := i.AllTracks.MediaTypes
+	if len(mediaTypes) == 0 {
+		mediaTypes = []MediaType{VIDEO, AUDIO, TEXT}
+	}
+
+	var inputs []Input
+	trackNums := map[MediaType]int{}
+
+	for _, stream := range streams {
+		mediaType := map[string]MediaType{"video": VIDEO, "audio": AUDIO, "subtitle": TEXT}[stream.CodecType]
+		if mediaType == "" {
+			// Data and attachment streams have no track number of a media type.
+			continue
+		}
+
+		// Track numbers count every stream of the media type, used or not.
+		trackNum := trackNums[mediaType]
+		trackNums[mediaType]++
+
+		if !i.wantsTrack(stream, mediaType, mediaTypes) {
+			continue
+		}
+
+		track := i
+		track.MediaType = mediaType
+		track.TrackNum = trackNum
+		track.AllTracks = AllTracksConfig{}
+		track.Language = ""
+
+		if mediaType != VIDEO {
+			track.ClosedCaptions = ClosedCaptionsConfig{}
+			track.Processing = VideoProcessingConfig{}
+		}
+
+		if mediaType == VIDEO {
+			track.Filters = i.AllTracks.VideoFilters
+		} else if mediaType == AUDIO {
+			track.Filters = i.AllTracks.AudioFilters
+		}
+
+		track.SetDefaults()
+
+		if track.Language == "und" && i.Language != "" {
+			track.Language = i.Language
+		}
+
+		inputs = append(inputs, track)
+	}
+
+	if len(inputs) == 0 {
+		panic(NewMalformedField(i, "AllTracks", fmt.Sprintf("no track of %q is left to use", i.Name)))
+	}
+
+	return inputs
+}
+
+// Returns true if a track of an input with media_type 'all' should be used.
+func (i Input) wantsTrack(stream ProbedStream, mediaType MediaType, mediaTypes []MediaType) bool {
+	if !ContainsMediaType(mediaTypes, mediaType) {
+		return false
+	}
+
+	if mediaType == VIDEO && stream.Disposition["attached_pic"] != 0 {
+		// Cover art is a single image, not a video.
+		return false
+	}
+
+	if mediaType == TEXT && (i.InputType != FILE || !ContainsString(TEXT_SUBTITLE_CODECS, stream.CodecName)) {
+		return false
+	}
+
+	language := stream.Tags["language"]
+	if language == "" {
+		language = "und"
+	}
+
+	// Video has no language to skip it by.
+	if mediaType != VIDEO && ContainsString(i.AllTracks.SkipLanguages, language) {
+		return false
+	}
+
+	for _, disposition := range i.AllTracks.SkipDispositions {
+		key := string(disposition)
+		if ffprobeKey, ok := FFPROBE_DISPOSITIONS[disposition]; ok {
+			key = ffprobeKey
+		}
+
+		if stream.Disposition[key] != 0 {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Replaces every input with media_type 'all' by the inputs of its tracks, and
+// adds a text input for each caption channel extracted from a video input.
+func expandInputs(inputs []Input) []Input {
+	var expanded []Input
+	for _, input := range inputs {
+		for _, track := range input.expandAllTracks() {
+			expanded = append(expanded, track)
+			expanded = append(expanded, track.captionInputs()...)
+		}
+	}
+
+	return expanded
+}
+
+/*
+Set track_num to the one track matching the track selectors.
+
+	The selectors are resolved once, so the stream specifier of the input is a
+	plain track number from then on.
+*/
+func (i *Input) resolveTrackSelectors() {
+	selector := "TrackLanguage"
+	if i.TrackDisposition != "" {
+		selector = "TrackDisposition"
+	} else if i.TrackCodec != "" {
+		selector = "TrackCodec"
+	}
+
+	if ContainsInputType(TYPES_WE_CANT_PROBE, i.InputType) || i.InputType == ABR_PULL {
+		reason := fmt.Sprintf("not supported with input_type %s", i.InputType)
+		panic(NewMalformedField(*i, selector, reason))
+	}
+
+	if i.Pid != 0 {
+		panic(NewConflictingFields(*i, "Pid", selector))
+	}
+
+	if i.TrackDisposition != "" && !ContainsDisposition(TRACK_DISPOSITIONS, i.TrackDisposition) {
+		reason := fmt.Sprintf("unknown disposition %q", i.TrackDisposition)
+		panic(NewMalformedField(*i, "TrackDisposition", reason))
+	}
+
+	streams, err := ProbeStreams(*i)
+	if err != nil {
+		panic(NewInputNotFound(*i))
+	}
+
+	trackNum, err := selectTrack(streams, i.TrackLanguage, i.TrackDisposition, i.TrackCodec)
+	if err != nil {
+		reason := fmt.Sprintf("in %q, %v", i.Name, err)
+		panic(NewMalformedField(*i, selector, reason))
+	}
+
+	i.TrackNum = trackNum
+}
+
+/*
+Returns the track number of the one stream matching every given selector.
+
+	The streams are all the streams of one media type, in order, so the
+	position of a stream in the list is its track number.
+*/
+func selectTrack(streams []ProbedStream, language string, disposition TrackDisposition, codec string) (int, error) {
+	dispositionKey := string(disposition)
+	if key, ok := FFPROBE_DISPOSITIONS[disposition]; ok {
+		dispositionKey = key
+	}
+
+	var matches []int
+	var described []string
+
+	for trackNum, stream := range streams {
+		described = append(described, stream.String())
+
+		if language != "" && !strings.EqualFold(stream.Tags["language"], language) {
+			continue
+		}
+
+		if disposition != "" && stream.Disposition[dispositionKey] == 0 {
+			continue
+		}
+
+		if codec != "" && !strings.EqualFold(stream.CodecName, codec) {
+			continue
+		}
+
+		matches = append(matches, trackNum)
+	}
+
+	wanted := describeTrackSelectors(language, disposition, codec)
+
+	if len(matches) == 0 {
+		return 0, fmt.Errorf("no track matches %s; the tracks are: %s", wanted, strings.Join(described, ", "))
+	}
+
+	if len(matches) > 1 {
+		return 0, fmt.Errorf("%d tracks match %s (track_num %v); add a selector to choose one", len(matches), wanted, matches)
+	}
+
+	return matches[0], nil
+}
+
+// Describes the given selectors for an error message.
+func describeTrackSelectors(language string, disposition TrackDisposition, codec string) string {
+	var selectors []string
+
+	if language != "" {
+		selectors = append(selectors, fmt.Sprintf("language %q", language))
+	}
+
+	if disposition != "" {
+		selectors = append(selectors, fmt.Sprintf("disposition %q", disposition))
+	}
+
+	if codec != "" {
+		selectors = append(selectors, fmt.Sprintf("codec %q", codec))
+	}
+
+	return strings.Join(selectors, " and ")
+}
+
 /*
 Get an FFmpeg stream specifier for this input.
 
@@ -288,18 +1202,40 @@ Get an FFmpeg stream specifier for this input.
 	format, not overall track numbers from the input file, and that they are
 	indexed starting at 0.
 
+	With a program, the track number is within that program, such as "p:2:a:1"
+	for the second audio track of program 2.  With a PID, the track is
+	selected by its PID alone, such as "#256".  A DASH representation is
+	selected by its ID, such as "m:id:video_1080p".
+
 	See also http://ffmpeg.org/ffmpeg.html#Stream-specifiers
 */
 func (i Input) GetStreamSpecifier() string {
+	if i.Pid != 0 {
+		// In MPEG-TS, the stream ID is the PID.
+		return fmt.Sprintf("#%d", i.Pid)
+	}
+
+	if i.AbrPull.Representation != "" {
+		// FFmpeg's DASH demuxer tags each stream with its representation ID.
+		return fmt.Sprintf("m:id:%s", i.AbrPull.Representation)
+	}
+
+	var specifier string
 	if i.MediaType == VIDEO {
-		return fmt.Sprintf("v:%d", i.TrackNum)
+		specifier = fmt.Sprintf("v:%d", i.TrackNum)
 	} else if i.MediaType == AUDIO {
-		return fmt.Sprintf("a:%d", i.TrackNum)
+		specifier = fmt.Sprintf("a:%d", i.TrackNum)
 	} else if i.MediaType == TEXT {
-		return fmt.Sprintf("s:%d", i.TrackNum)
+		specifier = fmt.Sprintf("s:%d", i.TrackNum)
 	} else {
 		panic("Unrecognized media_type! This should not happen.")
 	}
+
+	if i.Program != 0 {
+		return fmt.Sprintf("p:%d:%s", i.Program, specifier)
+	}
+
+	return specifier
 }
 
 /*
@@ -313,6 +1249,55 @@ Note that for types which support autodetect, these arguments must be
 understood by ffprobe as well as ffmpeg.
 */
 func (i Input) GetInputArgs() []string {
+	if i.relayFormat != "" {
+		// A relay node feeds this input through a pipe.
+		return []string{"-f", i.relayFormat}
+	}
+
+	if i.captionChannel.Channel != "" {
+		return []string{
+			"-f", "lavfi",
+			// Decode the data field which carries the channel.
+			"-data_field", i.captionChannel.dataField(),
+		}
+	}
+
+	if i.InputType == SRT {
+		args := []string{
+			"-f", "mpegts",
+			"-mode", string(i.Srt.Mode),
+			// FFmpeg takes the latency in microseconds.
+			"-latency", strconv.Itoa(i.Srt.Latency * 1000),
+		}
+
+		if i.Srt.Passphrase != "" {
+			args = append(args, "-passphrase", i.Srt.Passphrase)
+		}
+
+		if i.Srt.StreamID != "" {
+			args = append(args, "-streamid", i.Srt.StreamID)
+		}
+
+		return args
+	}
+
+	if i.InputType == GENERATOR {
+		return []string{"-f", "lavfi"}
+	}
+
+	if i.InputType == UDP_TS {
+		args := []string{
+			"-f", "mpegts",
+			"-fifo_size", strconv.Itoa(i.Udp.FifoSize),
+		}
+
+		if i.Udp.OverrunNonfatal {
+			args = append(args, "-overrun_nonfatal", "1")
+		}
+
+		return args
+	}
+
 	argsMatrix := map[InputType]map[string][]string{
 		WEBCAM: {
 			"Linux": []string{
@@ -401,6 +1386,8 @@ func NewInputConfig(inputs []Input, mpi []SinglePeriod) *InputConfig {
 		panic(err)
 	}
 
+	i.expandAllTracks()
+
 	return i
 }
 
@@ -415,6 +1402,8 @@ func (i *InputConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 		return err
 	}
 
+	i.expandAllTracks()
+
 	// validations
 	if err := validate.Validate(i); err != nil {
 		panic(err)
@@ -423,6 +1412,18 @@ func (i *InputConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// Expands the inputs with media_type 'all', in every period.
+func (i *InputConfig) expandAllTracks() {
+	if len(i.Inputs) > 0 {
+		i.Inputs = expandInputs(i.Inputs)
+	}
+
+	for idx := range i.MultiPeriodInputsList {
+		period := &i.MultiPeriodInputsList[idx]
+		period.Inputs = expandInputs(period.Inputs)
+	}
+}
+
 /*
 A constructor to check that either inputs or mutliperiod_inputs_list is provided,
 
@@ -1,8 +1,12 @@
 package streamer
 
 import (
+	"fmt"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/creasty/defaults"
 )
 
 func TestNewInput(t *testing.T) {
@@ -70,3 +74,377 @@ func TestNewInput(t *testing.T) {
 		})
 	}
 }
+
+func TestInput_GetInputArgs(t *testing.T) {
+	tests := []struct {
+		name  string
+		input Input
+		want  []string
+	}{
+		{
+			name: "SRT listener",
+			input: Input{
+				InputType: SRT,
+				Name:      "srt://0.0.0.0:9000",
+				Srt:       SrtConfig{Mode: SRT_LISTENER, Latency: 200},
+			},
+			want: []string{"-f", "mpegts", "-mode", "listener", "-latency", "200000"},
+		},
+		{
+			name: "SRT caller with passphrase and stream ID",
+			input: Input{
+				InputType: SRT,
+				Name:      "srt://truck.example:9000",
+				Srt:       SrtConfig{Mode: SRT_CALLER, Latency: 120, Passphrase: "0123456789", StreamID: "cam1"},
+			},
+			want: []string{"-f", "mpegts", "-mode", "caller", "-latency", "120000", "-passphrase", "0123456789", "-streamid", "cam1"},
+		},
+		{
+			name: "Relayed SRT",
+			input: Input{
+				InputType:   SRT,
+				Name:        "/tmp/pipe.ts",
+				Srt:         SrtConfig{Mode: SRT_LISTENER, Latency: 120},
+				relayFormat: "mpegts",
+			},
+			want: []string{"-f", "mpegts"},
+		},
+		{
+			name: "UDP TS",
+			input: Input{
+				InputType: UDP_TS,
+				Name:      "udp://239.1.1.1:5000",
+				Udp:       UdpConfig{FifoSize: 1000000, OverrunNonfatal: true},
+			},
+			want: []string{"-f", "mpegts", "-fifo_size", "1000000", "-overrun_nonfatal", "1"},
+		},
+		{
+			name: "UDP TS with fatal overruns",
+			input: Input{
+				InputType: UDP_TS,
+				Name:      "udp://239.1.1.1:5000",
+				Udp:       UdpConfig{FifoSize: 28672},
+			},
+			want: []string{"-f", "mpegts", "-fifo_size", "28672"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.input.GetInputArgs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetInputArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInput_GetStreamSpecifier(t *testing.T) {
+	tests := []struct {
+		name  string
+		input Input
+		want  string
+	}{
+		{
+			name:  "Track number",
+			input: Input{MediaType: AUDIO, TrackNum: 1},
+			want:  "a:1",
+		},
+		{
+			name:  "Program",
+			input: Input{MediaType: VIDEO, Program: 2},
+			want:  "p:2:v:0",
+		},
+		{
+			name:  "Program and track number",
+			input: Input{MediaType: AUDIO, Program: 2, TrackNum: 1},
+			want:  "p:2:a:1",
+		},
+		{
+			name:  "PID",
+			input: Input{MediaType: AUDIO, Program: 2, TrackNum: 1, Pid: 256},
+			want:  "#256",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.input.GetStreamSpecifier(); got != tt.want {
+				t.Errorf("GetStreamSpecifier() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInput_GetGeneratorGraph(t *testing.T) {
+	tests := []struct {
+		name      string
+		source    string
+		mediaType MediaType
+		configure func(i *Input)
+		want      string
+	}{
+		{
+			name:      "Default test pattern",
+			source:    "testsrc2",
+			mediaType: VIDEO,
+			want:      "testsrc2=size=1280x720:rate=30",
+		},
+		{
+			name:      "Bars with a clock",
+			source:    "smptehdbars",
+			mediaType: VIDEO,
+			configure: func(i *Input) {
+				i.Resolution = "1080p"
+				i.FrameRate = 25
+				i.Generator.Duration = 10
+				i.Generator.Overlay = GENERATOR_CLOCK
+			},
+			want: `smptehdbars=duration=10:size=1920x1080:rate=25,drawtext=fontsize=h/12:fontcolor=white:box=1:boxcolor=black@0.6:x=(w-tw)/2:y=h*2/3:text='%{localtime\:%T}'`,
+		},
+		{
+			name:      "Stereo tone",
+			source:    "sine",
+			mediaType: AUDIO,
+			want:      "sine=frequency=1000:sample_rate=48000,pan=2c|c0=c0|c1=c0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			i := Input{InputType: GENERATOR, Name: tt.source, MediaType: tt.mediaType}
+			if tt.configure != nil {
+				tt.configure(&i)
+			}
+
+			if err := defaults.Set(&i); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := i.GetGeneratorGraph(); got != tt.want {
+				t.Errorf("GetGeneratorGraph() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewInput_GeneratorSkipsAutodetect(t *testing.T) {
+	video := NewInput(GENERATOR, "testsrc2", VIDEO, nil)
+	if video.FrameRate != 30 || video.Resolution != "720p" {
+		t.Errorf("video = %v at %v fps, want 720p at 30 fps", video.Resolution, video.FrameRate)
+	}
+
+	audio := NewInput(GENERATOR, "sine", AUDIO, nil)
+	if audio.ChannelLayout != "stereo" || audio.Language != "und" {
+		t.Errorf("audio = %v in %v, want stereo in und", audio.ChannelLayout, audio.Language)
+	}
+}
+
+func TestInput_AvOffset(t *testing.T) {
+	tests := []struct {
+		name     string
+		offset   string
+		wantFail bool
+	}{
+		{name: "seconds", offset: "0.12"},
+		{name: "negative time", offset: "-00:00:00.040"},
+		{name: "malformed", offset: "120ms", wantFail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				_, malformed := recover().(*MalformedField)
+				if malformed != tt.wantFail {
+					t.Errorf("SetDefaults() failed = %v, want %v", malformed, tt.wantFail)
+				}
+			}()
+
+			i := Input{InputType: GENERATOR, Name: "sine", MediaType: AUDIO, AvOffset: tt.offset}
+			i.SetDefaults()
+		})
+	}
+}
+
+func TestSelectTrack(t *testing.T) {
+	streams := []ProbedStream{
+		{CodecName: "aac", Tags: map[string]string{"language": "eng"}, Disposition: map[string]int{"default": 1}},
+		{CodecName: "ac3", Tags: map[string]string{"language": "fra"}},
+		{CodecName: "aac", Tags: map[string]string{"language": "eng"}, Disposition: map[string]int{"comment": 1}},
+		{CodecName: "aac", Tags: map[string]string{"language": "fra"}, Disposition: map[string]int{"visual_impaired": 1}},
+	}
+
+	tests := []struct {
+		name        string
+		language    string
+		disposition TrackDisposition
+		codec       string
+		want        int
+		wantErr     string
+	}{
+		{name: "Disposition", disposition: DISPOSITION_DEFAULT, want: 0},
+		{name: "Commentary", disposition: DISPOSITION_COMMENTARY, want: 2},
+		{name: "Codec", codec: "AC3", want: 1},
+		{name: "Language and codec", language: "fra", codec: "aac", want: 3},
+		{name: "Several matches", language: "eng", wantErr: "2 tracks match language \"eng\" (track_num [0 2])"},
+		{name: "No match", language: "deu", wantErr: "the tracks are: aac (eng, default), ac3 (fra), aac (eng, commentary), aac (fra, visual_impaired)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := selectTrack(streams, tt.language, tt.disposition, tt.codec)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("error = %v, want it to contain %q", err, tt.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != tt.want {
+				t.Errorf("selectTrack() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInput_resolveTrackSelectors(t *testing.T) {
+	// A stand-in for ffprobe which describes two audio tracks.
+	ffprobe := `#!/bin/sh
+cat <<'JSON'
+{"streams": [
+  {"codec_name": "aac", "tags": {"language": "eng"}, "disposition": {"default": 1, "comment": 0}},
+  {"codec_name": "aac", "tags": {"language": "eng"}, "disposition": {"default": 0, "comment": 1}}
+]}
+JSON
+`
+	fakeTools(t, ffprobe, "")
+
+	i := Input{InputType: FILE, Name: "movie.mkv", MediaType: AUDIO, TrackDisposition: DISPOSITION_COMMENTARY}
+	i.resolveTrackSelectors()
+	if i.TrackNum != 1 {
+		t.Errorf("TrackNum = %d, want 1", i.TrackNum)
+	}
+
+	defer func() {
+		if _, ok := recover().(*MalformedField); !ok {
+			t.Errorf("an ambiguous selector should panic with a MalformedField")
+		}
+	}()
+
+	ambiguous := Input{InputType: FILE, Name: "movie.mkv", MediaType: AUDIO, TrackLanguage: "eng"}
+	ambiguous.resolveTrackSelectors()
+}
+
+func TestInput_expandAllTracks(t *testing.T) {
+	// A stand-in for ffprobe which describes a film with cover art, a
+	// commentary track, an untagged track and bitmap subtitles.
+	ffprobe := `#!/bin/sh
+case "$*" in
+  *json*) cat <<'JSON'
+{"streams": [
+  {"codec_type": "video", "codec_name": "h264", "disposition": {"attached_pic": 0}},
+  {"codec_type": "audio", "codec_name": "aac", "tags": {"language": "fra"}, "disposition": {"default": 1}},
+  {"codec_type": "audio", "codec_name": "aac", "tags": {"language": "fra"}, "disposition": {"comment": 1}},
+  {"codec_type": "audio", "codec_name": "ac3", "disposition": {}},
+  {"codec_type": "subtitle", "codec_name": "hdmv_pgs_subtitle", "tags": {"language": "eng"}},
+  {"codec_type": "subtitle", "codec_name": "subrip", "tags": {"language": "eng"}},
+  {"codec_type": "video", "codec_name": "mjpeg", "disposition": {"attached_pic": 1}},
+  {"codec_type": "data", "codec_name": "bin_data"}
+]}
+JSON
+  ;;
+  *a:2*stream_tags=language*) echo "" ;;
+  *s:1*stream_tags=language*) echo "eng" ;;
+  *stream_tags=language*) echo "fra" ;;
+  *width,height*) echo "1920|1080" ;;
+  *avg_frame_rate*) echo "30/1" ;;
+  *field_order*) echo "progressive" ;;
+  *channels*) echo "2" ;;
+  *) echo "0" ;;
+esac
+`
+	fakeTools(t, ffprobe, "")
+
+	type track struct {
+		MediaType MediaType
+		TrackNum  int
+		Language  string
+		Filters   []string
+	}
+
+	tests := []struct {
+		name      string
+		allTracks AllTracksConfig
+		want      []track
+	}{
+		{
+			name: "Every usable track",
+			want: []track{
+				{VIDEO, 0, "", nil},
+				{AUDIO, 0, "fra", nil},
+				{AUDIO, 1, "fra", nil},
+				{AUDIO, 2, "deu", nil},
+				{TEXT, 1, "eng", nil},
+			},
+		},
+		{
+			name: "Filtered",
+			allTracks: AllTracksConfig{
+				MediaTypes:       []MediaType{VIDEO, AUDIO},
+				SkipLanguages:    []string{"und"},
+				SkipDispositions: []TrackDisposition{DISPOSITION_COMMENTARY},
+				VideoFilters:     []string{"hflip"},
+				AudioFilters:     []string{"volume=2"},
+			},
+			want: []track{
+				{VIDEO, 0, "", []string{"hflip"}},
+				{AUDIO, 0, "fra", []string{"volume=2"}},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			input := Input{InputType: FILE, Name: "movie.mkv", MediaType: ALL, Language: "deu", AllTracks: tt.allTracks}
+
+			var got []track
+			for _, i := range input.expandAllTracks() {
+				got = append(got, track{i.MediaType, i.TrackNum, i.Language, i.Filters})
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("expandAllTracks() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInput_Pid(t *testing.T) {
+	tests := []struct {
+		pid      int
+		wantFail bool
+	}{
+		{pid: 0},
+		{pid: 256},
+		{pid: 0x1fff},
+		{pid: 0x2000, wantFail: true},
+		{pid: -1, wantFail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.pid), func(t *testing.T) {
+			defer func() {
+				_, malformed := recover().(*MalformedField)
+				if malformed != tt.wantFail {
+					t.Errorf("SetDefaults() failed = %v, want %v", malformed, tt.wantFail)
+				}
+			}()
+
+			i := Input{InputType: GENERATOR, Name: "sine", MediaType: AUDIO, Pid: tt.pid}
+			i.SetDefaults()
+		})
+	}
+}
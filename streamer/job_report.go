@@ -0,0 +1,147 @@
+// A module for the JSON report of what a job detected and decided.
+package streamer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The crop of a video input.
+type CropReport struct {
+	// The rectangle which is kept.
+	Width  int `json:"width"`
+	Height int `json:"height"`
+	X      int `json:"x"`
+	Y      int `json:"y"`
+
+	// True if the rectangle was detected, rather than configured.
+	Auto bool `json:"auto"`
+
+	// The samples the detected rectangle was chosen from.
+	Samples []CropSample `json:"samples,omitempty"`
+}
+
+// What was detected and decided for one input.
+type InputReport struct {
+	Name      string    `json:"name"`
+	MediaType MediaType `json:"media_type"`
+	TrackNum  int       `json:"track_num"`
+	Language  string    `json:"language,omitempty"`
+	FrameRate float64   `json:"frame_rate,omitempty"`
+	// True if the frame rate of the input was variable, and made constant.
+	VariableFrameRate bool                `json:"variable_frame_rate,omitempty"`
+	AvOffset          string              `json:"av_offset,omitempty"`
+	Resolution        VideoResolutionName `json:"resolution,omitempty"`
+	// How far the picture is turned clockwise, by its metadata, to show it.
+	Rotation int         `json:"rotation,omitempty"`
+	Crop     *CropReport `json:"crop,omitempty"`
+}
+
+// A report of a job, written as JSON to the output location.
+type JobReport struct {
+	// When the job started.
+	StartTime time.Time `json:"start_time"`
+
+	// The inputs of each period, in order.  Without a multiperiod inputs list,
+	// there is one period.
+	Periods [][]InputReport `json:"periods"`
+
+	// The quality of the video renditions, once they have been measured.
+	Quality *QualityReport `json:"quality,omitempty"`
+}
+
+// Creates a report of the inputs of a job, as configured and detected before
+// anything runs.
+func NewJobReport(inputConfig InputConfig) *JobReport {
+	report := &JobReport{StartTime: time.Now().UTC()}
+
+	if len(inputConfig.Inputs) > 0 {
+		report.Periods = append(report.Periods, newInputReports(inputConfig.Inputs))
+	}
+
+	for _, period := range inputConfig.MultiPeriodInputsList {
+		report.Periods = append(report.Periods, newInputReports(period.Inputs))
+	}
+
+	return report
+}
+
+func newInputReports(inputs []Input) []InputReport {
+	reports := []InputReport{}
+	for _, input := range inputs {
+		reports = append(reports, newInputReport(input))
+	}
+
+	return reports
+}
+
+func newInputReport(input Input) InputReport {
+	report := InputReport{
+		Name:      input.Name,
+		MediaType: input.MediaType,
+		TrackNum:  input.TrackNum,
+		AvOffset:  input.AvOffset,
+	}
+
+	if input.MediaType == VIDEO {
+		report.FrameRate = input.FrameRate
+		report.VariableFrameRate = input.IsVariableFrameRate
+		report.Resolution = input.Resolution
+		report.Rotation = input.display.Rotation
+	} else {
+		report.Language = input.Language
+	}
+
+	if crop := input.Processing.Crop; crop.Width > 0 && crop.Height > 0 {
+		report.Crop = &CropReport{
+			Width:   crop.Width,
+			Height:  crop.Height,
+			Auto:    crop.Auto,
+			Samples: crop.samples,
+		}
+
+		// A configured rectangle may be centered, in which case its position is
+		// only known to FFmpeg.
+		if crop.X != nil {
+			report.Crop.X = *crop.X
+		}
+		if crop.Y != nil {
+			report.Crop.Y = *crop.Y
+		}
+	}
+
+	return report
+}
+
+// Writes the report as indented JSON, replacing any earlier one.
+func (r *JobReport) Write(path string) error {
+	contents, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	temp, err := os.CreateTemp(filepath.Dir(path), ".job-report-*.json")
+	if err != nil {
+		return err
+	}
+
+	defer os.Remove(temp.Name())
+
+	if _, err := temp.Write(append(contents, '\n')); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Chmod(0644); err != nil {
+		temp.Close()
+		return err
+	}
+
+	if err := temp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(temp.Name(), path)
+}
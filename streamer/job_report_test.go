@@ -0,0 +1,58 @@
+package streamer
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestJobReport_Write(t *testing.T) {
+	x, y := 0, 140
+	inputConfig := InputConfig{
+		Inputs: []Input{
+			{
+				Name:       "film.mkv",
+				MediaType:  VIDEO,
+				FrameRate:  24,
+				Resolution: "1080p",
+				Processing: VideoProcessingConfig{Crop: CropConfig{
+					Width: 1920, Height: 800, X: &x, Y: &y, Auto: true, detected: true,
+					samples: []CropSample{{Time: 10, Width: 1920, Height: 800, X: 0, Y: 140}},
+				}},
+			},
+			{Name: "film.mkv", MediaType: AUDIO, Language: "eng"},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "job_report.json")
+	if err := NewJobReport(inputConfig).Write(path); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report JobReport
+	if err := json.Unmarshal(contents, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	want := [][]InputReport{{
+		{
+			Name: "film.mkv", MediaType: VIDEO, FrameRate: 24, Resolution: "1080p",
+			Crop: &CropReport{
+				Width: 1920, Height: 800, X: 0, Y: 140, Auto: true,
+				Samples: []CropSample{{Time: 10, Width: 1920, Height: 800, X: 0, Y: 140}},
+			},
+		},
+		{Name: "film.mkv", MediaType: AUDIO, Language: "eng"},
+	}}
+
+	if !reflect.DeepEqual(report.Periods, want) {
+		t.Errorf("Periods = %+v, want %+v", report.Periods, want)
+	}
+}
@@ -0,0 +1,432 @@
+// A module that segments live text from a command or an HTTP API for the packager.
+package streamer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A cue pushed to an input with input_type 'cue_api'.
+type LiveCue struct {
+	// The text of the cue.  It is shown as plain text, not WebVTT markup.
+	Text string `json:"text"`
+
+	/*
+		The start time, in seconds since the stream started.
+
+			If unspecified, the cue starts when it is received.
+	*/
+	Start *float64 `json:"start"`
+
+	// How long the cue is shown, in seconds.
+	Duration float64 `json:"duration"`
+
+	// The WebVTT cue settings, such as "line:0 align:left".
+	Settings string `json:"settings"`
+}
+
+/*
+Writes live cues to a named pipe as one continuous WebVTT stream, which
+Shaka Packager cuts into segments of segment_size.
+
+	The cues come from an external command, which writes WebVTT to the path in
+	$SHAKA_STREAMER_EXTERNAL_COMMAND_OUTPUT, or from HTTP requests to a cue API.
+	Cue times are in seconds since the node started.
+
+	The packager only ends a text segment when a later cue starts, so a
+	segment with no cues of its own gets an empty one, which shows nothing but
+	keeps the live manifests moving.
+*/
+type LiveTextNode struct {
+	NodeBase
+	input       Input
+	output      string
+	source      string
+	segmentSize float64
+	cues        chan SubtitleCue
+	done        chan struct{}
+	server      *http.Server
+	startTime   time.Time
+	mu          sync.Mutex
+	stopped     bool
+	Status      ProcessStatus
+}
+
+/*
+Creates a node which writes the text of an input to output.
+
+	An external command writes to a pipe created in tempDir.
+*/
+func NewLiveTextNode(input Input, tempDir string, output string, segmentSize float64) *LiveTextNode {
+	n := &LiveTextNode{
+		input:       input,
+		output:      output,
+		segmentSize: segmentSize,
+		cues:        make(chan SubtitleCue, 100),
+		done:        make(chan struct{}),
+		Status:      Finished,
+	}
+
+	if input.InputType == EXTERNAL_COMMAND {
+		pipe := NewPipe()
+		pipe.CreateIpcPipe(tempDir, ".vtt")
+		n.source = pipe.ReadEnd()
+	}
+
+	return n
+}
+
+func (n *LiveTextNode) Start() {
+	n.startTime = time.Now()
+	n.Status = Running
+
+	if n.input.InputType == CUE_API {
+		n.startServer()
+	} else {
+		n.Process = n.CreateProcess(BaseParams{
+			args:     []string{"sh", "-c", n.input.Name},
+			env:      map[string]string{"SHAKA_STREAMER_EXTERNAL_COMMAND_OUTPUT": n.source},
+			mergeEnv: true,
+			stdout:   os.Stdout,
+			stderr:   os.Stderr,
+		})
+
+		go n.readCommand()
+
+		go func() {
+			n.Process.Wait()
+
+			// If the command exits without ever opening the pipe, the reader is
+			// still waiting for it, so open it here instead.
+			if pipe, err := os.OpenFile(n.source, os.O_WRONLY|syscall.O_NONBLOCK, 0); err == nil {
+				pipe.Close()
+			}
+		}()
+	}
+
+	go n.run()
+}
+
+func (n *LiveTextNode) CheckStatus() ProcessStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.Status
+}
+
+func (n *LiveTextNode) Stop() {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return
+	}
+
+	n.stopped = true
+	close(n.done)
+	n.mu.Unlock()
+
+	if n.server != nil {
+		n.server.Close()
+	}
+
+	killProcessGroup(n.Process)
+}
+
+func (n *LiveTextNode) finish(status ProcessStatus) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Status = status
+}
+
+// Returns the number of seconds since the node started.
+func (n *LiveTextNode) elapsed() float64 {
+	return time.Since(n.startTime).Seconds()
+}
+
+// Listens for cues on the URL in the input's name.
+func (n *LiveTextNode) startServer() {
+	u, err := url.Parse(n.input.Name)
+	if err != nil || u.Scheme != "http" || u.Host == "" {
+		panic(fmt.Sprintf("%q is not a valid cue API URL. Use http://HOST:PORT/PATH.", n.input.Name))
+	}
+
+	listener, err := net.Listen("tcp", u.Host)
+	if err != nil {
+		panic(fmt.Sprintf("failed to listen for cues on %s: %v", u.Host, err))
+	}
+
+	path := u.Path
+	if path == "" {
+		path = "/"
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(path, n.handleCues)
+	n.server = &http.Server{Handler: mux}
+
+	go n.server.Serve(listener)
+}
+
+// Accepts a JSON cue, or an array of them.
+func (n *LiveTextNode) handleCues(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "cues must be POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var cues []LiveCue
+	if trimmed := strings.TrimSpace(string(body)); strings.HasPrefix(trimmed, "[") {
+		err = json.Unmarshal(body, &cues)
+	} else {
+		var cue LiveCue
+		err = json.Unmarshal(body, &cue)
+		cues = []LiveCue{cue}
+	}
+
+	if err != nil {
+		http.Error(w, fmt.Sprintf("malformed cue: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	now := n.elapsed()
+	for _, cue := range cues {
+		if cue.Duration <= 0 {
+			http.Error(w, "every cue needs a positive duration", http.StatusBadRequest)
+			return
+		}
+	}
+
+	for _, cue := range cues {
+		start := now
+		if cue.Start != nil {
+			start = *cue.Start
+		}
+
+		n.push(SubtitleCue{
+			Start:    start,
+			End:      start + cue.Duration,
+			Text:     escapeWebVtt(cue.Text),
+			Settings: cue.Settings,
+		})
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// Queues a cue to be written, unless the node has stopped.
+func (n *LiveTextNode) push(cue SubtitleCue) {
+	select {
+	case n.cues <- cue:
+	case <-n.done:
+	}
+}
+
+// Reads the WebVTT stream of the external command, until it exits.
+func (n *LiveTextNode) readCommand() {
+	defer close(n.cues)
+
+	source, err := os.Open(n.source)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the text of %s: %v\n", n.input.Name, err)
+		return
+	}
+
+	defer source.Close()
+
+	if err := ReadWebVttStream(source, n.push); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read the text of %s: %v\n", n.input.Name, err)
+	}
+}
+
+/*
+Reads a WebVTT stream, and calls handle with each cue as soon as it is
+complete.
+
+	Unlike ParseWebVtt, this doesn't wait for the end of the stream, so it can
+	read from a pipe which stays open.
+*/
+func ReadWebVttStream(r io.Reader, handle func(SubtitleCue)) error {
+	scanner := bufio.NewScanner(r)
+	lineNum := 0
+	// The block of lines since the last blank one, and the number of its first line.
+	var block []string
+	blockStart := 0
+
+	flush := func() error {
+		defer func() { block = nil }()
+
+		for num, line := range block {
+			if !strings.Contains(line, "-->") {
+				// The cue identifier, or a block which isn't a cue.
+				continue
+			}
+
+			match := webVttTimingPattern.FindStringSubmatch(line)
+			if match == nil {
+				return &SubtitleParseError{Line: blockStart + num, Message: fmt.Sprintf("malformed cue timing %q", line)}
+			}
+
+			handle(SubtitleCue{
+				Start:    parseCueTime(match[1]),
+				End:      parseCueTime(match[2]),
+				Settings: strings.TrimSpace(match[3]),
+				Text:     strings.Join(block[num+1:], "\n"),
+			})
+			return nil
+		}
+
+		return nil
+	}
+
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		lineNum++
+
+		if lineNum == 1 {
+			if !strings.HasPrefix(strings.TrimPrefix(line, "\uFEFF"), "WEBVTT") {
+				return &SubtitleParseError{Line: 1, Message: `a WebVTT stream must start with "WEBVTT"`}
+			}
+
+			continue
+		}
+
+		if strings.TrimSpace(line) != "" {
+			if len(block) == 0 {
+				blockStart = lineNum
+			}
+
+			block = append(block, line)
+			continue
+		}
+
+		// Each block runs until a blank line.
+		if err := flush(); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return flush()
+}
+
+// Writes a cue to the WebVTT stream.  A cue with no text is written as well,
+// to mark the passing of time.
+func writeLiveCue(w io.Writer, cue SubtitleCue) error {
+	timing := formatWebVttTime(cue.Start) + " --> " + formatWebVttTime(cue.End)
+	if cue.Settings != "" {
+		timing += " " + cue.Settings
+	}
+
+	var lines []string
+	for _, line := range strings.Split(cue.Text, "\n") {
+		// A blank line would end the cue early.
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, strings.ReplaceAll(line, "-->", "--&gt;"))
+		}
+	}
+
+	if len(lines) == 0 {
+		_, err := fmt.Fprintf(w, "%s\n\n", timing)
+		return err
+	}
+
+	_, err := fmt.Fprintf(w, "%s\n%s\n\n", timing, strings.Join(lines, "\n"))
+	return err
+}
+
+func (n *LiveTextNode) run() {
+	// This blocks until the packager opens the pipe.
+	output, err := os.OpenFile(n.output, os.O_WRONLY, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open the text output for %s: %v\n", n.input.Name, err)
+		n.finish(Errored)
+		return
+	}
+
+	defer output.Close()
+
+	if _, err := io.WriteString(output, "WEBVTT\n\n"); err != nil {
+		n.finish(Errored)
+		return
+	}
+
+	// Cues must be written in order of their start times, so a late cue
+	// starts when the last one did.
+	lastStart := 0.0
+	// The last segment in which a cue starts.
+	lastSegment := -1
+
+	ticker := time.NewTicker(time.Duration(n.segmentSize * float64(time.Second)))
+	defer ticker.Stop()
+
+	for {
+		var cue SubtitleCue
+
+		select {
+		case <-n.done:
+			n.finish(Finished)
+			return
+
+		case received, ok := <-n.cues:
+			if !ok {
+				// The command exited.
+				n.finish(Finished)
+				return
+			}
+
+			cue = received
+			cue.Start = math.Max(cue.Start, lastStart)
+
+		case <-ticker.C:
+			// Fill the last finished segment, if no cue starts in it.
+			segment := int(n.elapsed()/n.segmentSize) - 1
+			if segment <= lastSegment {
+				continue
+			}
+
+			cue = SubtitleCue{
+				Start: math.Max(float64(segment)*n.segmentSize, lastStart),
+				End:   float64(segment+1) * n.segmentSize,
+			}
+		}
+
+		if cue.End <= cue.Start {
+			// The cue is over before it can be shown.
+			continue
+		}
+
+		if err := writeLiveCue(output, cue); err != nil {
+			// The packager is gone, so there is nobody left to write to.
+			fmt.Fprintf(os.Stderr, "Failed to write the text of %s: %v\n", n.input.Name, err)
+			n.finish(Errored)
+			return
+		}
+
+		lastStart = cue.Start
+		if segment := int(cue.Start / n.segmentSize); segment > lastSegment {
+			lastSegment = segment
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package streamer
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadWebVttStream(t *testing.T) {
+	stream := "WEBVTT\n\n1\n00:00:01.000 --> 00:00:02.500 line:0\nHello\nworld\n\nNOTE a comment\n\n00:03.000 --> 00:04.000\nLast"
+
+	var got []SubtitleCue
+	if err := ReadWebVttStream(strings.NewReader(stream), func(cue SubtitleCue) { got = append(got, cue) }); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []SubtitleCue{
+		{Start: 1, End: 2.5, Text: "Hello\nworld", Settings: "line:0"},
+		{Start: 3, End: 4, Text: "Last"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadWebVttStream() = %v, want %v", got, want)
+	}
+
+	err := ReadWebVttStream(strings.NewReader("WEBVTT\n\n00:01 --> 00:02\nBad\n"), func(SubtitleCue) {})
+	if parseErr, ok := err.(*SubtitleParseError); !ok || parseErr.Line != 3 {
+		t.Errorf("ReadWebVttStream() error = %v, want a SubtitleParseError on line 3", err)
+	}
+}
+
+// Waits for a node to stop running.
+func waitForLiveText(t *testing.T, node *LiveTextNode) {
+	deadline := time.Now().Add(5 * time.Second)
+	for node.CheckStatus() == Running {
+		if time.Now().After(deadline) {
+			t.Fatal("the node did not finish")
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestLiveTextNode_CueApi(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	output := filepath.Join(t.TempDir(), "text.vtt")
+	if err := os.WriteFile(output, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	url := "http://" + address + "/cues"
+	node := NewLiveTextNode(Input{InputType: CUE_API, Name: url, MediaType: TEXT}, t.TempDir(), output, 0.2)
+	node.Start()
+
+	requests := []struct {
+		method string
+		body   string
+		want   int
+	}{
+		{http.MethodPost, `[{"text": "Hello <world>", "start": 0.05, "duration": 1}]`, http.StatusNoContent},
+		{http.MethodPost, `{"text": "No duration"}`, http.StatusBadRequest},
+		{http.MethodGet, "", http.StatusMethodNotAllowed},
+	}
+
+	for _, request := range requests {
+		req, _ := http.NewRequest(request.method, url, strings.NewReader(request.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != request.want {
+			t.Errorf("%s %s: status = %d, want %d", request.method, request.body, resp.StatusCode, request.want)
+		}
+	}
+
+	// Give the node time to fill a segment without cues.
+	time.Sleep(700 * time.Millisecond)
+	node.Stop()
+	waitForLiveText(t, node)
+
+	contents, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := string(contents)
+	if !strings.HasPrefix(got, "WEBVTT\n\n") {
+		t.Errorf("the stream should start with a WebVTT header, got %q", got)
+	}
+
+	if !strings.Contains(got, "00:00:00.050 --> 00:00:01.050\nHello &lt;world&gt;\n\n") {
+		t.Errorf("the stream should contain the pushed cue, got %q", got)
+	}
+
+	if !regexp.MustCompile(`--> \d{2}:\d{2}:\d{2}\.\d{3}\n\n`).MatchString(got) {
+		t.Errorf("the stream should contain an empty cue for a quiet segment, got %q", got)
+	}
+}
+
+func TestLiveTextNode_ExternalCommand(t *testing.T) {
+	output := filepath.Join(t.TempDir(), "text.vtt")
+	if err := os.WriteFile(output, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	command := `printf 'WEBVTT\n\n00:00:00.000 --> 00:00:01.000\nHi\n\n' > "$SHAKA_STREAMER_EXTERNAL_COMMAND_OUTPUT"`
+	node := NewLiveTextNode(Input{InputType: EXTERNAL_COMMAND, Name: command, MediaType: TEXT}, t.TempDir(), output, 2)
+	node.Start()
+	waitForLiveText(t, node)
+
+	if status := node.CheckStatus(); status != Finished {
+		t.Errorf("CheckStatus() = %v, want Finished once the command exits", status)
+	}
+
+	contents, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := "WEBVTT\n\n00:00:00.000 --> 00:00:01.000\nHi\n\n"; string(contents) != want {
+		t.Errorf("output = %q, want %q", contents, want)
+	}
+}
@@ -0,0 +1,284 @@
+// A module that serves the output folder over HTTP, for previews and small deployments.
+package streamer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// MIME types of the files written by Shaka Packager and the transcoder.
+var OUTPUT_MIME_TYPES = map[string]string{
+	".mpd":  "application/dash+xml",
+	".m3u8": "application/vnd.apple.mpegurl",
+	".m4s":  "video/iso.segment",
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".m4a":  "audio/mp4",
+	".webm": "video/webm",
+	".ts":   "video/mp2t",
+	".aac":  "audio/aac",
+	".vtt":  "text/vtt",
+	".ttml": "application/ttml+xml",
+}
+
+// Matches the segment number at the end of a segment file name, such as
+// "video_1080p_4M_h264_12.mp4".
+var segmentNumberRegex = regexp.MustCompile(`^(.*_)(\d+)(\.[^.]+)$`)
+
+// Serves the output folder over HTTP with the headers players expect.
+type OriginServerNode struct {
+	outputDir string
+	address   string
+
+	/*
+		How recently a segment must have been modified to be considered in
+		  progress.  In-progress segments are streamed with chunked transfer
+		  encoding as the packager writes them, which is what makes
+		  low_latency_dash_mode actually low latency.
+	*/
+	inProgressWindow time.Duration
+
+	// How long an in-progress segment may stop growing before it is considered
+	// complete.
+	idleTimeout time.Duration
+
+	// How often an in-progress segment is checked for new data.
+	pollInterval time.Duration
+
+	mu     sync.Mutex
+	server *http.Server
+	Status ProcessStatus
+}
+
+func NewOriginServerNode(outputDir string, address string) *OriginServerNode {
+	return &OriginServerNode{
+		outputDir:        outputDir,
+		address:          address,
+		inProgressWindow: 2 * time.Second,
+		idleTimeout:      2 * time.Second,
+		pollInterval:     20 * time.Millisecond,
+		Status:           Finished,
+	}
+}
+
+// Returns the HTTP handler for the output folder and the UTC timing endpoint.
+func (s *OriginServerNode) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle(UTC_TIMING_PATH, UtcTimingHandler())
+	mux.Handle(UTC_TIMING_PATH+"/", UtcTimingHandler())
+	mux.HandleFunc("/", s.serveOutput)
+
+	return withCors(mux)
+}
+
+// Serves until the server is stopped or fails.
+func (s *OriginServerNode) ListenAndServe() error {
+	server := &http.Server{
+		Addr:    s.address,
+		Handler: s.Handler(),
+	}
+
+	s.mu.Lock()
+	s.server = server
+	s.Status = Running
+	s.mu.Unlock()
+
+	err := server.ListenAndServe()
+
+	if err == http.ErrServerClosed {
+		s.setStatus(Finished)
+		return nil
+	}
+
+	s.setStatus(Errored)
+	return err
+}
+
+func (s *OriginServerNode) setStatus(status ProcessStatus) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Status = status
+}
+
+func (s *OriginServerNode) Start() {
+	s.setStatus(Running)
+
+	go func() {
+		if err := s.ListenAndServe(); err != nil {
+			fmt.Fprintf(os.Stderr, "Origin server failed: %v\n", err)
+		}
+	}()
+}
+
+func (s *OriginServerNode) CheckStatus() ProcessStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Status
+}
+
+func (s *OriginServerNode) Stop() {
+	s.mu.Lock()
+	server := s.server
+	s.mu.Unlock()
+
+	if server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		server.Shutdown(ctx)
+	}
+
+	s.setStatus(Finished)
+}
+
+// Adds the CORS headers needed by browser-based players on other origins.
+func withCors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header := w.Header()
+		header.Set("Access-Control-Allow-Origin", "*")
+		header.Set("Access-Control-Allow-Methods", "GET, HEAD, OPTIONS")
+		header.Set("Access-Control-Allow-Headers", "Range, Content-Type, Origin, Accept")
+		header.Set("Access-Control-Expose-Headers", "Content-Length, Content-Range, Date")
+
+		if r.Method == http.MethodOptions {
+			// Preflight request.
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *OriginServerNode) serveOutput(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Cleaning a rooted path removes any ".." that would escape the output dir.
+	urlPath := path.Clean("/" + r.URL.Path)
+	filePath := filepath.Join(s.outputDir, filepath.FromSlash(urlPath))
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+
+	ext := filepath.Ext(filePath)
+	if mimeType, ok := OUTPUT_MIME_TYPES[ext]; ok {
+		w.Header().Set("Content-Type", mimeType)
+	}
+
+	if ext == ".mpd" || ext == ".m3u8" {
+		// Manifests are rewritten constantly in live streams.
+		w.Header().Set("Cache-Control", "no-store, no-transform")
+	}
+
+	if r.Method == http.MethodGet && r.Header.Get("Range") == "" && s.isInProgress(filePath, info) {
+		s.streamInProgress(w, f, filePath)
+		return
+	}
+
+	// ServeContent takes care of range requests and conditional requests.
+	http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+}
+
+// Returns true if the packager may still be writing this segment.
+func (s *OriginServerNode) isInProgress(filePath string, info os.FileInfo) bool {
+	if time.Since(info.ModTime()) > s.inProgressWindow {
+		return false
+	}
+
+	// Only numbered segments are written progressively.  Once the next segment
+	// exists, this one is complete.
+	nextPath, ok := nextSegmentPath(filePath)
+	return ok && !FileExists(nextPath)
+}
+
+/*
+Streams a segment while the packager is still writing it.
+
+	No Content-Length is sent, so the response uses chunked transfer encoding.
+	Data is flushed to the client as soon as it is written to disk, until the
+	next segment appears or the file stops growing.
+*/
+func (s *OriginServerNode) streamInProgress(w http.ResponseWriter, f *os.File, filePath string) {
+	flusher, _ := w.(http.Flusher)
+	nextPath, _ := nextSegmentPath(filePath)
+	buf := make([]byte, 64*1024)
+	lastGrowth := time.Now()
+
+	w.WriteHeader(http.StatusOK)
+
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			if _, err := w.Write(buf[:n]); err != nil {
+				// The client went away.
+				return
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			lastGrowth = time.Now()
+			continue
+		}
+
+		if err != nil && err != io.EOF {
+			return
+		}
+
+		if FileExists(nextPath) {
+			// The segment is complete.  Send whatever was written since the
+			// last read.
+			io.Copy(w, f)
+			return
+		}
+
+		if time.Since(lastGrowth) > s.idleTimeout {
+			return
+		}
+
+		time.Sleep(s.pollInterval)
+	}
+}
+
+// Returns the path of the segment that follows this one, if this is a
+// numbered segment.
+func nextSegmentPath(filePath string) (string, bool) {
+	dir, name := filepath.Split(filePath)
+	match := segmentNumberRegex.FindStringSubmatch(name)
+	if match == nil {
+		return "", false
+	}
+
+	number, err := strconv.Atoi(match[2])
+	if err != nil {
+		return "", false
+	}
+
+	return filepath.Join(dir, match[1]+strconv.Itoa(number+1)+match[3]), true
+}
@@ -0,0 +1,135 @@
+package streamer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestOriginServerNode_Handler(t *testing.T) {
+	outputDir := t.TempDir()
+	os.WriteFile(filepath.Join(outputDir, "dash.mpd"), []byte("<MPD/>"), 0644)
+	os.WriteFile(filepath.Join(outputDir, "video_1080p_4M_h264_1.mp4"), []byte("0123456789"), 0644)
+	os.WriteFile(filepath.Join(outputDir, "video_1080p_4M_h264_2.mp4"), []byte("abc"), 0644)
+
+	server := httptest.NewServer(NewOriginServerNode(outputDir, "").Handler())
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		rangeHeader string
+		wantStatus  int
+		wantType    string
+		wantBody    string
+	}{
+		{
+			name:       "Manifest",
+			method:     http.MethodGet,
+			path:       "/dash.mpd",
+			wantStatus: http.StatusOK,
+			wantType:   "application/dash+xml",
+			wantBody:   "<MPD/>",
+		},
+		{
+			name:        "Range request",
+			method:      http.MethodGet,
+			path:        "/video_1080p_4M_h264_1.mp4",
+			rangeHeader: "bytes=2-5",
+			wantStatus:  http.StatusPartialContent,
+			wantType:    "video/mp4",
+			wantBody:    "2345",
+		},
+		{
+			name:       "Preflight",
+			method:     http.MethodOptions,
+			path:       "/dash.mpd",
+			wantStatus: http.StatusNoContent,
+		},
+		{
+			name:       "Missing file",
+			method:     http.MethodGet,
+			path:       "/missing.mp4",
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:       "Outside of the output folder",
+			method:     http.MethodGet,
+			path:       "/../origin_server.go",
+			wantStatus: http.StatusNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+			if tt.rangeHeader != "" {
+				req.Header.Set("Range", tt.rangeHeader)
+			}
+
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %v, want %v", resp.StatusCode, tt.wantStatus)
+			}
+
+			if got := resp.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, "*")
+			}
+
+			if tt.wantType != "" && resp.Header.Get("Content-Type") != tt.wantType {
+				t.Errorf("Content-Type = %v, want %v", resp.Header.Get("Content-Type"), tt.wantType)
+			}
+
+			if tt.wantBody != "" && string(body) != tt.wantBody {
+				t.Errorf("body = %q, want %q", body, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestOriginServerNode_InProgressSegment(t *testing.T) {
+	outputDir := t.TempDir()
+	segment := filepath.Join(outputDir, "audio_eng_2c_128k_aac_7.mp4")
+	os.WriteFile(segment, []byte("first"), 0644)
+
+	server := httptest.NewServer(NewOriginServerNode(outputDir, "").Handler())
+	defer server.Close()
+
+	// Keep writing the segment while it is being served, then start the next one.
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		f, _ := os.OpenFile(segment, os.O_APPEND|os.O_WRONLY, 0644)
+		f.WriteString("-second")
+		f.Close()
+		time.Sleep(100 * time.Millisecond)
+		os.WriteFile(filepath.Join(outputDir, "audio_eng_2c_128k_aac_8.mp4"), []byte{}, 0644)
+	}()
+
+	resp, err := http.Get(server.URL + "/audio_eng_2c_128k_aac_7.mp4")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+
+	if want := "first-second"; string(body) != want {
+		t.Errorf("body = %q, want %q", body, want)
+	}
+
+	if len(resp.TransferEncoding) == 0 || resp.TransferEncoding[0] != "chunked" {
+		t.Errorf("TransferEncoding = %v, want chunked", resp.TransferEncoding)
+	}
+}
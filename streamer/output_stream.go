@@ -163,6 +163,11 @@ func NewAudioOutputStream(i Input, pipeDir string, c *AudioCodec, l AudioChannel
 	features["format"] = c.GetOutputFormat()
 	features["codec"] = string(c.Name)
 
+	if c.Passthrough {
+		// A copy keeps the bitrate of the input, which isn't known.
+		features["bitrate"] = "copy"
+	}
+
 	s := NewOutputStream(AUDIO, i, c, pipeDir, false, "")
 	s.Features = features
 
@@ -173,8 +178,12 @@ func NewAudioOutputStream(i Input, pipeDir string, c *AudioCodec, l AudioChannel
 	}
 }
 
-// Returns the bitrate for this stream.
+// Returns the bitrate for this stream, or nothing for a copy.
 func (a AudioOutputStream) GetBitrate() string {
+	if a.Codec.Passthrough {
+		return ""
+	}
+
 	return string(a.Layout.Bitrates[a.Codec.Name])
 }
 
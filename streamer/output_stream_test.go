@@ -74,3 +74,89 @@ func TestOutputStream_GetMediaSegFile(t *testing.T) {
 		})
 	}
 }
+
+func TestOutputStream_OutputFormat(t *testing.T) {
+	pipelineConfig := PipelineConfig{
+		AudioCodecs:  []AudioCodecName{OPUS, AAC},
+		VideoCodecs:  []VideoCodecName{VP9, AV1},
+		OutputFormat: map[string]OutputFormat{"opus": OUTPUT_FORMAT_MP4, "vp9": OUTPUT_FORMAT_MP4},
+	}
+
+	vi := Input{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, Resolution: "720p"}
+	ai := Input{InputType: FILE, Name: "talk.mp4", MediaType: AUDIO, Language: "eng", ChannelLayout: "stereo"}
+
+	resolution := *NewBitrateConfig().GetResolutionValue("720p")
+	resolution.Name = "720p"
+	layout := *NewBitrateConfig().GetChannelLayoutValue("stereo")
+
+	var streams []MediaOutputStream
+	for _, codec := range pipelineConfig.GetAudioCodecs() {
+		streams = append(streams, NewAudioOutputStream(ai, t.TempDir(), codec, layout))
+	}
+	for _, codec := range pipelineConfig.GetVideoCodecs() {
+		streams = append(streams, NewVideoOutputStream(vi, t.TempDir(), codec, resolution))
+	}
+
+	tests := []struct {
+		want     string
+		dashOnly bool
+	}{
+		{want: "audio_eng_2c_64k_opus.mp4"},
+		{want: "audio_eng_2c_128k_aac.mp4"},
+		{want: "video_720p_1M_vp9.mp4"},
+		// AV1 keeps the default of its codec.
+		{want: "video_720p_512k_av1.mp4"},
+	}
+
+	for i, tt := range tests {
+		t.Run(tt.want, func(t *testing.T) {
+			single := streams[i].GetSingleSegFile()
+			if got := single.WriteEnd(); got != tt.want {
+				t.Errorf("GetSingleSegFile() = %v, want %v", got, tt.want)
+			}
+
+			if got := streams[i].IsDashOnly(); got != tt.dashOnly {
+				t.Errorf("IsDashOnly() = %v, want %v", got, tt.dashOnly)
+			}
+		})
+	}
+
+	// Without a setting, VP9 is packaged in WebM, for DASH only.
+	webm := NewVideoOutputStream(vi, t.TempDir(), NewVideoCodec(VP9), resolution)
+	if single := webm.GetSingleSegFile(); single.WriteEnd() != "video_720p_1M_vp9.webm" || !webm.IsDashOnly() {
+		t.Errorf("VP9 is in %s, and DASH only = %v", single.WriteEnd(), webm.IsDashOnly())
+	}
+
+	// A hardware encoder takes the container of its codec.
+	hardware := PipelineConfig{VideoCodecs: []VideoCodecName{"hw:vp9"}, OutputFormat: pipelineConfig.OutputFormat}
+	if format := hardware.GetVideoCodecs()[0].GetOutputFormat(); format != "mp4" {
+		t.Errorf("hw:vp9 is in %s, want mp4", format)
+	}
+}
+
+func Test_checkOutputFormat(t *testing.T) {
+	tests := []struct {
+		codec   string
+		format  OutputFormat
+		wantErr bool
+	}{
+		{codec: "vp9", format: OUTPUT_FORMAT_MP4},
+		{codec: "opus", format: OUTPUT_FORMAT_WEBM},
+		{codec: "h264", format: OUTPUT_FORMAT_WEBM, wantErr: true},
+		{codec: "aac", format: "ts", wantErr: true},
+		{codec: "vp8", format: OUTPUT_FORMAT_WEBM, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.codec+" in "+string(tt.format), func(t *testing.T) {
+			defer func() {
+				_, malformed := recover().(*MalformedField)
+				if malformed != tt.wantErr {
+					t.Errorf("checkOutputFormat() panicked = %v, want %v", malformed, tt.wantErr)
+				}
+			}()
+
+			checkOutputFormat(PipelineConfig{}, tt.codec, tt.format)
+		})
+	}
+}
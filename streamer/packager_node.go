@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func buildPath(outputLocation string, subPath string) string {
@@ -38,6 +39,10 @@ type PackagerNode struct {
 	OutputStreams  []MediaOutputStream
 	index          int
 	packager       string
+	// Closed when the node stops, to end the copying of the captioned manifests.
+	done chan struct{}
+	// Closed once the captioned manifests have been copied for the last time.
+	signalled chan struct{}
 }
 
 func NewPackagerNode(pipelineConfig PipelineConfig, outputLocation string, streams []MediaOutputStream, index int, hermeticPackager string) *PackagerNode {
@@ -110,6 +115,121 @@ func (pn *PackagerNode) Start() {
 
 	// start process
 	pn.Process = pn.CreateProcess(BaseParams{args: args, stdout: stdout})
+
+	if channels := pn.captionChannels(); len(channels) > 0 && !isUrl(pn.outputLocation) {
+		pn.done = make(chan struct{})
+		pn.signalled = make(chan struct{})
+		go pn.signalClosedCaptions(channels, pn.done, pn.signalled)
+	}
+}
+
+// Stop the packager, and signal the closed captions in its final manifests.
+func (pn *PackagerNode) Stop() {
+	pn.NodeBase.Stop()
+
+	if pn.done != nil {
+		close(pn.done)
+		<-pn.signalled
+		pn.done = nil
+	}
+}
+
+// Returns the closed caption channels passed through in the video streams,
+// which the packager doesn't signal on its own.
+func (pn PackagerNode) captionChannels() []CaptionChannel {
+	var channels []CaptionChannel
+	seen := map[string]bool{}
+
+	for _, stream := range pn.OutputStreams {
+		if !carriesClosedCaptions(stream) {
+			continue
+		}
+
+		for _, channel := range stream.GetInput().ClosedCaptions.GetChannels() {
+			if !seen[channel.Channel] {
+				seen[channel.Channel] = true
+				channels = append(channels, channel)
+			}
+		}
+	}
+
+	return channels
+}
+
+// Returns the local manifests the packager writes, with the function which
+// adds the closed captions to each.
+func (pn PackagerNode) captionedManifests() map[string]func(string, []CaptionChannel) (string, error) {
+	manifests := map[string]func(string, []CaptionChannel) (string, error){}
+
+	if containsManifestFormat(pn.pipelineConfig.ManifestFormat, DASH) {
+		manifests[filepath.Join(pn.outputLocation, pn.pipelineConfig.DashOutput)] = addClosedCaptionsToMpd
+	}
+
+	if containsManifestFormat(pn.pipelineConfig.ManifestFormat, HLS) {
+		manifests[filepath.Join(pn.outputLocation, pn.pipelineConfig.HlsOutput)] = addClosedCaptionsToMasterPlaylist
+	}
+
+	return manifests
+}
+
+/*
+Copies each manifest with the closed captions signalled whenever the packager
+writes it, until the node stops, and once more after that.
+
+	The manifests themselves are only read, since the packager keeps
+	rewriting them.
+*/
+func (pn PackagerNode) signalClosedCaptions(channels []CaptionChannel, done chan struct{}, signalled chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	defer close(signalled)
+
+	manifests := pn.captionedManifests()
+	copied := map[string]time.Time{}
+
+	for {
+		select {
+		case <-done:
+			for path, addClosedCaptions := range manifests {
+				pn.writeCaptionedManifest(path, channels, addClosedCaptions)
+			}
+
+			return
+		case <-ticker.C:
+			for path, addClosedCaptions := range manifests {
+				info, err := os.Stat(path)
+				if err != nil || info.ModTime().Equal(copied[path]) {
+					// The packager writes it once every stream has started.
+					continue
+				}
+
+				if pn.writeCaptionedManifest(path, channels, addClosedCaptions) {
+					copied[path] = info.ModTime()
+				}
+			}
+		}
+	}
+}
+
+// Writes the captioned copy of a manifest, and returns true if it succeeded.
+func (pn PackagerNode) writeCaptionedManifest(path string, channels []CaptionChannel, addClosedCaptions func(string, []CaptionChannel) (string, error)) bool {
+	if !FileExists(path) {
+		return false
+	}
+
+	if err := writeCaptionedManifest(path, channels, addClosedCaptions); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to signal the closed captions of %s: %v\n", path, err)
+		return false
+	}
+
+	return true
+}
+
+// Returns true if the stream is video whose encoder keeps the closed captions
+// passed through from its input.
+func carriesClosedCaptions(stream MediaOutputStream) bool {
+	videoStream, ok := stream.(*VideoOutputStream)
+	return ok && videoStream.GetInput().ClosedCaptions.Mode == CAPTIONS_PASSTHROUGH && videoStream.Codec.Name == H264
 }
 
 func (pn PackagerNode) setupStream(stream MediaOutputStream) string {
@@ -0,0 +1,372 @@
+// A module to fit the bitrate ladder of a VOD to its content.
+package streamer
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The options of a ladder fit to the content of each title.
+type PerTitleConfig struct {
+	/*
+		If true, the bitrates of the resolutions are chosen by trial encodes of
+		the video, before the real encode.
+
+		  Only valid for VOD.
+	*/
+	Enable bool `yaml:"enable"`
+
+	// The number of samples of the video to trial encode, spread along it.
+	Samples int `yaml:"samples" default:"3"`
+
+	// The length of each sample, in seconds.
+	SampleDuration float64 `yaml:"sample_duration" default:"10"`
+
+	/*
+		The CRFs to trial encode at, in the scale of each codec.
+
+		  The best quality which fits the bitrate of a resolution is chosen, and
+		  the bitrate is what that quality costs.  A resolution which can't fit
+		  any of them keeps its bitrate.
+
+		  Defaults to 4 below, at and 4 above the default CRF of each codec.
+	*/
+	CrfPoints []int `yaml:"crf_points"`
+
+	/*
+		The smallest ratio between the bitrates of neighbouring resolutions.
+
+		  A resolution which costs almost as much as the one above it adds
+		  little, and is dropped.  The smallest resolution is always kept.
+	*/
+	MinStep float64 `yaml:"min_step" default:"1.5"`
+
+	// The file name of the fitted bitrate config, written to the output
+	// location for audit.
+	Output string `yaml:"output" default:"per_title_bitrate_config.yaml"`
+}
+
+// Checks the per-title options of a pipeline.
+func (p PerTitleConfig) check(streamingMode StreamingMode) {
+	if !p.Enable {
+		return
+	}
+
+	if streamingMode != VOD {
+		panic(NewMalformedField(p, "Enable", `only valid when streaming_mode is "vod"`))
+	}
+
+	if p.Samples < 1 {
+		panic(NewMalformedField(p, "Samples", "must be at least 1"))
+	}
+
+	if p.SampleDuration <= 0 {
+		panic(NewMalformedField(p, "SampleDuration", "must be positive"))
+	}
+
+	if p.MinStep < 1 {
+		panic(NewMalformedField(p, "MinStep", "must be at least 1"))
+	}
+}
+
+// Returns the CRFs to trial encode a codec at.
+func (p PerTitleConfig) crfPoints(codec *VideoCodec) []int {
+	if len(p.CrfPoints) > 0 {
+		return p.CrfPoints
+	}
+
+	crf := DEFAULT_CRF[codec.Name]
+	return []int{crf - 4, crf, crf + 4}
+}
+
+/*
+Fits the bitrate ladder to the video inputs of a VOD, with trial encodes of
+samples of each input.
+
+	Only resolutions no bigger than an input, and software codecs, are tried.
+	With several video inputs, each resolution takes the highest bitrate any
+	of them needs.
+
+	The bitrate of each resolution is what the best quality which fits it
+	costs, as measured at the CRF points.  Only that cost is measured; the
+	quality of the trial encodes is not, so a CRF stands in for the same
+	quality at every resolution.
+
+	Returns a bitrate config holding the resolutions kept, in their places in
+	the pipeline's resolutions.
+*/
+func FitPerTitleLadder(inputs []Input, pipelineConfig PipelineConfig, bitrateConfig *BitrateConfig, tempDir string) (*BitrateConfig, error) {
+	perTitle := pipelineConfig.PerTitle
+	fitted := map[VideoResolutionName]*VideoResolution{}
+	// The bitrate chosen for each resolution and codec, so far.
+	chosen := map[string]float64{}
+
+	for _, input := range inputs {
+		if input.MediaType != VIDEO || ContainsInputType(TYPES_WE_CANT_PROBE, input.InputType) {
+			continue
+		}
+
+		size := input.GetResolution()
+		times := []float64{0}
+		if duration := GetDuration(input); duration > 0 {
+			times = nil
+			for n := 0; n < perTitle.Samples; n++ {
+				times = append(times, math.Max(0, duration*(float64(n)+0.5)/float64(perTitle.Samples)-perTitle.SampleDuration/2))
+			}
+		}
+
+		for _, name := range pipelineConfig.Resolutions {
+			resolution := bitrateConfig.GetResolutionValue(name)
+			if resolution == nil || size != nil && resolution.MaxHeight > size.MaxHeight {
+				// Upscaling wastes bits.
+				continue
+			}
+
+			if fitted[name] == nil {
+				copied := *resolution
+				copied.Name = name
+				copied.Bitrates = map[VideoCodecName]BitrateString{}
+				for codec, bitrate := range resolution.Bitrates {
+					copied.Bitrates[codec] = bitrate
+				}
+
+				fitted[name] = &copied
+			}
+
+			for _, codecName := range pipelineConfig.VideoCodecs {
+				codec := NewVideoCodec(codecName)
+				ceiling, err := resolution.Bitrates[codec.Name].BitsPerSecond()
+				if codec.IsHardwareAccelerated() || err != nil {
+					continue
+				}
+
+				measured := map[int]float64{}
+				for _, crf := range perTitle.crfPoints(codec) {
+					total, samples := 0.0, 0
+					for _, at := range times {
+						bitrate, err := trialEncode(input, *resolution, codec, crf, at, perTitle.SampleDuration, tempDir)
+						if err != nil {
+							return nil, err
+						}
+
+						if bitrate > 0 {
+							total += bitrate
+							samples++
+						}
+					}
+
+					if samples > 0 {
+						measured[crf] = total / float64(samples)
+					}
+				}
+
+				bitrate := chooseBitrate(measured, ceiling)
+				key := fmt.Sprintf("%s/%s", name, codec.Name)
+				if current, ok := chosen[key]; !ok || bitrate > current {
+					chosen[key] = bitrate
+					fitted[name].Bitrates[codec.Name] = formatBitrate(bitrate)
+				}
+			}
+		}
+	}
+
+	if len(fitted) == 0 {
+		return nil, fmt.Errorf("no video input can be trial encoded")
+	}
+
+	ladder := &BitrateConfig{
+		AudioChannelLayouts: bitrateConfig.AudioChannelLayouts,
+		VideoResolutions:    map[VideoResolutionName]*VideoResolution{},
+	}
+
+	for _, resolution := range pruneLadder(fitted, pipelineConfig.VideoCodecs, perTitle.MinStep) {
+		ladder.VideoResolutions[resolution.Name] = resolution
+	}
+
+	return ladder, nil
+}
+
+/*
+Returns the bitrate of the best quality which fits the ceiling, from the
+bitrates measured at each CRF.
+
+	If none of them fits, the content is too complex to save anything, and the
+	ceiling is kept.
+*/
+func chooseBitrate(measured map[int]float64, ceiling float64) float64 {
+	crfs := make([]int, 0, len(measured))
+	for crf := range measured {
+		crfs = append(crfs, crf)
+	}
+
+	// The lowest CRF is the best quality.
+	sort.Ints(crfs)
+
+	for _, crf := range crfs {
+		if measured[crf] <= ceiling {
+			return measured[crf]
+		}
+	}
+
+	return ceiling
+}
+
+// Formats a bitrate in bits per second as a bitrate string, such as '2350k'.
+func formatBitrate(bitrate float64) BitrateString {
+	return BitrateString(fmt.Sprintf("%dk", int(math.Ceil(bitrate/1000))))
+}
+
+/*
+Returns the resolutions worth keeping, from the smallest.
+
+	Going down from the biggest, a resolution is kept if it costs at most
+	1/minStep of the last one kept, in the first software codec.  The smallest
+	is always kept, for the slowest connections.
+*/
+func pruneLadder(resolutions map[VideoResolutionName]*VideoResolution, codecs []VideoCodecName, minStep float64) []*VideoResolution {
+	sorted := make([]*VideoResolution, 0, len(resolutions))
+	for _, resolution := range resolutions {
+		sorted = append(sorted, resolution)
+	}
+
+	sort.Slice(sorted, func(a, b int) bool {
+		if sorted[a].MaxHeight != sorted[b].MaxHeight {
+			return sorted[a].MaxHeight < sorted[b].MaxHeight
+		}
+
+		return sorted[a].Name < sorted[b].Name
+	})
+
+	var codec VideoCodecName
+	for _, name := range codecs {
+		if !NewVideoCodec(name).IsHardwareAccelerated() {
+			codec = name
+			break
+		}
+	}
+
+	var kept []*VideoResolution
+	last := math.Inf(1)
+	for n := len(sorted) - 1; n >= 0; n-- {
+		bitrate, err := sorted[n].Bitrates[codec].BitsPerSecond()
+		if n == 0 || err != nil || bitrate*minStep <= last {
+			kept = append([]*VideoResolution{sorted[n]}, kept...)
+			if err == nil {
+				last = bitrate
+			}
+		}
+	}
+
+	return kept
+}
+
+/*
+Trial encodes a sample of an input, and returns its bitrate in bits per
+second.
+
+	The sample is as long as the trial output, which is shorter than asked
+	for near the end of the input.  An empty sample, from past the end,
+	has a bitrate of 0.
+*/
+func trialEncode(i Input, resolution VideoResolution, codec *VideoCodec, crf int, at float64, duration float64, tempDir string) (float64, error) {
+	output := filepath.Join(tempDir, fmt.Sprintf("trial-%s-%s-%d.mkv", resolution.Name, codec.Name, crf))
+	defer os.Remove(output)
+
+	var filters []string
+	if i.IsInterlaced {
+		filters = append(filters, "pp=fd")
+	}
+
+	filters = append(filters, i.Processing.GetFilters()...)
+	filters = append(filters, i.Filters...)
+	filters = append(filters, "scale="+scaleSize(i, resolution), "setsar=1:1")
+
+	args := []string{HermeticFFmpeg, "-hide_banner", "-nostats", "-loglevel", "error", "-y"}
+	args = append(args, i.GetInputArgs()...)
+	if at > 0 {
+		args = append(args, "-ss", strconv.FormatFloat(at, 'f', 3, 64))
+	}
+
+	args = append(args,
+		"-t", strconv.FormatFloat(duration, 'f', 3, 64),
+		"-i", i.Name,
+		"-map", "0:"+i.GetStreamSpecifier(),
+		"-an", "-sn",
+		"-vf", strings.Join(filters, ","),
+		"-c:v", codec.GetFFmpegCodecString(""),
+		"-crf", strconv.Itoa(crf),
+	)
+
+	switch codec.Name {
+	case H264, HEVC:
+		// The trial only compares the cost of qualities, so it can be quick.
+		args = append(args, "-preset", "veryfast")
+	case VP9, AV1:
+		// A constant quality needs a bitrate of 0.
+		args = append(args, "-b:v", "0", "-cpu-used", "8", "-row-mt", "1")
+	}
+
+	args = append(args, "-f", "matroska", output)
+
+	if out, err := exec.Command(args[0], args[1:]...).CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("failed to trial encode %s at %s: %v: %s", i.Name, resolution.Name, err, strings.TrimSpace(string(out)))
+	}
+
+	info, err := os.Stat(output)
+	if err != nil {
+		return 0, err
+	}
+
+	encoded := GetDuration(Input{InputType: FILE, Name: output, MediaType: VIDEO})
+	if info.Size() == 0 || encoded <= 0 {
+		return 0, nil
+	}
+
+	return float64(info.Size()) * 8 / encoded, nil
+}
+
+// Writes a fitted ladder as a bitrate config YAML file.
+func WritePerTitleLadder(ladder *BitrateConfig, path string) error {
+	contents, err := yaml.Marshal(ladder)
+	if err != nil {
+		return err
+	}
+
+	header := "# The bitrate config fitted to the content of this title.  It can be\n" +
+		"# passed back with -bitrate-config.\n"
+	return os.WriteFile(path, append([]byte(header), contents...), 0644)
+}
+
+/*
+Uses a fitted ladder for the rest of the job.
+
+	The pipeline keeps only the resolutions of the ladder, and the ladder's
+	bitrates replace those of the job's bitrate config.  The resolutions of
+	the config are copied first, so the defaults they may share are left
+	alone.
+*/
+func ApplyPerTitleLadder(ladder *BitrateConfig, pipelineConfig *PipelineConfig, bitrateConfig *BitrateConfig) {
+	videoResolutions := map[VideoResolutionName]*VideoResolution{}
+	for name, resolution := range bitrateConfig.VideoResolutions {
+		videoResolutions[name] = resolution
+	}
+
+	var resolutions []VideoResolutionName
+	for _, name := range pipelineConfig.Resolutions {
+		if resolution, ok := ladder.VideoResolutions[name]; ok {
+			videoResolutions[name] = resolution
+			resolutions = append(resolutions, name)
+		}
+	}
+
+	bitrateConfig.VideoResolutions = videoResolutions
+	pipelineConfig.Resolutions = resolutions
+}
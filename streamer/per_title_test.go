@@ -0,0 +1,183 @@
+package streamer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestBitrateString_BitsPerSecond(t *testing.T) {
+	tests := map[BitrateString]float64{"108k": 108e3, "7.5M": 7.5e6, "2m": 2e6}
+	for bitrate, want := range tests {
+		if got, err := bitrate.BitsPerSecond(); err != nil || got != want {
+			t.Errorf("BitsPerSecond(%s) = %v, %v, want %v", bitrate, got, err, want)
+		}
+	}
+
+	if _, err := BitrateString("fast").BitsPerSecond(); err == nil {
+		t.Error("BitsPerSecond() should fail for a malformed bitrate")
+	}
+
+	if _, err := BitrateString("").BitsPerSecond(); err == nil {
+		t.Error("BitsPerSecond() should fail for an unset bitrate")
+	}
+}
+
+func Test_chooseBitrate(t *testing.T) {
+	measured := map[int]float64{19: 2.5e6, 23: 1.5e6, 27: 0.9e6}
+
+	tests := []struct {
+		name    string
+		ceiling float64
+		want    float64
+	}{
+		{name: "simple content", ceiling: 3e6, want: 2.5e6},
+		{name: "best quality which fits", ceiling: 2e6, want: 1.5e6},
+		{name: "too complex", ceiling: 0.5e6, want: 0.5e6},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := chooseBitrate(measured, tt.ceiling); got != tt.want {
+				t.Errorf("chooseBitrate() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_pruneLadder(t *testing.T) {
+	resolution := func(name VideoResolutionName, height int, bitrate BitrateString) *VideoResolution {
+		return &VideoResolution{Name: name, MaxHeight: height, Bitrates: map[VideoCodecName]BitrateString{H264: bitrate}}
+	}
+
+	resolutions := map[VideoResolutionName]*VideoResolution{
+		"240p":  resolution("240p", 240, "200k"),
+		"360p":  resolution("360p", 360, "260k"),
+		"480p":  resolution("480p", 480, "500k"),
+		"720p":  resolution("720p", 720, "650k"),
+		"1080p": resolution("1080p", 1080, "1200k"),
+	}
+
+	var got []VideoResolutionName
+	for _, kept := range pruneLadder(resolutions, []VideoCodecName{"hw:h264", H264}, 1.5) {
+		got = append(got, kept.Name)
+	}
+
+	// 480p costs almost as much as 720p.
+	if want := []VideoResolutionName{"240p", "360p", "720p", "1080p"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pruneLadder() = %v, want %v", got, want)
+	}
+}
+
+func TestFitPerTitleLadder(t *testing.T) {
+	// A stand-in for ffmpeg whose first sample is cut short to 5 seconds, with
+	// a size which depends on the height and the CRF, and whose last sample is
+	// empty.
+	ffmpeg := `#!/bin/sh
+for arg; do
+  case "$previous" in
+    -crf) crf=$arg ;;
+    -vf) vf=$arg ;;
+    -ss) at=$arg ;;
+  esac
+  previous=$arg
+  output=$arg
+done
+case "$vf:$crf" in
+  *-2:720,*:19) size=1562500 ;;
+  *-2:720,*:23) size=937500 ;;
+  *-2:480,*:19) size=750000 ;;
+  *-2:480,*:23) size=437500 ;;
+  *-2:360,*:19) size=187500 ;;
+  *) size=50000 ;;
+esac
+if [ "$at" = "445.000" ]; then size=0; fi
+head -c "$size" /dev/zero > "$output"
+`
+	ffprobe := `#!/bin/sh
+case "$1" in
+  *trial-*) if [ -s "$1" ]; then echo 5.000000; else echo N/A; fi ;;
+  *) echo 600.000000 ;;
+esac
+`
+	fakeTools(t, ffprobe, ffmpeg)
+
+	inputs := []Input{
+		{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, FrameRate: 30, Resolution: "720p"},
+		{InputType: FILE, Name: "talk.mp4", MediaType: AUDIO},
+	}
+
+	pipelineConfig := PipelineConfig{
+		StreamingMode: VOD,
+		Resolutions:   []VideoResolutionName{"1080p", "720p", "480p", "360p"},
+		VideoCodecs:   []VideoCodecName{H264},
+		PerTitle:      PerTitleConfig{Enable: true, Samples: 2, SampleDuration: 10, MinStep: 1.5},
+	}
+
+	ladder, err := FitPerTitleLadder(inputs, pipelineConfig, NewBitrateConfig(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := map[VideoResolutionName]BitrateString{}
+	for name, resolution := range ladder.VideoResolutions {
+		got[name] = resolution.Bitrates[H264]
+	}
+
+	// 1080p would upscale.  The others get the best quality under the default
+	// bitrate.
+	want := map[VideoResolutionName]BitrateString{"720p": "1500k", "480p": "700k", "360p": "300k"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("FitPerTitleLadder() = %v, want %v", got, want)
+	}
+
+	path := filepath.Join(t.TempDir(), "ladder.yaml")
+	if err := WritePerTitleLadder(ladder, path); err != nil {
+		t.Fatal(err)
+	}
+
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var written BitrateConfig
+	if err := yaml.Unmarshal(contents, &written); err != nil {
+		t.Fatal(err)
+	}
+
+	if bitrate := written.VideoResolutions["720p"].Bitrates[H264]; bitrate != "1500k" {
+		t.Errorf("the written ladder has 720p at %s, want 1500k:\n%s", bitrate, contents)
+	}
+
+	if strings.Contains(string(contents), "1080p") {
+		t.Errorf("the written ladder should not have 1080p:\n%s", contents)
+	}
+
+	if written.GetResolutionValue("1080p") != (*DefaultVideoResolutions)["1080p"] {
+		t.Errorf("reading the ladder changed the default resolutions")
+	}
+
+	bitrateConfig := NewBitrateConfig()
+	ApplyPerTitleLadder(ladder, &pipelineConfig, bitrateConfig)
+
+	resolutions := append([]VideoResolutionName{}, pipelineConfig.Resolutions...)
+	sort.Slice(resolutions, func(a, b int) bool { return resolutions[a] < resolutions[b] })
+	if want := []VideoResolutionName{"360p", "480p", "720p"}; !reflect.DeepEqual(resolutions, want) {
+		t.Errorf("Resolutions = %v, want %v", resolutions, want)
+	}
+
+	if bitrate := bitrateConfig.GetResolutionValue("720p").Bitrates[H264]; bitrate != "1500k" {
+		t.Errorf("the 720p bitrate = %s after applying the ladder, want 1500k", bitrate)
+	}
+
+	// The ladder is kept to the job.
+	if bitrate := NewBitrateConfig().GetResolutionValue("720p").Bitrates[H264]; bitrate != "2M" {
+		t.Errorf("the default 720p bitrate = %s after applying the ladder, want 2M", bitrate)
+	}
+}
@@ -1,10 +1,13 @@
 package streamer
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
 	"runtime"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/google/uuid"
@@ -147,3 +150,196 @@ func (p *Pipe) ReadEnd() string {
 func (p *Pipe) WriteEnd() string {
 	return p.readPipeName
 }
+
+// How much of a stream an output of a fanOutWriter holds for a reader which
+// hasn't opened it yet, or has fallen behind, before the output is dropped.
+const FAN_OUT_BUFFER_SIZE = 32 << 20
+
+/*
+Writes the same stream to several outputs, usually named pipes.
+
+	Each output is opened and written by a goroutine of its own, through a
+	bounded buffer.  A reader can open the pipes in any order, as FFmpeg does
+	with its inputs, and one which falls behind is dropped, seeing the end of
+	its stream, instead of holding up the others.
+*/
+type fanOutWriter struct {
+	outputs []*fanOutput
+	written atomic.Int64
+}
+
+// An output of a fanOutWriter, and the part of the stream not yet written to
+// it.
+type fanOutput struct {
+	path   string
+	limit  int
+	mu     sync.Mutex
+	cond   *sync.Cond
+	queue  [][]byte
+	size   int
+	opened bool
+	closed bool
+	err    error
+	// Closed when the output is done with.
+	done chan struct{}
+}
+
+// Starts a writer for every output.  Opening a named pipe blocks until the
+// reader opens the other end, so it is done in the background.
+func newFanOutWriter(paths []string) *fanOutWriter {
+	w := &fanOutWriter{}
+
+	for _, path := range paths {
+		o := &fanOutput{path: path, limit: FAN_OUT_BUFFER_SIZE, done: make(chan struct{})}
+		o.cond = sync.NewCond(&o.mu)
+		w.outputs = append(w.outputs, o)
+		go o.run()
+	}
+
+	return w
+}
+
+// Queues a copy of the data for every output.  Fails only once every output
+// has failed, since then nobody is left to read the stream.
+func (w *fanOutWriter) Write(p []byte) (int, error) {
+	chunk := append([]byte(nil), p...)
+
+	for _, o := range w.outputs {
+		o.push(chunk)
+	}
+
+	w.written.Add(int64(len(p)))
+
+	if err := w.Err(); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Returns the number of bytes written so far.
+func (w *fanOutWriter) Written() int64 {
+	return w.written.Load()
+}
+
+// Returns an error if every output has failed.
+func (w *fanOutWriter) Err() error {
+	var errs []error
+
+	for _, o := range w.outputs {
+		o.mu.Lock()
+		err := o.err
+		o.mu.Unlock()
+
+		if err == nil {
+			return nil
+		}
+
+		errs = append(errs, err)
+	}
+
+	if len(errs) == 0 {
+		return errors.New("there are no outputs")
+	}
+
+	return errors.Join(errs...)
+}
+
+/*
+Ends the stream.  Returns once what is queued for the opened outputs has been
+written, and they are closed.
+
+	An output whose reader hasn't opened it yet still gets the stream when it
+	does.
+*/
+func (w *fanOutWriter) Close() {
+	for _, o := range w.outputs {
+		if o.close() {
+			<-o.done
+		}
+	}
+}
+
+func (o *fanOutput) push(chunk []byte) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.err != nil || o.closed {
+		return
+	}
+
+	if o.size+len(chunk) > o.limit {
+		o.err = fmt.Errorf("the reader of %s fell behind", o.path)
+		o.queue = nil
+		o.size = 0
+		o.cond.Broadcast()
+		fmt.Fprintf(os.Stderr, "Dropped the output %s: %v\n", o.path, o.err)
+		return
+	}
+
+	o.queue = append(o.queue, chunk)
+	o.size += len(chunk)
+	o.cond.Signal()
+}
+
+// Ends the stream of an output.  Returns true if it has been opened.
+func (o *fanOutput) close() bool {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.closed = true
+	o.cond.Broadcast()
+
+	return o.opened
+}
+
+func (o *fanOutput) fail(err error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.err == nil {
+		o.err = err
+	}
+
+	o.queue = nil
+	o.size = 0
+}
+
+func (o *fanOutput) run() {
+	defer close(o.done)
+
+	f, err := os.OpenFile(o.path, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		o.fail(err)
+		return
+	}
+
+	defer f.Close()
+
+	o.mu.Lock()
+	o.opened = true
+	o.mu.Unlock()
+
+	for {
+		o.mu.Lock()
+		for len(o.queue) == 0 && !o.closed && o.err == nil {
+			o.cond.Wait()
+		}
+
+		if o.err != nil || len(o.queue) == 0 {
+			// Dropped, or closed with nothing left to write.
+			o.mu.Unlock()
+			return
+		}
+
+		chunk := o.queue[0]
+		o.queue = o.queue[1:]
+		o.size -= len(chunk)
+		o.mu.Unlock()
+
+		if _, err := f.Write(chunk); err != nil {
+			o.fail(err)
+			return
+		}
+	}
+}
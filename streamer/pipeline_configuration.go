@@ -5,6 +5,7 @@ import (
 	"encoding/base64"
 	"fmt"
 	"runtime"
+	"strings"
 
 	"github.com/creasty/defaults"
 	"gopkg.in/dealancer/validate.v2"
@@ -56,6 +57,40 @@ type UtcTimingPair struct {
 	Value string `yaml:"value"`
 }
 
+// Define a new type called SlateAudio, which is essentially a string.
+type SlateAudio string
+
+const (
+	SLATE_SILENCE SlateAudio = "silence" // No sound.
+	SLATE_TONE    SlateAudio = "tone"    // A continuous tone.
+)
+
+/*
+A slate shown in place of a live stream while every source is lost.
+
+	The slate is encoded like any other source, so it keeps the segment
+	cadence and keyframe alignment of the stream.  Set image or clip to enable
+	it.
+*/
+type SlateConfig struct {
+	// The path to a still image to show, such as "we'll be right back".
+	Image string `yaml:"image"`
+
+	// The path to a video clip to loop.  Any audio in the clip is ignored.
+	Clip string `yaml:"clip"`
+
+	// The audio of the slate.  Can be 'silence' or 'tone'.
+	Audio SlateAudio `yaml:"audio" default:"silence"`
+
+	// The frequency of the tone, in Hz.
+	Frequency int `yaml:"frequency" default:"1000"`
+}
+
+// Returns true if a slate is configured.
+func (s SlateConfig) IsEnabled() bool {
+	return s.Image != "" || s.Clip != ""
+}
+
 // An object representing a list of keys for Raw key encryption
 type RawKeyConfig struct {
 	/*
@@ -314,7 +349,15 @@ type PipelineConfig struct {
 	*/
 	ChannelLayouts []AudioChannelLayoutName `yaml:"channel_layouts"`
 
-	// The audio codecs to encode with.
+	/*
+		The audio codecs to encode with.
+
+			Note that the prefix "copy:" indicates that the input is already in
+			that codec, and is copied rather than encoded, once, in the channel
+			layout of the input.  Only ac3, eac3 and ac4 can be copied, and ac4
+			can only be copied.  mp3 and he-aac-v2 hold at most 2 channels, and
+			he-aac and he-aac-v2 need an FFmpeg built with libfdk_aac.
+	*/
 	AudioCodecs []AudioCodecName `yaml:"audio_codecs"`
 
 	/*
@@ -324,6 +367,15 @@ type PipelineConfig struct {
 	*/
 	VideoCodecs []VideoCodecName `yaml:"video_codecs"`
 
+	/*
+		The container of the output of each codec, mp4 or webm, such as
+		'vp9: mp4'.
+
+		  By default, VP9 and Opus are packaged in WebM, which only DASH takes,
+		  and the others in MP4.  In MP4, VP9 and Opus are in HLS as well.
+	*/
+	OutputFormat map[string]OutputFormat `yaml:"output_format"`
+
 	/*
 		A list of manifest formats (dash or hls) to create.
 
@@ -371,9 +423,47 @@ type PipelineConfig struct {
 		  If multiple UTCTiming pairs are provided for redundancy,
 		  list the pairs in the order of preference.
 
-		  Must be set for LL-DASH streaming.
+		  Must be set for LL-DASH streaming, unless utc_timing_server is enabled.
 	*/
 	UTCTimings []UtcTimingPair `yaml:"utc_timings"`
+
+	// Settings for the embedded UTC timing server.
+	UtcTimingServer UtcTimingServerConfig `yaml:"utc_timing_server"`
+
+	/*
+		A slate to show while every source of a live input is lost.
+
+		  Only valid for live.
+	*/
+	Slate SlateConfig `yaml:"slate"`
+
+	/*
+		The file name of a JSON report of the job, written to the output
+		location, such as 'job_report.json'.
+
+		  The report records what was detected and decided for each input, such
+		  as an automatic crop.  If unspecified, no report is written.
+	*/
+	JobReport string `yaml:"job_report"`
+
+	/*
+		If true, each video rendition is encoded twice: once to analyse the
+		picture, and once to spend its bitrate where it is needed.
+
+		  Only valid for VOD.  Renditions in 'crf' mode, and those of hardware
+		  encoders, are encoded once.
+	*/
+	TwoPass bool `yaml:"two_pass"`
+
+	// Fits the bitrates of the resolutions to the content of a VOD.
+	PerTitle PerTitleConfig `yaml:"per_title"`
+
+	// Measures the quality of the video renditions of a VOD against their
+	// sources, once they have been packaged.
+	Quality QualityConfig `yaml:"quality"`
+
+	// Encodes the video of a VOD in chunks, in parallel.
+	ChunkedEncode ChunkedEncodeConfig `yaml:"chunked_encode"`
 }
 
 // Validations
@@ -394,6 +484,8 @@ func (p *PipelineConfig) UnmarshalYAML(unmarshal func(interface{}) error) error
 		panic(err)
 	}
 
+	p.check()
+
 	return nil
 }
 
@@ -451,6 +543,114 @@ func (p *PipelineConfig) SetDefaults() {
 	}
 }
 
+/*
+Checks the options which depend on each other.
+
+	The defaults are set before the config is decoded, so these run once it
+	is.
+*/
+func (p *PipelineConfig) check() {
+	if p.Slate.Image != "" && p.Slate.Clip != "" {
+		panic(NewMalformedField(p.Slate, "Clip", "cannot be used together with image"))
+	}
+
+	if p.Slate.Audio != SLATE_SILENCE && p.Slate.Audio != SLATE_TONE {
+		panic(NewMalformedField(p.Slate, "Audio", `must be "silence" or "tone"`))
+	}
+
+	if p.TwoPass && p.StreamingMode != VOD {
+		panic(NewMalformedField(*p, "TwoPass", `only valid when streaming_mode is "vod"`))
+	}
+
+	for _, codec := range p.AudioCodecs {
+		checkAudioCodec(*p, codec)
+	}
+
+	for codec, format := range p.OutputFormat {
+		checkOutputFormat(*p, codec, format)
+	}
+
+	p.UtcTimingServer.check()
+	p.PerTitle.check(p.StreamingMode)
+	p.Quality.check(*p)
+	p.ChunkedEncode.check(*p)
+}
+
+// Checks the output format of a codec.  WebM only holds VP9, AV1 and Opus.
+func checkOutputFormat(p PipelineConfig, codec string, format OutputFormat) {
+	audio := audioCodecStrings(AUDIO_CODECS)
+	video := []string{string(H264), string(VP9), string(AV1), string(HEVC)}
+
+	if !ContainsString(append(audio, video...), codec) {
+		panic(NewMalformedField(p, "OutputFormat", fmt.Sprintf("%q is not a codec", codec)))
+	}
+
+	switch format {
+	case OUTPUT_FORMAT_MP4:
+	case OUTPUT_FORMAT_WEBM:
+		if codec != string(VP9) && codec != string(AV1) && codec != string(OPUS) {
+			panic(NewMalformedField(p, "OutputFormat", fmt.Sprintf("%s can't be packaged in webm", codec)))
+		}
+	default:
+		panic(NewMalformedField(p, "OutputFormat", fmt.Sprintf("%q is not mp4 or webm", format)))
+	}
+}
+
+// Checks an audio codec of a pipeline.  Only Dolby codecs are copied from the
+// input, AC-4 can only be copied, and MP3 and HE-AAC v2 only hold stereo.
+func checkAudioCodec(p PipelineConfig, name AudioCodecName) {
+	codec := NewAudioCodec(name)
+
+	if !ContainsString(audioCodecStrings(AUDIO_CODECS), string(codec.Name)) {
+		panic(NewMalformedField(p, "AudioCodecs", fmt.Sprintf("%q is not a codec", name)))
+	}
+
+	if codec.Passthrough && !ContainsString(audioCodecStrings(PASSTHROUGH_AUDIO_CODECS), string(codec.Name)) {
+		panic(NewMalformedField(p, "AudioCodecs", fmt.Sprintf("%s can't be copied from the input", codec.Name)))
+	}
+
+	if codec.Name == AC4 && !codec.Passthrough {
+		panic(NewMalformedField(p, "AudioCodecs", `ac4 can't be encoded, only copied with "copy:ac4"`))
+	}
+
+	if ContainsString(audioCodecStrings(STEREO_AUDIO_CODECS), string(codec.Name)) {
+		for _, name := range p.ChannelLayouts {
+			layout := NewBitrateConfig().GetChannelLayoutValue(name)
+			if layout != nil && layout.MaxChannels > 2 {
+				panic(NewMalformedField(p, "AudioCodecs", fmt.Sprintf("%s holds at most 2 channels, so it can't be used with the %s channel layout", codec.Name, name)))
+			}
+		}
+	}
+}
+
+// Returns the audio codecs to encode with, in their configured containers.  A
+// copied codec takes the container of its codec.
+func (p *PipelineConfig) GetAudioCodecs() []*AudioCodec {
+	codecs := make([]*AudioCodec, 0, len(p.AudioCodecs))
+
+	for _, name := range p.AudioCodecs {
+		codec := NewAudioCodec(name)
+		codec.OutputFormat = p.OutputFormat[string(codec.Name)]
+		codecs = append(codecs, codec)
+	}
+
+	return codecs
+}
+
+// Returns the video codecs to encode with, in their configured containers.  A
+// hardware encoder takes the container of its codec.
+func (p *PipelineConfig) GetVideoCodecs() []*VideoCodec {
+	codecs := make([]*VideoCodec, 0, len(p.VideoCodecs))
+
+	for _, name := range p.VideoCodecs {
+		codec := NewVideoCodec(name)
+		codec.OutputFormat = p.OutputFormat[strings.TrimPrefix(string(name), "hw:")]
+		codecs = append(codecs, codec)
+	}
+
+	return codecs
+}
+
 func (p *PipelineConfig) GetResolutions() []*VideoResolution {
 	resolutions := make([]*VideoResolution, 0, len(p.Resolutions))
 
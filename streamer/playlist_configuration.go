@@ -0,0 +1,114 @@
+package streamer
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/dealancer/validate.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// A single file in a playlist.
+type PlaylistItem struct {
+	/*
+		The path to the file.
+
+			A relative path is relative to the playlist file.
+	*/
+	Name string `yaml:"name" validate:"empty=false"`
+
+	/*
+		The start time of the slice of the file to play.
+
+			In any format FFmpeg accepts, such as '90' or '00:01:30'.
+	*/
+	StartTime string `yaml:"start_time"`
+
+	// The end time of the slice of the file to play.
+	EndTime string `yaml:"end_time"`
+
+	/*
+		The wall-clock time at which to start this item, such as
+		2026-10-18T20:00:00Z.
+
+			If the previous item ends early, black and silence, or the slate if
+			there is one, fill the gap.  If it ends late, this item is joined in
+			progress, so the schedule keeps to the clock.
+	*/
+	StartAt time.Time `yaml:"start_at"`
+}
+
+/*
+A list of files played back to back as a single live input.
+
+	The playlist file is read again before each item, so it can be edited
+	while the channel is running.  Playback continues at the same position in
+	the edited list.
+*/
+type Playlist struct {
+	/*
+		If true, start over from the first item after the last one ends.
+
+			Not valid with start_at, since the times of the items only happen
+			once.
+	*/
+	Loop bool `yaml:"loop"`
+
+	// The files to play, in order.
+	Items []PlaylistItem `yaml:"items"`
+}
+
+// Reads a playlist file.
+func LoadPlaylist(path string) (*Playlist, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	playlist := &Playlist{}
+	if err := yaml.Unmarshal(contents, playlist); err != nil {
+		return nil, fmt.Errorf("failed to parse playlist %s: %v", path, err)
+	}
+
+	if err := validate.Validate(playlist); err != nil {
+		return nil, fmt.Errorf("invalid playlist %s: %v", path, err)
+	}
+
+	if len(playlist.Items) == 0 {
+		return nil, fmt.Errorf("playlist %s has no items", path)
+	}
+
+	for idx := range playlist.Items {
+		item := &playlist.Items[idx]
+		if playlist.Loop && !item.StartAt.IsZero() {
+			return nil, fmt.Errorf("playlist %s can't loop, since %s has a start_at time", path, item.Name)
+		}
+
+		if !filepath.IsAbs(item.Name) {
+			item.Name = filepath.Join(filepath.Dir(path), item.Name)
+		}
+	}
+
+	return playlist, nil
+}
+
+// Parses a time in one of the formats FFmpeg accepts, [HH:]MM:SS[.m...] or
+// S[.m...], into seconds.
+func parseFFmpegTime(s string) (float64, error) {
+	seconds := 0.0
+
+	for _, piece := range strings.Split(s, ":") {
+		value, err := strconv.ParseFloat(piece, 64)
+		if err != nil {
+			return 0, fmt.Errorf("%q is not a valid time", s)
+		}
+
+		seconds = seconds*60 + value
+	}
+
+	return seconds, nil
+}
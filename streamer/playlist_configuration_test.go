@@ -0,0 +1,102 @@
+package streamer
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPlaylist(t *testing.T) {
+	tests := []struct {
+		name     string
+		contents string
+		wantName string
+		wantErr  bool
+	}{
+		{
+			name:     "Relative path",
+			contents: "items:\n  - name: show.mp4\n",
+			wantName: "show.mp4",
+		},
+		{
+			name:     "Absolute path",
+			contents: "items:\n  - name: /media/show.mp4\n    start_at: 2026-10-18T20:00:00Z\n",
+			wantName: "/media/show.mp4",
+		},
+		{
+			name:     "No items",
+			contents: "loop: true\n",
+			wantErr:  true,
+		},
+		{
+			name:     "Loop with a schedule",
+			contents: "loop: true\nitems:\n  - name: show.mp4\n    start_at: 2026-10-18T20:00:00Z\n",
+			wantErr:  true,
+		},
+		{
+			name:     "Missing name",
+			contents: "items:\n  - start_time: '10'\n",
+			wantErr:  true,
+		},
+		{
+			name:     "Malformed",
+			contents: "items: [",
+			wantErr:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "playlist.yaml")
+			if err := os.WriteFile(path, []byte(tt.contents), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			playlist, err := LoadPlaylist(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if tt.wantErr {
+				return
+			}
+
+			want := tt.wantName
+			if !filepath.IsAbs(want) {
+				want = filepath.Join(dir, want)
+			}
+
+			if got := playlist.Items[0].Name; got != want {
+				t.Errorf("Name = %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseFFmpegTime(t *testing.T) {
+	tests := []struct {
+		time    string
+		want    float64
+		wantErr bool
+	}{
+		{time: "90", want: 90},
+		{time: "1.5", want: 1.5},
+		{time: "01:30", want: 90},
+		{time: "01:00:30.5", want: 3630.5},
+		{time: "1m30s", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.time, func(t *testing.T) {
+			got, err := parseFFmpegTime(tt.time)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, wantErr %v", err, tt.wantErr)
+			}
+
+			if got != tt.want {
+				t.Errorf("parseFFmpegTime(%q) = %v, want %v", tt.time, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,248 @@
+// A module that plays a playlist of files as a single live input.
+package streamer
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// How long filler is played after an item fails, before the next item is
+// tried.  It doubles with each failure in a row, up to the maximum.
+const (
+	PLAYLIST_FAILURE_BACKOFF     = time.Second
+	PLAYLIST_MAX_FAILURE_BACKOFF = 30 * time.Second
+)
+
+/*
+Plays the files of a playlist back to back in real time, and relays them to
+named pipes as one continuous MPEG-TS stream.
+
+	Every item is encoded, so files with different codecs can follow each
+	other.  Timestamps are offset by the time since the node started, so they
+	keep increasing from one item to the next, and the transcoder sees a
+	single live source.
+*/
+type PlaylistNode struct {
+	NodeBase
+	path    string
+	slate   SlateConfig
+	ffmpeg  string
+	streams []Input
+	outputs []string
+	mu      sync.Mutex
+	stopped bool
+	Status  ProcessStatus
+}
+
+func NewPlaylistNode(path string, slate SlateConfig, hermeticFFmpeg string) *PlaylistNode {
+	n := &PlaylistNode{
+		path:   path,
+		slate:  slate,
+		ffmpeg: "ffmpeg",
+		Status: Finished,
+	}
+
+	if hermeticFFmpeg != "" {
+		n.ffmpeg = hermeticFFmpeg
+	}
+
+	return n
+}
+
+/*
+Adds a path (usually a named pipe) to which the playlist is written, and the
+input whose stream should be played.
+
+	Returns the track number of that stream in the relayed output, among the
+	streams of its media type.
+*/
+func (n *PlaylistNode) AddOutput(path string, stream Input) int {
+	trackNum := relayTrackNum(n.streams, stream)
+
+	n.outputs = append(n.outputs, path)
+	n.streams = append(n.streams, stream)
+
+	return trackNum
+}
+
+func (n *PlaylistNode) Start() {
+	n.mu.Lock()
+	n.Status = Running
+	n.mu.Unlock()
+	go n.run()
+}
+
+func (n *PlaylistNode) CheckStatus() ProcessStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.Status
+}
+
+func (n *PlaylistNode) Stop() {
+	n.mu.Lock()
+	n.stopped = true
+	process := n.Process
+	n.mu.Unlock()
+
+	killProcessGroup(process)
+}
+
+func (n *PlaylistNode) isStopped() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.stopped
+}
+
+func (n *PlaylistNode) finish(status ProcessStatus) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Status = status
+}
+
+// Returns the source which plays an item, joined the given number of
+// seconds late.
+func (n *PlaylistNode) itemSource(item PlaylistItem, lateness float64) (relaySource, error) {
+	input := Input{
+		InputType: FILE,
+		Name:      item.Name,
+		StartTime: item.StartTime,
+		EndTime:   item.EndTime,
+	}
+
+	if lateness > 0 {
+		start := 0.0
+		if item.StartTime != "" {
+			var err error
+			if start, err = parseFFmpegTime(item.StartTime); err != nil {
+				return relaySource{}, err
+			}
+		}
+
+		input.StartTime = strconv.FormatFloat(start+lateness, 'f', 3, 64)
+	}
+
+	source := readRelaySource(n.streams, input, true)
+	// Files in a playlist may have different codecs, so they are all encoded
+	// to the same ones.
+	source.encode = true
+
+	return source, nil
+}
+
+// Returns the source which fills a gap in the schedule.
+func (n *PlaylistNode) fillerSource() relaySource {
+	if n.slate.IsEnabled() {
+		return slateRelaySource(n.streams, n.slate)
+	}
+
+	source := readRelaySource(n.streams, Input{InputType: GENERATOR, Name: "color"}, true)
+	for idx := range source.inputs {
+		if source.inputs[idx].MediaType == AUDIO {
+			source.inputs[idx].Name = "anullsrc"
+		}
+	}
+
+	return source
+}
+
+// Plays a source until it ends, or for the given duration if it is positive.
+func (n *PlaylistNode) play(output *fanOutWriter, source relaySource, offset float64, duration float64) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil
+	}
+
+	n.Process = n.CreateProcess(BaseParams{
+		args:   relayArgs(n.ffmpeg, source, offset, duration),
+		stdout: output,
+		stderr: os.Stderr,
+	})
+	process := n.Process
+	n.mu.Unlock()
+
+	return process.Wait()
+}
+
+func (n *PlaylistNode) run() {
+	// Each output is opened when the transcoder opens the other end.
+	output := newFanOutWriter(n.outputs)
+	defer output.Close()
+
+	startTime := time.Now()
+	var playlist *Playlist
+	position := 0
+	backoff := PLAYLIST_FAILURE_BACKOFF
+
+	for !n.isStopped() {
+		// Read the playlist again before each item, to pick up any edits.
+		edited, err := LoadPlaylist(n.path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			if playlist == nil {
+				n.finish(Errored)
+				return
+			}
+		} else {
+			playlist = edited
+		}
+
+		if position >= len(playlist.Items) {
+			if !playlist.Loop {
+				break
+			}
+
+			position = 0
+		}
+
+		item := playlist.Items[position]
+		lateness := 0.0
+
+		if !item.StartAt.IsZero() {
+			wait := time.Until(item.StartAt).Seconds()
+			if wait > 0 {
+				// Fill the gap until the item is due.
+				n.play(output, n.fillerSource(), time.Since(startTime).Seconds(), wait)
+				continue
+			}
+
+			lateness = -wait
+		}
+
+		source, err := n.itemSource(item, lateness)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Skipping %s: %v\n", item.Name, err)
+		} else if err = n.play(output, source, time.Since(startTime).Seconds(), 0); err != nil && !n.isStopped() {
+			fmt.Fprintf(os.Stderr, "Failed to play %s: %v\n", item.Name, err)
+		}
+
+		if err != nil && !n.isStopped() {
+			// Play filler before the next item, so a list of broken items
+			// doesn't spin.
+			n.play(output, n.fillerSource(), time.Since(startTime).Seconds(), backoff.Seconds())
+
+			backoff *= 2
+			if backoff > PLAYLIST_MAX_FAILURE_BACKOFF {
+				backoff = PLAYLIST_MAX_FAILURE_BACKOFF
+			}
+		} else {
+			backoff = PLAYLIST_FAILURE_BACKOFF
+		}
+
+		if output.Err() != nil {
+			// The transcoder is gone, so there is nobody left to play to.
+			n.finish(Errored)
+			return
+		}
+
+		position++
+	}
+
+	n.finish(Finished)
+}
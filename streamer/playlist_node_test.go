@@ -0,0 +1,118 @@
+package streamer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPlaylistNode_PlaysItemsInOrder(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "playlist.yaml")
+	contents := "items:\n  - name: intro.mp4\n  - name: show.mp4\n    start_time: '10'\n    end_time: '20'\n"
+	if err := os.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "output.ts")
+	stream := Input{InputType: PLAYLIST, Name: path, MediaType: VIDEO, FrameRate: 30, Resolution: "720p"}
+
+	node := NewPlaylistNode(path, SlateConfig{}, writeTestRelayFFmpeg(t))
+	node.AddOutput(output, stream)
+	node.Start()
+	defer node.Stop()
+
+	for start := time.Now(); node.CheckStatus() == Running && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status := node.CheckStatus(); status != Finished {
+		t.Fatalf("status = %v, want Finished", status)
+	}
+
+	played, _ := os.ReadFile(output)
+	want := []string{filepath.Join(dir, "intro.mp4"), filepath.Join(dir, "show.mp4")}
+	if got := strings.Fields(string(played)); !reflect.DeepEqual(got, want) {
+		t.Errorf("played = %v, want %v", got, want)
+	}
+}
+
+func TestPlaylistNode_BacksOffAfterFailures(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "playlist.yaml")
+	if err := os.WriteFile(path, []byte("loop: true\nitems:\n  - name: broken.mp4\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "output.ts")
+	stream := Input{InputType: PLAYLIST, Name: path, MediaType: VIDEO, FrameRate: 30, Resolution: "720p"}
+
+	node := NewPlaylistNode(path, SlateConfig{}, writeTestRelayFFmpeg(t))
+	node.AddOutput(output, stream)
+	node.Start()
+	defer node.Stop()
+
+	var played []string
+	for start := time.Now(); len(played) < 4 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		contents, _ := os.ReadFile(output)
+		played = strings.Fields(string(contents))
+	}
+
+	if len(played) < 4 {
+		t.Fatalf("played = %v, want at least 4 sources", played)
+	}
+
+	// Filler is played after each failure.
+	for i, source := range played[:4] {
+		if isItem := source == filepath.Join(dir, "broken.mp4"); isItem != (i%2 == 0) {
+			t.Errorf("played = %v, want the item and filler in turns", played[:4])
+			break
+		}
+	}
+}
+
+func TestPlaylistNode_args(t *testing.T) {
+	video := Input{InputType: PLAYLIST, Name: "playlist.yaml", MediaType: VIDEO, FrameRate: 25, Resolution: "1080p"}
+	audio := Input{InputType: PLAYLIST, Name: "playlist.yaml", MediaType: AUDIO, ChannelLayout: "stereo"}
+
+	node := NewPlaylistNode("playlist.yaml", SlateConfig{}, "ffmpeg")
+	node.AddOutput("video.ts", video)
+	node.AddOutput("audio.ts", audio)
+
+	late, err := node.itemSource(PlaylistItem{Name: "show.mp4", StartTime: "00:01:00", EndTime: "00:30:00"}, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		source relaySource
+		want   string
+	}{
+		{
+			name:   "Joined late",
+			source: late,
+			want: "-ss 65.000 -to 00:30:00 -re -i show.mp4 -map 0:v:0? -map 0:a:0? " +
+				"-c:v libx264 -preset veryfast -tune zerolatency -crf 16 -pix_fmt yuv420p -c:a aac -b:a 320k",
+		},
+		{
+			name:   "Filler",
+			source: node.fillerSource(),
+			want: "-f lavfi -re -i color=size=1920x1080:rate=25 " +
+				"-f lavfi -re -i anullsrc=sample_rate=48000,pan=2c|c0=c0|c1=c0 -map 0:0 -map 1:0",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := strings.Join(relayArgs("ffmpeg", tt.source, 0, 0), " ")
+			if !strings.Contains(args, tt.want) {
+				t.Errorf("args = %v, want to contain %v", args, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,706 @@
+// A module to measure the quality of encoded video against its source.
+package streamer
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A measure of how closely a picture matches its source.
+type QualityMetric string
+
+const (
+	QUALITY_VMAF QualityMetric = "vmaf"
+	QUALITY_PSNR QualityMetric = "psnr"
+	QUALITY_SSIM QualityMetric = "ssim"
+)
+
+// Every metric, in the order they are reported.
+var QUALITY_METRICS = []QualityMetric{
+	QUALITY_VMAF,
+	QUALITY_PSNR,
+	QUALITY_SSIM,
+}
+
+// The PSNR of identical frames is infinite, which JSON can't hold, so it is
+// reported as this many decibels instead.
+const QUALITY_MAX_PSNR = 100
+
+// How often the quality node checks if the packagers have finished.
+const QUALITY_POLL_INTERVAL = time.Second
+
+// The options of the analysis of video renditions after a VOD encode.
+type QualityConfig struct {
+	/*
+		If true, each video rendition is compared with its source once it has
+		been packaged, and the scores are added to the job report.
+
+		  Only valid for VOD, without encryption, and with a job_report.
+	*/
+	Enable bool `yaml:"enable"`
+
+	/*
+		The metrics to measure: vmaf, psnr and ssim.
+
+		  Defaults to all of them.  VMAF needs an FFmpeg built with libvmaf.
+	*/
+	Metrics []QualityMetric `yaml:"metrics"`
+
+	/*
+		The percentile of the scores of the frames to report, alongside the
+		mean and the minimum.
+
+		  A low percentile shows how the worst parts of a title look, which
+		  the mean hides.
+	*/
+	Percentile float64 `yaml:"percentile" default:"5"`
+
+	// Compare one frame in every this many, to save time.
+	Subsample int `yaml:"subsample" default:"1"`
+
+	/*
+		The lowest acceptable mean score of each metric, such as 'vmaf: 80'.
+
+		  Renditions below any of them are flagged in the job report.
+	*/
+	Thresholds map[QualityMetric]float64 `yaml:"thresholds"`
+}
+
+// Checks the quality options of a pipeline.
+func (q QualityConfig) check(pipelineConfig PipelineConfig) {
+	if !q.Enable {
+		return
+	}
+
+	if pipelineConfig.StreamingMode != VOD {
+		panic(NewMalformedField(q, "Enable", `only valid when streaming_mode is "vod"`))
+	}
+
+	if pipelineConfig.Encryption.Enable {
+		panic(NewMalformedField(q, "Enable", "encrypted renditions can't be compared with their source"))
+	}
+
+	if pipelineConfig.JobReport == "" {
+		panic(NewMissingRequiredField(pipelineConfig, "JobReport"))
+	}
+
+	for _, metric := range q.Metrics {
+		if !isQualityMetric(metric) {
+			panic(NewMalformedField(q, "Metrics", fmt.Sprintf("%q is not vmaf, psnr or ssim", metric)))
+		}
+	}
+
+	if q.Percentile <= 0 || q.Percentile > 100 {
+		panic(NewMalformedField(q, "Percentile", "must be above 0 and at most 100"))
+	}
+
+	if q.Subsample < 1 {
+		panic(NewMalformedField(q, "Subsample", "must be at least 1"))
+	}
+
+	for metric := range q.Thresholds {
+		if !ContainsString(qualityMetricStrings(q.metrics()), string(metric)) {
+			panic(NewMalformedField(q, "Thresholds", fmt.Sprintf("%q is not a measured metric", metric)))
+		}
+	}
+}
+
+func isQualityMetric(metric QualityMetric) bool {
+	return ContainsString(qualityMetricStrings(QUALITY_METRICS), string(metric))
+}
+
+func qualityMetricStrings(metrics []QualityMetric) []string {
+	strs := make([]string, 0, len(metrics))
+	for _, metric := range metrics {
+		strs = append(strs, string(metric))
+	}
+
+	return strs
+}
+
+// Returns the metrics to measure.
+func (q QualityConfig) metrics() []QualityMetric {
+	if len(q.Metrics) == 0 {
+		return QUALITY_METRICS
+	}
+
+	return q.Metrics
+}
+
+// The scores of one metric over the frames of a rendition.
+type QualityScore struct {
+	Mean float64 `json:"mean"`
+	Min  float64 `json:"min"`
+	// The score which the configured percentile of the frames fall below.
+	Percentile float64 `json:"percentile"`
+}
+
+// The quality of one video rendition.
+type RenditionQuality struct {
+	// The period of the rendition, counting from 1.
+	Period     int                 `json:"period"`
+	Resolution VideoResolutionName `json:"resolution"`
+	Codec      VideoCodecName      `json:"codec"`
+	Bitrate    string              `json:"bitrate"`
+	// The packaged rendition, and the input it was encoded from.
+	Output string `json:"output"`
+	Source string `json:"source"`
+
+	Scores map[QualityMetric]QualityScore `json:"scores,omitempty"`
+
+	// The metrics whose mean score is below its threshold.
+	BelowThreshold []QualityMetric `json:"below_threshold,omitempty"`
+
+	// Why the rendition couldn't be measured.
+	Error string `json:"error,omitempty"`
+}
+
+// The quality of every video rendition of a job.
+type QualityReport struct {
+	Percentile float64                   `json:"percentile"`
+	Thresholds map[QualityMetric]float64 `json:"thresholds,omitempty"`
+	Renditions []RenditionQuality        `json:"renditions"`
+	// True if any rendition is below a threshold.
+	Flagged bool `json:"flagged"`
+}
+
+/*
+Measures the video renditions of a VOD job against their sources, once the
+packagers have finished, and adds the scores to the job report.
+
+	The source is put through the same filters as the rendition, and scaled
+	to its size, so that only the encode is measured.
+*/
+type QualityNode struct {
+	NodeBase
+	config         QualityConfig
+	segmentPerFile bool
+	packagerNodes  []PackagerNode
+	report         *JobReport
+	reportPath     string
+	tempDir        string
+	ffmpeg         string
+	pollInterval   time.Duration
+	mu             sync.Mutex
+	stopped        bool
+	Status         ProcessStatus
+}
+
+func NewQualityNode(pipelineConfig PipelineConfig, packagerNodes []PackagerNode, report *JobReport, reportPath string, tempDir string, hermeticFFmpeg string) *QualityNode {
+	n := &QualityNode{
+		config:         pipelineConfig.Quality,
+		segmentPerFile: pipelineConfig.SegmentPerFile,
+		packagerNodes:  packagerNodes,
+		report:         report,
+		reportPath:     reportPath,
+		tempDir:        tempDir,
+		ffmpeg:         "ffmpeg",
+		pollInterval:   QUALITY_POLL_INTERVAL,
+		Status:         Finished,
+	}
+
+	if hermeticFFmpeg != "" {
+		n.ffmpeg = hermeticFFmpeg
+	}
+
+	return n
+}
+
+func (n *QualityNode) Start() {
+	n.setStatus(Running)
+	go n.run()
+}
+
+func (n *QualityNode) CheckStatus() ProcessStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.Status
+}
+
+func (n *QualityNode) Stop() {
+	n.mu.Lock()
+	n.stopped = true
+	process := n.Process
+	n.mu.Unlock()
+
+	killProcessGroup(process)
+}
+
+func (n *QualityNode) isStopped() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.stopped
+}
+
+func (n *QualityNode) setStatus(status ProcessStatus) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Status = status
+}
+
+func (n *QualityNode) run() {
+	for {
+		done, err := n.packaged()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			n.setStatus(Errored)
+			return
+		}
+
+		if done {
+			break
+		}
+
+		if n.isStopped() {
+			n.setStatus(Finished)
+			return
+		}
+
+		time.Sleep(n.pollInterval)
+	}
+
+	quality := &QualityReport{
+		Percentile: n.config.Percentile,
+		Thresholds: n.config.Thresholds,
+		Renditions: []RenditionQuality{},
+	}
+
+	for _, packagerNode := range n.packagerNodes {
+		for _, stream := range packagerNode.OutputStreams {
+			video, ok := stream.(*VideoOutputStream)
+			if !ok {
+				continue
+			}
+
+			if n.isStopped() {
+				n.setStatus(Finished)
+				return
+			}
+
+			period := packagerNode.index
+			if period == 0 {
+				period = 1
+			}
+
+			rendition := n.measureRendition(video, period, packagerNode.segmentDir)
+			if len(rendition.BelowThreshold) > 0 {
+				quality.Flagged = true
+			}
+
+			quality.Renditions = append(quality.Renditions, rendition)
+		}
+	}
+
+	n.report.Quality = quality
+	if err := n.report.Write(n.reportPath); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to write the quality scores to the job report: %v\n", err)
+		n.setStatus(Errored)
+		return
+	}
+
+	n.setStatus(Finished)
+}
+
+// Returns true once every packager has finished.  A packager which failed
+// leaves nothing to measure, so the node fails with it.
+func (n *QualityNode) packaged() (bool, error) {
+	for i, packagerNode := range n.packagerNodes {
+		switch packagerNode.CheckStatus() {
+		case Running:
+			return false, nil
+		case Errored:
+			return false, fmt.Errorf("Quality analysis is stopped due to an error in PackagerNode#%d.", i+1)
+		}
+	}
+
+	return true, nil
+}
+
+func (n *QualityNode) measureRendition(stream *VideoOutputStream, period int, segmentDir string) RenditionQuality {
+	source := stream.GetInput()
+	rendition := RenditionQuality{
+		Period:     period,
+		Resolution: stream.Resolution.Name,
+		Codec:      stream.Codec.Name,
+		Bitrate:    stream.GetBitrate(),
+		Source:     source.Name,
+	}
+
+	output, temporary, err := renditionFile(stream, segmentDir, n.segmentPerFile, n.tempDir)
+	if temporary {
+		defer os.Remove(output)
+	}
+
+	if err != nil {
+		rendition.Error = err.Error()
+		return rendition
+	}
+
+	if temporary {
+		// Report the segments, rather than the file they were joined into.
+		mediaSegment := stream.GetMediaSegFile()
+		rendition.Output = buildPath(segmentDir, mediaSegment.WriteEnd())
+	} else {
+		rendition.Output = output
+	}
+
+	if source.relayFormat != "" {
+		rendition.Error = "the source was relayed, so it can't be read again"
+		return rendition
+	}
+
+	scores, err := n.measure(source, stream.Resolution, output)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to measure the %s of the %s %s rendition of %s: %v\n",
+			strings.Join(qualityMetricStrings(n.config.metrics()), ", "),
+			rendition.Resolution, rendition.Codec, source.Name, err)
+		rendition.Error = err.Error()
+		return rendition
+	}
+
+	rendition.Scores = scores
+	rendition.BelowThreshold = belowThresholds(scores, n.config)
+
+	return rendition
+}
+
+// Runs FFmpeg to measure a rendition, so that it can be stopped.
+func (n *QualityNode) measure(source Input, resolution VideoResolution, rendition string) (map[QualityMetric]QualityScore, error) {
+	dir, err := os.MkdirTemp(n.tempDir, "quality-")
+	if err != nil {
+		return nil, err
+	}
+
+	defer os.RemoveAll(dir)
+
+	var stderr strings.Builder
+	args := qualityArgs(n.ffmpeg, source, resolution, rendition, n.config, dir)
+
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil, fmt.Errorf("stopped")
+	}
+
+	n.Process = n.CreateProcess(BaseParams{
+		args:     args,
+		mergeEnv: true,
+		stdout:   io.Discard,
+		stderr:   &stderr,
+	})
+	process := n.Process
+	n.mu.Unlock()
+
+	if err := process.Wait(); err != nil {
+		return nil, fmt.Errorf("failed to compare with the source: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return readQualityScores(dir, n.config)
+}
+
+/*
+Returns the path of a packaged rendition, and true if it is a temporary file
+which the caller must remove.
+
+	Segments written to files of their own are joined after their init
+	segment into a single file, which FFmpeg can read.
+*/
+func renditionFile(stream MediaOutputStream, segmentDir string, segmentPerFile bool, tempDir string) (string, bool, error) {
+	if !segmentPerFile {
+		singleSegment := stream.GetSingleSegFile()
+		return buildPath(segmentDir, singleSegment.WriteEnd()), false, nil
+	}
+
+	initSegment := stream.GetInitSegFile()
+	mediaSegment := stream.GetMediaSegFile()
+	template := buildPath(segmentDir, mediaSegment.WriteEnd())
+
+	prefix, suffix, _ := strings.Cut(template, "$Number$")
+	paths, err := filepath.Glob(prefix + "*" + suffix)
+	if err != nil {
+		return "", false, err
+	}
+
+	numbers := map[string]int{}
+	var segments []string
+	for _, path := range paths {
+		number, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(path, prefix), suffix))
+		if err != nil {
+			continue
+		}
+
+		numbers[path] = number
+		segments = append(segments, path)
+	}
+
+	if len(segments) == 0 {
+		return "", false, fmt.Errorf("no segments match %s", template)
+	}
+
+	sort.Slice(segments, func(a, b int) bool {
+		return numbers[segments[a]] < numbers[segments[b]]
+	})
+
+	joined, err := os.CreateTemp(tempDir, "rendition-*"+filepath.Ext(template))
+	if err != nil {
+		return "", false, err
+	}
+
+	defer joined.Close()
+
+	for _, path := range append([]string{buildPath(segmentDir, initSegment.WriteEnd())}, segments...) {
+		if err := appendFile(joined, path); err != nil {
+			return joined.Name(), true, err
+		}
+	}
+
+	return joined.Name(), true, nil
+}
+
+func appendFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+/*
+Returns the FFmpeg command line which compares a rendition with its source,
+writing the score of each frame to a file per metric in dir.
+
+	The rendition is the first input and the source the second.  The source
+	goes through the filters of the encode, and is scaled to the size and
+	frame rate of the rendition.  The timestamps of both start at zero, so
+	their frames are paired in order.
+*/
+func qualityArgs(ffmpeg string, source Input, resolution VideoResolution, rendition string, config QualityConfig, dir string) []string {
+	common := []string{"settb=AVTB", "setpts=PTS-STARTPTS"}
+	if config.Subsample > 1 {
+		common = append(common, fmt.Sprintf("framestep=%d", config.Subsample))
+	}
+
+	var before []string
+	if source.IsInterlaced {
+		before = append(before, "pp=fd")
+	}
+
+	before = append(before, source.Processing.GetFilters()...)
+	before = append(before, source.Filters...)
+
+	after := []string{"scale=" + scaleSize(source, resolution), "setsar=1:1"}
+
+	if frameRate := outputFrameRate(source, resolution); frameRate > 0 {
+		after = append(after, "fps="+strconv.FormatFloat(frameRate, 'f', -1, 64))
+	}
+
+	after = append(after, common...)
+
+	metrics := config.metrics()
+
+	var distorted, reference string
+	var comparisons []string
+	for m, metric := range metrics {
+		distorted += fmt.Sprintf("[d%d]", m)
+		reference += fmt.Sprintf("[r%d]", m)
+
+		stats := escapeFilterValue(filepath.Join(dir, string(metric)+".log"))
+
+		switch metric {
+		case QUALITY_VMAF:
+			comparisons = append(comparisons, fmt.Sprintf("[d%d][r%d]libvmaf=log_fmt=json:log_path=%s", m, m, stats))
+		case QUALITY_PSNR:
+			comparisons = append(comparisons, fmt.Sprintf("[d%d][r%d]psnr=stats_file=%s", m, m, stats))
+		case QUALITY_SSIM:
+			comparisons = append(comparisons, fmt.Sprintf("[d%d][r%d]ssim=stats_file=%s", m, m, stats))
+		}
+	}
+
+	graph := []string{
+		"[0:v:0]" + strings.Join(common, ",") + fmt.Sprintf(",split=%d", len(metrics)) + distorted,
+		"[1:" + source.GetStreamSpecifier() + "]" + source.Processing.Watermark.buildGraph(before, after) + fmt.Sprintf(",split=%d", len(metrics)) + reference,
+	}
+	graph = append(graph, comparisons...)
+
+	args := []string{ffmpeg, "-hide_banner", "-nostats", "-loglevel", "error", "-y", "-i", rendition}
+
+	args = append(args, source.GetInputArgs()...)
+	args = append(args, strings.Fields(source.ExtraInputArgs)...)
+
+	if source.StartTime != "" {
+		args = append(args, "-ss", source.StartTime)
+	}
+	if source.EndTime != "" {
+		args = append(args, "-to", source.EndTime)
+	}
+
+	name := source.Name
+	if source.InputType == GENERATOR {
+		name = source.GetGeneratorGraph()
+	}
+
+	return append(args,
+		"-i", name,
+		"-filter_complex", strings.Join(graph, ";"),
+		"-f", "null", "-",
+	)
+}
+
+// Reads the scores which qualityArgs had FFmpeg write to dir.
+func readQualityScores(dir string, config QualityConfig) (map[QualityMetric]QualityScore, error) {
+	scores := map[QualityMetric]QualityScore{}
+
+	for _, metric := range config.metrics() {
+		path := filepath.Join(dir, string(metric)+".log")
+
+		var values []float64
+		var err error
+		switch metric {
+		case QUALITY_VMAF:
+			values, err = parseVmafLog(path)
+		case QUALITY_PSNR:
+			values, err = parseQualityStats(path, "psnr_avg")
+		case QUALITY_SSIM:
+			values, err = parseQualityStats(path, "All")
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		if len(values) == 0 {
+			return nil, fmt.Errorf("no frames were compared for %s", metric)
+		}
+
+		scores[metric] = summarizeScores(values, config.Percentile)
+	}
+
+	return scores, nil
+}
+
+// Reads the VMAF of each frame from a JSON log of libvmaf.
+func parseVmafLog(path string) ([]float64, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var log struct {
+		Frames []struct {
+			Metrics struct {
+				Vmaf float64 `json:"vmaf"`
+			} `json:"metrics"`
+		} `json:"frames"`
+	}
+
+	if err := json.Unmarshal(contents, &log); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", path, err)
+	}
+
+	values := make([]float64, 0, len(log.Frames))
+	for _, frame := range log.Frames {
+		values = append(values, frame.Metrics.Vmaf)
+	}
+
+	return values, nil
+}
+
+/*
+Reads one value of each frame from a stats file of the psnr or ssim filter.
+
+	Each line holds the values of a frame as "key:value" fields, such as
+	"n:1 mse_avg:0.52 ... psnr_avg:50.97" or "n:1 Y:0.99 ... All:0.98 (17.1)".
+*/
+func parseQualityStats(path string, key string) ([]float64, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer f.Close()
+
+	var values []float64
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		for _, field := range strings.Fields(scanner.Text()) {
+			value, found := strings.CutPrefix(field, key+":")
+			if !found {
+				continue
+			}
+
+			score, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("failed to read %s: %q is not a number", path, value)
+			}
+
+			// Identical frames have an infinite PSNR.
+			if key == "psnr_avg" && score > QUALITY_MAX_PSNR {
+				score = QUALITY_MAX_PSNR
+			}
+
+			values = append(values, score)
+		}
+	}
+
+	return values, scanner.Err()
+}
+
+// Summarizes the scores of the frames of a rendition.  There must be at least
+// one.
+func summarizeScores(values []float64, percentile float64) QualityScore {
+	sorted := append([]float64{}, values...)
+	sort.Float64s(sorted)
+
+	sum := 0.0
+	for _, value := range sorted {
+		sum += value
+	}
+
+	// The nearest rank: the smallest score which at least the percentile of
+	// the frames are at or below.
+	rank := int(math.Ceil(percentile/100*float64(len(sorted)))) - 1
+	if rank < 0 {
+		rank = 0
+	}
+
+	return QualityScore{
+		Mean:       sum / float64(len(sorted)),
+		Min:        sorted[0],
+		Percentile: sorted[rank],
+	}
+}
+
+// Returns the metrics whose mean score is below its threshold, in the order
+// they are measured.
+func belowThresholds(scores map[QualityMetric]QualityScore, config QualityConfig) []QualityMetric {
+	var below []QualityMetric
+	for _, metric := range config.metrics() {
+		threshold, ok := config.Thresholds[metric]
+		if !ok {
+			continue
+		}
+
+		if score, measured := scores[metric]; measured && score.Mean < threshold {
+			below = append(below, metric)
+		}
+	}
+
+	return below
+}
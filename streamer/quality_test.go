@@ -0,0 +1,261 @@
+package streamer
+
+import (
+	"encoding/json"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_summarizeScores(t *testing.T) {
+	values := []float64{90, 80, 70, 95, 85, 60, 75, 88, 92, 65}
+
+	got := summarizeScores(values, 20)
+	want := QualityScore{Mean: 80, Min: 60, Percentile: 65}
+	if got != want {
+		t.Errorf("summarizeScores() = %+v, want %+v", got, want)
+	}
+
+	if got := summarizeScores([]float64{42}, 5); got != (QualityScore{Mean: 42, Min: 42, Percentile: 42}) {
+		t.Errorf("summarizeScores() of one frame = %+v", got)
+	}
+}
+
+func Test_parseQualityStats(t *testing.T) {
+	dir := t.TempDir()
+
+	psnr := filepath.Join(dir, "psnr.log")
+	os.WriteFile(psnr, []byte("n:1 mse_avg:0.00 mse_y:0.00 psnr_avg:inf psnr_y:inf\nn:2 mse_avg:1.50 mse_y:1.20 psnr_avg:46.37 psnr_y:47.34\n"), 0644)
+
+	ssim := filepath.Join(dir, "ssim.log")
+	os.WriteFile(ssim, []byte("n:1 Y:0.990000 U:0.995000 V:0.994000 All:0.992000 (20.969100)\nn:2 Y:0.950000 U:0.970000 V:0.960000 All:0.956667 (13.635121)\n"), 0644)
+
+	tests := []struct {
+		name string
+		path string
+		key  string
+		want []float64
+	}{
+		{name: "psnr", path: psnr, key: "psnr_avg", want: []float64{QUALITY_MAX_PSNR, 46.37}},
+		{name: "ssim", path: ssim, key: "All", want: []float64{0.992, 0.956667}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseQualityStats(tt.path, tt.key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseQualityStats() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQualityConfig_check(t *testing.T) {
+	vod := PipelineConfig{StreamingMode: VOD, JobReport: "job_report.json"}
+	enabled := QualityConfig{Enable: true, Percentile: 5, Subsample: 1}
+
+	withQuality := func(p PipelineConfig, q QualityConfig) PipelineConfig {
+		p.Quality = q
+		return p
+	}
+
+	tests := []struct {
+		name           string
+		pipelineConfig PipelineConfig
+		wantErr        bool
+	}{
+		{name: "disabled", pipelineConfig: PipelineConfig{StreamingMode: LIVE}},
+		{name: "enabled", pipelineConfig: withQuality(vod, enabled)},
+		{name: "live", pipelineConfig: withQuality(PipelineConfig{StreamingMode: LIVE, JobReport: "job_report.json"}, enabled), wantErr: true},
+		{name: "without a job report", pipelineConfig: withQuality(PipelineConfig{StreamingMode: VOD}, enabled), wantErr: true},
+		{name: "encrypted", pipelineConfig: withQuality(PipelineConfig{StreamingMode: VOD, JobReport: "job_report.json", Encryption: EncryptionConfig{Enable: true}}, enabled), wantErr: true},
+		{name: "unknown metric", pipelineConfig: withQuality(vod, QualityConfig{Enable: true, Percentile: 5, Subsample: 1, Metrics: []QualityMetric{"butteraugli"}}), wantErr: true},
+		{name: "percentile out of range", pipelineConfig: withQuality(vod, QualityConfig{Enable: true, Percentile: 0, Subsample: 1}), wantErr: true},
+		{name: "threshold of an unmeasured metric", pipelineConfig: withQuality(vod, QualityConfig{Enable: true, Percentile: 5, Subsample: 1, Metrics: []QualityMetric{QUALITY_PSNR}, Thresholds: map[QualityMetric]float64{QUALITY_VMAF: 80}}), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				err := recover()
+				_, malformed := err.(*MalformedField)
+				_, missing := err.(*MissingRequiredField)
+				if (malformed || missing) != tt.wantErr {
+					t.Errorf("check() panicked with %v, want an error = %v", err, tt.wantErr)
+				}
+			}()
+
+			tt.pipelineConfig.Quality.check(tt.pipelineConfig)
+		})
+	}
+}
+
+func Test_renditionFile(t *testing.T) {
+	segmentDir := t.TempDir()
+
+	input := Input{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, FrameRate: 30, Resolution: "720p"}
+	resolution := *NewBitrateConfig().GetResolutionValue("720p")
+	resolution.Name = "720p"
+	stream := NewVideoOutputStream(input, t.TempDir(), getTestVideoCodec(), resolution)
+
+	for name, contents := range map[string]string{
+		"video_720p_2M_h264_init.mp4": "init,",
+		"video_720p_2M_h264_1.mp4":    "1,",
+		"video_720p_2M_h264_2.mp4":    "2,",
+		"video_720p_2M_h264_10.mp4":   "10",
+	} {
+		if err := os.WriteFile(filepath.Join(segmentDir, name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path, temporary, err := renditionFile(stream, segmentDir, true, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !temporary {
+		t.Errorf("renditionFile() of segments should be temporary")
+	}
+
+	// The segments follow their init segment in numeric order.
+	if contents, _ := os.ReadFile(path); string(contents) != "init,1,2,10" {
+		t.Errorf("renditionFile() joined %q", contents)
+	}
+
+	path, temporary, _ = renditionFile(stream, segmentDir, false, t.TempDir())
+	if want := filepath.Join(segmentDir, "video_720p_2M_h264.mp4"); path != want || temporary {
+		t.Errorf("renditionFile() of a single file = %s, %v, want %s, false", path, temporary, want)
+	}
+}
+
+func TestQualityNode(t *testing.T) {
+
+	// A stand-in for ffmpeg which writes the scores of two frames to the
+	// files named in the filter graph.
+	script := `#!/bin/sh
+for arg; do
+  if [ "$previous" = "-filter_complex" ]; then graph=$arg; fi
+  previous=$arg
+done
+path() { echo "$graph" | tr ';' '\n' | sed -n "s/.*$1=\(.*\)$/\1/p"; }
+echo '{"frames":[{"metrics":{"vmaf":90}},{"metrics":{"vmaf":70}}]}' > "$(path log_path)"
+printf 'n:1 psnr_avg:44.00\nn:2 psnr_avg:40.00\n' > "$(path psnr=stats_file)"
+printf 'n:1 All:0.990000 (20.0)\nn:2 All:0.970000 (15.2)\n' > "$(path ssim=stats_file)"
+`
+	_, ffmpeg := fakeTools(t, "", script)
+
+	segmentDir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(segmentDir, "video_720p_2M_h264.mp4"), []byte("rendition"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	input := Input{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, FrameRate: 30, Resolution: "720p"}
+	resolution := *NewBitrateConfig().GetResolutionValue("720p")
+	resolution.Name = "720p"
+	stream := NewVideoOutputStream(input, t.TempDir(), getTestVideoCodec(), resolution)
+
+	pipelineConfig := PipelineConfig{
+		StreamingMode: VOD,
+		JobReport:     "job_report.json",
+		Quality: QualityConfig{
+			Enable:     true,
+			Percentile: 50,
+			Subsample:  1,
+			Thresholds: map[QualityMetric]float64{QUALITY_VMAF: 85, QUALITY_PSNR: 40},
+		},
+	}
+
+	// A packager which has already finished.
+	packagerNode := NewPackagerNode(pipelineConfig, segmentDir, []MediaOutputStream{stream}, 0, "")
+	packagerNode.Process = exec.Command("true")
+	if err := packagerNode.Process.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	reportPath := filepath.Join(t.TempDir(), "job_report.json")
+	node := NewQualityNode(pipelineConfig, []PackagerNode{*packagerNode}, &JobReport{}, reportPath, t.TempDir(), ffmpeg)
+	node.pollInterval = 10 * time.Millisecond
+	node.Start()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for node.CheckStatus() == Running && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if status := node.CheckStatus(); status != Finished {
+		t.Fatalf("CheckStatus() = %v, want Finished", status)
+	}
+
+	contents, err := os.ReadFile(reportPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report JobReport
+	if err := json.Unmarshal(contents, &report); err != nil {
+		t.Fatal(err)
+	}
+
+	if report.Quality == nil || len(report.Quality.Renditions) != 1 {
+		t.Fatalf("the report has no rendition:\n%s", contents)
+	}
+
+	rendition := report.Quality.Renditions[0]
+	if rendition.Error != "" {
+		t.Fatalf("the rendition failed: %s", rendition.Error)
+	}
+
+	wantScores := map[QualityMetric]QualityScore{
+		QUALITY_VMAF: {Mean: 80, Min: 70, Percentile: 70},
+		QUALITY_PSNR: {Mean: 42, Min: 40, Percentile: 40},
+		QUALITY_SSIM: {Mean: 0.98, Min: 0.97, Percentile: 0.97},
+	}
+	if !reflect.DeepEqual(rendition.Scores, wantScores) {
+		t.Errorf("the scores are %+v, want %+v", rendition.Scores, wantScores)
+	}
+
+	// Only VMAF has a mean below its threshold.
+	if !reflect.DeepEqual(rendition.BelowThreshold, []QualityMetric{QUALITY_VMAF}) || !report.Quality.Flagged {
+		t.Errorf("the rendition is below %v, and flagged = %v", rendition.BelowThreshold, report.Quality.Flagged)
+	}
+
+	if rendition.Period != 1 || rendition.Resolution != "720p" || !strings.HasSuffix(rendition.Output, "video_720p_2M_h264.mp4") {
+		t.Errorf("the rendition is %+v", rendition)
+	}
+}
+
+func Test_qualityArgs(t *testing.T) {
+	source := Input{InputType: FILE, Name: "talk.mp4", MediaType: VIDEO, FrameRate: 60, Resolution: "1080p", StartTime: "10"}
+	resolution := VideoResolution{Name: "720p", MaxWidth: 1280, MaxHeight: 720, MaxFrameRate: 30}
+	config := QualityConfig{Metrics: []QualityMetric{QUALITY_PSNR, QUALITY_SSIM}, Subsample: 2}
+
+	args := qualityArgs("ffmpeg", source, resolution, "rendition.mp4", config, "/tmp/q")
+
+	var graph string
+	for i, arg := range args {
+		if arg == "-filter_complex" {
+			graph = args[i+1]
+		}
+	}
+
+	want := "[0:v:0]settb=AVTB,setpts=PTS-STARTPTS,framestep=2,split=2[d0][d1];" +
+		"[1:v:0]scale=-2:720,setsar=1:1,fps=30,settb=AVTB,setpts=PTS-STARTPTS,framestep=2,split=2[r0][r1];" +
+		"[d0][r0]psnr=stats_file=/tmp/q/psnr.log;" +
+		"[d1][r1]ssim=stats_file=/tmp/q/ssim.log"
+	if graph != want {
+		t.Errorf("qualityArgs() graph =\n%s\nwant\n%s", graph, want)
+	}
+
+	if !strings.Contains(strings.Join(args, " "), "-i rendition.mp4 -ss 10 -i talk.mp4") {
+		t.Errorf("qualityArgs() = %v", args)
+	}
+}
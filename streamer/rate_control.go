@@ -0,0 +1,231 @@
+// A module for the rate control of video encoders.
+package streamer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type RateControlMode string
+
+const (
+	// A constant bitrate, as strict as the encoder allows.  Best for live.
+	RATE_CONTROL_CBR RateControlMode = "cbr"
+	// A variable bitrate averaging the resolution's bitrate, capped at maxrate.
+	RATE_CONTROL_CAPPED_VBR RateControlMode = "capped-vbr"
+	// A constant quality, capped at maxrate if one is given.  Best for VOD.
+	RATE_CONTROL_CRF RateControlMode = "crf"
+)
+
+// The CRF of each software encoder, when one isn't given.  The scales of the
+// encoders differ, so these are roughly the same quality.
+var DEFAULT_CRF = map[VideoCodecName]int{
+	H264: 23,
+	HEVC: 28,
+	VP9:  31,
+	AV1:  30,
+}
+
+// The presets of x264 and x265.
+var ENCODER_PRESETS = []string{
+	"ultrafast", "superfast", "veryfast", "faster", "fast",
+	"medium", "slow", "slower", "veryslow", "placebo",
+}
+
+// How the encoder spends the bits of a resolution.
+type RateControlConfig struct {
+	/*
+		The rate control mode: 'cbr', 'capped-vbr' or 'crf'.
+
+		  If unspecified, the encoder aims for the resolution's bitrate, in its own
+		  default mode.
+	*/
+	Mode RateControlMode `yaml:"mode,omitempty"`
+
+	/*
+		The highest bitrate, such as '6M'.
+
+		  Required with 'capped-vbr', and caps the quality of 'crf'.  With 'cbr',
+		  it is the resolution's bitrate.
+	*/
+	MaxRate BitrateString `yaml:"maxrate,omitempty"`
+
+	/*
+		The size of the decoder's buffer, such as '12M', which sets how far the
+		bitrate may stray from the target, and for how long.
+
+		  Defaults to one second of maxrate, or of the bitrate with 'cbr'.
+	*/
+	BufSize BitrateString `yaml:"bufsize,omitempty"`
+
+	/*
+		The constant rate factor with 'crf'.  Lower is better.
+
+		  Defaults to 23 for h264, 28 for hevc, 31 for vp9 and 30 for av1.
+	*/
+	Crf int `yaml:"crf,omitempty"`
+
+	/*
+		The preset of the h264 and hevc software encoders, such as 'medium'.
+
+		  Defaults to 'ultrafast' for live and 'slow' for VOD.
+	*/
+	Preset string `yaml:"preset,omitempty"`
+}
+
+// Checks the rate control of a resolution.
+func (rc RateControlConfig) check() {
+	switch rc.Mode {
+	case "", RATE_CONTROL_CBR, RATE_CONTROL_CRF:
+	case RATE_CONTROL_CAPPED_VBR:
+		if rc.MaxRate == "" {
+			panic(NewMissingRequiredField(rc, "MaxRate"))
+		}
+	default:
+		panic(NewMalformedField(rc, "Mode", `must be "cbr", "capped-vbr" or "crf"`))
+	}
+
+	if rc.MaxRate != "" {
+		if err := rc.MaxRate.Validate(); err != nil {
+			panic(NewMalformedField(rc, "MaxRate", err.Error()))
+		}
+
+		if rc.Mode == RATE_CONTROL_CBR {
+			panic(NewMalformedField(rc, "MaxRate", `not supported with mode "cbr"`))
+		}
+	}
+
+	if rc.BufSize != "" {
+		if err := rc.BufSize.Validate(); err != nil {
+			panic(NewMalformedField(rc, "BufSize", err.Error()))
+		}
+	}
+
+	if rc.Crf != 0 && rc.Mode != RATE_CONTROL_CRF {
+		panic(NewMalformedField(rc, "Crf", `only valid with mode "crf"`))
+	}
+
+	if rc.Crf < 0 || rc.Crf > 63 {
+		panic(NewMalformedField(rc, "Crf", "must be between 0 and 63"))
+	}
+
+	if rc.Preset != "" && !ContainsString(ENCODER_PRESETS, rc.Preset) {
+		reason := fmt.Sprintf("must be one of %v", ENCODER_PRESETS)
+		panic(NewMalformedField(rc, "Preset", reason))
+	}
+}
+
+// Returns true if an encoder in this mode can make use of a first pass.
+func (rc RateControlConfig) isTwoPass(codec *VideoCodec) bool {
+	// A constant quality needs no analysis, and hardware encoders have no
+	// first pass.
+	return rc.Mode != RATE_CONTROL_CRF && !codec.IsHardwareAccelerated()
+}
+
+/*
+Returns the arguments which set the bitrate of an encoder.
+
+	Hardware encoders have no CRF, so they aim for the bitrate instead, capped
+	at maxrate.
+*/
+func (rc RateControlConfig) GetArgs(codec *VideoCodec, bitrate string) []string {
+	bufsize := func(rate string) string {
+		if rc.BufSize != "" {
+			return string(rc.BufSize)
+		}
+
+		return rate
+	}
+
+	switch rc.Mode {
+	case RATE_CONTROL_CBR:
+		return []string{
+			"-b:v", bitrate,
+			"-minrate", bitrate,
+			"-maxrate", bitrate,
+			"-bufsize", bufsize(bitrate),
+		}
+
+	case RATE_CONTROL_CAPPED_VBR:
+		return []string{
+			"-b:v", bitrate,
+			"-maxrate", string(rc.MaxRate),
+			"-bufsize", bufsize(string(rc.MaxRate)),
+		}
+
+	case RATE_CONTROL_CRF:
+		if codec.IsHardwareAccelerated() {
+			args := []string{"-b:v", bitrate}
+			if rc.MaxRate != "" {
+				args = append(args, "-maxrate", string(rc.MaxRate), "-bufsize", bufsize(string(rc.MaxRate)))
+			}
+
+			return args
+		}
+
+		crf := rc.Crf
+		if crf == 0 {
+			crf = DEFAULT_CRF[codec.Name]
+		}
+
+		args := []string{"-crf", strconv.Itoa(crf)}
+		if rc.MaxRate != "" {
+			args = append(args, "-maxrate", string(rc.MaxRate), "-bufsize", bufsize(string(rc.MaxRate)))
+		}
+
+		if codec.Name == VP9 || codec.Name == AV1 {
+			// libvpx and libaom only take the CRF as a constant quality with a
+			// bitrate of 0.  With a bitrate, it is a floor on the quality.
+			if rc.MaxRate != "" {
+				args = append(args, "-b:v", string(rc.MaxRate))
+			} else {
+				args = append(args, "-b:v", "0")
+			}
+		}
+
+		return args
+	}
+
+	return []string{"-b:v", bitrate}
+}
+
+/*
+Returns the private options of x264 and x265 for this mode, and for a pass
+of a two-pass encode, if any.
+
+	x265 is given its passes here, since FFmpeg's -pass doesn't reach it.
+*/
+func (rc RateControlConfig) encoderParams(codec *VideoCodec, pass int, passLog string) []string {
+	if codec.IsHardwareAccelerated() {
+		return nil
+	}
+
+	var params []string
+	switch codec.Name {
+	case H264:
+		if rc.Mode == RATE_CONTROL_CBR {
+			// Fill the stream to the bitrate, so it is constant on the wire.
+			params = append(params, "nal-hrd=cbr")
+		}
+
+		if len(params) > 0 {
+			return []string{"-x264-params", strings.Join(params, ":")}
+		}
+
+	case HEVC:
+		if rc.Mode == RATE_CONTROL_CBR {
+			params = append(params, "strict-cbr=1")
+		}
+
+		if pass > 0 {
+			params = append(params, fmt.Sprintf("pass=%d", pass), "stats="+passLog)
+		}
+
+		if len(params) > 0 {
+			return []string{"-x265-params", strings.Join(params, ":")}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,175 @@
+package streamer
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestRateControlConfig_GetArgs(t *testing.T) {
+	tests := []struct {
+		name        string
+		rateControl RateControlConfig
+		codec       *VideoCodec
+		want        []string
+	}{
+		{
+			name:  "default",
+			codec: NewVideoCodec(H264),
+			want:  []string{"-b:v", "4M"},
+		},
+		{
+			name:        "cbr",
+			rateControl: RateControlConfig{Mode: RATE_CONTROL_CBR},
+			codec:       NewVideoCodec(H264),
+			want:        []string{"-b:v", "4M", "-minrate", "4M", "-maxrate", "4M", "-bufsize", "4M"},
+		},
+		{
+			name:        "capped vbr",
+			rateControl: RateControlConfig{Mode: RATE_CONTROL_CAPPED_VBR, MaxRate: "6M", BufSize: "12M"},
+			codec:       NewVideoCodec(HEVC),
+			want:        []string{"-b:v", "4M", "-maxrate", "6M", "-bufsize", "12M"},
+		},
+		{
+			name:        "capped crf",
+			rateControl: RateControlConfig{Mode: RATE_CONTROL_CRF, MaxRate: "6M"},
+			codec:       NewVideoCodec(H264),
+			want:        []string{"-crf", "23", "-maxrate", "6M", "-bufsize", "6M"},
+		},
+		{
+			name:        "constant quality vp9",
+			rateControl: RateControlConfig{Mode: RATE_CONTROL_CRF, Crf: 35},
+			codec:       NewVideoCodec(VP9),
+			want:        []string{"-crf", "35", "-b:v", "0"},
+		},
+		{
+			name:        "crf on hardware",
+			rateControl: RateControlConfig{Mode: RATE_CONTROL_CRF, MaxRate: "6M"},
+			codec:       NewVideoCodec("hw:h264"),
+			want:        []string{"-b:v", "4M", "-maxrate", "6M", "-bufsize", "6M"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.rateControl.GetArgs(tt.codec, "4M"); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetArgs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRateControlConfig_check(t *testing.T) {
+	tests := []struct {
+		name        string
+		rateControl RateControlConfig
+		wantErr     bool
+	}{
+		{name: "crf", rateControl: RateControlConfig{Mode: RATE_CONTROL_CRF, Crf: 20, MaxRate: "6M", Preset: "medium"}},
+		{name: "unknown mode", rateControl: RateControlConfig{Mode: "abr"}, wantErr: true},
+		{name: "capped vbr without a cap", rateControl: RateControlConfig{Mode: RATE_CONTROL_CAPPED_VBR}, wantErr: true},
+		{name: "cbr with a cap", rateControl: RateControlConfig{Mode: RATE_CONTROL_CBR, MaxRate: "6M"}, wantErr: true},
+		{name: "crf without the mode", rateControl: RateControlConfig{Crf: 20}, wantErr: true},
+		{name: "malformed bufsize", rateControl: RateControlConfig{BufSize: "lots"}, wantErr: true},
+		{name: "unknown preset", rateControl: RateControlConfig{Preset: "glacial"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				err := recover()
+				_, malformed := err.(*MalformedField)
+				_, missing := err.(*MissingRequiredField)
+				if (malformed || missing) != tt.wantErr {
+					t.Errorf("check() panicked with %v, want an error = %v", err, tt.wantErr)
+				}
+			}()
+
+			tt.rateControl.check()
+		})
+	}
+}
+
+func TestVideoResolution_RateControlYaml(t *testing.T) {
+	config := `
+video_resolutions:
+  plain:
+    max_width: 640
+    max_height: 360
+    bitrates:
+      h264: 400k
+  capped:
+    max_width: 1280
+    max_height: 720
+    bitrates:
+      h264: 2M
+    rate_control:
+      mode: crf
+      maxrate: 3M
+`
+
+	var bitrateConfig BitrateConfig
+	if err := yaml.Unmarshal([]byte(config), &bitrateConfig); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := bitrateConfig.VideoResolutions["capped"].RateControl; got != (RateControlConfig{Mode: RATE_CONTROL_CRF, MaxRate: "3M"}) {
+		t.Errorf("RateControl = %+v, want capped crf", got)
+	}
+
+	// A bitrate is still required for each codec listed.
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Unmarshal() of an empty bitrate succeeded")
+		}
+	}()
+
+	yaml.Unmarshal([]byte("video_resolutions:\n  blank:\n    max_height: 360\n    bitrates:\n      h264: \"\"\n"), &BitrateConfig{})
+}
+
+func TestTranscoderNode_TwoPass(t *testing.T) {
+	dir := t.TempDir()
+	video := Input{Name: "film.mkv", MediaType: VIDEO, FrameRate: 24, Resolution: "1080p"}
+	audio := Input{Name: "film.mkv", MediaType: AUDIO, ChannelLayout: "stereo"}
+
+	resolution := *NewBitrateConfig().GetResolutionValue("1080p")
+	resolution.RateControl = RateControlConfig{Mode: RATE_CONTROL_CAPPED_VBR, MaxRate: "6M"}
+	videoStream := NewVideoOutputStream(video, dir, NewVideoCodec(H264), resolution)
+	audioStream := NewAudioOutputStream(audio, dir, NewAudioCodec(AAC), *NewBitrateConfig().GetChannelLayoutValue("stereo"))
+
+	pipelineConfig := PipelineConfig{StreamingMode: VOD, SegmentSize: 4, TwoPass: true}
+	node := NewTranscoderNode([]Input{video, audio}, pipelineConfig, []MediaOutputStream{videoStream, audioStream}, 0, "")
+
+	if !node.isTwoPass() {
+		t.Fatal("isTwoPass() = false, want true for a capped VBR rendition")
+	}
+
+	videoPipe := videoStream.GetIpcPipe()
+	audioPipe := audioStream.GetIpcPipe()
+	passLog := videoPipe.WriteEnd() + "-pass"
+
+	first := strings.Join(node.commandLine(1), " ")
+	if !strings.Contains(first, "-pass 1 -passlogfile "+passLog) || !strings.Contains(first, "-f null") || !strings.HasSuffix(first, os.DevNull) {
+		t.Errorf("the first pass should analyse the video into %s, got %s", passLog, first)
+	}
+
+	if strings.Contains(first, "-c:a") {
+		t.Errorf("the first pass should not encode audio, got %s", first)
+	}
+
+	second := strings.Join(node.commandLine(2), " ")
+	if !strings.Contains(second, "-pass 2 -passlogfile "+passLog+" -f mp4") || !strings.Contains(second, audioPipe.WriteEnd()) {
+		t.Errorf("the second pass should encode every output, got %s", second)
+	}
+}
+
+func Test_shellJoin(t *testing.T) {
+	got := shellJoin([]string{"ffmpeg", "-vf", "drawtext=text='%{pts}'", "a b"})
+	want := `'ffmpeg' '-vf' 'drawtext=text='\''%{pts}'\''' 'a b'`
+	if got != want {
+		t.Errorf("shellJoin() = %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,522 @@
+// A module that relays live inputs to the transcoder, switching sources when one fails.
+package streamer
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// How long to wait before reconnecting to a source which dropped.
+const RELAY_RECONNECT_DELAY = time.Second
+
+// How often the relay checks its sources for stalls.
+const RELAY_STALL_CHECK_INTERVAL = 250 * time.Millisecond
+
+// How often lost sources are probed while the slate is shown, unless the
+// input's failover options set a revert interval.
+const RELAY_SLATE_RETRY_INTERVAL = 5 * time.Second
+
+// Input types whose streams are raw, and must be encoded to fit in MPEG-TS.
+var RELAY_ENCODED_TYPES = []InputType{
+	WEBCAM,
+	MICROPHONE,
+	GENERATOR,
+}
+
+// Input types which are relayed so that the slate can replace them, when
+// there is one.
+var SLATE_INPUT_TYPES = []InputType{
+	WEBCAM,
+	MICROPHONE,
+	SRT,
+	UDP_TS,
+}
+
+// Why a relayed source was left.
+type relayExit int
+
+const (
+	relayDropped relayExit = iota
+	relayStalled
+	relayReverted
+	relayStopped
+)
+
+// A way to produce every stream of a relay node.
+type relaySource struct {
+	// A name for the source in logs.
+	label string
+
+	// The FFmpeg inputs to read.
+	inputs []Input
+
+	// The -map argument of each relayed stream, in order.
+	maps []string
+
+	// True if the streams are raw, and must be encoded.
+	encode bool
+
+	// The input to probe to tell if the source is available, or nil if it
+	// always is.
+	probe *Input
+}
+
+/*
+Relays a live input to named pipes as MPEG-TS, switching to the next source
+whenever the current one drops or stalls.
+
+	The sources are the input itself, followed by its failover backups and
+	the slate, if there is one.  With no backups and no slate, the input is
+	reconnected instead.  The pipes are held open across switches, so the
+	transcoder and packager never see the end of the stream.  Timestamps are
+	offset by the time since the relay started, so they keep increasing
+	across a switch and the manifests stay valid.
+
+	Every output receives the streams of every input added with AddOutput,
+	so inputs which share a source share a single connection.
+*/
+type RelayNode struct {
+	NodeBase
+	primary        Input
+	slate          SlateConfig
+	ffmpeg         string
+	streams        []Input
+	outputs        []string
+	reconnectDelay time.Duration
+	mu             sync.Mutex
+	stopped        bool
+	Status         ProcessStatus
+}
+
+func NewRelayNode(input Input, slate SlateConfig, hermeticFFmpeg string) *RelayNode {
+	n := &RelayNode{
+		primary:        input,
+		slate:          slate,
+		ffmpeg:         "ffmpeg",
+		reconnectDelay: RELAY_RECONNECT_DELAY,
+		Status:         Finished,
+	}
+
+	if hermeticFFmpeg != "" {
+		n.ffmpeg = hermeticFFmpeg
+	}
+
+	return n
+}
+
+/*
+Adds a path (usually a named pipe) to which the relayed stream is written,
+and the input whose stream should be relayed.
+
+	Returns the track number of that stream in the relayed output, among the
+	streams of its media type.
+*/
+func (n *RelayNode) AddOutput(path string, stream Input) int {
+	trackNum := relayTrackNum(n.streams, stream)
+
+	n.outputs = append(n.outputs, path)
+	n.streams = append(n.streams, stream)
+
+	return trackNum
+}
+
+// Returns the track number a stream will have among the relayed streams of
+// its media type, if it is added after the given streams.
+func relayTrackNum(streams []Input, stream Input) int {
+	trackNum := 0
+	for _, s := range streams {
+		if s.MediaType == stream.MediaType {
+			trackNum++
+		}
+	}
+
+	return trackNum
+}
+
+func (n *RelayNode) Start() {
+	n.mu.Lock()
+	n.Status = Running
+	n.mu.Unlock()
+	go n.run()
+}
+
+func (n *RelayNode) CheckStatus() ProcessStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.Status
+}
+
+func (n *RelayNode) Stop() {
+	n.mu.Lock()
+	n.stopped = true
+	process := n.Process
+	n.mu.Unlock()
+
+	killProcessGroup(process)
+}
+
+func (n *RelayNode) isStopped() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.stopped
+}
+
+// Ends a process and its children.  The caller still has to wait for it.
+func killProcessGroup(process *exec.Cmd) {
+	if process == nil || process.Process == nil {
+		return
+	}
+
+	if pgid, err := syscall.Getpgid(process.Process.Pid); err == nil {
+		syscall.Kill(-pgid, syscall.SIGKILL)
+	}
+}
+
+// Lists the sources of the relay, in the order in which they are tried.
+func (n *RelayNode) sources() []relaySource {
+	sources := []relaySource{readRelaySource(n.streams, n.primary, true)}
+
+	for _, backup := range n.primary.Failover.Backups {
+		sources = append(sources, readRelaySource(n.streams, backup.asInput(n.primary), false))
+	}
+
+	if n.slate.IsEnabled() {
+		sources = append(sources, slateRelaySource(n.streams, n.slate))
+	}
+
+	return sources
+}
+
+// Returns the source which reads every stream from the given input.
+func readRelaySource(streams []Input, source Input, isPrimary bool) relaySource {
+	rs := relaySource{
+		label:  source.Name,
+		encode: ContainsInputType(RELAY_ENCODED_TYPES, source.InputType),
+	}
+
+	if source.InputType == GENERATOR {
+		// Each stream needs a generator of its own media type.
+		for idx, stream := range streams {
+			generator := stream
+			generator.InputType = GENERATOR
+			generator.Generator = source.Generator
+
+			generator.Name = source.Name
+			if !ContainsString(GENERATOR_SOURCES[stream.MediaType], generator.Name) {
+				generator.Name = GENERATOR_SOURCES[stream.MediaType][0]
+			}
+
+			// Fall back to the defaults of a generator input for anything the
+			// stream doesn't know.
+			if stream.MediaType == VIDEO && generator.GetResolution() == nil {
+				generator.Resolution = "720p"
+			}
+
+			if stream.MediaType == VIDEO && generator.FrameRate == 0 {
+				generator.FrameRate = 30
+			}
+
+			if stream.MediaType == AUDIO && generator.GetChannelLayout() == nil {
+				generator.ChannelLayout = "stereo"
+			}
+
+			if generator.Generator.Frequency == 0 {
+				generator.Generator.Frequency = 1000
+			}
+
+			rs.inputs = append(rs.inputs, generator)
+			rs.maps = append(rs.maps, fmt.Sprintf("%d:0", idx))
+		}
+
+		return rs
+	}
+
+	rs.inputs = []Input{source}
+
+	for _, stream := range streams {
+		if !isPrimary {
+			// Track numbers are the only selection shared by every source.
+			stream.resetTrack(stream.TrackNum)
+		}
+
+		// A stream missing from a backup is skipped instead of failing it.
+		rs.maps = append(rs.maps, fmt.Sprintf("0:%s?", stream.GetStreamSpecifier()))
+	}
+
+	probe := source
+	if len(streams) > 0 {
+		probe.MediaType = streams[0].MediaType
+		probe.TrackNum = streams[0].TrackNum
+	}
+
+	rs.probe = &probe
+	return rs
+}
+
+// Returns the source which shows the slate in place of every stream.
+func slateRelaySource(streams []Input, slate SlateConfig) relaySource {
+	rs := relaySource{label: "slate", encode: true}
+
+	for idx, stream := range streams {
+		var input Input
+
+		if stream.MediaType == VIDEO {
+			frameRate := stream.FrameRate
+			if frameRate == 0 {
+				frameRate = 30
+			}
+
+			input = Input{InputType: LOOPED_FILE, Name: slate.Clip, MediaType: VIDEO}
+			if slate.Image != "" {
+				// Repeat the still image at the frame rate of the stream.
+				input.Name = slate.Image
+				input.ExtraInputArgs = fmt.Sprintf("-loop 1 -framerate %s", strconv.FormatFloat(frameRate, 'f', -1, 64))
+			}
+		} else {
+			input = Input{
+				InputType:     GENERATOR,
+				Name:          "anullsrc",
+				MediaType:     AUDIO,
+				ChannelLayout: stream.ChannelLayout,
+				Generator:     GeneratorConfig{Frequency: slate.Frequency},
+			}
+
+			if slate.Audio == SLATE_TONE {
+				input.Name = "sine"
+			}
+
+			if input.GetChannelLayout() == nil {
+				input.ChannelLayout = "stereo"
+			}
+		}
+
+		rs.inputs = append(rs.inputs, input)
+		rs.maps = append(rs.maps, fmt.Sprintf("%d:%s:0", idx, map[MediaType]string{VIDEO: "v", AUDIO: "a"}[stream.MediaType]))
+	}
+
+	return rs
+}
+
+/*
+Builds the command line which copies a source to stdout, with timestamps
+starting at the given offset in seconds.
+
+	With a duration in seconds, the source is cut off after that long.
+*/
+func relayArgs(ffmpeg string, source relaySource, offset float64, duration float64) []string {
+	args := []string{
+		ffmpeg,
+		"-nostdin",
+		"-loglevel", "error",
+	}
+
+	for _, input := range source.inputs {
+		args = append(args, input.GetInputArgs()...)
+		args = append(args, strings.Fields(input.ExtraInputArgs)...)
+
+		if input.StartTime != "" {
+			args = append(args, "-ss", input.StartTime)
+		}
+
+		if input.EndTime != "" {
+			args = append(args, "-to", input.EndTime)
+		}
+
+		name := input.Name
+		switch input.InputType {
+		case FILE:
+			// Files are played as live sources, in real time.
+			args = append(args, "-re")
+		case LOOPED_FILE:
+			args = append(args, "-stream_loop", "-1", "-re")
+		case GENERATOR:
+			args = append(args, "-re")
+			name = input.GetGeneratorGraph()
+		}
+
+		args = append(args, "-i", name)
+	}
+
+	for _, m := range source.maps {
+		args = append(args, "-map", m)
+	}
+
+	if source.encode {
+		// Raw streams can't be carried in MPEG-TS, so they are encoded at a high
+		// quality.  The transcoder decodes them again anyway.
+		args = append(args, []string{
+			"-c:v", "libx264", "-preset", "veryfast", "-tune", "zerolatency", "-crf", "16", "-pix_fmt", "yuv420p",
+			"-c:a", "aac", "-b:a", "320k",
+		}...)
+	} else {
+		args = append(args, "-c", "copy")
+	}
+
+	if duration > 0 {
+		args = append(args, "-t", strconv.FormatFloat(duration, 'f', 3, 64))
+	}
+
+	args = append(args, []string{
+		"-output_ts_offset", strconv.FormatFloat(offset, 'f', 3, 64),
+		"-f", "mpegts",
+		"pipe:1",
+	}...)
+
+	return args
+}
+
+func (n *RelayNode) run() {
+	// Each output is opened when the transcoder opens the other end.
+	output := newFanOutWriter(n.outputs)
+	defer output.Close()
+
+	sources := n.sources()
+
+	// The sources which can be lost, which excludes the slate.
+	live := len(sources)
+	if n.slate.IsEnabled() {
+		live--
+	}
+
+	startTime := time.Now()
+	current := 0
+
+	for !n.isStopped() {
+		source := sources[current]
+
+		n.mu.Lock()
+		n.Process = n.CreateProcess(BaseParams{
+			args:   relayArgs(n.ffmpeg, source, time.Since(startTime).Seconds(), 0),
+			stdout: output,
+			stderr: os.Stderr,
+		})
+		process := n.Process
+		n.mu.Unlock()
+
+		exit, next := n.watch(process, output, sources, current, live)
+
+		if output.Err() != nil {
+			// The transcoder is gone, so there is nobody left to relay to.
+			n.finish(Errored)
+			return
+		}
+
+		if exit == relayStopped || n.isStopped() {
+			break
+		}
+
+		switch exit {
+		case relayDropped:
+			fmt.Fprintf(os.Stderr, "Lost input %s, switching to %s\n", source.label, sources[next].label)
+		case relayStalled:
+			fmt.Fprintf(os.Stderr, "Input %s stalled, switching to %s\n", source.label, sources[next].label)
+		case relayReverted:
+			fmt.Fprintf(os.Stderr, "Input %s is back, switching to it\n", sources[next].label)
+		}
+
+		if next <= current && exit != relayReverted {
+			// Every source has been tried, so give them a moment to recover.
+			time.Sleep(n.reconnectDelay)
+		}
+
+		current = next
+	}
+
+	n.finish(Finished)
+}
+
+/*
+Waits for the process relaying a source to exit, and ends it early if the
+source stalls or an earlier source should be used again.
+
+	Returns why the source was left, and the index of the source to use next.
+*/
+func (n *RelayNode) watch(process *exec.Cmd, output *fanOutWriter, sources []relaySource, current int, live int) (relayExit, int) {
+	done := make(chan struct{})
+	go func() {
+		process.Wait()
+		close(done)
+	}()
+
+	failover := n.primary.Failover
+	stallTimeout := time.Duration(failover.StallTimeout * float64(time.Second))
+	stallTicker := time.NewTicker(RELAY_STALL_CHECK_INTERVAL)
+	defer stallTicker.Stop()
+
+	revertInterval := time.Duration(failover.RevertInterval * float64(time.Second))
+
+	// While the slate is shown, every source is probed.  While a backup is in
+	// use, only the primary source is, and only if reverting is enabled.
+	candidates := 0
+	if current >= live {
+		candidates = live
+		if revertInterval == 0 {
+			revertInterval = RELAY_SLATE_RETRY_INTERVAL
+		}
+	} else if current != 0 && failover.RevertToPrimary {
+		candidates = 1
+	}
+
+	var revert <-chan time.Time
+	if candidates > 0 && revertInterval > 0 {
+		revertTicker := time.NewTicker(revertInterval)
+		defer revertTicker.Stop()
+		revert = revertTicker.C
+	}
+
+	// The next source, if this one fails.
+	next := current + 1
+	if next >= len(sources) || current >= live {
+		next = 0
+	}
+
+	lastWritten := output.Written()
+	lastProgress := time.Now()
+
+	// Ends the process early, and waits for it to exit.
+	end := func(exit relayExit, next int) (relayExit, int) {
+		killProcessGroup(process)
+		<-done
+		return exit, next
+	}
+
+	for {
+		select {
+		case <-done:
+			if n.isStopped() {
+				return relayStopped, current
+			}
+
+			return relayDropped, next
+		case <-stallTicker.C:
+			if written := output.Written(); written != lastWritten {
+				lastWritten = written
+				lastProgress = time.Now()
+			} else if stallTimeout > 0 && time.Since(lastProgress) > stallTimeout {
+				return end(relayStalled, next)
+			}
+		case <-revert:
+			for idx := 0; idx < candidates; idx++ {
+				probe := sources[idx].probe
+				if probe == nil || IsAlive(*probe, stallTimeout+RELAY_SLATE_RETRY_INTERVAL) {
+					return end(relayReverted, idx)
+				}
+			}
+		}
+	}
+}
+
+func (n *RelayNode) finish(status ProcessStatus) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Status = status
+}
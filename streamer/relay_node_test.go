@@ -0,0 +1,275 @@
+package streamer
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRelayNode_Reconnects(t *testing.T) {
+	dir := t.TempDir()
+
+	// A stand-in for ffmpeg which prints its timestamp offset and exits, as if
+	// the sender dropped right away.
+	_, ffmpeg := fakeTools(t, "", "#!/bin/sh\nwhile [ \"$1\" != \"-output_ts_offset\" ]; do shift; done\necho \"$2\"\n")
+
+	output := filepath.Join(dir, "output.ts")
+	input := Input{InputType: SRT, Name: "srt://127.0.0.1:9000", MediaType: VIDEO, Srt: SrtConfig{Mode: SRT_CALLER, Latency: 120}}
+
+	node := NewRelayNode(input, SlateConfig{}, ffmpeg)
+	node.reconnectDelay = 10 * time.Millisecond
+	node.AddOutput(output, input)
+	node.Start()
+
+	var offsets []string
+	for start := time.Now(); len(offsets) < 3 && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+		contents, _ := os.ReadFile(output)
+		offsets = strings.Fields(string(contents))
+	}
+
+	node.Stop()
+
+	if len(offsets) < 3 {
+		t.Fatalf("relay ran %d times, want at least 3", len(offsets))
+	}
+
+	if offsets[0] != "0.000" || offsets[1] <= offsets[0] || offsets[2] <= offsets[1] {
+		t.Errorf("offsets = %v, want increasing offsets starting at 0.000", offsets)
+	}
+
+	if status := node.CheckStatus(); status == Errored {
+		t.Errorf("status = %v after Stop(), want not Errored", status)
+	}
+}
+
+// Writes a stand-in for ffmpeg which prints the source it reads, then acts
+// like it: sources named "stall" hang, sources named "steady" keep sending
+// data, and any other source drops right away.
+func writeTestRelayFFmpeg(t *testing.T) string {
+	script := `#!/bin/sh
+while [ "$1" != "-i" ]; do shift; done
+echo "$2"
+case "$2" in
+  *stall*) sleep 30 ;;
+  *steady*) while true; do echo data; sleep 0.05; done ;;
+  *broken*) exit 1 ;;
+esac
+`
+	_, ffmpeg := fakeTools(t, "", script)
+
+	return ffmpeg
+}
+
+// Runs a relay until it has read the given number of sources, and returns
+// them in order.
+func runTestRelay(t *testing.T, input Input, slate SlateConfig, count int) []string {
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output.ts")
+
+	node := NewRelayNode(input, slate, writeTestRelayFFmpeg(t))
+	node.reconnectDelay = 10 * time.Millisecond
+	node.AddOutput(output, input)
+	node.Start()
+	defer node.Stop()
+
+	var sources []string
+	for start := time.Now(); len(sources) < count && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+
+		contents, _ := os.ReadFile(output)
+		sources = nil
+		for _, line := range strings.Fields(string(contents)) {
+			if line != "data" {
+				sources = append(sources, line)
+			}
+		}
+	}
+
+	if len(sources) < count {
+		t.Fatalf("relay read %v, want at least %d sources", sources, count)
+	}
+
+	return sources[:count]
+}
+
+func TestRelayNode_Failover(t *testing.T) {
+	input := Input{
+		InputType: UDP_TS,
+		Name:      "udp://stall",
+		MediaType: VIDEO,
+		Failover: FailoverConfig{
+			Backups: []FailoverSource{
+				{InputType: UDP_TS, Name: "udp://drop"},
+				{InputType: UDP_TS, Name: "udp://backup"},
+			},
+			StallTimeout: 0.3,
+		},
+	}
+
+	want := []string{"udp://stall", "udp://drop", "udp://backup", "udp://stall"}
+	if got := runTestRelay(t, input, SlateConfig{}, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("sources = %v, want %v", got, want)
+	}
+}
+
+// Replaces ffprobe with a stand-in which always finds the stream.
+func useTestAliveFFProbe(t *testing.T) {
+	fakeTools(t, "#!/bin/sh\necho 0\n", "")
+}
+
+func TestRelayNode_RevertToPrimary(t *testing.T) {
+	useTestAliveFFProbe(t)
+
+	input := Input{
+		InputType: UDP_TS,
+		Name:      "udp://primary",
+		MediaType: VIDEO,
+		Failover: FailoverConfig{
+			Backups:         []FailoverSource{{InputType: UDP_TS, Name: "udp://steady"}},
+			StallTimeout:    1,
+			RevertToPrimary: true,
+			RevertInterval:  0.1,
+		},
+	}
+
+	want := []string{"udp://primary", "udp://steady", "udp://primary"}
+	if got := runTestRelay(t, input, SlateConfig{}, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("sources = %v, want %v", got, want)
+	}
+}
+
+func TestRelayNode_Slate(t *testing.T) {
+	useTestAliveFFProbe(t)
+
+	input := Input{
+		InputType: SRT,
+		Name:      "srt://drop",
+		MediaType: VIDEO,
+		Failover:  FailoverConfig{StallTimeout: 1, RevertInterval: 0.1},
+	}
+
+	// The slate keeps sending data until the input is back.
+	slate := SlateConfig{Image: "slate-steady.png", Audio: SLATE_SILENCE}
+
+	want := []string{"srt://drop", "slate-steady.png", "srt://drop"}
+	if got := runTestRelay(t, input, slate, len(want)); !reflect.DeepEqual(got, want) {
+		t.Errorf("sources = %v, want %v", got, want)
+	}
+}
+
+func TestRelayNode_args(t *testing.T) {
+	video := Input{InputType: UDP_TS, Name: "udp://239.1.1.1:5000", MediaType: VIDEO, FrameRate: 25, Program: 2}
+	audio := Input{InputType: UDP_TS, Name: "udp://239.1.1.1:5000", MediaType: AUDIO, ChannelLayout: "stereo", Pid: 257, AvOffset: "0.2"}
+	video.Failover.Backups = []FailoverSource{
+		{InputType: UDP_TS, Name: "udp://239.1.1.2:5000"},
+		{InputType: GENERATOR, Name: "smptehdbars"},
+	}
+
+	node := NewRelayNode(video, SlateConfig{Image: "slate.png", Audio: SLATE_TONE, Frequency: 440}, "ffmpeg")
+	if trackNum := node.AddOutput("video.ts", video); trackNum != 0 {
+		t.Errorf("video track = %d, want 0", trackNum)
+	}
+
+	if trackNum := node.AddOutput("audio.ts", audio); trackNum != 0 {
+		t.Errorf("audio track = %d, want 0", trackNum)
+	}
+
+	sources := node.sources()
+	tests := []struct {
+		name string
+		want string
+	}{
+		{
+			name: "Primary",
+			want: "-i udp://239.1.1.1:5000 -map 0:p:2:v:0? -map 0:#257? -c copy",
+		},
+		{
+			name: "Backup",
+			want: "-i udp://239.1.1.2:5000 -map 0:v:0? -map 0:a:0? -c copy",
+		},
+		{
+			name: "Generator",
+			want: "-i smptehdbars=size=1280x720:rate=25 -f lavfi -re -i sine=frequency=1000:sample_rate=48000,pan=2c|c0=c0|c1=c0 -map 0:0 -map 1:0 -c:v libx264",
+		},
+		{
+			name: "Slate",
+			want: "-i slate.png -f lavfi -re -i sine=frequency=440:sample_rate=48000,pan=2c|c0=c0|c1=c0 -map 0:v:0 -map 1:a:0 -c:v libx264",
+		},
+	}
+
+	for idx, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := strings.Join(relayArgs("ffmpeg", sources[idx], 0, 0), " ")
+			if !strings.Contains(args, tt.want) {
+				t.Errorf("args = %v, want them to contain %v", args, tt.want)
+			}
+
+			// The offset of one track is applied by the transcoder.
+			if strings.Contains(args, "-itsoffset") {
+				t.Errorf("args = %v, want no -itsoffset", args)
+			}
+		})
+	}
+}
+
+func TestFanOutWriter_DropsReaderWhichFallsBehind(t *testing.T) {
+	dir := t.TempDir()
+	slow, fast := NewPipe(), NewPipe()
+	slow.CreateIpcPipe(dir, ".ts")
+	fast.CreateIpcPipe(dir, ".ts")
+
+	output := newFanOutWriter([]string{slow.WriteEnd(), fast.WriteEnd()})
+	output.outputs[0].limit = 1 << 20
+
+	// The fast reader is opened first, and reads everything.
+	read := make(chan int)
+	go func() {
+		f, err := os.Open(fast.ReadEnd())
+		if err != nil {
+			read <- 0
+			return
+		}
+
+		defer f.Close()
+		data, _ := io.ReadAll(f)
+		read <- len(data)
+	}()
+
+	// The slow reader opens its pipe, but never reads it.
+	slowReader, err := os.Open(slow.ReadEnd())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	chunk := make([]byte, 64*1024)
+	for i := 0; i < 64; i++ {
+		if _, err := output.Write(chunk); err != nil {
+			t.Fatalf("Write() error = %v, with a reader keeping up", err)
+		}
+	}
+
+	if output.Err() != nil {
+		t.Errorf("Err() = %v, with a reader keeping up", output.Err())
+	}
+
+	dropped := output.outputs[0]
+	dropped.mu.Lock()
+	if dropped.err == nil {
+		t.Errorf("the output which fell behind was kept")
+	}
+	dropped.mu.Unlock()
+
+	// The writer of the dropped output is blocked on the full pipe until it is
+	// closed.
+	slowReader.Close()
+	output.Close()
+
+	if got := <-read; got != 64*len(chunk) {
+		t.Errorf("the fast reader read %d bytes, want %d", got, 64*len(chunk))
+	}
+}
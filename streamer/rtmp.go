@@ -0,0 +1,567 @@
+// A minimal implementation of the RTMP protocol, enough to receive a published stream.
+package streamer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// The size of the C1/S1 and C2/S2 handshake packets.
+const RTMP_HANDSHAKE_SIZE = 1536
+
+// The default RTMP chunk size, until a peer changes it.
+const RTMP_DEFAULT_CHUNK_SIZE = 128
+
+// RTMP message type IDs.
+const (
+	RTMP_MSG_SET_CHUNK_SIZE     = 1
+	RTMP_MSG_ABORT              = 2
+	RTMP_MSG_ACK                = 3
+	RTMP_MSG_USER_CONTROL       = 4
+	RTMP_MSG_WINDOW_ACK_SIZE    = 5
+	RTMP_MSG_SET_PEER_BANDWIDTH = 6
+	RTMP_MSG_AUDIO              = 8
+	RTMP_MSG_VIDEO              = 9
+	RTMP_MSG_AMF3_DATA          = 15
+	RTMP_MSG_AMF3_COMMAND       = 17
+	RTMP_MSG_AMF0_DATA          = 18
+	RTMP_MSG_AMF0_COMMAND       = 20
+)
+
+// AMF0 type markers.
+const (
+	amf0Number      = 0x00
+	amf0Boolean     = 0x01
+	amf0String      = 0x02
+	amf0Object      = 0x03
+	amf0Null        = 0x05
+	amf0Undefined   = 0x06
+	amf0EcmaArray   = 0x08
+	amf0ObjectEnd   = 0x09
+	amf0StrictArray = 0x0a
+	amf0Date        = 0x0b
+	amf0LongString  = 0x0c
+)
+
+// A complete RTMP message, reassembled from its chunks.
+type RtmpMessage struct {
+	TypeID    byte
+	StreamID  uint32
+	Timestamp uint32
+	Payload   []byte
+}
+
+// Performs the server side of the simple (unsigned) RTMP handshake.
+func rtmpServerHandshake(rw *bufio.ReadWriter) error {
+	c0c1 := make([]byte, 1+RTMP_HANDSHAKE_SIZE)
+	if _, err := io.ReadFull(rw, c0c1); err != nil {
+		return err
+	}
+
+	if c0c1[0] != 3 {
+		return fmt.Errorf("unsupported RTMP version %d", c0c1[0])
+	}
+
+	// S0 is the version.  S1 is a timestamp, four zero bytes (which selects the
+	// simple handshake) and random data.  S2 echoes C1.
+	s0s1s2 := make([]byte, 1+2*RTMP_HANDSHAKE_SIZE)
+	s0s1s2[0] = 3
+	rand.Read(s0s1s2[9 : 1+RTMP_HANDSHAKE_SIZE])
+	copy(s0s1s2[1+RTMP_HANDSHAKE_SIZE:], c0c1[1:])
+
+	if _, err := rw.Write(s0s1s2); err != nil {
+		return err
+	}
+
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+
+	c2 := make([]byte, RTMP_HANDSHAKE_SIZE)
+	_, err := io.ReadFull(rw, c2)
+	return err
+}
+
+// Performs the client side of the simple RTMP handshake.
+func rtmpClientHandshake(rw *bufio.ReadWriter) error {
+	c0c1 := make([]byte, 1+RTMP_HANDSHAKE_SIZE)
+	c0c1[0] = 3
+	rand.Read(c0c1[9:])
+
+	if _, err := rw.Write(c0c1); err != nil {
+		return err
+	}
+
+	if err := rw.Flush(); err != nil {
+		return err
+	}
+
+	s0s1s2 := make([]byte, 1+2*RTMP_HANDSHAKE_SIZE)
+	if _, err := io.ReadFull(rw, s0s1s2); err != nil {
+		return err
+	}
+
+	// C2 echoes S1.
+	if _, err := rw.Write(s0s1s2[1 : 1+RTMP_HANDSHAKE_SIZE]); err != nil {
+		return err
+	}
+
+	return rw.Flush()
+}
+
+// The state of a single chunk stream, needed to decode compressed headers.
+type rtmpChunkStream struct {
+	timestamp   uint32
+	delta       uint32
+	length      uint32
+	typeID      byte
+	streamID    uint32
+	extended    bool
+	payload     []byte
+	hasReceived bool
+}
+
+// Reads RTMP messages from a chunk stream.
+type RtmpChunkReader struct {
+	r         io.Reader
+	chunkSize uint32
+	streams   map[uint32]*rtmpChunkStream
+}
+
+func NewRtmpChunkReader(r io.Reader) *RtmpChunkReader {
+	return &RtmpChunkReader{
+		r:         r,
+		chunkSize: RTMP_DEFAULT_CHUNK_SIZE,
+		streams:   make(map[uint32]*rtmpChunkStream),
+	}
+}
+
+func (cr *RtmpChunkReader) readUint(size int) (uint32, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(cr.r, buf[4-size:]); err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+// Reads chunks until a whole message is available.
+func (cr *RtmpChunkReader) ReadMessage() (*RtmpMessage, error) {
+	for {
+		first, err := cr.readUint(1)
+		if err != nil {
+			return nil, err
+		}
+
+		format := first >> 6
+		csid := first & 0x3f
+
+		// Chunk stream IDs 0 and 1 signal a longer basic header.
+		if csid == 0 {
+			b, err := cr.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+
+			csid = b + 64
+		} else if csid == 1 {
+			buf := make([]byte, 2)
+			if _, err := io.ReadFull(cr.r, buf); err != nil {
+				return nil, err
+			}
+
+			csid = uint32(buf[1])*256 + uint32(buf[0]) + 64
+		}
+
+		cs, ok := cr.streams[csid]
+		if !ok {
+			cs = &rtmpChunkStream{}
+			cr.streams[csid] = cs
+		}
+
+		if format != 0 && !cs.hasReceived {
+			return nil, fmt.Errorf("RTMP chunk stream %d starts with a compressed header", csid)
+		}
+
+		var timestampField uint32
+
+		if format <= 2 {
+			if timestampField, err = cr.readUint(3); err != nil {
+				return nil, err
+			}
+		}
+
+		if format <= 1 {
+			if cs.length, err = cr.readUint(3); err != nil {
+				return nil, err
+			}
+
+			typeID, err := cr.readUint(1)
+			if err != nil {
+				return nil, err
+			}
+
+			cs.typeID = byte(typeID)
+		}
+
+		if format == 0 {
+			// The message stream ID is the only little-endian field in RTMP.
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(cr.r, buf); err != nil {
+				return nil, err
+			}
+
+			cs.streamID = binary.LittleEndian.Uint32(buf)
+		}
+
+		if format <= 2 {
+			cs.extended = timestampField == 0xffffff
+		}
+
+		if cs.extended {
+			if timestampField, err = cr.readUint(4); err != nil {
+				return nil, err
+			}
+		}
+
+		// A chunk of type 3 which starts a new message reuses the previous delta.
+		newMessage := len(cs.payload) == 0
+
+		switch {
+		case format == 0:
+			cs.timestamp = timestampField
+			cs.delta = 0
+		case format <= 2:
+			cs.delta = timestampField
+			cs.timestamp += cs.delta
+		case newMessage:
+			cs.timestamp += cs.delta
+		}
+
+		cs.hasReceived = true
+
+		remaining := cs.length - uint32(len(cs.payload))
+		size := remaining
+		if size > cr.chunkSize {
+			size = cr.chunkSize
+		}
+
+		chunk := make([]byte, size)
+		if _, err := io.ReadFull(cr.r, chunk); err != nil {
+			return nil, err
+		}
+
+		cs.payload = append(cs.payload, chunk...)
+
+		if uint32(len(cs.payload)) < cs.length {
+			continue
+		}
+
+		message := &RtmpMessage{
+			TypeID:    cs.typeID,
+			StreamID:  cs.streamID,
+			Timestamp: cs.timestamp,
+			Payload:   cs.payload,
+		}
+
+		cs.payload = nil
+
+		if message.TypeID == RTMP_MSG_SET_CHUNK_SIZE {
+			if len(message.Payload) < 4 {
+				return nil, errors.New("RTMP set chunk size message is too short")
+			}
+
+			// The most significant bit must be zero.
+			chunkSize := binary.BigEndian.Uint32(message.Payload) & 0x7fffffff
+			if chunkSize == 0 {
+				return nil, errors.New("RTMP chunk size must not be zero")
+			}
+
+			cr.chunkSize = chunkSize
+		}
+
+		return message, nil
+	}
+}
+
+// Writes RTMP messages to a chunk stream, always with full (type 0) headers.
+type RtmpChunkWriter struct {
+	w         *bufio.Writer
+	chunkSize uint32
+}
+
+func NewRtmpChunkWriter(w *bufio.Writer) *RtmpChunkWriter {
+	return &RtmpChunkWriter{
+		w:         w,
+		chunkSize: RTMP_DEFAULT_CHUNK_SIZE,
+	}
+}
+
+// Sends a message on the given chunk stream, and flushes it.
+func (cw *RtmpChunkWriter) WriteMessage(csid byte, m *RtmpMessage) error {
+	header := make([]byte, 12)
+	header[0] = csid & 0x3f
+
+	timestamp := m.Timestamp
+	if timestamp >= 0xffffff {
+		timestamp = 0xffffff
+	}
+
+	putUint24(header[1:], timestamp)
+	putUint24(header[4:], uint32(len(m.Payload)))
+	header[7] = m.TypeID
+	binary.LittleEndian.PutUint32(header[8:], m.StreamID)
+
+	if _, err := cw.w.Write(header); err != nil {
+		return err
+	}
+
+	extended := make([]byte, 4)
+	if timestamp == 0xffffff {
+		binary.BigEndian.PutUint32(extended, m.Timestamp)
+		cw.w.Write(extended)
+	}
+
+	for offset := 0; offset < len(m.Payload); offset += int(cw.chunkSize) {
+		if offset > 0 {
+			// Continuation chunks have a type 3 header.
+			cw.w.WriteByte(0xc0 | (csid & 0x3f))
+
+			if timestamp == 0xffffff {
+				cw.w.Write(extended)
+			}
+		}
+
+		end := offset + int(cw.chunkSize)
+		if end > len(m.Payload) {
+			end = len(m.Payload)
+		}
+
+		if _, err := cw.w.Write(m.Payload[offset:end]); err != nil {
+			return err
+		}
+	}
+
+	if m.TypeID == RTMP_MSG_SET_CHUNK_SIZE && len(m.Payload) >= 4 {
+		cw.chunkSize = binary.BigEndian.Uint32(m.Payload) & 0x7fffffff
+	}
+
+	return cw.w.Flush()
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v >> 16)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v)
+}
+
+// An AMF0 object or ECMA array.  Keys are written in sorted order.
+type AmfObject map[string]interface{}
+
+// Encodes values as AMF0.  Supports numbers, booleans, strings, nil and objects.
+func AmfEncode(values ...interface{}) []byte {
+	var buf bytes.Buffer
+
+	for _, value := range values {
+		amfEncodeValue(&buf, value)
+	}
+
+	return buf.Bytes()
+}
+
+func amfEncodeString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func amfEncodeValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(amf0Null)
+	case float64:
+		buf.WriteByte(amf0Number)
+		binary.Write(buf, binary.BigEndian, math.Float64bits(v))
+	case int:
+		amfEncodeValue(buf, float64(v))
+	case bool:
+		buf.WriteByte(amf0Boolean)
+		if v {
+			buf.WriteByte(1)
+		} else {
+			buf.WriteByte(0)
+		}
+	case string:
+		buf.WriteByte(amf0String)
+		amfEncodeString(buf, v)
+	case AmfObject:
+		buf.WriteByte(amf0Object)
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			amfEncodeString(buf, key)
+			amfEncodeValue(buf, v[key])
+		}
+
+		buf.Write([]byte{0, 0, amf0ObjectEnd})
+	default:
+		panic(fmt.Sprintf("Unsupported AMF0 value: %v", value))
+	}
+}
+
+// Decodes all the AMF0 values in a payload.
+func AmfDecode(payload []byte) ([]interface{}, error) {
+	r := bytes.NewReader(payload)
+	values := []interface{}{}
+
+	for r.Len() > 0 {
+		value, err := amfDecodeValue(r)
+		if err != nil {
+			return values, err
+		}
+
+		values = append(values, value)
+	}
+
+	return values, nil
+}
+
+func amfDecodeString(r *bytes.Reader, long bool) (string, error) {
+	var length uint32
+
+	if long {
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return "", err
+		}
+	} else {
+		var short uint16
+		if err := binary.Read(r, binary.BigEndian, &short); err != nil {
+			return "", err
+		}
+
+		length = uint32(short)
+	}
+
+	if int(length) > r.Len() {
+		return "", errors.New("AMF0 string is truncated")
+	}
+
+	buf := make([]byte, length)
+	io.ReadFull(r, buf)
+	return string(buf), nil
+}
+
+func amfDecodeProperties(r *bytes.Reader) (AmfObject, error) {
+	object := AmfObject{}
+
+	for {
+		key, err := amfDecodeString(r, false)
+		if err != nil {
+			return nil, err
+		}
+
+		if key == "" {
+			marker, err := r.ReadByte()
+			if err != nil {
+				return nil, err
+			}
+
+			if marker == amf0ObjectEnd {
+				return object, nil
+			}
+
+			r.UnreadByte()
+		}
+
+		value, err := amfDecodeValue(r)
+		if err != nil {
+			return nil, err
+		}
+
+		object[key] = value
+	}
+}
+
+func amfDecodeValue(r *bytes.Reader) (interface{}, error) {
+	marker, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch marker {
+	case amf0Number:
+		var bits uint64
+		if err := binary.Read(r, binary.BigEndian, &bits); err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(bits), nil
+	case amf0Boolean:
+		b, err := r.ReadByte()
+		return b != 0, err
+	case amf0String:
+		return amfDecodeString(r, false)
+	case amf0LongString:
+		return amfDecodeString(r, true)
+	case amf0Object:
+		return amfDecodeProperties(r)
+	case amf0EcmaArray:
+		// The count is only a hint; the array ends like an object.
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+
+		return amfDecodeProperties(r)
+	case amf0StrictArray:
+		var count uint32
+		if err := binary.Read(r, binary.BigEndian, &count); err != nil {
+			return nil, err
+		}
+
+		// The count comes from the peer, and each value takes at least a byte.
+		if int64(count) > int64(r.Len()) {
+			return nil, errors.New("AMF0 strict array is truncated")
+		}
+
+		values := make([]interface{}, 0, count)
+		for i := uint32(0); i < count; i++ {
+			value, err := amfDecodeValue(r)
+			if err != nil {
+				return nil, err
+			}
+
+			values = append(values, value)
+		}
+
+		return values, nil
+	case amf0Date:
+		// A number of milliseconds and a time zone, which is always zero.
+		var date struct {
+			Millis   uint64
+			TimeZone int16
+		}
+
+		if err := binary.Read(r, binary.BigEndian, &date); err != nil {
+			return nil, err
+		}
+
+		return math.Float64frombits(date.Millis), nil
+	case amf0Null, amf0Undefined:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unsupported AMF0 type marker 0x%02x", marker)
+	}
+}
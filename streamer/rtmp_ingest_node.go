@@ -0,0 +1,365 @@
+// A module that receives a stream from an RTMP encoder and relays it to the transcoder.
+package streamer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+// The default port for RTMP.
+const RTMP_DEFAULT_PORT = "1935"
+
+// The message stream ID given to the publisher in reply to createStream.
+const rtmpPublishStreamID = 1
+
+/*
+Listens for an RTMP encoder, such as OBS, and relays its stream as FLV.
+
+	The listen URL has the form rtmp://HOST:PORT/APP/STREAM_KEY.  Connections
+	to any other app or stream key are rejected.  Only one encoder may publish
+	at a time, and the node finishes when that encoder disconnects.
+
+	The stream is written to every output, so that the audio and video tracks
+	of one connection can be read by separate inputs of the transcoder.
+*/
+type RtmpIngestNode struct {
+	address   string
+	app       string
+	streamKey string
+	outputs   []string
+	listener  net.Listener
+	mu        sync.Mutex
+	published bool
+	Status    ProcessStatus
+}
+
+func NewRtmpIngestNode(listenURL string) *RtmpIngestNode {
+	u, err := url.Parse(listenURL)
+	if err != nil || u.Scheme != "rtmp" {
+		panic(fmt.Sprintf("%q is not a valid RTMP listen URL. Use rtmp://HOST:PORT/APP/STREAM_KEY.", listenURL))
+	}
+
+	address := u.Host
+	if u.Port() == "" {
+		address = net.JoinHostPort(u.Hostname(), RTMP_DEFAULT_PORT)
+	}
+
+	// The first path component is the app, and the rest is the stream key.
+	pieces := strings.SplitN(strings.TrimPrefix(u.Path, "/"), "/", 2)
+	if len(pieces) != 2 || pieces[0] == "" || pieces[1] == "" {
+		panic(fmt.Sprintf("%q must contain both an app and a stream key. Use rtmp://HOST:PORT/APP/STREAM_KEY.", listenURL))
+	}
+
+	return &RtmpIngestNode{
+		address:   address,
+		app:       pieces[0],
+		streamKey: pieces[1],
+		Status:    Finished,
+	}
+}
+
+// Adds a path (usually a named pipe) to which the received stream is written.
+func (n *RtmpIngestNode) AddOutput(path string) {
+	n.outputs = append(n.outputs, path)
+}
+
+func (n *RtmpIngestNode) Start() {
+	listener, err := net.Listen("tcp", n.address)
+	if err != nil {
+		panic(fmt.Sprintf("failed to listen for RTMP on %s: %v", n.address, err))
+	}
+
+	n.listener = listener
+	n.setStatus(Running)
+
+	go n.acceptLoop()
+}
+
+// Returns the address the node is listening on.
+func (n *RtmpIngestNode) Addr() net.Addr {
+	return n.listener.Addr()
+}
+
+func (n *RtmpIngestNode) CheckStatus() ProcessStatus {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.Status
+}
+
+func (n *RtmpIngestNode) Stop() {
+	n.finish(Finished)
+}
+
+// Closes the listener and sets the final status.
+func (n *RtmpIngestNode) finish(status ProcessStatus) {
+	if n.listener != nil {
+		n.listener.Close()
+	}
+
+	n.setStatus(status)
+}
+
+func (n *RtmpIngestNode) setStatus(status ProcessStatus) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.Status = status
+}
+
+func (n *RtmpIngestNode) acceptLoop() {
+	for {
+		conn, err := n.listener.Accept()
+		if err != nil {
+			// The listener was closed.
+			return
+		}
+
+		go n.handleConnection(conn)
+	}
+}
+
+// Claims the outputs for a publisher.  Only the first publisher gets them.
+func (n *RtmpIngestNode) claimOutputs() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.published {
+		return false
+	}
+
+	n.published = true
+	return true
+}
+
+func (n *RtmpIngestNode) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if err := rtmpServerHandshake(rw); err != nil {
+		fmt.Fprintf(os.Stderr, "RTMP handshake with %s failed: %v\n", conn.RemoteAddr(), err)
+		return
+	}
+
+	session := &rtmpSession{
+		node:   n,
+		reader: NewRtmpChunkReader(rw),
+		writer: NewRtmpChunkWriter(rw.Writer),
+	}
+
+	err := session.run()
+
+	if session.flv != nil {
+		session.flv.Close()
+
+		// Without a publisher, there is nothing left to relay.
+		if err != nil && err != io.EOF {
+			n.finish(Errored)
+		} else {
+			n.finish(Finished)
+		}
+	}
+
+	if err != nil && err != io.EOF {
+		fmt.Fprintf(os.Stderr, "RTMP connection from %s closed: %v\n", conn.RemoteAddr(), err)
+	}
+}
+
+// The state of a single RTMP connection.
+type rtmpSession struct {
+	node   *RtmpIngestNode
+	reader *RtmpChunkReader
+	writer *RtmpChunkWriter
+	flv    *flvMultiWriter
+}
+
+func (s *rtmpSession) run() error {
+	for {
+		message, err := s.reader.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		switch message.TypeID {
+		case RTMP_MSG_AMF0_COMMAND, RTMP_MSG_AMF3_COMMAND:
+			payload := message.Payload
+			if message.TypeID == RTMP_MSG_AMF3_COMMAND && len(payload) > 0 {
+				// AMF3 commands start with a format byte, followed by AMF0 values.
+				payload = payload[1:]
+			}
+
+			if err := s.handleCommand(payload); err != nil {
+				return err
+			}
+		case RTMP_MSG_AUDIO, RTMP_MSG_VIDEO, RTMP_MSG_AMF0_DATA:
+			if s.flv == nil {
+				// Media before a successful publish is ignored.
+				continue
+			}
+
+			if err := s.flv.WriteTag(message); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *rtmpSession) handleCommand(payload []byte) error {
+	values, err := AmfDecode(payload)
+	if err != nil || len(values) < 2 {
+		return fmt.Errorf("malformed RTMP command: %v", err)
+	}
+
+	name, _ := values[0].(string)
+	transactionID, _ := values[1].(float64)
+
+	switch name {
+	case "connect":
+		app := ""
+		if len(values) > 2 {
+			object, _ := values[2].(AmfObject)
+			app, _ = object["app"].(string)
+		}
+
+		// Some encoders append a query string to the app.
+		if strings.SplitN(app, "?", 2)[0] != s.node.app {
+			s.sendCommand(0, "_error", transactionID, nil, AmfObject{
+				"level":       "error",
+				"code":        "NetConnection.Connect.Rejected",
+				"description": fmt.Sprintf("Unknown app %q.", app),
+			})
+
+			return fmt.Errorf("rejected unknown app %q", app)
+		}
+
+		s.sendControl(RTMP_MSG_WINDOW_ACK_SIZE, 2500000)
+		s.sendControl(RTMP_MSG_SET_PEER_BANDWIDTH, 2500000, 2)
+		s.sendControl(RTMP_MSG_SET_CHUNK_SIZE, 4096)
+
+		return s.sendCommand(0, "_result", transactionID,
+			AmfObject{
+				"fmsVer":       "FMS/3,0,1,123",
+				"capabilities": 31,
+			},
+			AmfObject{
+				"level":          "status",
+				"code":           "NetConnection.Connect.Success",
+				"description":    "Connection succeeded.",
+				"objectEncoding": 0,
+			})
+	case "createStream":
+		return s.sendCommand(0, "_result", transactionID, nil, rtmpPublishStreamID)
+	case "publish":
+		streamKey := ""
+		if len(values) > 3 {
+			streamKey, _ = values[3].(string)
+		}
+
+		// Some encoders append a query string to the stream key.
+		if strings.SplitN(streamKey, "?", 2)[0] != s.node.streamKey {
+			s.sendStatus("error", "NetStream.Publish.BadName", "Unknown stream key.")
+			return fmt.Errorf("rejected unknown stream key")
+		}
+
+		if !s.node.claimOutputs() {
+			s.sendStatus("error", "NetStream.Publish.BadName", "Stream is already being published.")
+			return fmt.Errorf("rejected a second publisher")
+		}
+
+		flv, err := newFlvMultiWriter(s.node.outputs)
+		if err != nil {
+			return err
+		}
+
+		s.flv = flv
+		return s.sendStatus("status", "NetStream.Publish.Start", "Publishing started.")
+	case "releaseStream", "FCPublish", "FCUnpublish", "deleteStream", "closeStream":
+		// Nothing to do, but some encoders wait for a reply.
+		if transactionID > 0 {
+			return s.sendCommand(0, "_result", transactionID, nil)
+		}
+	}
+
+	return nil
+}
+
+// Sends a protocol control message made of 32-bit values, with an optional
+// trailing byte (used by Set Peer Bandwidth).
+func (s *rtmpSession) sendControl(typeID byte, value uint32, extra ...byte) error {
+	payload := make([]byte, 4, 5)
+	binary.BigEndian.PutUint32(payload, value)
+	payload = append(payload, extra...)
+
+	return s.writer.WriteMessage(2, &RtmpMessage{TypeID: typeID, Payload: payload})
+}
+
+func (s *rtmpSession) sendCommand(streamID uint32, values ...interface{}) error {
+	return s.writer.WriteMessage(3, &RtmpMessage{
+		TypeID:   RTMP_MSG_AMF0_COMMAND,
+		StreamID: streamID,
+		Payload:  AmfEncode(values...),
+	})
+}
+
+func (s *rtmpSession) sendStatus(level string, code string, description string) error {
+	return s.sendCommand(rtmpPublishStreamID, "onStatus", 0, nil, AmfObject{
+		"level":       level,
+		"code":        code,
+		"description": description,
+	})
+}
+
+// Writes RTMP media messages as FLV tags to several outputs.
+type flvMultiWriter struct {
+	writer *fanOutWriter
+}
+
+// Starts writing to every output, beginning with the FLV header.  Each output
+// is opened on its own, when the transcoder opens the other end of its pipe.
+func newFlvMultiWriter(paths []string) (*flvMultiWriter, error) {
+	fw := &flvMultiWriter{writer: newFanOutWriter(paths)}
+
+	// FLV version 1 with audio and video, followed by PreviousTagSize0.
+	header := []byte{'F', 'L', 'V', 1, 0x05, 0, 0, 0, 9, 0, 0, 0, 0}
+	if _, err := fw.writer.Write(header); err != nil {
+		fw.Close()
+		return nil, err
+	}
+
+	return fw, nil
+}
+
+// Prefix of metadata messages sent by encoders, which is not part of FLV.
+var setDataFramePrefix = AmfEncode("@setDataFrame")
+
+func (fw *flvMultiWriter) WriteTag(m *RtmpMessage) error {
+	payload := m.Payload
+	if m.TypeID == RTMP_MSG_AMF0_DATA {
+		payload = bytes.TrimPrefix(payload, setDataFramePrefix)
+	}
+
+	tag := make([]byte, 11, 11+len(payload)+4)
+	tag[0] = m.TypeID
+	putUint24(tag[1:], uint32(len(payload)))
+	putUint24(tag[4:], m.Timestamp&0xffffff)
+	tag[7] = byte(m.Timestamp >> 24)
+	// The stream ID is always zero.
+
+	tag = append(tag, payload...)
+	tag = binary.BigEndian.AppendUint32(tag, uint32(11+len(payload)))
+
+	_, err := fw.writer.Write(tag)
+	return err
+}
+
+func (fw *flvMultiWriter) Close() {
+	fw.writer.Close()
+}
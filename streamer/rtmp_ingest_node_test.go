@@ -0,0 +1,223 @@
+package streamer
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Connects to an RTMP server and tries to publish, like an encoder would.
+// Returns the status code of the last reply.
+func rtmpTestPublish(t *testing.T, addr string, app string, streamKey string, media ...*RtmpMessage) string {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if err := rtmpClientHandshake(rw); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := NewRtmpChunkReader(rw)
+	writer := NewRtmpChunkWriter(rw.Writer)
+
+	// Sends a command and returns the code in the reply's info object.
+	command := func(streamID uint32, values ...interface{}) string {
+		writer.WriteMessage(3, &RtmpMessage{TypeID: RTMP_MSG_AMF0_COMMAND, StreamID: streamID, Payload: AmfEncode(values...)})
+
+		for {
+			message, err := reader.ReadMessage()
+			if err != nil {
+				return ""
+			}
+
+			if message.TypeID != RTMP_MSG_AMF0_COMMAND {
+				continue
+			}
+
+			reply, _ := AmfDecode(message.Payload)
+			info, _ := reply[len(reply)-1].(AmfObject)
+			code, _ := info["code"].(string)
+			return code
+		}
+	}
+
+	if code := command(0, "connect", 1, AmfObject{"app": app, "type": "nonprivate"}); code != "NetConnection.Connect.Success" {
+		return code
+	}
+
+	command(0, "createStream", 2, nil)
+
+	code := command(rtmpPublishStreamID, "publish", 3, nil, streamKey, "live")
+	if code != "NetStream.Publish.Start" {
+		return code
+	}
+
+	for _, m := range media {
+		writer.WriteMessage(4, m)
+	}
+
+	return code
+}
+
+func TestRtmpIngestNode(t *testing.T) {
+	tests := []struct {
+		name      string
+		app       string
+		streamKey string
+		want      string
+	}{
+		{
+			name:      "Unknown app",
+			app:       "other",
+			streamKey: "secret",
+			want:      "NetConnection.Connect.Rejected",
+		},
+		{
+			name:      "Unknown stream key",
+			app:       "live",
+			streamKey: "guess",
+			want:      "NetStream.Publish.BadName",
+		},
+		{
+			name:      "Known stream key",
+			app:       "live",
+			streamKey: "secret?token=1",
+			want:      "NetStream.Publish.Start",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "output.flv")
+			node := NewRtmpIngestNode("rtmp://127.0.0.1:0/live/secret")
+			node.AddOutput(output)
+			node.Start()
+			defer node.Stop()
+
+			if got := rtmpTestPublish(t, node.Addr().String(), tt.app, tt.streamKey); got != tt.want {
+				t.Errorf("status = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRtmpIngestNode_RelaysFlv(t *testing.T) {
+	outputs := []string{
+		filepath.Join(t.TempDir(), "video.flv"),
+		filepath.Join(t.TempDir(), "audio.flv"),
+	}
+
+	node := NewRtmpIngestNode("rtmp://127.0.0.1:0/live/secret")
+	for _, output := range outputs {
+		node.AddOutput(output)
+	}
+
+	node.Start()
+	defer node.Stop()
+
+	// A payload larger than the default chunk size, to exercise reassembly.
+	videoPayload := bytes.Repeat([]byte{0x17}, 300)
+	metadata := append(AmfEncode("@setDataFrame"), AmfEncode("onMetaData", AmfObject{"width": 1280})...)
+
+	rtmpTestPublish(t, node.Addr().String(), "live", "secret",
+		&RtmpMessage{TypeID: RTMP_MSG_AMF0_DATA, StreamID: rtmpPublishStreamID, Payload: metadata},
+		&RtmpMessage{TypeID: RTMP_MSG_VIDEO, StreamID: rtmpPublishStreamID, Timestamp: 40, Payload: videoPayload},
+	)
+
+	for start := time.Now(); node.CheckStatus() == Running && time.Since(start) < 5*time.Second; {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	for _, output := range outputs {
+		flv, err := os.ReadFile(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.HasPrefix(flv, []byte("FLV")) {
+			t.Fatalf("%s does not start with an FLV header", output)
+		}
+
+		// The metadata tag follows the header, without the @setDataFrame prefix.
+		metadataTag := flv[13:]
+		if metadataTag[0] != RTMP_MSG_AMF0_DATA || !bytes.HasPrefix(metadataTag[11:], AmfEncode("onMetaData")) {
+			t.Errorf("%s has a malformed metadata tag", output)
+		}
+
+		if !bytes.Contains(flv, videoPayload) {
+			t.Errorf("%s does not contain the video payload", output)
+		}
+	}
+}
+
+func TestFlvMultiWriter_PipesOpenedInReverse(t *testing.T) {
+	dir := t.TempDir()
+	pipes := []Pipe{NewPipe(), NewPipe()}
+	paths := []string{}
+	for i := range pipes {
+		pipes[i].CreateIpcPipe(dir, ".flv")
+		paths = append(paths, pipes[i].WriteEnd())
+	}
+
+	fw, err := newFlvMultiWriter(paths)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := bytes.Repeat([]byte{0x17}, 300)
+	if err := fw.WriteTag(&RtmpMessage{TypeID: RTMP_MSG_VIDEO, Timestamp: 40, Payload: payload}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Like FFmpeg, the reader opens one pipe at a time, and reads the header of
+	// the last one before it opens the first.
+	results := make(chan []byte, len(pipes))
+	go func() {
+		for i := len(pipes) - 1; i >= 0; i-- {
+			f, err := os.Open(pipes[i].ReadEnd())
+			if err != nil {
+				results <- nil
+				continue
+			}
+
+			header := make([]byte, 13)
+			if _, err := io.ReadFull(f, header); err != nil {
+				header = nil
+			}
+
+			rest, _ := io.ReadAll(f)
+			f.Close()
+			results <- append(header, rest...)
+		}
+	}()
+
+	// The stream ends once both have been read.
+	done := make(chan struct{})
+	go func() {
+		fw.Close()
+		close(done)
+	}()
+
+	for range pipes {
+		select {
+		case flv := <-results:
+			if !bytes.HasPrefix(flv, []byte("FLV")) || !bytes.Contains(flv, payload) {
+				t.Errorf("read %d bytes, without the header and the tag", len(flv))
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("the writer blocked on the pipe which was opened last")
+		}
+	}
+
+	<-done
+}
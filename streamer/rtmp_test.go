@@ -0,0 +1,74 @@
+package streamer
+
+import (
+	"bufio"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+func TestAmfDecode(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []interface{}
+		wantErr bool
+	}{
+		{
+			name:    "strict array",
+			payload: []byte{0x0a, 0, 0, 0, 2, 0x01, 1, 0x05},
+			want:    []interface{}{[]interface{}{true, nil}},
+		},
+		{
+			// A count of four billion values, in a payload of none.
+			name:    "strict array with a huge count",
+			payload: []byte{0x0a, 0xff, 0xff, 0xff, 0xff},
+			wantErr: true,
+		},
+		{
+			name:    "truncated strict array",
+			payload: []byte{0x0a, 0, 0, 0, 3, 0x05},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := AmfDecode(tt.payload)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("AmfDecode() error = %v, want an error = %v", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("AmfDecode() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRtmpChunkReader_SetChunkSize(t *testing.T) {
+	tests := []struct {
+		name      string
+		chunkSize []byte
+		wantErr   bool
+	}{
+		{name: "valid", chunkSize: []byte{0, 0, 0x10, 0}},
+		{name: "zero", chunkSize: []byte{0, 0, 0, 0}, wantErr: true},
+		{name: "zero but the reserved bit", chunkSize: []byte{0x80, 0, 0, 0}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			if err := NewRtmpChunkWriter(w).WriteMessage(2, &RtmpMessage{TypeID: RTMP_MSG_SET_CHUNK_SIZE, Payload: tt.chunkSize}); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := NewRtmpChunkReader(&buf).ReadMessage()
+			if (err != nil) != tt.wantErr {
+				t.Errorf("ReadMessage() error = %v, want an error = %v", err, tt.wantErr)
+			}
+		})
+	}
+}
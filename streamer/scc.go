@@ -0,0 +1,519 @@
+// A module to decode the CEA-608 captions of Scenarist SCC files.
+package streamer
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The frame rate of SCC timecodes, unless configured otherwise.
+const SCC_FRAME_RATE = 30000.0 / 1001.0
+
+// How long the last caption of a file stays up, if the file never clears it.
+const SCC_TRAILING_CAPTION_DURATION = 4.0
+
+// The number of rows and columns of the CEA-608 caption grid.
+const (
+	CEA608_ROWS    = 15
+	CEA608_COLUMNS = 32
+)
+
+// The colors of CEA-608 styles, in order of their codes, as WebVTT classes.
+var CEA608_COLORS = []string{"white", "lime", "blue", "cyan", "red", "yellow", "magenta"}
+
+// The special characters, selected by 0x11 0x30 to 0x3f.
+var CEA608_SPECIAL_CHARS = []rune("®°½¿™¢£♪à èâêîôû")
+
+// The extended characters, selected by 0x12 0x20 to 0x3f and 0x13 0x20 to 0x3f.
+var CEA608_EXTENDED_CHARS = map[byte][]rune{
+	0x12: []rune("ÁÉÓÚÜü‘¡*'—©℠•“”ÀÂÇÈÊËëÎÏïÔÙùÛ«»"),
+	0x13: []rune("ÃãÍÌìÒòÕõ{}\\^_|~ÄäÖöß¥¤│ÅåØø┌┐└┘"),
+}
+
+// The basic characters which differ from ASCII.
+var CEA608_BASIC_CHARS = map[byte]rune{
+	0x2a: 'á',
+	0x5c: 'é',
+	0x5e: 'í',
+	0x5f: 'ó',
+	0x60: 'ú',
+	0x7b: 'ç',
+	0x7c: '÷',
+	0x7d: 'Ñ',
+	0x7e: 'ñ',
+	0x7f: '█',
+}
+
+// The first row of a preamble address code, by its first byte.  The second
+// byte picks this row or the next one.
+var CEA608_PAC_ROWS = map[byte]int{
+	0x11: 1,
+	0x12: 3,
+	0x15: 5,
+	0x16: 7,
+	0x17: 9,
+	0x10: 11,
+	0x13: 12,
+	0x14: 14,
+}
+
+// The style of a caption character.
+type cea608Style struct {
+	color     string
+	italic    bool
+	underline bool
+}
+
+type cea608Cell struct {
+	char  rune
+	style cea608Style
+}
+
+// The characters on the screen, or in the non-displayed memory of pop-on
+// captions.
+type cea608Memory [CEA608_ROWS + 1][]cea608Cell
+
+func (m *cea608Memory) isEmpty() bool {
+	for _, row := range m {
+		for _, cell := range row {
+			if cell.char != 0 && cell.char != ' ' {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (m *cea608Memory) clear() {
+	*m = cea608Memory{}
+}
+
+/*
+Returns the WebVTT text and cue settings of the captions in memory.
+
+	The cue is placed at the top row and the leftmost column of the captions,
+	so captions which move around the screen keep their places.
+*/
+func (m *cea608Memory) render() (string, string) {
+	var lines []string
+	topRow, indent := 0, CEA608_COLUMNS
+
+	for row := 1; row <= CEA608_ROWS; row++ {
+		cells := m[row]
+
+		// Skip the leading blanks, which are the indent of the row.
+		first := 0
+		for first < len(cells) && (cells[first].char == 0 || cells[first].char == ' ') {
+			first++
+		}
+
+		last := len(cells)
+		for last > first && (cells[last-1].char == 0 || cells[last-1].char == ' ') {
+			last--
+		}
+
+		if first == last {
+			continue
+		}
+
+		if topRow == 0 {
+			topRow = row
+		}
+		indent = int(math.Min(float64(indent), float64(first)))
+
+		var line strings.Builder
+		var open cea608Style
+		closing := ""
+		for _, cell := range cells[first:last] {
+			if cell.style != open {
+				line.WriteString(closing)
+				closing = ""
+				open = cell.style
+
+				if open.color != "" && open.color != "white" {
+					line.WriteString("<c." + open.color + ">")
+					closing = "</c>" + closing
+				}
+
+				if open.italic {
+					line.WriteString("<i>")
+					closing = "</i>" + closing
+				}
+
+				if open.underline {
+					line.WriteString("<u>")
+					closing = "</u>" + closing
+				}
+			}
+
+			char := cell.char
+			if char == 0 {
+				char = ' '
+			}
+			line.WriteString(escapeWebVtt(string(char)))
+		}
+
+		line.WriteString(closing)
+		lines = append(lines, line.String())
+	}
+
+	if len(lines) == 0 {
+		return "", ""
+	}
+
+	// Rows are placed from the top of the caption area, which is inset by 10%
+	// of the screen on every side.
+	line := 10 + float64(topRow-1)*80/CEA608_ROWS
+	position := 10 + float64(indent)*80/CEA608_COLUMNS
+	settings := fmt.Sprintf("line:%s%% position:%s%% align:left",
+		strconv.FormatFloat(math.Round(line*100)/100, 'f', -1, 64),
+		strconv.FormatFloat(math.Round(position*100)/100, 'f', -1, 64))
+
+	return strings.Join(lines, "\n"), settings
+}
+
+// Define a new type called cea608Mode, which is essentially an int.
+type cea608Mode int
+
+const (
+	CEA608_POP_ON cea608Mode = iota
+	CEA608_ROLL_UP
+	CEA608_PAINT_ON
+)
+
+// Decodes the CEA-608 commands of caption channel 1 into cues.
+type cea608Decoder struct {
+	mode         cea608Mode
+	displayed    cea608Memory
+	nonDisplayed cea608Memory
+	rollUpRows   int
+	row          int
+	column       int
+	style        cea608Style
+	// Whether the commands are for channel 1, which is the one decoded.
+	channel1 bool
+	// The last control code, since every control code is usually sent twice.
+	lastControl uint16
+	cues        []SubtitleCue
+	// The start of the cue on the screen, or -1 if there is none.
+	cueStart float64
+}
+
+func newCea608Decoder() *cea608Decoder {
+	return &cea608Decoder{row: CEA608_ROWS, channel1: true, cueStart: -1}
+}
+
+// Returns the memory characters are written to in the current mode.
+func (d *cea608Decoder) memory() *cea608Memory {
+	if d.mode == CEA608_POP_ON {
+		return &d.nonDisplayed
+	}
+
+	return &d.displayed
+}
+
+// Ends the cue on the screen at the given time.
+func (d *cea608Decoder) endCue(t float64) {
+	if d.cueStart >= 0 && t > d.cueStart {
+		text, settings := d.displayed.render()
+		if text != "" {
+			d.cues = append(d.cues, SubtitleCue{Start: d.cueStart, End: t, Text: text, Settings: settings})
+		}
+	}
+
+	d.cueStart = -1
+}
+
+// Starts a cue for whatever is on the screen at the given time.
+func (d *cea608Decoder) startCue(t float64) {
+	if d.cueStart < 0 && !d.displayed.isEmpty() {
+		d.cueStart = t
+	}
+}
+
+// Writes a character at the cursor.
+func (d *cea608Decoder) writeChar(char rune, t float64) {
+	memory := d.memory()
+	row := memory[d.row]
+	for len(row) <= d.column {
+		row = append(row, cea608Cell{})
+	}
+
+	row[d.column] = cea608Cell{char: char, style: d.style}
+	memory[d.row] = row
+
+	if d.column < CEA608_COLUMNS-1 {
+		d.column++
+	}
+
+	if d.mode != CEA608_POP_ON {
+		// Roll-up and paint-on captions appear as they are written.
+		d.startCue(t)
+	}
+}
+
+// Handles a command, which is one pair of bytes without their parity bits.
+func (d *cea608Decoder) decode(b1 byte, b2 byte, t float64) {
+	if b1 == 0 && b2 == 0 {
+		// Padding.
+		return
+	}
+
+	if b1 >= 0x20 {
+		d.lastControl = 0
+		if !d.channel1 {
+			return
+		}
+
+		for _, b := range []byte{b1, b2} {
+			if b < 0x20 {
+				continue
+			}
+
+			if char, ok := CEA608_BASIC_CHARS[b]; ok {
+				d.writeChar(char, t)
+			} else {
+				d.writeChar(rune(b), t)
+			}
+		}
+		return
+	}
+
+	if b1 < 0x10 || b2 < 0x20 {
+		// Extended data services, which aren't captions.
+		return
+	}
+
+	code := uint16(b1)<<8 | uint16(b2)
+	if code == d.lastControl {
+		// The second copy of a control code.
+		d.lastControl = 0
+		return
+	}
+	d.lastControl = code
+
+	// Channel 2 uses the same codes, with bit 3 of the first byte set.
+	d.channel1 = b1&0x08 == 0
+	if !d.channel1 {
+		return
+	}
+
+	switch {
+	case b1 == 0x11 && b2 >= 0x20 && b2 <= 0x2f:
+		// A mid-row code, which changes the style and takes up a space.
+		attribute := (b2 - 0x20) >> 1
+		d.style = cea608Style{color: "white", italic: attribute == 7, underline: b2&1 == 1}
+		if attribute < 7 {
+			d.style.color = CEA608_COLORS[attribute]
+		}
+		d.writeChar(' ', t)
+
+	case b1 == 0x11 && b2 >= 0x30 && b2 <= 0x3f:
+		d.writeChar(CEA608_SPECIAL_CHARS[b2-0x30], t)
+
+	case (b1 == 0x12 || b1 == 0x13) && b2 >= 0x20 && b2 <= 0x3f:
+		// An extended character replaces the standard character sent before it,
+		// for decoders which don't know it.
+		if d.column > 0 {
+			d.column--
+		}
+		d.writeChar(CEA608_EXTENDED_CHARS[b1][b2-0x20], t)
+
+	case (b1 == 0x14 || b1 == 0x15) && b2 >= 0x20 && b2 <= 0x2f:
+		d.control(b2, t)
+
+	case b1 == 0x17 && b2 >= 0x21 && b2 <= 0x23:
+		// A tab offset.
+		d.column = int(math.Min(float64(d.column+int(b2-0x20)), CEA608_COLUMNS-1))
+
+	case b2 >= 0x40:
+		d.preambleAddress(b1, b2, t)
+	}
+}
+
+// Handles a preamble address code, which moves the cursor to a row and sets
+// the style or indent.
+func (d *cea608Decoder) preambleAddress(b1 byte, b2 byte, t float64) {
+	row, ok := CEA608_PAC_ROWS[b1]
+	if !ok {
+		return
+	}
+
+	if b2 >= 0x60 && b1 != 0x10 {
+		row++
+	}
+
+	attribute := (b2 & 0x1f) >> 1
+	underline := b2&1 == 1
+
+	if d.mode == CEA608_ROLL_UP && row != d.row {
+		// Roll-up captions move to the new base row, with the rows above it.
+		var moved cea608Memory
+		for offset := 0; offset < d.rollUpRows; offset++ {
+			if d.row-offset >= 1 && row-offset >= 1 {
+				moved[row-offset] = d.displayed[d.row-offset]
+			}
+		}
+		d.displayed = moved
+	}
+
+	d.row = row
+	d.column = 0
+	d.style = cea608Style{color: "white", underline: underline}
+
+	if attribute < 7 {
+		d.style.color = CEA608_COLORS[attribute]
+	} else if attribute == 7 {
+		d.style.italic = true
+	} else {
+		d.column = int(attribute-8) * 4
+	}
+}
+
+// Handles a miscellaneous control code.
+func (d *cea608Decoder) control(b2 byte, t float64) {
+	switch b2 {
+	case 0x20:
+		// Resume caption loading: pop-on captions.
+		d.mode = CEA608_POP_ON
+
+	case 0x25, 0x26, 0x27:
+		// Roll-up captions, with 2, 3 or 4 rows.
+		if d.mode != CEA608_ROLL_UP {
+			d.endCue(t)
+			d.displayed.clear()
+			d.nonDisplayed.clear()
+		}
+
+		d.mode = CEA608_ROLL_UP
+		d.rollUpRows = int(b2-0x25) + 2
+		d.column = 0
+
+	case 0x29:
+		// Resume direct captioning: paint-on captions.
+		d.mode = CEA608_PAINT_ON
+
+	case 0x21:
+		// Backspace.
+		memory := d.memory()
+		if d.column > 0 {
+			d.column--
+			if d.column < len(memory[d.row]) {
+				memory[d.row][d.column] = cea608Cell{}
+			}
+		}
+
+	case 0x24:
+		// Delete to end of row.
+		memory := d.memory()
+		if d.column < len(memory[d.row]) {
+			memory[d.row] = memory[d.row][:d.column]
+		}
+
+	case 0x2c:
+		// Erase displayed memory.
+		d.endCue(t)
+		d.displayed.clear()
+
+	case 0x2e:
+		// Erase non-displayed memory.
+		d.nonDisplayed.clear()
+
+	case 0x2d:
+		// Carriage return, which scrolls roll-up captions up by a row.
+		if d.mode == CEA608_ROLL_UP {
+			d.endCue(t)
+
+			top := d.row - d.rollUpRows + 1
+			for row := 1; row <= CEA608_ROWS; row++ {
+				switch {
+				case row < top || row > d.row:
+					d.displayed[row] = nil
+				case row < d.row:
+					d.displayed[row] = d.displayed[row+1]
+				default:
+					d.displayed[row] = nil
+				}
+			}
+
+			d.startCue(t)
+		}
+		d.column = 0
+
+	case 0x2f:
+		// End of caption: show the pop-on captions.
+		d.endCue(t)
+		d.displayed, d.nonDisplayed = d.nonDisplayed, d.displayed
+		d.mode = CEA608_POP_ON
+		d.startCue(t)
+	}
+}
+
+var sccLinePattern = regexp.MustCompile(`^(\d{2}:\d{2}:\d{2}[:;.,]\d{2})\s+(.*)$`)
+var sccWordPattern = regexp.MustCompile(`^[0-9a-fA-F]{4}$`)
+
+/*
+Parses a Scenarist SCC file, and decodes the CEA-608 captions of channel 1.
+
+	Each line has a timecode, and the byte pairs sent from that frame on, one
+	pair per frame.  Pop-on captions become one cue each.  Roll-up captions
+	become a cue for every line they scroll.  Colors, italics, underlines and
+	the position of the captions are kept.
+*/
+func ParseScc(r io.Reader, frameRate float64) ([]SubtitleCue, error) {
+	lines, err := readSubtitleLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "Scenarist_SCC V1.0" {
+		return nil, &SubtitleParseError{Line: 1, Message: `an SCC file must start with "Scenarist_SCC V1.0"`}
+	}
+
+	decoder := newCea608Decoder()
+	last := 0.0
+
+	for idx, line := range lines[1:] {
+		lineNum := idx + 2
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		match := sccLinePattern.FindStringSubmatch(line)
+		if match == nil {
+			return nil, &SubtitleParseError{Line: lineNum, Message: fmt.Sprintf("expected a timecode and caption data, got %q", line)}
+		}
+
+		start, err := parseTimecode(strings.Replace(match[1], ",", ":", 1), frameRate)
+		if err != nil {
+			return nil, &SubtitleParseError{Line: lineNum, Message: err.Error()}
+		}
+
+		if start < last {
+			return nil, &SubtitleParseError{Line: lineNum, Message: "the timecode goes back in time"}
+		}
+
+		for num, word := range strings.Fields(match[2]) {
+			if !sccWordPattern.MatchString(word) {
+				return nil, &SubtitleParseError{Line: lineNum, Message: fmt.Sprintf("%q is not a pair of hex bytes", word)}
+			}
+
+			value, _ := strconv.ParseUint(word, 16, 16)
+			last = start + float64(num)/frameRate
+			decoder.decode(byte(value>>8)&0x7f, byte(value)&0x7f, last)
+		}
+	}
+
+	if decoder.cueStart >= 0 {
+		// The file never clears the last caption.
+		decoder.endCue(math.Max(last, decoder.cueStart) + SCC_TRAILING_CAPTION_DURATION)
+	}
+
+	return decoder.cues, nil
+}
@@ -0,0 +1,536 @@
+// A module to convert sidecar subtitles to WebVTT.
+package streamer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Define a new type called SubtitleFormat, which is essentially a string.
+type SubtitleFormat string
+
+const (
+	SUBTITLE_WEBVTT SubtitleFormat = "webvtt" // WebVTT, which the packager takes as is.
+	SUBTITLE_SRT    SubtitleFormat = "srt"    // SubRip.
+	SUBTITLE_TTML   SubtitleFormat = "ttml"   // TTML, including DFXP and IMSC1.
+	SUBTITLE_SCC    SubtitleFormat = "scc"    // Scenarist SCC, which carries CEA-608 captions.
+)
+
+// The subtitle format of each file extension.
+var SUBTITLE_EXTENSIONS = map[string]SubtitleFormat{
+	".vtt":  SUBTITLE_WEBVTT,
+	".srt":  SUBTITLE_SRT,
+	".ttml": SUBTITLE_TTML,
+	".dfxp": SUBTITLE_TTML,
+	".xml":  SUBTITLE_TTML,
+	".scc":  SUBTITLE_SCC,
+}
+
+// The timing options of a text input.
+type TextTimingConfig struct {
+	/*
+		A time to add to every cue, such as '-01:00:00:00' to start a caption file
+		made for a tape at 01:00:00:00 at zero.
+
+			In seconds, in [HH:]MM:SS[.m], or in a HH:MM:SS:FF timecode with frames
+			at frame_rate.  Use ';' before the frames for a drop-frame timecode.
+	*/
+	Offset string `yaml:"offset"`
+
+	/*
+		The frame rate of timecodes in the offset and in the file.
+
+			If unspecified, the offset and SCC files use 29.97, and TTML files use
+			the frame rate they declare, or 30.
+	*/
+	FrameRate float64 `yaml:"frame_rate"`
+}
+
+// A single cue of a subtitle file.
+type SubtitleCue struct {
+	// The start and end times, in seconds.
+	Start float64
+	End   float64
+
+	// The text of the cue, with WebVTT markup such as <i> and <c.yellow>.
+	Text string
+
+	// The WebVTT cue settings, such as "line:0 align:left".
+	Settings string
+}
+
+// An error raised when a subtitle file can't be parsed.
+type SubtitleParseError struct {
+	Path    string
+	Line    int
+	Message string
+}
+
+func (e SubtitleParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.Path, e.Line, e.Message)
+}
+
+// The colors of the default WebVTT cue classes, by the names and hex values
+// subtitle formats use for them.
+var WEBVTT_COLOR_CLASSES = map[string]string{
+	"white":   "white",
+	"#ffffff": "white",
+	"lime":    "lime",
+	"green":   "lime",
+	"#00ff00": "lime",
+	"cyan":    "cyan",
+	"aqua":    "cyan",
+	"#00ffff": "cyan",
+	"red":     "red",
+	"#ff0000": "red",
+	"yellow":  "yellow",
+	"#ffff00": "yellow",
+	"magenta": "magenta",
+	"fuchsia": "magenta",
+	"#ff00ff": "magenta",
+	"blue":    "blue",
+	"#0000ff": "blue",
+	"black":   "black",
+	"#000000": "black",
+}
+
+// Returns the WebVTT class of a color, such as "yellow" for "#FFFF00", or ""
+// if WebVTT has no class for it.
+func webVttColorClass(color string) string {
+	color = strings.ToLower(strings.TrimSpace(color))
+	if len(color) == 9 && strings.HasPrefix(color, "#") {
+		// Drop the alpha of #rrggbbaa.
+		color = color[:7]
+	}
+
+	return WEBVTT_COLOR_CLASSES[color]
+}
+
+// Returns the format of a subtitle file, from its extension.
+func GetSubtitleFormat(path string) SubtitleFormat {
+	return SUBTITLE_EXTENSIONS[strings.ToLower(filepath.Ext(path))]
+}
+
+// Parses a time in the format [-]HH:MM:SS:FF, or [-]HH:MM:SS;FF for drop
+// frame, into seconds at the given frame rate.
+func parseTimecode(s string, frameRate float64) (float64, error) {
+	dropFrame := strings.ContainsAny(s, ";.") && strings.Count(s, ":") == 2
+	pieces := strings.FieldsFunc(s, func(r rune) bool { return r == ':' || r == ';' || r == '.' })
+	if len(pieces) != 4 {
+		return 0, fmt.Errorf("%q is not a valid timecode", s)
+	}
+
+	var values [4]int
+	for idx, piece := range pieces {
+		value, err := strconv.Atoi(piece)
+		if err != nil || value < 0 {
+			return 0, fmt.Errorf("%q is not a valid timecode", s)
+		}
+
+		values[idx] = value
+	}
+
+	hours, minutes, seconds, frames := values[0], values[1], values[2], values[3]
+	timebase := int(math.Round(frameRate))
+	if frames >= timebase {
+		return 0, fmt.Errorf("%q has more frames than the frame rate %v", s, frameRate)
+	}
+
+	count := ((hours*60+minutes)*60+seconds)*timebase + frames
+
+	if dropFrame {
+		// Drop frame timecodes skip the first frames of every minute, except
+		// every tenth minute, to keep up with the clock.
+		dropped := timebase / 15
+		totalMinutes := hours*60 + minutes
+		count -= dropped * (totalMinutes - totalMinutes/10)
+	}
+
+	return float64(count) / frameRate, nil
+}
+
+// Parses a timing offset, in seconds, [HH:]MM:SS[.m] or a timecode.
+func parseTextOffset(s string, frameRate float64) (float64, error) {
+	sign := 1.0
+	if strings.HasPrefix(s, "-") {
+		sign = -1.0
+		s = s[1:]
+	}
+
+	var offset float64
+	var err error
+	if strings.Count(s, ":") == 3 || strings.Contains(s, ";") {
+		offset, err = parseTimecode(s, frameRate)
+	} else {
+		offset, err = parseFFmpegTime(s)
+	}
+
+	return sign * offset, err
+}
+
+/*
+Converts a subtitle file to WebVTT, and writes it to outputPath.
+
+	The timing offset is applied to every cue, and cues which end up before
+	zero are dropped.  Returns the language the file declares, if any.
+*/
+func ConvertToWebVtt(path string, timing TextTimingConfig, outputPath string) (string, error) {
+	format := GetSubtitleFormat(path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	var cues []SubtitleCue
+	var language string
+
+	switch format {
+	case SUBTITLE_WEBVTT:
+		cues, err = ParseWebVtt(file)
+	case SUBTITLE_SRT:
+		cues, err = ParseSrt(file)
+	case SUBTITLE_TTML:
+		cues, language, err = ParseTtml(file, timing.FrameRate)
+	case SUBTITLE_SCC:
+		frameRate := timing.FrameRate
+		if frameRate == 0 {
+			frameRate = SCC_FRAME_RATE
+		}
+		cues, err = ParseScc(file, frameRate)
+	default:
+		return "", fmt.Errorf("%s is not a known subtitle format", path)
+	}
+
+	if parseErr, ok := err.(*SubtitleParseError); ok {
+		parseErr.Path = path
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if timing.Offset != "" {
+		frameRate := timing.FrameRate
+		if frameRate == 0 {
+			frameRate = SCC_FRAME_RATE
+		}
+
+		offset, err := parseTextOffset(timing.Offset, frameRate)
+		if err != nil {
+			return "", err
+		}
+
+		cues = offsetCues(cues, offset)
+	}
+
+	output, err := os.Create(outputPath)
+	if err != nil {
+		return "", err
+	}
+	defer output.Close()
+
+	return language, WriteWebVtt(output, cues)
+}
+
+// Moves every cue by the offset in seconds, and drops cues which end before
+// zero.
+func offsetCues(cues []SubtitleCue, offset float64) []SubtitleCue {
+	var moved []SubtitleCue
+	for _, cue := range cues {
+		cue.Start = math.Max(cue.Start+offset, 0)
+		cue.End += offset
+
+		if cue.End > cue.Start {
+			moved = append(moved, cue)
+		}
+	}
+
+	return moved
+}
+
+// Formats seconds as a WebVTT timestamp, HH:MM:SS.mmm.
+func formatWebVttTime(seconds float64) string {
+	millis := int64(math.Round(seconds * 1000))
+	return fmt.Sprintf("%02d:%02d:%02d.%03d", millis/3600000, millis/60000%60, millis/1000%60, millis%1000)
+}
+
+var webVttClassPattern = regexp.MustCompile(`<c\.([a-z]+)>`)
+
+// Writes cues as a WebVTT file, with a style for each color class used.
+func WriteWebVtt(w io.Writer, cues []SubtitleCue) error {
+	// Cues must be in order of their start times.
+	sort.SliceStable(cues, func(a, b int) bool { return cues[a].Start < cues[b].Start })
+
+	out := bufio.NewWriter(w)
+	out.WriteString("WEBVTT\n\n")
+
+	classes := map[string]bool{}
+	for _, cue := range cues {
+		for _, match := range webVttClassPattern.FindAllStringSubmatch(cue.Text, -1) {
+			classes[match[1]] = true
+		}
+	}
+
+	if len(classes) > 0 {
+		// Players don't all style the default classes, so they are spelled out.
+		names := make([]string, 0, len(classes))
+		for name := range classes {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		out.WriteString("STYLE\n")
+		for _, name := range names {
+			fmt.Fprintf(out, "::cue(.%s) { color: %s; }\n", name, name)
+		}
+		out.WriteString("\n")
+	}
+
+	for _, cue := range cues {
+		// A blank line would end the cue early.
+		var lines []string
+		for _, line := range strings.Split(cue.Text, "\n") {
+			if strings.TrimSpace(line) != "" {
+				lines = append(lines, strings.ReplaceAll(line, "-->", "--&gt;"))
+			}
+		}
+
+		if len(lines) == 0 {
+			continue
+		}
+
+		timing := formatWebVttTime(cue.Start) + " --> " + formatWebVttTime(cue.End)
+		if cue.Settings != "" {
+			timing += " " + cue.Settings
+		}
+
+		fmt.Fprintf(out, "%s\n%s\n\n", timing, strings.Join(lines, "\n"))
+	}
+
+	return out.Flush()
+}
+
+// Reads the lines of a text subtitle file, without a byte order mark or
+// carriage returns.
+func readSubtitleLines(r io.Reader) ([]string, error) {
+	contents, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	text := strings.TrimPrefix(string(contents), "\uFEFF")
+	text = strings.ReplaceAll(text, "\r\n", "\n")
+	text = strings.ReplaceAll(text, "\r", "\n")
+
+	return strings.Split(text, "\n"), nil
+}
+
+var srtTimingPattern = regexp.MustCompile(`^\s*(\d+:\d{2}:\d{2}[,.]\d{1,3})\s*-->\s*(\d+:\d{2}:\d{2}[,.]\d{1,3})`)
+
+// Parses an SRT or WebVTT timestamp, such as 00:01:02,500, into seconds.
+func parseCueTime(s string) float64 {
+	seconds, _ := parseFFmpegTime(strings.Replace(s, ",", ".", 1))
+	return seconds
+}
+
+/*
+Parses an SRT file.
+
+	Bold, italic and underlined text, font colors WebVTT has a class for, and
+	the {\an1} to {\an9} position tags are kept.  Other tags are dropped.
+*/
+func ParseSrt(r io.Reader) ([]SubtitleCue, error) {
+	lines, err := readSubtitleLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var cues []SubtitleCue
+
+	for idx := 0; idx < len(lines); {
+		if strings.TrimSpace(lines[idx]) == "" {
+			idx++
+			continue
+		}
+
+		// The cue number is optional in practice.
+		if _, err := strconv.Atoi(strings.TrimSpace(lines[idx])); err == nil && idx+1 < len(lines) {
+			idx++
+		}
+
+		match := srtTimingPattern.FindStringSubmatch(lines[idx])
+		if match == nil {
+			return nil, &SubtitleParseError{Line: idx + 1, Message: fmt.Sprintf("expected a timing line, such as 00:00:01,000 --> 00:00:02,000, got %q", lines[idx])}
+		}
+
+		cue := SubtitleCue{Start: parseCueTime(match[1]), End: parseCueTime(match[2])}
+		if cue.End < cue.Start {
+			return nil, &SubtitleParseError{Line: idx + 1, Message: "the cue ends before it starts"}
+		}
+
+		var text []string
+		for idx++; idx < len(lines) && strings.TrimSpace(lines[idx]) != ""; idx++ {
+			text = append(text, lines[idx])
+		}
+
+		cue.Text, cue.Settings = convertSrtMarkup(strings.Join(text, "\n"))
+		cues = append(cues, cue)
+	}
+
+	return cues, nil
+}
+
+var srtTagPattern = regexp.MustCompile(`(?i)<(/?)([a-z]+)([^>]*)>|\{\\[^}]*\}`)
+var srtColorPattern = regexp.MustCompile(`(?i)color\s*=\s*["']?([#\w]+)`)
+var srtAlignmentPattern = regexp.MustCompile(`\\an([1-9])`)
+
+// The WebVTT cue settings of each {\anN} position of SRT, which is laid out
+// like a numeric keypad.
+var SRT_ALIGNMENT_SETTINGS = map[string]string{
+	"1": "align:left",
+	"2": "",
+	"3": "align:right",
+	"4": "line:50%,center align:left",
+	"5": "line:50%,center",
+	"6": "line:50%,center align:right",
+	"7": "line:0 align:left",
+	"8": "line:0",
+	"9": "line:0 align:right",
+}
+
+// Converts the markup of an SRT cue to WebVTT markup and cue settings.
+func convertSrtMarkup(text string) (string, string) {
+	var out strings.Builder
+	var settings string
+	// The closing tag of each open <font>, which is empty if it had no class.
+	var fonts []string
+
+	last := 0
+	for _, loc := range srtTagPattern.FindAllStringSubmatchIndex(text, -1) {
+		out.WriteString(escapeWebVtt(text[last:loc[0]]))
+		last = loc[1]
+
+		tag := text[loc[0]:loc[1]]
+		if strings.HasPrefix(tag, "{") {
+			if match := srtAlignmentPattern.FindStringSubmatch(tag); match != nil {
+				settings = SRT_ALIGNMENT_SETTINGS[match[1]]
+			}
+			continue
+		}
+
+		closing := text[loc[2]:loc[3]] == "/"
+		name := strings.ToLower(text[loc[4]:loc[5]])
+		attributes := text[loc[6]:loc[7]]
+
+		switch name {
+		case "b", "i", "u":
+			if closing {
+				out.WriteString("</" + name + ">")
+			} else {
+				out.WriteString("<" + name + ">")
+			}
+		case "font":
+			if closing {
+				if len(fonts) > 0 {
+					out.WriteString(fonts[len(fonts)-1])
+					fonts = fonts[:len(fonts)-1]
+				}
+				continue
+			}
+
+			class := ""
+			if match := srtColorPattern.FindStringSubmatch(attributes); match != nil {
+				class = webVttColorClass(match[1])
+			}
+
+			if class != "" {
+				out.WriteString("<c." + class + ">")
+				fonts = append(fonts, "</c>")
+			} else {
+				fonts = append(fonts, "")
+			}
+		}
+	}
+
+	out.WriteString(escapeWebVtt(text[last:]))
+
+	// Close any font the file left open.
+	for idx := len(fonts) - 1; idx >= 0; idx-- {
+		out.WriteString(fonts[idx])
+	}
+
+	return out.String(), settings
+}
+
+// Escapes the characters which are markup in WebVTT.
+func escapeWebVtt(text string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(text)
+}
+
+var webVttTimingPattern = regexp.MustCompile(`^\s*((?:\d+:)?\d{2}:\d{2}\.\d{3})\s*-->\s*((?:\d+:)?\d{2}:\d{2}\.\d{3})(.*)$`)
+
+/*
+Parses a WebVTT file, so its timing can be offset.
+
+	The text and settings of each cue are kept as they are.  Blocks other than
+	cues, such as STYLE and NOTE, are dropped.
+*/
+func ParseWebVtt(r io.Reader) ([]SubtitleCue, error) {
+	lines, err := readSubtitleLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lines) == 0 || !strings.HasPrefix(lines[0], "WEBVTT") {
+		return nil, &SubtitleParseError{Line: 1, Message: `a WebVTT file must start with "WEBVTT"`}
+	}
+
+	var cues []SubtitleCue
+
+	for idx := 1; idx < len(lines); {
+		// Each block runs until a blank line.
+		start := idx
+		for idx < len(lines) && strings.TrimSpace(lines[idx]) != "" {
+			idx++
+		}
+
+		block := lines[start:idx]
+		idx++
+
+		if len(block) == 0 {
+			continue
+		}
+
+		for num, line := range block {
+			if !strings.Contains(line, "-->") {
+				// The cue identifier, or a block which isn't a cue.
+				continue
+			}
+
+			match := webVttTimingPattern.FindStringSubmatch(line)
+			if match == nil {
+				return nil, &SubtitleParseError{Line: start + num + 1, Message: fmt.Sprintf("malformed cue timing %q", line)}
+			}
+
+			cues = append(cues, SubtitleCue{
+				Start:    parseCueTime(match[1]),
+				End:      parseCueTime(match[2]),
+				Settings: strings.TrimSpace(match[3]),
+				Text:     strings.Join(block[num+1:], "\n"),
+			})
+			break
+		}
+	}
+
+	return cues, nil
+}
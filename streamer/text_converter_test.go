@@ -0,0 +1,195 @@
+package streamer
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Parses a subtitle file with the given parser, and returns it as WebVTT.
+func toWebVtt(t *testing.T, cues []SubtitleCue, err error) string {
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	if err := WriteWebVtt(&out, cues); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.String()
+}
+
+func TestParseSrt(t *testing.T) {
+	srt := "\uFEFF1\r\n00:00:01,000 --> 00:00:02,500\r\n<i>Hello</i> & <font color=\"#ffff00\">world</font>\r\n\r\n" +
+		"2\r\n00:00:03,000 --> 00:00:04,000\r\n{\\an8}Top <b>line</b>\r\n<font face=\"Arial\">second</font>\r\n"
+
+	cues, err := ParseSrt(strings.NewReader(srt))
+	got := toWebVtt(t, cues, err)
+
+	want := "WEBVTT\n\nSTYLE\n::cue(.yellow) { color: yellow; }\n\n" +
+		"00:00:01.000 --> 00:00:02.500\n<i>Hello</i> &amp; <c.yellow>world</c>\n\n" +
+		"00:00:03.000 --> 00:00:04.000 line:0\nTop <b>line</b>\nsecond\n\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	_, err = ParseSrt(strings.NewReader("1\n00:00:01,000 --> 00:00:02,000\nOK\n\n2\n00:00:03,000 -> 00:00:04,000\nBroken\n"))
+	if parseErr, ok := err.(*SubtitleParseError); !ok || parseErr.Line != 6 {
+		t.Errorf("error = %v, want a parse error on line 6", err)
+	}
+}
+
+const testTtml = `<?xml version="1.0" encoding="UTF-8"?>
+<tt xmlns="http://www.w3.org/ns/ttml" xmlns:tts="http://www.w3.org/ns/ttml#styling"
+    xmlns:ttp="http://www.w3.org/ns/ttml#parameter" ttp:frameRate="25" xml:lang="fr">
+  <head>
+    <styling>
+      <style xml:id="yellow" tts:color="#FFFF00"/>
+    </styling>
+    <layout>
+      <region xml:id="top" tts:origin="10% 10%" tts:extent="80% 20%" tts:displayAlign="before"/>
+    </layout>
+  </head>
+  <body>
+    <div begin="10s">
+      <p begin="00:00:01:05" end="00:00:03:00">
+        Bonjour<br/>le <span tts:fontStyle="italic">monde</span>
+      </p>
+      <p begin="5s" dur="1.5s" region="top" style="yellow">En haut &amp; jaune</p>
+    </div>
+  </body>
+</tt>
+`
+
+func TestParseTtml(t *testing.T) {
+	cues, language, err := ParseTtml(strings.NewReader(testTtml), 0)
+	got := toWebVtt(t, cues, err)
+
+	want := "WEBVTT\n\nSTYLE\n::cue(.yellow) { color: yellow; }\n\n" +
+		"00:00:11.200 --> 00:00:13.000\nBonjour\nle <i>monde</i>\n\n" +
+		"00:00:15.000 --> 00:00:16.500 line:10% position:10%,line-left size:80%\n<c.yellow>En haut &amp; jaune</c>\n\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if language != "fr" {
+		t.Errorf("language = %q, want fr", language)
+	}
+
+	tests := []struct {
+		name     string
+		ttml     string
+		wantLine int
+	}{
+		{
+			name:     "No end time",
+			ttml:     "<tt>\n<body>\n<div>\n<p begin=\"1s\">Forever</p>\n</div>\n</body>\n</tt>",
+			wantLine: 4,
+		},
+		{
+			name:     "Bad time",
+			ttml:     "<tt>\n<body>\n<p begin=\"soon\" end=\"2s\">Soon</p>\n</body>\n</tt>",
+			wantLine: 3,
+		},
+		{
+			name:     "Malformed XML",
+			ttml:     "<tt>\n<body>\n<p begin=\"1s\" end=\"2s\">Open\n</body>\n</tt>",
+			wantLine: 4,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := ParseTtml(strings.NewReader(tt.ttml), 0)
+			if parseErr, ok := err.(*SubtitleParseError); !ok || parseErr.Line != tt.wantLine {
+				t.Errorf("error = %v, want a parse error on line %d", err, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestParseScc(t *testing.T) {
+	scc := "Scenarist_SCC V1.0\n\n" +
+		// Pop-on: "HELLO" indented on row 14, and "YO" in italics on row 15.
+		"00:00:00:00\t9420 9420 94ae 94ae 9452 9452 97a2 97a2 c845 4c4c 4f80 946e 946e d94f 942f 942f\n\n" +
+		"00:00:02:00\t942c 942c\n\n" +
+		// Roll-up: "HI" then "OK", which scrolls "HI" up a row.
+		"00:00:03:00\t9425 9425 94ad 94ad 9470 9470 c849\n\n" +
+		"00:00:04:00\t94ad 94ad 9470 9470 4fcb\n\n" +
+		"00:00:05:00\t942c 942c\n"
+
+	cues, err := ParseScc(strings.NewReader(scc), SCC_FRAME_RATE)
+	got := toWebVtt(t, cues, err)
+
+	want := "WEBVTT\n\n" +
+		"00:00:00.467 --> 00:00:02.002 line:79.33% position:10% align:left\nHELLO\n<i>YO</i>\n\n" +
+		"00:00:03.203 --> 00:00:04.004 line:84.67% position:10% align:left\nHI\n\n" +
+		"00:00:04.004 --> 00:00:05.005 line:79.33% position:10% align:left\nHI\nOK\n\n"
+	if got != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	_, err = ParseScc(strings.NewReader("Scenarist_SCC V1.0\n\n00:00:00:00\t9420 94zz\n"), SCC_FRAME_RATE)
+	if parseErr, ok := err.(*SubtitleParseError); !ok || parseErr.Line != 3 {
+		t.Errorf("error = %v, want a parse error on line 3", err)
+	}
+}
+
+func TestParseTextOffset(t *testing.T) {
+	tests := []struct {
+		offset    string
+		frameRate float64
+		want      float64
+	}{
+		{offset: "1.5", frameRate: 25, want: 1.5},
+		{offset: "-00:01:30", frameRate: 25, want: -90},
+		{offset: "00:00:01:05", frameRate: 25, want: 1.2},
+		{offset: "00:01:00;02", frameRate: SCC_FRAME_RATE, want: 60.06},
+		{offset: "-01:00:00;00", frameRate: SCC_FRAME_RATE, want: -3599.9964},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.offset, func(t *testing.T) {
+			got, err := parseTextOffset(tt.offset, tt.frameRate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if math.Abs(got-tt.want) > 0.0001 {
+				t.Errorf("parseTextOffset(%q) = %v, want %v", tt.offset, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConvertToWebVtt(t *testing.T) {
+	dir := t.TempDir()
+	input := filepath.Join(dir, "captions.srt")
+	srt := "1\n00:00:00,500 --> 00:00:01,000\nBefore\n\n2\n00:00:02,000 --> 00:00:03,000\nAfter\n"
+	if err := os.WriteFile(input, []byte(srt), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(dir, "captions.vtt")
+	if _, err := ConvertToWebVtt(input, TextTimingConfig{Offset: "-00:00:01:15", FrameRate: 30}, output); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := os.ReadFile(output)
+	want := "WEBVTT\n\n00:00:00.500 --> 00:00:01.500\nAfter\n\n"
+	if string(got) != want {
+		t.Errorf("got:\n%s\nwant:\n%s", got, want)
+	}
+
+	if err := os.WriteFile(input, []byte("1\n00:00:01 --> 00:00:02\nBroken\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := ConvertToWebVtt(input, TextTimingConfig{}, output)
+	if err == nil || !strings.HasPrefix(err.Error(), input+":2:") {
+		t.Errorf("error = %v, want it to start with %s:2:", err, input)
+	}
+}
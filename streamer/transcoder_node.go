@@ -3,6 +3,7 @@ package streamer
 
 import (
 	"fmt"
+	"os"
 	"strconv"
 	"strings"
 )
@@ -14,6 +15,8 @@ type TranscoderNode struct {
 	outputs        []MediaOutputStream
 	index          int
 	ffmpeg         string
+	// The pass of a two-pass encode being built, or 0 for a single pass.
+	pass int
 }
 
 func NewTranscoderNode(inputs []Input, pipelineConfig PipelineConfig, outputs []MediaOutputStream, index int, hermeticFFmpeg string) *TranscoderNode {
@@ -33,6 +36,56 @@ func NewTranscoderNode(inputs []Input, pipelineConfig PipelineConfig, outputs []
 }
 
 func (t *TranscoderNode) Start() {
+	args := t.commandLine(0)
+	mergeEnv := false
+
+	if t.isTwoPass() {
+		// The first pass analyses every rendition which can use it, and the
+		// second encodes all of them into the pipes.  They run one after the
+		// other in a shell, so the node is a single process group.
+		first, second := t.commandLine(1), t.commandLine(2)
+		args = []string{"sh", "-c", shellJoin(first) + " && exec " + shellJoin(second)}
+		// The shell finds ffmpeg in the PATH.
+		mergeEnv = true
+	}
+
+	env := map[string]string{}
+
+	if t.pipelineConfig.DebugLogs {
+		// Use this environment variable to turn on ffmpeg's logging.  This is
+		// independent of the -loglevel switch above.
+		ffmpegLogFile := fmt.Sprintf("TranscoderNode-%d.log", t.index)
+		env["FFREPORT"] = fmt.Sprintf("file=%s:level=32", ffmpegLogFile)
+	}
+
+	// start process
+	t.Process = t.CreateProcess(BaseParams{args: args, env: env, mergeEnv: mergeEnv})
+}
+
+// Returns true if any video output of a VOD is encoded in two passes.
+func (t *TranscoderNode) isTwoPass() bool {
+	if !t.pipelineConfig.TwoPass || t.pipelineConfig.StreamingMode != VOD {
+		return false
+	}
+
+	for _, output := range t.outputs {
+		if video, ok := output.(*VideoOutputStream); ok && video.Resolution.RateControl.isTwoPass(video.Codec) {
+			return true
+		}
+	}
+
+	return false
+}
+
+/*
+Builds the FFmpeg command line of a pass of the encode.
+
+	The first pass of a two-pass encode only analyses the video outputs which
+	can use it, and throws the picture away.  Pass 0 is a single pass.
+*/
+func (t *TranscoderNode) commandLine(pass int) []string {
+	t.pass = pass
+
 	args := []string{
 		t.ffmpeg,
 		// Do not prompt for output files that already exist. Since we created
@@ -74,7 +127,14 @@ func (t *TranscoderNode) Start() {
 		// string will produce an empty array.
 		args = append(args, strings.Fields(input.ExtraInputArgs)...)
 
-		if input.InputType == LOOPED_FILE {
+		// A relayed input is read from a pipe, whatever its source.
+		isRelayed := input.relayFormat != ""
+
+		// Extracted captions are read through a filter graph, which loops the
+		// input itself.
+		isCaptions := input.captionChannel.Channel != ""
+
+		if input.InputType == LOOPED_FILE && !isRelayed && !isCaptions {
 			// These are handled here instead of in get_input_args() because these
 			// arguments are specific to ffmpeg and are not understood by ffprobe.
 			args = append(args, []string{
@@ -108,10 +168,30 @@ func (t *TranscoderNode) Start() {
 			}...)
 		}
 
+		if input.AvOffset != "" {
+			// Shift the timestamps of this input alone.  A relay carries every
+			// track of its source, so the offset is applied here, to the track
+			// read from its pipe.
+			args = append(args, "-itsoffset", input.AvOffset)
+		}
+
+		if (input.InputType == GENERATOR && !isRelayed || isCaptions) && t.pipelineConfig.StreamingMode == LIVE {
+			// A filter graph runs as fast as it can, so slow it down to real time.
+			args = append(args, "-re")
+		}
+
+		name := input.Name
+		if input.InputType == GENERATOR && !isRelayed {
+			// The lavfi input format takes a filter graph in place of a file.
+			name = input.GetGeneratorGraph()
+		} else if isCaptions {
+			name = input.GetCaptionsGraph()
+		}
+
 		// The input name always comes after the applicable input arguments.
 		args = append(args, []string{
 			// The input itself.
-			"-i", input.Name,
+			"-i", name,
 		}...)
 	}
 
@@ -128,7 +208,7 @@ func (t *TranscoderNode) Start() {
 		for _, stream := range t.outputs {
 			streamInput := stream.GetInput()
 
-			if streamInput.TrackNum != input.TrackNum && streamInput.Name != input.Name {
+			if streamInput.Name != input.Name || streamInput.GetStreamSpecifier() != input.GetStreamSpecifier() || streamInput.captionChannel != input.captionChannel {
 				// Skip outputs that don't match this exact input object.
 				continue
 			}
@@ -138,6 +218,14 @@ func (t *TranscoderNode) Start() {
 				continue
 			}
 
+			if pass == 1 {
+				video, ok := stream.(*VideoOutputStream)
+				if !ok || !video.Resolution.RateControl.isTwoPass(video.Codec) {
+					// Only video is analysed.
+					continue
+				}
+			}
+
 			// Map arguments must be repeated for each output file.
 			args = append(args, mapArgs...)
 
@@ -153,25 +241,40 @@ func (t *TranscoderNode) Start() {
 				args = append(args, t.encodeText(textStream, input)...)
 			}
 
+			if pass == 1 {
+				// The analysis is all that is kept of the first pass.
+				args = append(args, os.DevNull)
+				continue
+			}
+
 			ipcPipe := stream.GetIpcPipe()
 			args = append(args, ipcPipe.WriteEnd())
 		}
 	}
 
-	env := map[string]string{}
+	return args
+}
 
-	if t.pipelineConfig.DebugLogs {
-		// Use this environment variable to turn on ffmpeg's logging.  This is
-		// independent of the -loglevel switch above.
-		ffmpegLogFile := fmt.Sprintf("TranscoderNode-%d.log", t.index)
-		env["FFREPORT"] = fmt.Sprintf("file=%s:level=32", ffmpegLogFile)
+func (t TranscoderNode) encodeAudio(stream *AudioOutputStream, i Input) []string {
+	// The same fragmented MP4 in the pipe, whatever the codec.
+	muxerArgs := []string{
+		// Output MP4 in the pipe, for all codecs.
+		"-f", "mp4",
+		// This explicit fragment duration affects both audio and video, and
+		// ensures that there are no single large MP4 boxes that Shaka Packager
+		// can't consume from a pipe.
+		// FFmpeg fragment duration is in microseconds.
+		"-frag_duration", strconv.Itoa(int(t.pipelineConfig.SegmentSize * 1e6)),
+		// Opus, FLAC and AC-4 in MP4 are considered "experimental".
+		"-strict", "experimental",
 	}
 
-	// start process
-	t.Process = t.CreateProcess(BaseParams{args: args, env: env})
-}
+	if stream.Codec.Passthrough {
+		// The input is already encoded, so it is copied with its own channels
+		// and bitrate.
+		return append([]string{"-vn", "-c:a", "copy"}, muxerArgs...)
+	}
 
-func (t TranscoderNode) encodeAudio(stream *AudioOutputStream, i Input) []string {
 	var filters []string
 	args := []string{
 		// No video encoding for audio.
@@ -189,23 +292,40 @@ func (t TranscoderNode) encodeAudio(stream *AudioOutputStream, i Input) []string
 		)
 	}
 
+	if i.relayFormat != "" {
+		// A relayed input has gaps when it switches sources.  Fill them with
+		// silence, so the stream never stops.
+		filters = append(filters, "aresample=async=1")
+	}
+
 	filters = append(filters, i.Filters...)
 	hwaccelAPI := t.pipelineConfig.HWAccelAPI
 
-	args = append(args,
-		// Set codec and bitrate.
-		"-c:a", stream.GetFFmpegCodecString(hwaccelAPI),
-		"-b:a", stream.GetBitrate(),
-		// Output MP4 in the pipe, for all codecs.
-		"-f", "mp4",
-		// This explicit fragment duration affects both audio and video, and
-		// ensures that there are no single large MP4 boxes that Shaka Packager
-		// can't consume from a pipe.
-		// FFmpeg fragment duration is in microseconds.
-		"-frag_duration", strconv.Itoa(int(t.pipelineConfig.SegmentSize*1e6)),
-		// Opus in MP4 is considered "experimental".
-		"-strict", "experimental",
-	)
+	// Set codec.
+	args = append(args, "-c:a", stream.GetFFmpegCodecString(hwaccelAPI))
+
+	switch stream.Codec.Name {
+	case FLAC:
+		// Lossless, so there is no bitrate to set.
+	case HE_AAC, HE_AAC_V2:
+		profile := "aac_he"
+		if stream.Codec.Name == HE_AAC_V2 {
+			profile = "aac_he_v2"
+		}
+
+		args = append(args,
+			"-b:a", stream.GetBitrate(),
+			"-profile:a", profile,
+			// Put SBR (and PS) in the header of the stream, so the manifests
+			// signal mp4a.40.5 (or mp4a.40.29), rather than plain AAC.
+			"-signaling", "explicit_hierarchical",
+		)
+	default:
+		// Set bitrate.
+		args = append(args, "-b:a", stream.GetBitrate())
+	}
+
+	args = append(args, muxerArgs...)
 
 	if len(filters) > 0 {
 		args = append(args,
@@ -217,6 +337,42 @@ func (t TranscoderNode) encodeAudio(stream *AudioOutputStream, i Input) []string
 	return args
 }
 
+// Returns the size options of the scale filters which fit the picture of an
+// input to a resolution.
+func scaleSize(i Input, resolution VideoResolution) string {
+	// A portrait picture is scaled on its side, so the height of the
+	// resolution is its width.
+	width, height := resolution.MaxWidth, resolution.MaxHeight
+	if i.isPortrait() {
+		width, height = height, width
+	}
+
+	if i.Processing.Crop.IsEnabled() {
+		// A cropped picture is often wider than the resolution's own aspect
+		// ratio, so it is fit inside the resolution instead, keeping its aspect
+		// ratio.
+		return fmt.Sprintf("w=%d:h=%d:force_original_aspect_ratio=decrease:force_divisible_by=2", width, height)
+	}
+
+	// -2 in the scale filters means to choose a value to keep the original
+	// aspect ratio.
+	if width < height {
+		return fmt.Sprintf("%d:-2", width)
+	}
+
+	return fmt.Sprintf("-2:%d", height)
+}
+
+// Returns the frame rate of a video output.  A resolution without a max frame
+// rate takes any.
+func outputFrameRate(i Input, resolution VideoResolution) float64 {
+	if resolution.MaxFrameRate > 0 && resolution.MaxFrameRate < i.FrameRate {
+		return resolution.MaxFrameRate
+	}
+
+	return i.FrameRate
+}
+
 func (t TranscoderNode) encodeVideo(stream *VideoOutputStream, i Input) []string {
 	var filters []string
 	var args []string
@@ -226,23 +382,43 @@ func (t TranscoderNode) encodeVideo(stream *VideoOutputStream, i Input) []string
 		args = append(args, "-r", strconv.FormatFloat(i.FrameRate, 'f', -1, 64))
 	}
 
-	if stream.Resolution.MaxFrameRate < i.FrameRate {
-		args = append(args, "-r", strconv.FormatFloat(stream.Resolution.MaxFrameRate, 'f', -1, 64))
+	// The frame rate of the output, which the keyframe interval is counted in.
+	frameRate := outputFrameRate(i, stream.Resolution)
+	if frameRate != i.FrameRate {
+		args = append(args, "-r", strconv.FormatFloat(frameRate, 'f', -1, 64))
+	} else if i.relayFormat != "" || i.IsVariableFrameRate {
+		// A relayed input has gaps when it switches sources, and a variable
+		// frame rate has them all the time.  A constant frame rate fills them,
+		// so the stream never stops, and keyframes fall on segment boundaries.
+		args = append(args, "-r", strconv.FormatFloat(frameRate, 'f', -1, 64))
+	}
+
+	// FFmpeg turns the picture of a file upright by itself, following its
+	// rotation metadata.  A relay carries the picture through MPEG-TS, which
+	// has no rotation metadata, so it is turned here instead.
+	if i.relayFormat != "" {
+		filters = append(filters, rotateFilters(i.display.Rotation)...)
 	}
 
+	// Typed processing runs on the deinterlaced picture, before raw filters.
+	filters = append(filters, i.Processing.GetFilters()...)
 	filters = append(filters, i.Filters...)
 
+	// The watermark goes on last, so the filters after it scale the picture
+	// and the watermark together.
+	var scaling []string
+
 	hwaccelAPI := t.pipelineConfig.HWAccelAPI
 
-	// -2 in the scale filters means to choose a value to keep the original
-	// aspect ratio.
+	size := scaleSize(i, stream.Resolution)
+
 	if stream.IsHardwareAccelerated() && hwaccelAPI == "vaapi" {
 		// These filters are specific to Linux's vaapi.
-		filters = append(filters, "format=nv12")
-		filters = append(filters, "hwupload")
-		filters = append(filters, fmt.Sprintf("scale_vaapi=-2:%d", stream.Resolution.MaxHeight))
+		scaling = append(scaling, "format=nv12")
+		scaling = append(scaling, "hwupload")
+		scaling = append(scaling, "scale_vaapi="+size)
 	} else {
-		filters = append(filters, fmt.Sprintf("scale=-2:%d", stream.Resolution.MaxHeight))
+		scaling = append(scaling, "scale="+size)
 	}
 
 	// To avoid weird rounding errors in Sample Aspect Ratio, set it explicitly
@@ -251,16 +427,27 @@ func (t TranscoderNode) encodeVideo(stream *VideoOutputStream, i Input) []string
 	// worse. Some of the width values in the playlist wind up off by one,
 	// which causes playback failures in ExoPlayer.
 	// https://github.com/shaka-project/shaka-streamer/issues/36
-	filters = append(filters, "setsar=1:1")
+	scaling = append(scaling, "setsar=1:1")
+
+	rateControl := stream.Resolution.RateControl
 
 	// These presets are specifically recognized by the software encoder.
 	if (stream.Codec.Name == H264 || stream.Codec.Name == HEVC) && !stream.IsHardwareAccelerated() {
+		preset := rateControl.Preset
 		if t.pipelineConfig.StreamingMode == LIVE {
 			// Encodes with highest-speed presets for real-time live streaming.
-			args = append(args, "-preset", "ultrafast")
+			if preset == "" {
+				preset = "ultrafast"
+			}
+
+			args = append(args, "-preset", preset)
 		} else {
 			// Take your time for VOD streams.
-			args = append(args, "-preset", "slow")
+			if preset == "" {
+				preset = "slow"
+			}
+
+			args = append(args, "-preset", preset)
 			// Apply the loop filter for higher quality output.
 			args = append(args, "-flags", "+loop")
 		}
@@ -281,6 +468,12 @@ func (t TranscoderNode) encodeVideo(stream *VideoOutputStream, i Input) []string
 		// "-preset ultrafast" option, presumably because the baseline encoder
 		// is faster.
 		args = append(args, "-profile:v", profile)
+
+		if i.ClosedCaptions.Mode == CAPTIONS_PASSTHROUGH && !stream.IsHardwareAccelerated() {
+			// Copy the captions of the input into the encoded video.  This is the
+			// default of libx264, but the manifests promise them, so don't rely on it.
+			args = append(args, "-a53cc", "1")
+		}
 	}
 
 	if stream.Codec.Name == H264 || stream.Codec.Name == HEVC {
@@ -322,27 +515,61 @@ func (t TranscoderNode) encodeVideo(stream *VideoOutputStream, i Input) []string
 		)
 	}
 
-	keyframeInterval := int(t.pipelineConfig.SegmentSize * i.FrameRate)
+	keyframeInterval := int(t.pipelineConfig.SegmentSize * frameRate)
 
 	args = append(args,
 		// No audio encoding for video.
 		"-an",
-		// Set codec and bitrate.
+		// Set codec.
 		"-c:v", stream.GetFFmpegCodecString(hwaccelAPI),
-		"-b:v", stream.GetBitrate(),
-		// Output MP4 in the pipe, for all codecs.
-		"-f", "mp4",
-		// This flag forces a video fragment at each keyframe.
-		"-movflags", "+frag_keyframe",
-		// This explicit fragment duration affects both audio and video, and
-		// ensures that there are no single large MP4 boxes that Shaka Packager
-		// can't consume from a pipe.
-		// FFmpeg fragment duration is in microseconds.
-		"-frag_duration", strconv.FormatInt(int64(t.pipelineConfig.SegmentSize*1e6), 10),
+	)
+
+	// Set bitrate.
+	args = append(args, rateControl.GetArgs(stream.Codec, stream.GetBitrate())...)
+
+	// Each rendition keeps its own analysis, next to its pipe.
+	passLog := ""
+	if t.pass > 0 {
+		ipcPipe := stream.GetIpcPipe()
+		passLog = ipcPipe.WriteEnd() + "-pass"
+		if stream.Codec.Name != HEVC {
+			args = append(args, "-pass", strconv.Itoa(t.pass), "-passlogfile", passLog)
+		}
+	}
+
+	args = append(args, rateControl.encoderParams(stream.Codec, t.pass, passLog)...)
+
+	if t.pass == 1 {
+		// The first pass only writes its analysis.
+		args = append(args, "-f", "null")
+	} else {
+		args = append(args,
+			// Output MP4 in the pipe, for all codecs.
+			"-f", "mp4",
+			// This flag forces a video fragment at each keyframe.
+			"-movflags", "+frag_keyframe",
+			// This explicit fragment duration affects both audio and video, and
+			// ensures that there are no single large MP4 boxes that Shaka Packager
+			// can't consume from a pipe.
+			// FFmpeg fragment duration is in microseconds.
+			"-frag_duration", strconv.FormatInt(int64(t.pipelineConfig.SegmentSize*1e6), 10),
+		)
+	}
+
+	args = append(args,
 		// Set minimum and maximum GOP length.
 		"-keyint_min", strconv.Itoa(keyframeInterval), "-g", strconv.Itoa(keyframeInterval),
+	)
+
+	if i.relayFormat != "" {
+		// Place keyframes by time as well, so they stay aligned to segments
+		// when a relayed input switches sources.
+		args = append(args, "-force_key_frames", fmt.Sprintf("expr:gte(t,n_forced*%s)", strconv.FormatFloat(t.pipelineConfig.SegmentSize, 'f', -1, 64)))
+	}
+
+	args = append(args,
 		// Set video filters.
-		"-vf", strings.Join(filters, ","),
+		"-vf", i.Processing.Watermark.buildGraph(filters, scaling),
 	)
 
 	return args
@@ -2,6 +2,8 @@ package streamer
 
 import (
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -53,3 +55,152 @@ func TestNewTranscoderNode(t *testing.T) {
 		})
 	}
 }
+
+func TestTranscoderNode_encodeAudio(t *testing.T) {
+	input := Input{InputType: FILE, Name: "concert.mkv", MediaType: AUDIO, Language: "eng", ChannelLayout: "stereo"}
+	layout := *NewBitrateConfig().GetChannelLayoutValue("stereo")
+	node := NewTranscoderNode([]Input{input}, PipelineConfig{SegmentSize: 4}, nil, 0, "")
+
+	tests := []struct {
+		codec AudioCodecName
+		want  string
+	}{
+		{codec: AAC, want: "-c:a aac -b:a 128k -f mp4"},
+		{codec: HE_AAC, want: "-c:a libfdk_aac -b:a 48k -profile:a aac_he -signaling explicit_hierarchical -f mp4"},
+		{codec: HE_AAC_V2, want: "-c:a libfdk_aac -b:a 32k -profile:a aac_he_v2 -signaling explicit_hierarchical -f mp4"},
+		{codec: MP3, want: "-c:a libmp3lame -b:a 128k -f mp4"},
+		// Lossless, with no bitrate.
+		{codec: FLAC, want: "-ac 2 -c:a flac -f mp4"},
+		// Copied, with none of the channels, bitrate or filters.
+		{codec: "copy:ac4", want: "-vn -c:a copy -f mp4"},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.codec), func(t *testing.T) {
+			stream := NewAudioOutputStream(input, t.TempDir(), NewAudioCodec(tt.codec), layout)
+
+			if got := strings.Join(node.encodeAudio(stream, input), " "); !strings.Contains(got, tt.want) {
+				t.Errorf("encodeAudio() = %s, want it to contain %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTranscoderNode_AvOffset(t *testing.T) {
+	// The tracks of one relayed source, each read from its own pipe.
+	video := Input{InputType: SRT, Name: "srt://127.0.0.1:9000", MediaType: VIDEO, FrameRate: 25, Resolution: "1080p"}
+	audio := Input{InputType: SRT, Name: "srt://127.0.0.1:9000", MediaType: AUDIO, ChannelLayout: "stereo", AvOffset: "0.2"}
+	video.resetToRelay("video.ts", "mpegts")
+	audio.resetToRelay("audio.ts", "mpegts")
+
+	node := NewTranscoderNode([]Input{video, audio}, PipelineConfig{StreamingMode: LIVE}, nil, 0, "")
+	args := node.commandLine(0)
+
+	// Returns the arguments of the input read from a pipe.
+	inputArgs := func(pipe string) string {
+		start := 0
+		for i, arg := range args {
+			if arg == "-i" && args[i+1] == pipe {
+				return strings.Join(args[start:i], " ")
+			}
+
+			if arg == "-i" {
+				start = i + 2
+			}
+		}
+
+		t.Fatalf("no input %s in %v", pipe, args)
+		return ""
+	}
+
+	if got := inputArgs("audio.ts"); !strings.Contains(got, "-itsoffset 0.2") {
+		t.Errorf("the audio input args = %v, want -itsoffset 0.2", got)
+	}
+
+	if got := inputArgs("video.ts"); strings.Contains(got, "-itsoffset") {
+		t.Errorf("the video input args = %v, want no -itsoffset", got)
+	}
+}
+
+func TestNewAudioCodec(t *testing.T) {
+	tests := []struct {
+		name    AudioCodecName
+		want    AudioCodec
+		wantErr bool
+	}{
+		{name: HE_AAC_V2, want: AudioCodec{Name: HE_AAC_V2}},
+		{name: "copy:eac3", want: AudioCodec{Name: EAC3, Passthrough: true}},
+		{name: "copy:ac4", want: AudioCodec{Name: AC4, Passthrough: true}},
+		{name: AC4, want: AudioCodec{Name: AC4}, wantErr: true},
+		{name: "copy:aac", want: AudioCodec{Name: AAC, Passthrough: true}, wantErr: true},
+		{name: "vorbis", want: AudioCodec{Name: "vorbis"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.name), func(t *testing.T) {
+			if got := NewAudioCodec(tt.name); !reflect.DeepEqual(*got, tt.want) {
+				t.Errorf("NewAudioCodec() = %+v, want %+v", *got, tt.want)
+			}
+
+			defer func() {
+				_, malformed := recover().(*MalformedField)
+				if malformed != tt.wantErr {
+					t.Errorf("checkAudioCodec() panicked = %v, want %v", malformed, tt.wantErr)
+				}
+			}()
+
+			checkAudioCodec(PipelineConfig{}, tt.name)
+		})
+	}
+}
+
+func TestCheckAudioCodec_ChannelLayouts(t *testing.T) {
+	tests := []struct {
+		codec   AudioCodecName
+		layouts []AudioChannelLayoutName
+		wantErr bool
+	}{
+		{codec: MP3, layouts: []AudioChannelLayoutName{"mono", "stereo"}},
+		{codec: MP3, layouts: []AudioChannelLayoutName{"stereo", "surround"}, wantErr: true},
+		{codec: HE_AAC_V2, layouts: []AudioChannelLayoutName{"surround"}, wantErr: true},
+		{codec: HE_AAC, layouts: []AudioChannelLayoutName{"surround"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.codec), func(t *testing.T) {
+			defer func() {
+				_, malformed := recover().(*MalformedField)
+				if malformed != tt.wantErr {
+					t.Errorf("checkAudioCodec() panicked = %v, want %v", malformed, tt.wantErr)
+				}
+			}()
+
+			checkAudioCodec(PipelineConfig{ChannelLayouts: tt.layouts}, tt.codec)
+		})
+	}
+}
+
+func TestCheckFFmpegEncoder(t *testing.T) {
+	_, ffmpeg := fakeTools(t, "", `#!/bin/sh
+echo "Encoders:"
+echo " A....D aac                  AAC (Advanced Audio Coding)"
+echo " A....D libmp3lame           libmp3lame MP3 (MPEG audio layer 3) (codec mp3)"
+`)
+
+	tests := []struct {
+		encoder string
+		wantErr bool
+	}{
+		{encoder: "aac"},
+		{encoder: "libmp3lame"},
+		{encoder: "libfdk_aac", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.encoder, func(t *testing.T) {
+			if err := CheckFFmpegEncoder(ffmpeg, tt.encoder); (err != nil) != tt.wantErr {
+				t.Errorf("CheckFFmpegEncoder() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
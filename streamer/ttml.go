@@ -0,0 +1,462 @@
+// A module to parse TTML subtitles, including DFXP and IMSC1.
+package streamer
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The frame rate of TTML frame times, if the file doesn't declare one.
+const TTML_DEFAULT_FRAME_RATE = 30
+
+// The timing parameters a TTML document declares on its root element.
+type ttmlTiming struct {
+	frameRate float64
+	tickRate  float64
+}
+
+var ttmlClockTimePattern = regexp.MustCompile(`^(\d+):(\d{2}):(\d{2})(?:(\.\d+)|:(\d+)(?:\.\d+)?)?$`)
+var ttmlOffsetTimePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)(h|ms|m|s|f|t)$`)
+
+/*
+Parses a TTML time expression into seconds.
+
+	Clock times are HH:MM:SS, HH:MM:SS.fraction or HH:MM:SS:frames, and offset
+	times are a number followed by h, m, s, ms, f (frames) or t (ticks).
+*/
+func (t ttmlTiming) parseTime(s string) (float64, error) {
+	s = strings.TrimSpace(s)
+
+	if match := ttmlClockTimePattern.FindStringSubmatch(s); match != nil {
+		hours, _ := strconv.ParseFloat(match[1], 64)
+		minutes, _ := strconv.ParseFloat(match[2], 64)
+		seconds, _ := strconv.ParseFloat(match[3], 64)
+		total := hours*3600 + minutes*60 + seconds
+
+		if match[4] != "" {
+			fraction, _ := strconv.ParseFloat(match[4], 64)
+			total += fraction
+		}
+
+		if match[5] != "" {
+			frames, _ := strconv.ParseFloat(match[5], 64)
+			total += frames / t.frameRate
+		}
+
+		return total, nil
+	}
+
+	if match := ttmlOffsetTimePattern.FindStringSubmatch(s); match != nil {
+		value, _ := strconv.ParseFloat(match[1], 64)
+
+		switch match[2] {
+		case "h":
+			return value * 3600, nil
+		case "m":
+			return value * 60, nil
+		case "s":
+			return value, nil
+		case "ms":
+			return value / 1000, nil
+		case "f":
+			return value / t.frameRate, nil
+		case "t":
+			return value / t.tickRate, nil
+		}
+	}
+
+	return 0, fmt.Errorf("%q is not a valid time expression", s)
+}
+
+// The timing and styling of an element, inherited by its children.
+type ttmlElement struct {
+	name   string
+	begin  float64
+	end    float64
+	style  map[string]string
+	region string
+	// The markup which closes any tags this element opened.
+	closing string
+}
+
+// Returns the value of an attribute by its local name, whatever its namespace.
+func ttmlAttr(element xml.StartElement, name string) string {
+	for _, attr := range element.Attr {
+		if attr.Name.Local == name {
+			return attr.Value
+		}
+	}
+
+	return ""
+}
+
+// The style attributes which can be expressed in WebVTT.
+var TTML_STYLE_ATTRIBUTES = []string{
+	"color",
+	"fontStyle",
+	"fontWeight",
+	"textDecoration",
+	"textAlign",
+	"displayAlign",
+	"origin",
+	"extent",
+}
+
+// Returns the style attributes set directly on an element.
+func ttmlInlineStyle(element xml.StartElement) map[string]string {
+	style := map[string]string{}
+	for _, attr := range element.Attr {
+		if ContainsString(TTML_STYLE_ATTRIBUTES, attr.Name.Local) {
+			style[attr.Name.Local] = attr.Value
+		}
+	}
+
+	return style
+}
+
+// Returns a copy of a style, overridden by another.
+func mergeStyles(base map[string]string, override map[string]string) map[string]string {
+	style := map[string]string{}
+	for key, value := range base {
+		style[key] = value
+	}
+
+	for key, value := range override {
+		style[key] = value
+	}
+
+	return style
+}
+
+// Returns the style of an element: the inherited style, overridden by the
+// referenced styles, overridden by its inline style.
+func ttmlComputeStyle(inherited map[string]string, styles map[string]map[string]string, element xml.StartElement) map[string]string {
+	style := mergeStyles(inherited, nil)
+
+	for _, id := range strings.Fields(ttmlAttr(element, "style")) {
+		style = mergeStyles(style, styles[id])
+	}
+
+	return mergeStyles(style, ttmlInlineStyle(element))
+}
+
+// Returns the WebVTT tags which apply the text styles of an element that its
+// parent doesn't already apply, and the tags which close them.
+func ttmlStyleTags(style map[string]string, parent map[string]string) (string, string) {
+	var opening, closing string
+
+	wrap := func(open string, close string) {
+		opening += open
+		closing = close + closing
+	}
+
+	if class := webVttColorClass(style["color"]); class != "" && style["color"] != parent["color"] && class != "white" {
+		wrap("<c."+class+">", "</c>")
+	}
+
+	if style["fontStyle"] == "italic" && parent["fontStyle"] != "italic" {
+		wrap("<i>", "</i>")
+	}
+
+	if style["fontWeight"] == "bold" && parent["fontWeight"] != "bold" {
+		wrap("<b>", "</b>")
+	}
+
+	if style["textDecoration"] == "underline" && parent["textDecoration"] != "underline" {
+		wrap("<u>", "</u>")
+	}
+
+	return opening, closing
+}
+
+// Parses a TTML length in percent, such as "80%".
+func ttmlPercents(value string) []float64 {
+	var percents []float64
+	for _, field := range strings.Fields(value) {
+		percent, err := strconv.ParseFloat(strings.TrimSuffix(field, "%"), 64)
+		if err != nil || !strings.HasSuffix(field, "%") {
+			return nil
+		}
+
+		percents = append(percents, percent)
+	}
+
+	return percents
+}
+
+/*
+Returns the WebVTT cue settings for the region and alignment of a paragraph.
+
+	Only regions positioned in percent can be expressed in WebVTT.
+*/
+func ttmlCueSettings(style map[string]string) string {
+	var settings []string
+	format := func(value float64) string { return strconv.FormatFloat(math.Round(value*100)/100, 'f', -1, 64) + "%" }
+
+	origin := ttmlPercents(style["origin"])
+	extent := ttmlPercents(style["extent"])
+
+	if len(origin) == 2 {
+		height := 0.0
+		if len(extent) == 2 {
+			height = extent[1]
+		}
+
+		switch style["displayAlign"] {
+		case "center":
+			settings = append(settings, "line:"+format(origin[1]+height/2)+",center")
+		case "after":
+			settings = append(settings, "line:"+format(origin[1]+height)+",end")
+		default:
+			settings = append(settings, "line:"+format(origin[1]))
+		}
+
+		if len(extent) == 2 {
+			settings = append(settings, "position:"+format(origin[0])+",line-left", "size:"+format(extent[0]))
+		}
+	}
+
+	switch style["textAlign"] {
+	case "left", "start":
+		settings = append(settings, "align:left")
+	case "right", "end":
+		settings = append(settings, "align:right")
+	}
+
+	return strings.Join(settings, " ")
+}
+
+var ttmlWhitespacePattern = regexp.MustCompile(`\s+`)
+
+/*
+Parses a TTML document.
+
+	Paragraphs become cues, with the timing of their enclosing body and divs.
+	Italic, bold and underlined text, colors WebVTT has a class for, line
+	breaks and regions positioned in percent are kept.  The frame rate is the
+	one the document declares, or the given one, or 30.  Returns the cues and
+	the language of the document.
+*/
+func ParseTtml(r io.Reader, frameRate float64) ([]SubtitleCue, string, error) {
+	decoder := xml.NewDecoder(r)
+	// Some vendors use HTML entities, such as &nbsp;.
+	decoder.Entity = xml.HTMLEntity
+
+	timing := ttmlTiming{frameRate: frameRate, tickRate: 1}
+	if timing.frameRate == 0 {
+		timing.frameRate = TTML_DEFAULT_FRAME_RATE
+	}
+
+	var language string
+	var cues []SubtitleCue
+	styles := map[string]map[string]string{}
+	regions := map[string]map[string]string{}
+
+	// The open elements of the body, innermost last.
+	var stack []*ttmlElement
+	// The cue being built, while inside a paragraph.
+	var cue *SubtitleCue
+	var cueText strings.Builder
+	// The region being defined, while inside a region element.
+	var region map[string]string
+	var regionID string
+
+	parseError := func(message string) error {
+		line, _ := decoder.InputPos()
+		return &SubtitleParseError{Line: line, Message: message}
+	}
+
+	for {
+		token, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+
+		if err != nil {
+			if syntaxErr, ok := err.(*xml.SyntaxError); ok {
+				return nil, "", &SubtitleParseError{Line: syntaxErr.Line, Message: syntaxErr.Msg}
+			}
+			return nil, "", parseError(err.Error())
+		}
+
+		switch token := token.(type) {
+		case xml.StartElement:
+			switch token.Name.Local {
+			case "tt":
+				language = ttmlAttr(token, "lang")
+
+				if value := ttmlAttr(token, "frameRate"); value != "" {
+					rate, err := strconv.ParseFloat(value, 64)
+					if err != nil || rate <= 0 {
+						return nil, "", parseError(fmt.Sprintf("malformed frameRate %q", value))
+					}
+					timing.frameRate = rate
+				}
+
+				if value := ttmlAttr(token, "frameRateMultiplier"); value != "" {
+					var numerator, denominator float64
+					if _, err := fmt.Sscanf(value, "%g %g", &numerator, &denominator); err != nil || denominator == 0 {
+						return nil, "", parseError(fmt.Sprintf("malformed frameRateMultiplier %q", value))
+					}
+					timing.frameRate *= numerator / denominator
+				}
+
+				if value := ttmlAttr(token, "tickRate"); value != "" {
+					rate, err := strconv.ParseFloat(value, 64)
+					if err != nil || rate <= 0 {
+						return nil, "", parseError(fmt.Sprintf("malformed tickRate %q", value))
+					}
+					timing.tickRate = rate
+				}
+
+			case "style":
+				style := ttmlComputeStyle(nil, styles, token)
+				if region != nil {
+					// A style inside a region styles the region.
+					region = mergeStyles(region, style)
+					regions[regionID] = region
+				} else if id := ttmlAttr(token, "id"); id != "" && len(stack) == 0 {
+					styles[id] = style
+				}
+
+			case "region":
+				if len(stack) == 0 {
+					regionID = ttmlAttr(token, "id")
+					region = ttmlComputeStyle(nil, styles, token)
+					regions[regionID] = region
+				}
+
+			case "body", "div", "p", "span":
+				parent := &ttmlElement{end: math.Inf(1)}
+				if len(stack) > 0 {
+					parent = stack[len(stack)-1]
+				} else if token.Name.Local != "body" {
+					return nil, "", parseError(fmt.Sprintf("<%s> outside of <body>", token.Name.Local))
+				}
+
+				element := &ttmlElement{
+					name:   token.Name.Local,
+					begin:  parent.begin,
+					end:    parent.end,
+					region: parent.region,
+				}
+
+				if id := ttmlAttr(token, "region"); id != "" {
+					element.region = id
+				}
+
+				inherited := parent.style
+				if parent.region != element.region {
+					// The style of a region applies to everything in it.
+					inherited = mergeStyles(parent.style, regions[element.region])
+				}
+				element.style = ttmlComputeStyle(inherited, styles, token)
+
+				// Times are relative to the parent, which is a parallel time container.
+				if value := ttmlAttr(token, "begin"); value != "" {
+					begin, err := timing.parseTime(value)
+					if err != nil {
+						return nil, "", parseError(err.Error())
+					}
+					element.begin = parent.begin + begin
+				}
+
+				if value := ttmlAttr(token, "end"); value != "" {
+					end, err := timing.parseTime(value)
+					if err != nil {
+						return nil, "", parseError(err.Error())
+					}
+					element.end = math.Min(parent.begin+end, parent.end)
+				}
+
+				if value := ttmlAttr(token, "dur"); value != "" {
+					dur, err := timing.parseTime(value)
+					if err != nil {
+						return nil, "", parseError(err.Error())
+					}
+					element.end = math.Min(element.begin+dur, element.end)
+				}
+
+				if element.name == "p" {
+					if cue != nil {
+						return nil, "", parseError("<p> inside another <p>")
+					}
+
+					if math.IsInf(element.end, 1) {
+						return nil, "", parseError("<p> has no end time")
+					}
+
+					cue = &SubtitleCue{
+						Start:    element.begin,
+						End:      element.end,
+						Settings: ttmlCueSettings(element.style),
+					}
+					cueText.Reset()
+				}
+
+				if cue != nil {
+					// Tags for the styles of the cue as a whole, and of spans in it.
+					outer := parent.style
+					if element.name == "p" {
+						outer = nil
+					}
+
+					opening, closing := ttmlStyleTags(element.style, outer)
+					cueText.WriteString(opening)
+					element.closing = closing
+				}
+
+				stack = append(stack, element)
+
+			case "br":
+				if cue != nil {
+					cueText.WriteString("\n")
+				}
+			}
+
+		case xml.EndElement:
+			switch token.Name.Local {
+			case "region":
+				region = nil
+
+			case "body", "div", "p", "span":
+				if len(stack) == 0 {
+					continue
+				}
+
+				element := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+
+				if cue != nil {
+					cueText.WriteString(element.closing)
+				}
+
+				if element.name == "p" && cue != nil {
+					var lines []string
+					for _, line := range strings.Split(cueText.String(), "\n") {
+						lines = append(lines, strings.TrimSpace(line))
+					}
+
+					cue.Text = strings.Join(lines, "\n")
+					if cue.End > cue.Start {
+						cues = append(cues, *cue)
+					}
+					cue = nil
+				}
+			}
+
+		case xml.CharData:
+			if cue != nil {
+				// Whitespace in TTML collapses, like in HTML.
+				cueText.WriteString(escapeWebVtt(ttmlWhitespacePattern.ReplaceAllString(string(token), " ")))
+			}
+		}
+	}
+
+	return cues, language, nil
+}
@@ -0,0 +1,189 @@
+// A module that serves the current time for DASH UTCTiming elements.
+package streamer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UTCTiming schemes served by the embedded timing server.
+const (
+	UTC_TIMING_XSDATE = "urn:mpeg:dash:utc:http-xsdate:2014" // The time as an xs:dateTime in the body.
+	UTC_TIMING_ISO    = "urn:mpeg:dash:utc:http-iso:2014"    // The time as an ISO 8601 date in the body.
+	UTC_TIMING_HEAD   = "urn:mpeg:dash:utc:http-head:2014"   // The time in the Date header of a HEAD response.
+)
+
+// The path of the UTC timing endpoints, relative to the server root.
+const UTC_TIMING_PATH = "/utc_timing"
+
+// The path of each UTCTiming scheme, in order of preference.
+var UTC_TIMING_SCHEME_PATHS = []struct {
+	SchemeIdUri string
+	Path        string
+}{
+	{UTC_TIMING_XSDATE, UTC_TIMING_PATH + "/xsdate"},
+	{UTC_TIMING_ISO, UTC_TIMING_PATH + "/iso"},
+	{UTC_TIMING_HEAD, UTC_TIMING_PATH + "/head"},
+}
+
+// An object representing the embedded UTC timing server.
+type UtcTimingServerConfig struct {
+	/*
+		If true, serve UTC timing from Shaka Streamer itself.
+
+		  This removes the need for an external time server in low_latency_dash_mode.
+		  If utc_timings is not set, it will be filled in with pairs pointing at this
+		  server.
+	*/
+	Enable bool `yaml:"enable" default:"false"`
+
+	/*
+		The address the timing server listens on, such as ':8081'.
+
+		  If blank, no separate server is started, and base_url must point at a
+		  server with the same endpoints, such as the one of the --serve option.
+	*/
+	ListenAddress string `yaml:"listen_address"`
+
+	/*
+		The URL at which players reach the timing server.
+
+		  Defaults to http://localhost on the port of listen_address.
+	*/
+	BaseURL string `yaml:"base_url" validate:"empty=true | format=url"`
+}
+
+// Checks that players can reach the timing server.
+func (u UtcTimingServerConfig) check() {
+	if u.Enable && u.ListenAddress == "" && u.BaseURL == "" {
+		panic(NewMissingRequiredField(u, "ListenAddress"))
+	}
+}
+
+// Returns the UTCTiming pairs that point at the embedded timing server.
+func (u UtcTimingServerConfig) GetUtcTimings() []UtcTimingPair {
+	baseURL := u.BaseURL
+
+	if baseURL == "" {
+		if u.ListenAddress == "" {
+			panic(NewMissingRequiredField(u, "BaseURL"))
+		}
+
+		_, port, err := net.SplitHostPort(u.ListenAddress)
+		if err != nil {
+			panic(NewMalformedField(u, "ListenAddress", err.Error()))
+		}
+
+		baseURL = "http://localhost:" + port
+	}
+
+	baseURL = strings.TrimSuffix(baseURL, "/")
+	timings := make([]UtcTimingPair, 0, len(UTC_TIMING_SCHEME_PATHS))
+
+	for _, scheme := range UTC_TIMING_SCHEME_PATHS {
+		timings = append(timings, UtcTimingPair{
+			SchemeIdUri: scheme.SchemeIdUri,
+			Value:       baseURL + scheme.Path,
+		})
+	}
+
+	return timings
+}
+
+/*
+Returns a handler for all the UTC timing endpoints.
+
+	Requests to UTC_TIMING_PATH itself are answered in the xsdate format.  Every
+	response carries a Date header, so any of the endpoints can also be used with
+	the http-head scheme.
+*/
+func UtcTimingHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now().UTC()
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Date", now.Format(http.TimeFormat))
+
+		switch strings.TrimSuffix(r.URL.Path, "/") {
+		case UTC_TIMING_PATH, UTC_TIMING_PATH + "/xsdate", UTC_TIMING_PATH + "/iso":
+			w.Header().Set("Content-Type", "text/plain")
+
+			if r.Method != http.MethodHead {
+				// The same representation satisfies both xs:dateTime and ISO 8601.
+				io.WriteString(w, now.Format("2006-01-02T15:04:05.000Z"))
+			}
+		case UTC_TIMING_PATH + "/head":
+			// Only the Date header is needed.
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+}
+
+// Serves the UTC timing endpoints on their own address.
+type UtcTimingServerNode struct {
+	address string
+	server  *http.Server
+	mu      sync.Mutex
+	Status  ProcessStatus
+}
+
+func NewUtcTimingServerNode(address string) *UtcTimingServerNode {
+	return &UtcTimingServerNode{
+		address: address,
+		Status:  Finished,
+	}
+}
+
+func (u *UtcTimingServerNode) Start() {
+	mux := http.NewServeMux()
+	mux.Handle(UTC_TIMING_PATH, UtcTimingHandler())
+	mux.Handle(UTC_TIMING_PATH+"/", UtcTimingHandler())
+
+	u.server = &http.Server{
+		Addr:    u.address,
+		Handler: withCors(mux),
+	}
+
+	u.setStatus(Running)
+
+	go func() {
+		if err := u.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "UTC timing server failed: %v\n", err)
+			u.setStatus(Errored)
+		}
+	}()
+}
+
+func (u *UtcTimingServerNode) setStatus(status ProcessStatus) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	u.Status = status
+}
+
+func (u *UtcTimingServerNode) CheckStatus() ProcessStatus {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return u.Status
+}
+
+func (u *UtcTimingServerNode) Stop() {
+	if u.server != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		u.server.Shutdown(ctx)
+	}
+
+	u.setStatus(Finished)
+}
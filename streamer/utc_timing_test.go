@@ -0,0 +1,150 @@
+package streamer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestUtcTimingHandler(t *testing.T) {
+	server := httptest.NewServer(UtcTimingHandler())
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		method   string
+		path     string
+		wantBody bool
+	}{
+		{
+			name:     "xsdate",
+			method:   http.MethodGet,
+			path:     UTC_TIMING_PATH + "/xsdate",
+			wantBody: true,
+		},
+		{
+			name:     "iso",
+			method:   http.MethodGet,
+			path:     UTC_TIMING_PATH + "/iso",
+			wantBody: true,
+		},
+		{
+			name:     "head",
+			method:   http.MethodHead,
+			path:     UTC_TIMING_PATH + "/head",
+			wantBody: false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest(tt.method, server.URL+tt.path, nil)
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			defer resp.Body.Close()
+			body, _ := io.ReadAll(resp.Body)
+
+			date, err := http.ParseTime(resp.Header.Get("Date"))
+			if err != nil || time.Since(date) > time.Minute {
+				t.Errorf("Date header = %q, want the current time", resp.Header.Get("Date"))
+			}
+
+			if !tt.wantBody {
+				return
+			}
+
+			got, err := time.Parse(time.RFC3339Nano, string(body))
+			if err != nil || time.Since(got) > time.Minute {
+				t.Errorf("body = %q, want the current time", body)
+			}
+		})
+	}
+}
+
+func TestUtcTimingServerConfig_GetUtcTimings(t *testing.T) {
+	tests := []struct {
+		name   string
+		config UtcTimingServerConfig
+		want   []UtcTimingPair
+	}{
+		{
+			name:   "Default base URL",
+			config: UtcTimingServerConfig{Enable: true, ListenAddress: ":8081"},
+			want: []UtcTimingPair{
+				{UTC_TIMING_XSDATE, "http://localhost:8081/utc_timing/xsdate"},
+				{UTC_TIMING_ISO, "http://localhost:8081/utc_timing/iso"},
+				{UTC_TIMING_HEAD, "http://localhost:8081/utc_timing/head"},
+			},
+		},
+		{
+			name:   "Custom base URL",
+			config: UtcTimingServerConfig{Enable: true, BaseURL: "http://venue.local/"},
+			want: []UtcTimingPair{
+				{UTC_TIMING_XSDATE, "http://venue.local/utc_timing/xsdate"},
+				{UTC_TIMING_ISO, "http://venue.local/utc_timing/iso"},
+				{UTC_TIMING_HEAD, "http://venue.local/utc_timing/head"},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.config.GetUtcTimings(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetUtcTimings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUtcTimingServerConfig_ListenAddress(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		want    string
+		wantErr bool
+	}{
+		{
+			name: "separate server",
+			yaml: "utc_timing_server:\n  enable: true\n  listen_address: ':8081'\n",
+			want: ":8081",
+		},
+		{
+			// The endpoints of --serve are used instead.
+			name: "no separate server",
+			yaml: "utc_timing_server:\n  enable: true\n  base_url: http://venue.local:8080\n",
+		},
+		{
+			name:    "unreachable",
+			yaml:    "utc_timing_server:\n  enable: true\n",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				err := recover()
+				if _, missing := err.(*MissingRequiredField); missing != tt.wantErr {
+					t.Errorf("Unmarshal() panicked with %v, want an error = %v", err, tt.wantErr)
+				}
+			}()
+
+			var config PipelineConfig
+			if err := yaml.Unmarshal([]byte("streaming_mode: live\nsegment_per_file: true\n"+tt.yaml), &config); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := config.UtcTimingServer.ListenAddress; got != tt.want {
+				t.Errorf("ListenAddress = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
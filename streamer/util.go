@@ -26,6 +26,24 @@ func ContainsInputType(arr []InputType, val InputType) bool {
 	return false
 }
 
+func ContainsDisposition(arr []TrackDisposition, val TrackDisposition) bool {
+	for _, v := range arr {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
+func ContainsMediaType(arr []MediaType, val MediaType) bool {
+	for _, v := range arr {
+		if v == val {
+			return true
+		}
+	}
+	return false
+}
+
 func ContainsString(arr []string, val string) bool {
 	for _, v := range arr {
 		if v == val {
@@ -151,12 +169,12 @@ func RootDir() (string, error) {
 
 // ParseInt parses a string into an integer or returns 0 if it fails
 func ParseInt(s string) int {
-	n, err := fmt.Sscanf(s, "%d")
-	if err != nil || n != 1 {
+	var value int
+	if n, err := fmt.Sscanf(s, "%d", &value); err != nil || n != 1 {
 		return 0
 	}
 
-	return n
+	return value
 }
 
 func FileExists(filePath string) bool {
@@ -205,6 +223,28 @@ func CheckCommandVersion(name string, command []string, minimumVersion []int) er
 	return nil
 }
 
+/*
+Returns an error if an FFmpeg binary has no encoder of this name.
+
+	Encoders from other libraries, such as libfdk_aac, are left out of many
+	builds of FFmpeg.
+*/
+func CheckFFmpegEncoder(ffmpeg string, encoder string) error {
+	output, err := exec.Command(ffmpeg, "-hide_banner", "-encoders").Output()
+	if err != nil {
+		return fmt.Errorf("failed to list the encoders of %s: %v", ffmpeg, err)
+	}
+
+	// Each encoder is listed after its capabilities, such as " A....D aac".
+	for _, line := range strings.Split(string(output), "\n") {
+		if fields := strings.Fields(line); len(fields) >= 2 && fields[1] == encoder {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s has no %s encoder", ffmpeg, encoder)
+}
+
 func StartsWithAny(s string, prefixes []string) bool {
 	for _, prefix := range prefixes {
 		if strings.HasPrefix(s, prefix) {
@@ -237,3 +277,13 @@ func ManifestFormatListToStringList(manifestFormatList []ManifestFormat) []strin
 	}
 	return stringList
 }
+
+// Joins a command line into a string for sh, quoting every argument.
+func shellJoin(args []string) string {
+	quoted := make([]string, 0, len(args))
+	for _, arg := range args {
+		quoted = append(quoted, "'"+strings.ReplaceAll(arg, "'", `'\''`)+"'")
+	}
+
+	return strings.Join(quoted, " ")
+}
@@ -1,7 +1,9 @@
 package streamer
 
 import (
+	"os"
 	"path/filepath"
+	"testing"
 
 	"github.com/Koodeyo-Media/shaka-streamer-go/tests"
 )
@@ -11,6 +13,36 @@ func getTestInput(idx int, mediaType MediaType) Input {
 	return *NewInput(FILE, filepath.Join(rootDir, tests.TestDir, tests.TestFiles[idx]), mediaType, []string{})
 }
 
+/*
+Installs shell scripts as stand-ins for ffprobe and ffmpeg until the end of a
+test, and returns their paths.
+
+	A blank script leaves that tool as it is, and returns a blank path.
+*/
+func fakeTools(t *testing.T, ffprobe string, ffmpeg string) (string, string) {
+	t.Helper()
+
+	dir := t.TempDir()
+	install := func(name string, script string, hermetic *string) string {
+		if script == "" {
+			return ""
+		}
+
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		previous := *hermetic
+		*hermetic = path
+		t.Cleanup(func() { *hermetic = previous })
+
+		return path
+	}
+
+	return install("ffprobe", ffprobe, &HermeticFFProbe), install("ffmpeg", ffmpeg, &HermeticFFmpeg)
+}
+
 func getTestVideoCodec() *VideoCodec {
 	return &VideoCodec{Name: H264, HWAcc: false}
 }
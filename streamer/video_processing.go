@@ -0,0 +1,411 @@
+// A module for the typed video processing options of an input.
+package streamer
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// The strength of a denoise filter.
+type DenoiseLevel string
+
+const (
+	DENOISE_LIGHT  DenoiseLevel = "light"
+	DENOISE_MEDIUM DenoiseLevel = "medium"
+	DENOISE_STRONG DenoiseLevel = "strong"
+)
+
+// The hqdn3d parameters of each denoise level: luma and chroma spatial, then
+// luma and chroma temporal strength.  Medium is hqdn3d's default.
+var DENOISE_PARAMETERS = map[DenoiseLevel]string{
+	DENOISE_LIGHT:  "2:1.5:3:2.25",
+	DENOISE_MEDIUM: "4:3:6:4.5",
+	DENOISE_STRONG: "8:6:12:9",
+}
+
+// The direction in which to mirror the picture.
+type FlipDirection string
+
+const (
+	FLIP_HORIZONTAL FlipDirection = "horizontal"
+	FLIP_VERTICAL   FlipDirection = "vertical"
+	FLIP_BOTH       FlipDirection = "both"
+)
+
+// The corner or center of the picture at which a watermark is placed.
+type WatermarkPosition string
+
+const (
+	WATERMARK_TOP_LEFT     WatermarkPosition = "top_left"
+	WATERMARK_TOP_RIGHT    WatermarkPosition = "top_right"
+	WATERMARK_BOTTOM_LEFT  WatermarkPosition = "bottom_left"
+	WATERMARK_BOTTOM_RIGHT WatermarkPosition = "bottom_right"
+	WATERMARK_CENTER       WatermarkPosition = "center"
+)
+
+// The overlay filter position of each watermark position, with M standing
+// for the margin.
+var WATERMARK_OVERLAY_POSITIONS = map[WatermarkPosition]string{
+	WATERMARK_TOP_LEFT:     "x=M:y=M",
+	WATERMARK_TOP_RIGHT:    "x=main_w-overlay_w-M:y=M",
+	WATERMARK_BOTTOM_LEFT:  "x=M:y=main_h-overlay_h-M",
+	WATERMARK_BOTTOM_RIGHT: "x=main_w-overlay_w-M:y=main_h-overlay_h-M",
+	WATERMARK_CENTER:       "x=(main_w-overlay_w)/2:y=(main_h-overlay_h)/2",
+}
+
+var aspectRatioRegex = regexp.MustCompile(`^([1-9][0-9]*):([1-9][0-9]*)$`)
+
+// A rectangle of the input picture to keep.
+type CropConfig struct {
+	// The width of the rectangle, in pixels of the input.
+	Width int `yaml:"width"`
+
+	// The height of the rectangle, in pixels of the input.
+	Height int `yaml:"height"`
+
+	// The left edge of the rectangle.  If unspecified, the rectangle is centered.
+	X *int `yaml:"x"`
+
+	// The top edge of the rectangle.  If unspecified, the rectangle is centered.
+	Y *int `yaml:"y"`
+
+	/*
+		If true, the black bars around the picture are detected and cropped, in
+		place of a rectangle.
+
+			Only valid for input types which can be auto-detected.
+	*/
+	Auto bool `yaml:"auto"`
+
+	// True once the rectangle of an automatic crop has been detected.
+	detected bool
+
+	// The samples an automatic crop was chosen from.
+	samples []CropSample
+}
+
+// Returns true if any part of the picture is cropped.
+func (c CropConfig) IsEnabled() bool {
+	return c.Auto || c.Width > 0 || c.Height > 0
+}
+
+// Padding of the picture to an aspect ratio.
+type PadConfig struct {
+	// The aspect ratio to pad to, such as '16:9'.  The picture is centered.
+	Aspect string `yaml:"aspect"`
+
+	// The color of the padding, by FFmpeg color name or '#RRGGBB'.
+	Color string `yaml:"color" default:"black"`
+}
+
+// An image overlaid on the picture.
+type WatermarkConfig struct {
+	// The path to the image, such as a PNG with transparency.
+	Image string `yaml:"image"`
+
+	/*
+		Where the image is placed.
+
+			Can be 'top_left', 'top_right', 'bottom_left', 'bottom_right' or
+			'center'.
+	*/
+	Position WatermarkPosition `yaml:"position" default:"bottom_right"`
+
+	// The distance from the edges of the picture, in pixels of the input.
+	Margin int `yaml:"margin" default:"20"`
+
+	// The opacity of the image, from 0 (exclusive) to 1 (opaque).
+	Opacity float64 `yaml:"opacity" default:"1"`
+
+	/*
+		The width of the image, as a fraction of the width of the picture, such
+		as 0.1.
+
+			If unspecified, the image keeps its own size.
+	*/
+	Width float64 `yaml:"width"`
+}
+
+/*
+The typed processing options of a video input.
+
+	They are applied in a fixed order: after deinterlacing, the picture is
+	cropped, denoised, rotated, flipped and padded, then any raw filters run,
+	and the watermark is overlaid last, before the picture is scaled for each
+	resolution.
+*/
+type VideoProcessingConfig struct {
+	// A rectangle of the input to keep, or the automatic removal of black bars.
+	Crop CropConfig `yaml:"crop"`
+
+	// The strength of denoising: 'light', 'medium' or 'strong'.
+	Denoise DenoiseLevel `yaml:"denoise"`
+
+	// The clockwise rotation, in degrees: 0, 90, 180 or 270.
+	Rotate int `yaml:"rotate"`
+
+	// The direction to mirror the picture: 'horizontal', 'vertical' or 'both'.
+	Flip FlipDirection `yaml:"flip"`
+
+	// Padding of the picture to an aspect ratio.
+	Pad PadConfig `yaml:"pad"`
+
+	// An image overlaid on the picture.
+	Watermark WatermarkConfig `yaml:"watermark"`
+}
+
+// Returns true if any processing is asked for.  Fields with defaults don't
+// count on their own.
+func (p VideoProcessingConfig) isSet() bool {
+	return p.Crop.IsEnabled() || p.Crop.X != nil || p.Crop.Y != nil || p.Denoise != "" || p.Rotate != 0 || p.Flip != "" || p.Pad.Aspect != "" || p.Watermark.Image != "" || p.Watermark.Width != 0
+}
+
+/*
+Find the rectangle of an automatic crop, if there is one to find.
+
+	Called once the input is known to be present, and before its resolution is
+	detected, since the resolution is that of the cropped picture.
+*/
+func (i *Input) detectCrop() {
+	crop := &i.Processing.Crop
+	if !crop.Auto || crop.detected {
+		return
+	}
+
+	detected, err := DetectCrop(*i)
+	if err != nil {
+		panic(NewMalformedField(*crop, "Auto", err.Error()))
+	}
+
+	detected.Auto = true
+	detected.detected = true
+	*crop = detected
+}
+
+// Checks the processing options of an input.
+func (i *Input) checkProcessing() {
+	p := &i.Processing
+	if i.MediaType != VIDEO {
+		panic(NewMalformedField(*i, "Processing", `only valid with media_type "video"`))
+	}
+
+	crop := p.Crop
+	if crop.Auto && !crop.detected {
+		if crop.Width != 0 || crop.Height != 0 || crop.X != nil || crop.Y != nil {
+			panic(NewConflictingFields(crop, "Auto", "Width"))
+		}
+
+		if ContainsInputType(TYPES_WE_CANT_PROBE, i.InputType) {
+			reason := fmt.Sprintf("not supported with input_type %s", i.InputType)
+			panic(NewMalformedField(crop, "Auto", reason))
+		}
+	} else if !crop.Auto && (crop.IsEnabled() || crop.X != nil || crop.Y != nil) {
+		if crop.Width <= 0 || crop.Height <= 0 {
+			panic(NewMalformedField(crop, "Width", "a crop needs a positive width and height"))
+		}
+
+		if crop.X != nil && *crop.X < 0 || crop.Y != nil && *crop.Y < 0 {
+			panic(NewMalformedField(crop, "X", "must not be negative"))
+		}
+	}
+
+	if _, ok := DENOISE_PARAMETERS[p.Denoise]; p.Denoise != "" && !ok {
+		panic(NewMalformedField(*p, "Denoise", `must be "light", "medium" or "strong"`))
+	}
+
+	if p.Rotate != 0 && p.Rotate != 90 && p.Rotate != 180 && p.Rotate != 270 {
+		panic(NewMalformedField(*p, "Rotate", "must be 0, 90, 180 or 270"))
+	}
+
+	if p.Flip != "" && p.Flip != FLIP_HORIZONTAL && p.Flip != FLIP_VERTICAL && p.Flip != FLIP_BOTH {
+		panic(NewMalformedField(*p, "Flip", `must be "horizontal", "vertical" or "both"`))
+	}
+
+	if p.Pad.Aspect != "" && !aspectRatioRegex.MatchString(p.Pad.Aspect) {
+		panic(NewMalformedField(p.Pad, "Aspect", "must be a ratio such as 16:9"))
+	}
+
+	if p.Pad.Color == "" {
+		p.Pad.Color = "black"
+	}
+
+	watermark := &p.Watermark
+	if watermark.Image != "" {
+		if !FileExists(watermark.Image) {
+			panic(NewMalformedField(*watermark, "Image", fmt.Sprintf("%q does not exist", watermark.Image)))
+		}
+
+		if watermark.Position == "" {
+			watermark.Position = WATERMARK_BOTTOM_RIGHT
+		}
+
+		if _, ok := WATERMARK_OVERLAY_POSITIONS[watermark.Position]; !ok {
+			panic(NewMalformedField(*watermark, "Position", "must be top_left, top_right, bottom_left, bottom_right or center"))
+		}
+
+		if watermark.Margin < 0 {
+			panic(NewMalformedField(*watermark, "Margin", "must not be negative"))
+		}
+
+		if watermark.Opacity == 0 {
+			watermark.Opacity = 1
+		}
+
+		if watermark.Opacity < 0 || watermark.Opacity > 1 {
+			panic(NewMalformedField(*watermark, "Opacity", "must be between 0 and 1"))
+		}
+
+		if watermark.Width < 0 || watermark.Width > 1 {
+			panic(NewMalformedField(*watermark, "Width", "must be between 0 and 1"))
+		}
+	} else if watermark.Width != 0 {
+		panic(NewMissingRequiredField(*watermark, "Image"))
+	}
+}
+
+/*
+Get the filters which crop, denoise, rotate, flip and pad a video input, in
+that order.
+
+	The watermark isn't among them, since it needs a graph of its own.  An
+	automatic crop must have been detected first.
+*/
+func (p VideoProcessingConfig) GetFilters() []string {
+	var filters []string
+
+	if crop := p.Crop; crop.Width > 0 && crop.Height > 0 {
+		filter := fmt.Sprintf("crop=%d:%d", crop.Width, crop.Height)
+		if crop.X != nil || crop.Y != nil {
+			// The crop filter centers the rectangle on any axis left out.
+			x, y := "(in_w-out_w)/2", "(in_h-out_h)/2"
+			if crop.X != nil {
+				x = strconv.Itoa(*crop.X)
+			}
+			if crop.Y != nil {
+				y = strconv.Itoa(*crop.Y)
+			}
+
+			filter += ":" + x + ":" + y
+		}
+
+		filters = append(filters, filter)
+	}
+
+	if p.Denoise != "" {
+		filters = append(filters, "hqdn3d="+DENOISE_PARAMETERS[p.Denoise])
+	}
+
+	filters = append(filters, rotateFilters(p.Rotate)...)
+
+	switch p.Flip {
+	case FLIP_HORIZONTAL:
+		filters = append(filters, "hflip")
+	case FLIP_VERTICAL:
+		filters = append(filters, "vflip")
+	case FLIP_BOTH:
+		filters = append(filters, "hflip", "vflip")
+	}
+
+	if match := aspectRatioRegex.FindStringSubmatch(p.Pad.Aspect); match != nil {
+		// Grow whichever side is too short, and keep both sides even, which
+		// the encoders require.
+		num, den := match[1], match[2]
+		color := p.Pad.Color
+		if color == "" {
+			color = "black"
+		}
+
+		filters = append(filters, fmt.Sprintf(
+			"pad=w='trunc(max(iw,ih*%[1]s/%[2]s)/2)*2':h='trunc(max(ih,iw*%[2]s/%[1]s)/2)*2':x=(ow-iw)/2:y=(oh-ih)/2:color=%[3]s",
+			num, den, color))
+	}
+
+	return filters
+}
+
+/*
+Join the filters of a video input into one filter graph.
+
+	The filters before the watermark run on the input picture, and the ones
+	after it, such as scaling, on the watermarked picture.  Without a
+	watermark, the graph is a simple chain.
+*/
+func (w WatermarkConfig) buildGraph(before []string, after []string) string {
+	if w.Image == "" {
+		return strings.Join(append(append([]string{}, before...), after...), ",")
+	}
+
+	main := "null"
+	if len(before) > 0 {
+		main = strings.Join(before, ",")
+	}
+
+	// A still image is a single frame, which overlay repeats to the end.
+	image := "movie=" + escapeFilterValue(w.Image) + ",format=rgba"
+	if w.Opacity < 1 {
+		image += fmt.Sprintf(",colorchannelmixer=aa=%s", strconv.FormatFloat(w.Opacity, 'f', -1, 64))
+	}
+
+	graph := main + "[main];" + image
+	if w.Width > 0 {
+		// Size the image relative to the picture, keeping its aspect ratio.
+		graph += fmt.Sprintf("[image];[image][main]scale2ref=w=main_w*%s:h=ow/a[watermark][main];", strconv.FormatFloat(w.Width, 'f', -1, 64))
+	} else {
+		graph += "[watermark];"
+	}
+
+	position := strings.ReplaceAll(WATERMARK_OVERLAY_POSITIONS[w.Position], "M", strconv.Itoa(w.Margin))
+	graph += "[main][watermark]overlay=" + position
+
+	if len(after) > 0 {
+		graph += "," + strings.Join(after, ",")
+	}
+
+	return graph
+}
+
+// Returns the filters which turn the picture clockwise by 90, 180 or 270
+// degrees.
+func rotateFilters(degrees int) []string {
+	switch degrees {
+	case 90:
+		return []string{"transpose=clock"}
+	case 180:
+		return []string{"hflip", "vflip"}
+	case 270:
+		return []string{"transpose=cclock"}
+	}
+
+	return nil
+}
+
+/*
+Returns true if the picture encoded from this input is taller than it is
+wide, so each resolution is scaled to fit on its side.
+
+	The picture is the one shown, after any rotation in its metadata, and then
+	cropped, rotated and padded by the processing options.
+*/
+func (i Input) isPortrait() bool {
+	p := i.Processing
+
+	// Padding decides the shape of the picture by itself.
+	if match := aspectRatioRegex.FindStringSubmatch(p.Pad.Aspect); match != nil {
+		num, _ := strconv.Atoi(match[1])
+		den, _ := strconv.Atoi(match[2])
+		return num < den
+	}
+
+	width, height := i.display.Width, i.display.Height
+	if p.Crop.Width > 0 && p.Crop.Height > 0 {
+		width, height = p.Crop.Width, p.Crop.Height
+	}
+
+	if p.Rotate == 90 || p.Rotate == 270 {
+		width, height = height, width
+	}
+
+	return height > width
+}
@@ -0,0 +1,266 @@
+package streamer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func intPointer(i int) *int {
+	return &i
+}
+
+func TestVideoProcessingConfig_GetFilters(t *testing.T) {
+	tests := []struct {
+		name       string
+		processing VideoProcessingConfig
+		want       []string
+	}{
+		{
+			name:       "nothing",
+			processing: VideoProcessingConfig{Pad: PadConfig{Color: "black"}},
+			want:       nil,
+		},
+		{
+			name:       "centered crop",
+			processing: VideoProcessingConfig{Crop: CropConfig{Width: 1920, Height: 800}},
+			want:       []string{"crop=1920:800"},
+		},
+		{
+			name:       "crop at a row",
+			processing: VideoProcessingConfig{Crop: CropConfig{Width: 1920, Height: 800, Y: intPointer(140)}},
+			want:       []string{"crop=1920:800:(in_w-out_w)/2:140"},
+		},
+		{
+			name: "everything in order",
+			processing: VideoProcessingConfig{
+				Crop:    CropConfig{Width: 640, Height: 480, X: intPointer(0), Y: intPointer(0)},
+				Denoise: DENOISE_LIGHT,
+				Rotate:  270,
+				Flip:    FLIP_HORIZONTAL,
+				Pad:     PadConfig{Aspect: "16:9", Color: "white"},
+			},
+			want: []string{
+				"crop=640:480:0:0",
+				"hqdn3d=2:1.5:3:2.25",
+				"transpose=cclock",
+				"hflip",
+				"pad=w='trunc(max(iw,ih*16/9)/2)*2':h='trunc(max(ih,iw*9/16)/2)*2':x=(ow-iw)/2:y=(oh-ih)/2:color=white",
+			},
+		},
+		{
+			name:       "upside down",
+			processing: VideoProcessingConfig{Rotate: 180},
+			want:       []string{"hflip", "vflip"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.processing.GetFilters(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("GetFilters() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWatermarkConfig_buildGraph(t *testing.T) {
+	tests := []struct {
+		name      string
+		watermark WatermarkConfig
+		before    []string
+		want      string
+	}{
+		{
+			name:   "no watermark",
+			before: []string{"pp=fd"},
+			want:   "pp=fd,scale=-2:720,setsar=1:1",
+		},
+		{
+			name:      "opaque at its own size",
+			watermark: WatermarkConfig{Image: "logo.png", Position: WATERMARK_TOP_LEFT, Margin: 10, Opacity: 1},
+			want:      "null[main];movie=logo.png,format=rgba[watermark];[main][watermark]overlay=x=10:y=10,scale=-2:720,setsar=1:1",
+		},
+		{
+			name:      "translucent and sized",
+			watermark: WatermarkConfig{Image: "logos/a:b.png", Position: WATERMARK_BOTTOM_RIGHT, Margin: 20, Opacity: 0.5, Width: 0.1},
+			before:    []string{"pp=fd", "hqdn3d=4:3:6:4.5"},
+			want: `pp=fd,hqdn3d=4:3:6:4.5[main];movie=logos/a\\:b.png,format=rgba,colorchannelmixer=aa=0.5[image];` +
+				`[image][main]scale2ref=w=main_w*0.1:h=ow/a[watermark][main];` +
+				`[main][watermark]overlay=x=main_w-overlay_w-20:y=main_h-overlay_h-20,scale=-2:720,setsar=1:1`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.watermark.buildGraph(tt.before, []string{"scale=-2:720", "setsar=1:1"}); got != tt.want {
+				t.Errorf("buildGraph() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInput_checkProcessing(t *testing.T) {
+	image := filepath.Join(t.TempDir(), "logo.png")
+	if err := os.WriteFile(image, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		input   Input
+		wantErr bool
+	}{
+		{
+			name:  "valid",
+			input: Input{MediaType: VIDEO, Processing: VideoProcessingConfig{Crop: CropConfig{Width: 10, Height: 10}, Rotate: 90, Watermark: WatermarkConfig{Image: image, Opacity: 0.3}}},
+		},
+		{
+			name:    "audio",
+			input:   Input{MediaType: AUDIO, Processing: VideoProcessingConfig{Denoise: DENOISE_STRONG}},
+			wantErr: true,
+		},
+		{
+			name:    "crop without a height",
+			input:   Input{MediaType: VIDEO, Processing: VideoProcessingConfig{Crop: CropConfig{Width: 10}}},
+			wantErr: true,
+		},
+		{
+			name:    "auto crop with a rectangle",
+			input:   Input{MediaType: VIDEO, Processing: VideoProcessingConfig{Crop: CropConfig{Auto: true, Width: 10, Height: 10}}},
+			wantErr: true,
+		},
+		{
+			name:    "auto crop of a generator",
+			input:   Input{InputType: GENERATOR, MediaType: VIDEO, Processing: VideoProcessingConfig{Crop: CropConfig{Auto: true}}},
+			wantErr: true,
+		},
+		{
+			name:    "odd rotation",
+			input:   Input{MediaType: VIDEO, Processing: VideoProcessingConfig{Rotate: 45}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown aspect",
+			input:   Input{MediaType: VIDEO, Processing: VideoProcessingConfig{Pad: PadConfig{Aspect: "wide"}}},
+			wantErr: true,
+		},
+		{
+			name:    "missing watermark",
+			input:   Input{MediaType: VIDEO, Processing: VideoProcessingConfig{Watermark: WatermarkConfig{Image: "missing.png"}}},
+			wantErr: true,
+		},
+		{
+			name:    "watermark position",
+			input:   Input{MediaType: VIDEO, Processing: VideoProcessingConfig{Watermark: WatermarkConfig{Image: image, Position: "middle"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				err := recover()
+				_, malformed := err.(*MalformedField)
+				_, conflicting := err.(*ConflictingFields)
+				if (malformed || conflicting) != tt.wantErr {
+					t.Errorf("checkProcessing() panicked with %v, want an error = %v", err, tt.wantErr)
+				}
+			}()
+
+			tt.input.checkProcessing()
+		})
+	}
+}
+
+func TestDetectCrop(t *testing.T) {
+	// A stand-in for ffmpeg which logs like cropdetect.
+	ffmpeg := `#!/bin/sh
+echo "[Parsed_cropdetect_0 @ 0x1] x1:0 x2:1919 y1:130 y2:949 w:1920 h:816 x:0 y:132 pts:1 t:0.04 crop=1920:816:0:132" >&2
+echo "[Parsed_cropdetect_0 @ 0x1] x1:0 x2:1919 y1:138 y2:941 w:1920 h:800 x:0 y:140 pts:2 t:0.08 crop=1920:800:0:140" >&2
+`
+	fakeTools(t, "", ffmpeg)
+
+	i := Input{InputType: FILE, Name: "film.mkv", MediaType: VIDEO, Processing: VideoProcessingConfig{Crop: CropConfig{Auto: true}}}
+	i.detectCrop()
+
+	if got := i.Processing.GetFilters(); !reflect.DeepEqual(got, []string{"crop=1920:800:0:140"}) {
+		t.Errorf("GetFilters() after detection = %v, want the last detected crop", got)
+	}
+
+	// A detected crop passes the checks which a rectangle given with auto
+	// would not.
+	i.checkProcessing()
+}
+
+func TestDetectCrop_Samples(t *testing.T) {
+	// A film of 100 seconds, whose bars change height, and which is black
+	// halfway through.
+	ffmpeg := `#!/bin/sh
+case "$*" in
+*"-ss 10.000 "*) echo "crop=1920:800:0:140" >&2 ;;
+*"-ss 30.000 "*) echo "crop=1900:816:10:132" >&2 ;;
+*"-ss 50.000 "*) echo "no picture" >&2 ;;
+*) echo "crop=1920:804:0:138" >&2 ;;
+esac
+`
+	fakeTools(t, "#!/bin/sh\necho 100.000000\n", ffmpeg)
+
+	crop, err := DetectCrop(Input{InputType: FILE, Name: "film.mkv", MediaType: VIDEO})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := (VideoProcessingConfig{Crop: crop}).GetFilters(); !reflect.DeepEqual(got, []string{"crop=1920:816:0:132"}) {
+		t.Errorf("DetectCrop() = %v, want the rectangle holding every sample", got)
+	}
+
+	times := []float64{}
+	for _, sample := range crop.samples {
+		times = append(times, sample.Time)
+	}
+
+	if want := []float64{10, 30, 70, 90}; !reflect.DeepEqual(times, want) {
+		t.Errorf("sample times = %v, want %v without the black one", times, want)
+	}
+}
+
+func TestInput_isPortrait(t *testing.T) {
+	tests := []struct {
+		name  string
+		input Input
+		want  bool
+	}{
+		{
+			name:  "landscape",
+			input: Input{display: DisplaySize{Width: 1920, Height: 1080}},
+		},
+		{
+			name:  "recorded on its side",
+			input: Input{display: DisplaySize{Width: 1080, Height: 1920, Rotation: 90}},
+			want:  true,
+		},
+		{
+			name:  "turned back by processing",
+			input: Input{display: DisplaySize{Width: 1080, Height: 1920}, Processing: VideoProcessingConfig{Rotate: 270}},
+		},
+		{
+			name:  "cropped to a column",
+			input: Input{display: DisplaySize{Width: 1920, Height: 1080}, Processing: VideoProcessingConfig{Crop: CropConfig{Width: 608, Height: 1080}}},
+			want:  true,
+		},
+		{
+			name:  "padded to landscape",
+			input: Input{display: DisplaySize{Width: 1080, Height: 1920}, Processing: VideoProcessingConfig{Pad: PadConfig{Aspect: "16:9"}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.input.isPortrait(); got != tt.want {
+				t.Errorf("isPortrait() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// The duration of each generated test asset, in seconds.
+const generatedDuration = "10"
+
+// The subtitle languages of the generated VTT assets, by file name.
+var generatedSubtitles = map[string]string{
+	"Sintel.2010.Arabic.vtt":    "ara",
+	"Sintel.2010.Chinese.vtt":   "zho",
+	"Sintel.2010.English.vtt":   "eng",
+	"Sintel.2010.Esperanto.vtt": "epo",
+	"Sintel.2010.French.vtt":    "fra",
+	"Sintel.2010.Spanish.vtt":   "spa",
+}
+
+// Returns the lavfi inputs for a test pattern with a tone.
+func lavfiInputs(size string, rate string) []string {
+	return []string{
+		"-f", "lavfi", "-i", fmt.Sprintf("testsrc2=size=%s:rate=%s:duration=%s", size, rate, generatedDuration),
+		"-f", "lavfi", "-i", fmt.Sprintf("sine=frequency=1000:sample_rate=48000:duration=%s,pan=stereo|c0=c0|c1=c0", generatedDuration),
+	}
+}
+
+/*
+GenerateTestAssets generates stand-ins for the test assets with FFmpeg,
+instead of downloading them.
+
+	Each file has the same tracks, resolution, frame rate and languages as
+	the asset it stands in for, so the tests can run with no network access.
+*/
+func GenerateTestAssets(ffmpeg string) error {
+	testDirPath := filepath.Join(".", TestDir)
+
+	if err := os.MkdirAll(testDirPath, os.ModePerm); err != nil {
+		return fmt.Errorf("failed to create test directory: %v", err)
+	}
+
+	// The subtitles are written first, because the MKV with subtitles muxes them.
+	for file, language := range generatedSubtitles {
+		cues := fmt.Sprintf("WEBVTT\n\n00:00:00.000 --> 00:00:05.000\nSubtitle in %s.\n\n00:00:05.000 --> 00:00:10.000\nSecond subtitle in %s.\n", language, language)
+		if err := os.WriteFile(filepath.Join(testDirPath, file), []byte(cues), 0644); err != nil {
+			return err
+		}
+	}
+
+	commands := map[string][]string{
+		"BigBuckBunny.1080p.mp4":     lavfiInputs("1920x1080", "30"),
+		"Sintel.2010.720p.Small.mkv": lavfiInputs("1280x720", "24"),
+	}
+
+	withSubs := lavfiInputs("1280x720", "24")
+	maps := []string{"-map", "0", "-map", "1"}
+	metadata := []string{}
+	for idx, file := range []string{"Sintel.2010.English.vtt", "Sintel.2010.Spanish.vtt"} {
+		withSubs = append(withSubs, "-i", filepath.Join(testDirPath, file))
+		maps = append(maps, "-map", fmt.Sprintf("%d", idx+2))
+		metadata = append(metadata, fmt.Sprintf("-metadata:s:s:%d", idx), "language="+generatedSubtitles[file])
+	}
+
+	withSubs = append(withSubs, maps...)
+	withSubs = append(withSubs, metadata...)
+	withSubs = append(withSubs, "-c:s", "subrip")
+	commands["Sintel.with.subs.mkv"] = withSubs
+
+	for file, inputs := range commands {
+		args := append([]string{"-y", "-loglevel", "error"}, inputs...)
+		args = append(args, "-c:v", "libx264", "-pix_fmt", "yuv420p", "-c:a", "aac")
+		args = append(args, filepath.Join(testDirPath, file))
+
+		cmd := exec.Command(ffmpeg, args...)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to generate %s: %v\n%s", file, err, strings.TrimSpace(string(output)))
+		}
+	}
+
+	return nil
+}